@@ -1,11 +1,16 @@
 package cl
 
-import "github.com/itchio/itch-setup/localize"
+import (
+	"time"
+
+	"github.com/itchio/itch-setup/localize"
+)
 
 // globals, get your globals here!
 
 type CLI struct {
 	AppName       string
+	Version       string
 	VersionString string
 
 	Localizer *localize.Localizer
@@ -16,8 +21,43 @@ type CLI struct {
 	Info         bool
 	Relaunch     bool
 	RelaunchPID  int
+	SelfUpdate   bool
+
+	RepairLauncher bool
+
+	Doctor bool
+	Fix    bool
+
+	Watch         bool
+	WatchInterval time.Duration
+	SystemdTimer  bool
+
+	Rollback        bool
+	RollbackVersion string
+	KeepPrevious    int
 
 	Silent     bool
+	JSON       bool
 	NoFallback bool
+	Channel    string
+	Pin        string
+	Unpin      bool
+	FromBundle string
+	BrothURLs  []string
+	MaxBPS     int64
 	Args       []string
+
+	RetryAttempts int
+	RetryDelay    time.Duration
+	StallTimeout  time.Duration
+
+	Proxy   string
+	NoProxy string
+
+	CABundle      string
+	PinPublicKeys []string
+
+	ExportBundle  string
+	ExportFrom    string
+	ExportChannel string
 }
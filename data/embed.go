@@ -8,9 +8,10 @@ import (
 	"strings"
 )
 
-// Embedded installer assets and locale files.
+// Embedded installer assets, locale files, and the public key release
+// manifests are signed with.
 //
-//go:embed *.png *.ico locales/*.json
+//go:embed *.png *.ico *.pub locales/*.json
 var assets embed.FS
 
 // Asset returns the contents of an embedded file. Paths may be passed with or
@@ -0,0 +1,48 @@
+package native
+
+import (
+	"log"
+
+	"github.com/itchio/itch-setup/cl"
+	"github.com/itchio/itch-setup/setup"
+)
+
+// exportBundle is the same on all platforms: it only talks to broth
+// and writes to the folder passed on the command-line.
+func exportBundle(cli cl.CLI) error {
+	proxy, err := proxyFromFlags(cli)
+	if err != nil {
+		return err
+	}
+
+	tls, err := tlsFromFlags(cli)
+	if err != nil {
+		return err
+	}
+
+	installer, err := setup.NewInstaller(setup.InstallerSettings{
+		BrothURLs:   cli.BrothURLs,
+		AppName:     cli.AppName,
+		Localizer:   cli.Localizer,
+		ChannelName: cli.ExportChannel,
+		Channel:     cli.Channel,
+		Pin:         cli.Pin,
+		MaxBPS:      cli.MaxBPS,
+		Retry:       retryPolicy(cli),
+		Proxy:       proxy,
+		TLS:         tls,
+		// an explicit channel is exported as-is
+		NoFallback: cli.NoFallback || cli.ExportChannel != "",
+	})
+	if err != nil {
+		return err
+	}
+
+	manifest, err := installer.ExportBundle(cli.ExportBundle, cli.ExportFrom)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Bundle for %s %s (%s) is ready in (%s)", manifest.AppName, manifest.Version, manifest.Channel, cli.ExportBundle)
+	return nil
+}
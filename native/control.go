@@ -0,0 +1,41 @@
+package native
+
+import (
+	"os"
+	"sync"
+
+	"github.com/itchio/itch-setup/cl"
+	"github.com/itchio/itch-setup/setup"
+)
+
+var theUpgradeControl *setup.Control
+var upgradeControlOnce sync.Once
+
+// upgradeControl returns the Control fed by the commands the itch app
+// writes to our stdin while we upgrade. There's only one per process,
+// shared by all the upgrades of `--watch`.
+func upgradeControl() *setup.Control {
+	upgradeControlOnce.Do(func() {
+		theUpgradeControl = setup.NewControl()
+		go theUpgradeControl.ReadCommands(os.Stdin)
+	})
+	return theUpgradeControl
+}
+
+// retryPolicy returns the RetryPolicy set on the command-line
+func retryPolicy(cli cl.CLI) *setup.RetryPolicy {
+	policy := setup.DefaultRetryPolicy
+	policy.Attempts = cli.RetryAttempts
+	policy.Delay = cli.RetryDelay
+	policy.StallTimeout = cli.StallTimeout
+	return &policy
+}
+
+// watch is the same on all platforms: it calls upgrade periodically
+func watch(cli cl.CLI, upgrade func() error) error {
+	return setup.Watch(setup.WatchSettings{
+		Interval: cli.WatchInterval,
+		Control:  upgradeControl(),
+		Upgrade:  upgrade,
+	})
+}
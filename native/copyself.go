@@ -1,14 +1,23 @@
 package native
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/setup"
 )
 
+// CopySelf copies the running itch-setup to targetExecPath, which the
+// launcher script and shortcuts point at. The copy is made in a temporary
+// file next to it, checked against us, then renamed over it, so that a
+// crash or a full disk can't leave a truncated launcher behind.
 func CopySelf(targetExecPath string) (string, error) {
 	log.Printf("Copying self to (%s)", targetExecPath)
 
@@ -31,13 +40,20 @@ func CopySelf(targetExecPath string) (string, error) {
 	}
 	defer src.Close()
 
-	dst, err := os.Create(targetExecPath)
+	dir, name := filepath.Split(targetExecPath)
+	dst, err := os.CreateTemp(dir, copySelfTempPattern(name))
 	if err != nil {
 		return "", fmt.Errorf("while creating copy of self in install folder: %w", err)
 	}
-	defer dst.Close()
+	tempPath := dst.Name()
+	defer func() {
+		dst.Close()
+		// after the rename, there's nothing left to remove
+		os.Remove(tempPath)
+	}()
 
-	_, err = io.Copy(dst, src)
+	srcHash := sha256.New()
+	size, err := io.Copy(dst, io.TeeReader(src, srcHash))
 	if err != nil {
 		return "", fmt.Errorf("while copying self to install folder: %w", err)
 	}
@@ -49,5 +65,126 @@ func CopySelf(targetExecPath string) (string, error) {
 		}
 	}
 
+	err = dst.Sync()
+	if err != nil {
+		return "", fmt.Errorf("while flushing copy of self: %w", err)
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return "", fmt.Errorf("while closing copy of self: %w", err)
+	}
+
+	err = checkCopy(tempPath, size, srcHash.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tempPath, targetExecPath)
+	if err != nil {
+		return "", fmt.Errorf("while moving copy of self into place: %w", err)
+	}
+	syncDir(dir)
+
 	return targetExecPath, nil
 }
+
+// copySelfTempPattern is what CopySelf names its temporary files, for
+// os.CreateTemp
+func copySelfTempPattern(name string) string {
+	return fmt.Sprintf(".%s-*.tmp", name)
+}
+
+// checkCopy reads back what CopySelf wrote, in case it didn't all make
+// it to disk
+func checkCopy(path string, size int64, sum []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("while checking copy of self: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	copySize, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("while checking copy of self: %w", err)
+	}
+	if copySize != size {
+		return fmt.Errorf("copy of self is %d bytes, expected %d", copySize, size)
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("copy of self (%s) doesn't have the same contents as us", path)
+	}
+	return nil
+}
+
+// syncDir makes a rename in dir durable, where that's a thing
+func syncDir(dir string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Printf("While opening (%s) to sync it: %v", dir, err)
+		return
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		log.Printf("While syncing (%s): %v", dir, err)
+	}
+}
+
+// updateLauncher copies us to launcherPath like CopySelf does, unless the
+// itch-setup there is newer than us, like after a --self-update: that one
+// is left alone rather than downgraded.
+func updateLauncher(launcherPath string, version string) (string, error) {
+	if setup.SetupIsNewer(launcherPath, version) {
+		log.Printf("Launcher (%s) is newer than us (%s), leaving it alone", launcherPath, version)
+		return filepath.Clean(launcherPath), nil
+	}
+	return CopySelf(launcherPath)
+}
+
+// repairLauncher is the same on Linux and Windows: it copies us over the
+// launcher copy of itch-setup at launcherPath if it's missing or doesn't
+// run anymore, and removes what interrupted copies left behind.
+func repairLauncher(launcherPath string) error {
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseRepair})
+
+	dir, name := filepath.Split(launcherPath)
+	leftovers, err := filepath.Glob(filepath.Join(dir, copySelfTempPattern(name)))
+	if err != nil {
+		return err
+	}
+	for _, leftover := range leftovers {
+		log.Printf("Removing leftover of interrupted copy (%s)", leftover)
+		err = os.Remove(leftover)
+		if err != nil {
+			return err
+		}
+		setup.Emit(protocol.FileRemoved{Path: leftover})
+	}
+
+	err = setup.SmokeTestSetup(launcherPath, "")
+	if err == nil {
+		log.Printf("Launcher (%s) is fine, leaving it alone", launcherPath)
+		return nil
+	}
+	log.Printf("Launcher (%s) needs repairing: %v", launcherPath, err)
+
+	targetExecPath, err := CopySelf(launcherPath)
+	if err != nil {
+		return fmt.Errorf("while repairing launcher: %w", err)
+	}
+	setup.Emit(protocol.ShortcutCreated{Kind: "launcher-copy", Path: targetExecPath})
+
+	err = setup.SmokeTestSetup(targetExecPath, "")
+	if err != nil {
+		return fmt.Errorf("launcher still doesn't work after repairing it: %w", err)
+	}
+	log.Printf("Launcher (%s) repaired", targetExecPath)
+	return nil
+}
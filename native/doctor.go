@@ -0,0 +1,88 @@
+package native
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/itchio/itch-setup/cl"
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/setup"
+)
+
+// doctor is the same on every platform: it reports what's wrong with the
+// installation mv is for, then with the rest of it (platform, found by
+// the Core), and fixes all of it if cli.Fix is set.
+func doctor(cli cl.CLI, mv setup.Multiverse, platform []*setup.Diagnosis) error {
+	setup.EnableJSON()
+	defer setup.DisableJSON()
+
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseDoctor})
+
+	diagnoses := append(mv.Diagnose(), platform...)
+	if len(diagnoses) == 0 {
+		log.Printf("Found nothing wrong with %s", mv)
+		return nil
+	}
+
+	var fixErr error
+	for _, d := range diagnoses {
+		issue := d.Issue
+		log.Printf("Found %s at (%s): %s", issue.Kind, issue.Path, issue.Message)
+
+		if cli.Fix {
+			err := d.Fix()
+			if err != nil {
+				log.Printf("While fixing %s: %+v", issue.Kind, err)
+				if fixErr == nil {
+					fixErr = fmt.Errorf("while fixing %s at (%s): %w", issue.Kind, issue.Path, err)
+				}
+			} else {
+				issue.Fixed = true
+			}
+		}
+		setup.Emit(issue)
+	}
+
+	if !cli.Fix {
+		log.Printf("Found %d issue(s), run with --fix to fix them", len(diagnoses))
+	}
+	return fixErr
+}
+
+// diagnoseLauncher is the same on Linux and Windows: it checks that the
+// launcher copy of itch-setup at launcherPath runs, and that no
+// `--self-update` was interrupted.
+func diagnoseLauncher(launcherPath string) []*setup.Diagnosis {
+	var res []*setup.Diagnosis
+
+	err := setup.SmokeTestSetup(launcherPath, "")
+	if err != nil {
+		res = append(res, &setup.Diagnosis{
+			Issue: protocol.DoctorIssue{
+				Kind:    protocol.DoctorIssueBrokenLauncher,
+				Path:    launcherPath,
+				Message: fmt.Sprintf("Launcher copy of itch-setup doesn't work: %v", err),
+			},
+			Fix: func() error {
+				return repairLauncher(launcherPath)
+			},
+		})
+	}
+
+	staging := setup.SelfUpdateStagingPath(launcherPath)
+	if _, err := os.Stat(staging); err == nil {
+		res = append(res, &setup.Diagnosis{
+			Issue: protocol.DoctorIssue{
+				Kind:    protocol.DoctorIssueLeftoverStaging,
+				Path:    staging,
+				Message: "Staging folder was left behind by an interrupted --self-update",
+			},
+			Fix: func() error {
+				return os.RemoveAll(staging)
+			},
+		})
+	}
+
+	return res
+}
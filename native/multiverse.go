@@ -0,0 +1,166 @@
+package native
+
+import (
+	"fmt"
+
+	"github.com/itchio/itch-setup/cl"
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/setup"
+)
+
+// openMultiverse opens the multiverse described by params, read-only for
+// verbs that only look at it, then applies any multiverse settings passed
+// on the command-line.
+func openMultiverse(cli cl.CLI, params *setup.MultiverseParams) (setup.Multiverse, error) {
+	// an interrupted transition is --doctor's to report, and --fix's to recover
+	params.ReadOnly = cli.Info || cli.Doctor
+
+	mv, err := setup.NewMultiverse(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if cli.KeepPrevious >= 0 {
+		err = mv.SetKeepPrevious(cli.KeepPrevious)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cli.Pin != "" && cli.Unpin {
+		return nil, setup.WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("--pin and --unpin can't be used together"))
+	}
+	if cli.Unpin {
+		err = mv.SetPin("")
+		if err != nil {
+			return nil, err
+		}
+	} else if cli.Pin != "" {
+		err = mv.SetPin(cli.Pin)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = applyProxyFlags(cli, mv)
+	if err != nil {
+		return nil, err
+	}
+
+	err = applyTLSFlags(cli, mv)
+	if err != nil {
+		return nil, err
+	}
+
+	return mv, nil
+}
+
+// applyProxyFlags persists the proxy passed on the command-line, if any.
+// --no-proxy alone updates the exceptions of the proxy we already have.
+func applyProxyFlags(cli cl.CLI, mv setup.Multiverse) error {
+	if cli.Proxy == "" && cli.NoProxy == "" {
+		return nil
+	}
+
+	if cli.Proxy == setup.ProxyDirect {
+		return mv.SetProxy(nil)
+	}
+
+	proxyURL := cli.Proxy
+	noProxy := setup.ParseNoProxy(cli.NoProxy)
+	if current := mv.GetProxy(); current != nil {
+		if proxyURL == "" {
+			proxyURL = current.URL
+		}
+		if cli.NoProxy == "" {
+			noProxy = current.NoProxy
+		}
+	}
+	if proxyURL == "" {
+		return setup.WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("--no-proxy needs a proxy, see --proxy"))
+	}
+
+	proxy, err := setup.NewProxySettings(proxyURL, noProxy)
+	if err != nil {
+		return err
+	}
+	return mv.SetProxy(proxy)
+}
+
+// proxyFromFlags is for verbs that don't have a multiverse to remember
+// the proxy in: it returns the one passed on the command-line, if any.
+func proxyFromFlags(cli cl.CLI) (*setup.ProxySettings, error) {
+	if cli.Proxy == "" || cli.Proxy == setup.ProxyDirect {
+		return nil, nil
+	}
+	return setup.NewProxySettings(cli.Proxy, setup.ParseNoProxy(cli.NoProxy))
+}
+
+// applyTLSFlags persists the CA bundle and pins passed on the
+// command-line, if any. Each of them is kept as-is unless it's passed.
+func applyTLSFlags(cli cl.CLI, mv setup.Multiverse) error {
+	if cli.CABundle == "" && len(cli.PinPublicKeys) == 0 {
+		return nil
+	}
+
+	var caBundle string
+	var pins []string
+	if current := mv.GetTLS(); current != nil {
+		caBundle = current.CABundle
+		pins = current.Pins
+	}
+
+	if cli.CABundle != "" {
+		caBundle = cli.CABundle
+		if caBundle == setup.TLSReset {
+			caBundle = ""
+		}
+	}
+	if len(cli.PinPublicKeys) > 0 {
+		pins = pinsFromFlags(cli)
+	}
+
+	if caBundle == "" && len(pins) == 0 {
+		return mv.SetTLS(nil)
+	}
+
+	tls, err := setup.NewTLSSettings(caBundle, pins)
+	if err != nil {
+		return err
+	}
+	return mv.SetTLS(tls)
+}
+
+// tlsFromFlags is like proxyFromFlags, for the CA bundle and pins
+func tlsFromFlags(cli cl.CLI) (*setup.TLSSettings, error) {
+	caBundle := cli.CABundle
+	if caBundle == setup.TLSReset {
+		caBundle = ""
+	}
+	pins := pinsFromFlags(cli)
+
+	if caBundle == "" && len(pins) == 0 {
+		return nil, nil
+	}
+	return setup.NewTLSSettings(caBundle, pins)
+}
+
+// pinsFromFlags returns the pins passed with --pin-public-key, or none
+// if one of them is 'none'
+func pinsFromFlags(cli cl.CLI) []string {
+	for _, pin := range cli.PinPublicKeys {
+		if pin == setup.TLSReset {
+			return nil
+		}
+	}
+	return cli.PinPublicKeys
+}
+
+// channelFor returns the release channel to install or upgrade from: the
+// one passed on the command-line, or else the one we're already on.
+func channelFor(cli cl.CLI, mv setup.Multiverse) string {
+	if cli.Channel != "" {
+		return cli.Channel
+	}
+	return mv.GetChannel()
+}
@@ -13,11 +13,33 @@ type Core interface {
 	// progress and whether a relaunch is needed.
 	Upgrade() error
 
+	// Upgrades periodically, until cancelled
+	Watch() error
+
 	// Waits for PID to exit, then opens latest version of
 	// the app. On macOS, moves latest to /Applications before
 	// launching
 	Relaunch() error
 
+	// Makes a retained previous version current again
+	Rollback() error
+
+	// Replaces the launcher copy of itch-setup with the latest
+	// version of itch-setup, keeping the previous one around
+	SelfUpdate() error
+
+	// Replaces the launcher copy of itch-setup with ourselves if it's
+	// missing or broken
+	RepairLauncher() error
+
+	// Reports what's wrong with the installation, and fixes it if
+	// asked to
+	Doctor() error
+
+	// Downloads the latest version (and optionally an upgrade path
+	// to it) into an offline bundle
+	ExportBundle() error
+
 	// Shows an error dialog (with stack trace and repo link)
 	// and exits afterwards.
 	ErrorDialog(err error)
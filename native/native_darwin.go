@@ -24,6 +24,7 @@ import (
 
 	"github.com/itchio/itch-setup/cl"
 	"github.com/itchio/itch-setup/data"
+	"github.com/itchio/itch-setup/protocol"
 	"github.com/itchio/itch-setup/setup"
 	"github.com/itchio/ox/macox"
 )
@@ -104,6 +105,8 @@ func (nc *nativeCore) killRunningApp() {
 }
 
 func (nc *nativeCore) Uninstall() error {
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseUninstall})
+
 	warn := func(err error) {
 		log.Printf("warning: %v", err)
 		log.Printf("(continuing anyway)")
@@ -120,6 +123,8 @@ func (nc *nativeCore) Uninstall() error {
 		err := os.RemoveAll(appBundlePath)
 		if err != nil {
 			warn(err)
+		} else {
+			setup.Emit(protocol.FileRemoved{Path: appBundlePath})
 		}
 	}
 
@@ -143,8 +148,16 @@ func (nc *nativeCore) Uninstall() error {
 		deleteMap := map[string]bool{
 			// installed version state
 			"state.json": true,
+			// proxy settings, see --proxy
+			"proxy.json": true,
+			// TLS settings, see --ca-bundle and --pin-public-key
+			"tls.json": true,
 			// staging directory
 			"staging": true,
+			// retained previous versions
+			"previous": true,
+			// cached broth metadata
+			setup.MetadataCacheName: true,
 		}
 
 		for _, name := range names {
@@ -155,12 +168,16 @@ func (nc *nativeCore) Uninstall() error {
 				err := os.RemoveAll(fullPath)
 				if err != nil {
 					warn(err)
+				} else {
+					setup.Emit(protocol.FileRemoved{Path: fullPath})
 				}
 			} else if strings.HasPrefix(name, "app-") {
 				log.Printf("delete (%s)/", fullPath)
 				err := os.RemoveAll(fullPath)
 				if err != nil {
 					warn(err)
+				} else {
+					setup.Emit(protocol.FileRemoved{Path: fullPath})
 				}
 			} else {
 				log.Printf("keep (%s)", fullPath)
@@ -197,11 +214,23 @@ func (nc *nativeCore) Upgrade() error {
 		return err
 	}
 
-	installer := setup.NewInstaller(setup.InstallerSettings{
+	installer, err := setup.NewInstaller(setup.InstallerSettings{
+		Channel:    channelFor(cli, mv),
+		Pin:        mv.GetPin(),
+		Proxy:      mv.GetProxy(),
+		TLS:        mv.GetTLS(),
+		BrothURLs:  cli.BrothURLs,
 		Localizer:  cli.Localizer,
 		AppName:    cli.AppName,
 		NoFallback: cli.NoFallback,
+		MaxBPS:     cli.MaxBPS,
+		Retry:      retryPolicy(cli),
+		CacheDir:   filepath.Join(nc.roamingSetupPath, setup.MetadataCacheName),
+		Control:    upgradeControl(),
 	})
+	if err != nil {
+		return err
+	}
 	res, err := installer.Upgrade(mv)
 	if err != nil {
 		return err
@@ -219,7 +248,7 @@ func (nc *nativeCore) Relaunch() error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
-	setup.WaitForProcessToExit(ctx, pid)
+	setup.WaitForProcessToExit(ctx, pid, nil)
 
 	mv, err := nc.newMultiverse()
 	if err != nil {
@@ -233,11 +262,11 @@ func (nc *nativeCore) Relaunch() error {
 		}
 	}
 
-	nc.tryLaunchCurrent(mv)
-	return nil
+	return nc.tryLaunchCurrent(mv)
 }
 
 func (nc *nativeCore) ErrorDialog(err error) {
+	setup.EmitFailed(err)
 	// TODO: use cocoa for this?
 	log.Fatalf("Fatal error: %+v", err)
 }
@@ -267,13 +296,23 @@ func StartItchSetup() {
 		}
 	}
 
-	installer = setup.NewInstaller(setup.InstallerSettings{
+	installer, err = setup.NewInstaller(setup.InstallerSettings{
+		Channel:    channelFor(cli, mv),
+		Pin:        mv.GetPin(),
+		Proxy:      mv.GetProxy(),
+		TLS:        mv.GetTLS(),
+		BrothURLs:  cli.BrothURLs,
 		Localizer:  cli.Localizer,
 		AppName:    cli.AppName,
 		NoFallback: cli.NoFallback,
+		MaxBPS:     cli.MaxBPS,
+		Retry:      retryPolicy(cli),
+		CacheDir:   filepath.Join(nc.roamingSetupPath, setup.MetadataCacheName),
+		BundlePath: cli.FromBundle,
 		OnError: func(err error) {
 			C.SetInstalling(0)
 			log.Printf("Error: %+v", err)
+			setup.EmitFailed(err)
 			C.SetLabel(C.CString(fmt.Sprintf("%+v", err)))
 		},
 		OnFinish: func(source setup.InstallSource) {
@@ -292,6 +331,10 @@ func StartItchSetup() {
 			C.SetLabel(C.CString(label))
 		},
 	})
+	if err != nil {
+		nc.ErrorDialog(err)
+		return
+	}
 	installer.WarmUp()
 
 	C.SetInstalling(1)
@@ -301,7 +344,7 @@ func StartItchSetup() {
 func (nc *nativeCore) tryLaunchCurrent(mv setup.Multiverse) error {
 	b := mv.GetCurrentVersion()
 	if b == nil {
-		return fmt.Errorf("No valid version of %s found installed", nc.cli.AppName)
+		return setup.WithErrorCode(protocol.ErrorCodeNotInstalled, fmt.Errorf("No valid version of %s found installed", nc.cli.AppName))
 	}
 
 	log.Printf("Launching (%s) from (%s)", b.Version, b.Path)
@@ -309,7 +352,10 @@ func (nc *nativeCore) tryLaunchCurrent(mv setup.Multiverse) error {
 		return fmt.Errorf("Could not launch (%s)", b.Path)
 	}
 
+	setup.Emit(protocol.LaunchStarted{Version: b.Version, Path: b.Path})
+
 	log.Printf("Bundle launched successfully, getting out of the way")
+	setup.Emit(protocol.Done{})
 	C.Quit()
 
 	// unreachable, but the go compiler doesn't know it
@@ -326,8 +372,55 @@ func (nc *nativeCore) validateBundle(bundlePath string) error {
 	return nil
 }
 
+func (nc *nativeCore) SelfUpdate() error {
+	// there's no launcher copy: itch-setup ships inside the app bundle
+	return setup.WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("--self-update isn't supported on macOS, itch-setup is updated along with %s", nc.cli.AppName))
+}
+
+func (nc *nativeCore) RepairLauncher() error {
+	// there's no launcher copy to repair, see SelfUpdate
+	return setup.WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("--repair-launcher isn't supported on macOS, itch-setup is part of the %s app bundle", nc.cli.AppName))
+}
+
+func (nc *nativeCore) Doctor() error {
+	mv, err := nc.newMultiverse()
+	if err != nil {
+		return err
+	}
+
+	// there's no launcher copy or desktop file, see SelfUpdate
+	return doctor(nc.cli, mv, nil)
+}
+
+func (nc *nativeCore) ExportBundle() error {
+	return exportBundle(nc.cli)
+}
+
+func (nc *nativeCore) Watch() error {
+	return watch(nc.cli, nc.Upgrade)
+}
+
+func (nc *nativeCore) Rollback() error {
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseRollback})
+
+	mv, err := nc.newMultiverse()
+	if err != nil {
+		return err
+	}
+
+	nc.killRunningApp()
+
+	err = mv.Rollback(nc.cli.RollbackVersion)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rolled back to (%s)", mv.GetCurrentVersion().Version)
+	return nil
+}
+
 func (nc *nativeCore) newMultiverse() (setup.Multiverse, error) {
-	return setup.NewMultiverse(&setup.MultiverseParams{
+	return openMultiverse(nc.cli, &setup.MultiverseParams{
 		AppName:         nc.cli.AppName,
 		BaseDir:         nc.roamingSetupPath,
 		ApplicationsDir: nc.homeApplicationsPath,
@@ -15,6 +15,7 @@ import (
 	"github.com/itchio/itch-setup/cl"
 	"github.com/itchio/itch-setup/data"
 	"github.com/itchio/itch-setup/native/nlinux"
+	"github.com/itchio/itch-setup/protocol"
 	"github.com/itchio/itch-setup/setup"
 )
 
@@ -51,10 +52,7 @@ func (nc *nativeCore) Install() error {
 	var err error
 	cli := nc.cli
 
-	mv, err := setup.NewMultiverse(&setup.MultiverseParams{
-		AppName: cli.AppName,
-		BaseDir: nc.baseDir,
-	})
+	mv, err := nc.newMultiverse()
 	if err != nil {
 		return fmt.Errorf("Internal error: %w", err)
 	}
@@ -75,10 +73,19 @@ func (nc *nativeCore) Install() error {
 		return err
 	}
 
-	installer := setup.NewInstaller(setup.InstallerSettings{
+	installer, err := setup.NewInstaller(setup.InstallerSettings{
+		Channel:    channelFor(cli, mv),
+		Pin:        mv.GetPin(),
+		Proxy:      mv.GetProxy(),
+		TLS:        mv.GetTLS(),
+		BrothURLs:  cli.BrothURLs,
 		Localizer:  cli.Localizer,
 		AppName:    cli.AppName,
 		NoFallback: cli.NoFallback,
+		MaxBPS:     cli.MaxBPS,
+		Retry:      retryPolicy(cli),
+		CacheDir:   filepath.Join(nc.baseDir, setup.MetadataCacheName),
+		BundlePath: cli.FromBundle,
 		OnProgress: func(progress float64) {
 			iw.SetProgress(progress)
 		},
@@ -87,7 +94,7 @@ func (nc *nativeCore) Install() error {
 		},
 		OnError: func(err error) {
 			nc.nui.RunInMainThread(func() {
-				nc.nui.ShowErrorAndQuit(fmt.Errorf("Warm-up error: %w", err))
+				nc.ErrorDialog(fmt.Errorf("Warm-up error: %w", err))
 			})
 		},
 		OnSource: func(source setup.InstallSource) {
@@ -102,6 +109,7 @@ func (nc *nativeCore) Install() error {
 
 				if nc.cli.Silent {
 					log.Printf("Was silent installation, just quitting with successful exit code")
+					setup.Emit(protocol.Done{})
 					os.Exit(0)
 				}
 
@@ -112,6 +120,9 @@ func (nc *nativeCore) Install() error {
 			})
 		},
 	})
+	if err != nil {
+		return err
+	}
 	installer.WarmUp()
 
 	kickoffInstall := func() {
@@ -134,11 +145,15 @@ func (nc *nativeCore) Install() error {
 }
 
 func (nc *nativeCore) Uninstall() error {
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseUninstall})
+
 	warn := func(err error) {
 		log.Printf("warning: %v", err)
 		log.Printf("(continuing anyway)")
 	}
 
+	nc.uninstallSystemdUnits()
+
 	installedFiles := nc.installedFiles()
 	for _, installedFile := range installedFiles {
 		_, statErr := os.Lstat(installedFile)
@@ -147,6 +162,8 @@ func (nc *nativeCore) Uninstall() error {
 			err := os.Remove(installedFile)
 			if err != nil {
 				warn(err)
+			} else {
+				setup.Emit(protocol.FileRemoved{Path: installedFile})
 			}
 		}
 	}
@@ -172,8 +189,16 @@ func (nc *nativeCore) Uninstall() error {
 			"icon.png": true,
 			// copy of itch-setup
 			"itch-setup": true,
+			// the one it replaced, see --self-update
+			"itch-setup-previous": true,
 			// installed version state
 			"state.json": true,
+			// interrupted version switch, if any
+			"journal.json": true,
+			// proxy settings, see --proxy
+			"proxy.json": true,
+			// TLS settings, see --ca-bundle and --pin-public-key
+			"tls.json": true,
 			// launcher script
 			nc.cli.AppName: true,
 		}
@@ -186,12 +211,16 @@ func (nc *nativeCore) Uninstall() error {
 				err := os.Remove(fullPath)
 				if err != nil {
 					warn(err)
+				} else {
+					setup.Emit(protocol.FileRemoved{Path: fullPath})
 				}
-			} else if strings.HasPrefix(name, "app-") {
+			} else if strings.HasPrefix(name, "app-") || name == "previous" || name == setup.MetadataCacheName || name == "itch-setup-staging" || name == "staging" {
 				log.Printf("delete (%s)/", fullPath)
 				err := os.RemoveAll(fullPath)
 				if err != nil {
 					warn(err)
+				} else {
+					setup.Emit(protocol.FileRemoved{Path: fullPath})
 				}
 			} else {
 				log.Printf("keep (%s)", fullPath)
@@ -234,17 +263,30 @@ func (nc *nativeCore) Upgrade() error {
 		return err
 	}
 
-	installer := setup.NewInstaller(setup.InstallerSettings{
+	installer, err := setup.NewInstaller(setup.InstallerSettings{
+		Channel:    channelFor(cli, mv),
+		Pin:        mv.GetPin(),
+		Proxy:      mv.GetProxy(),
+		TLS:        mv.GetTLS(),
+		BrothURLs:  cli.BrothURLs,
 		Localizer:  cli.Localizer,
 		AppName:    cli.AppName,
 		NoFallback: cli.NoFallback,
+		MaxBPS:     cli.MaxBPS,
+		Retry:      retryPolicy(cli),
+		CacheDir:   filepath.Join(nc.baseDir, setup.MetadataCacheName),
+		Control:    upgradeControl(),
 	})
+	if err != nil {
+		return err
+	}
 	res, err := installer.Upgrade(mv)
 	if err != nil {
 		return err
 	}
 
-	if res.DidUpgrade {
+	// --systemd-timer can be added to an existing install
+	if res.DidUpgrade || cli.SystemdTimer {
 		err = nc.installDesktopFiles()
 		if err != nil {
 			return err
@@ -270,18 +312,14 @@ func (nc *nativeCore) Relaunch() error {
 		log.Printf("Killed!")
 		return nil
 	}
-	err := killIfExists()
-	if err != nil {
-		log.Printf("While killing: %+v", err)
-	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
-	setup.WaitForProcessToExit(ctx, pid)
+	setup.WaitForProcessToExit(ctx, pid, killIfExists)
 
 	// Update launcher copy from broth-managed version
 	launcherPath := filepath.Join(nc.baseDir, "itch-setup")
-	_, err = CopySelf(launcherPath)
+	_, err := updateLauncher(launcherPath, nc.cli.Version)
 	if err != nil {
 		log.Printf("While updating launcher: %+v", err)
 		log.Printf("Continuing with relaunch anyway...")
@@ -295,8 +333,110 @@ func (nc *nativeCore) Relaunch() error {
 	return nc.tryLaunchCurrent(mv)
 }
 
+func (nc *nativeCore) SelfUpdate() error {
+	mv, err := nc.newMultiverse()
+	if err != nil {
+		return err
+	}
+
+	return selfUpdate(nc.cli, mv, filepath.Join(nc.baseDir, "itch-setup"))
+}
+
+func (nc *nativeCore) RepairLauncher() error {
+	return repairLauncher(filepath.Join(nc.baseDir, "itch-setup"))
+}
+
+func (nc *nativeCore) Doctor() error {
+	mv, err := nc.newMultiverse()
+	if err != nil {
+		return err
+	}
+
+	var platform []*setup.Diagnosis
+	if mv.GetCurrentVersion() != nil {
+		platform, err = nc.diagnoseIntegration()
+		if err != nil {
+			return err
+		}
+	}
+	return doctor(nc.cli, mv, platform)
+}
+
+// diagnoseIntegration checks what installDesktopFiles sets up
+func (nc *nativeCore) diagnoseIntegration() ([]*setup.Diagnosis, error) {
+	packaged, err := nc.installedViaPackage()
+	if err != nil {
+		return nil, err
+	}
+	if packaged {
+		log.Printf("Not checking desktop files")
+		return nil, nil
+	}
+
+	launcherPath := filepath.Join(nc.baseDir, "itch-setup")
+	res := diagnoseLauncher(launcherPath)
+
+	// both are fixed by writing them all again
+	reinstall := func() error {
+		return nc.installDesktopFiles()
+	}
+
+	launchScriptPath := filepath.Join(nc.baseDir, nc.cli.AppName)
+	launchScript, err := os.ReadFile(launchScriptPath)
+	if err != nil || !strings.Contains(string(launchScript), launcherPath+" ") {
+		res = append(res, &setup.Diagnosis{
+			Issue: protocol.DoctorIssue{
+				Kind:    protocol.DoctorIssueBrokenLauncher,
+				Path:    launchScriptPath,
+				Message: "Launcher script is missing or doesn't run the launcher copy of itch-setup",
+			},
+			Fix: reinstall,
+		})
+	}
+
+	desktopFilePath := nc.desktopFileName()
+	desktopFile, err := os.ReadFile(desktopFilePath)
+	if err != nil || !strings.Contains(string(desktopFile), "\nExec="+launchScriptPath+" ") {
+		res = append(res, &setup.Diagnosis{
+			Issue: protocol.DoctorIssue{
+				Kind:    protocol.DoctorIssueBrokenDesktopFile,
+				Path:    desktopFilePath,
+				Message: "Desktop file is missing or doesn't run the launcher script",
+			},
+			Fix: reinstall,
+		})
+	}
+
+	return res, nil
+}
+
+func (nc *nativeCore) ExportBundle() error {
+	return exportBundle(nc.cli)
+}
+
+func (nc *nativeCore) Watch() error {
+	return watch(nc.cli, nc.Upgrade)
+}
+
+func (nc *nativeCore) Rollback() error {
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseRollback})
+
+	mv, err := nc.newMultiverse()
+	if err != nil {
+		return err
+	}
+
+	err = mv.Rollback(nc.cli.RollbackVersion)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rolled back to (%s)", mv.GetCurrentVersion().Version)
+	return nil
+}
+
 func (nc *nativeCore) newMultiverse() (setup.Multiverse, error) {
-	return setup.NewMultiverse(&setup.MultiverseParams{
+	return openMultiverse(nc.cli, &setup.MultiverseParams{
 		AppName: nc.cli.AppName,
 		BaseDir: nc.baseDir,
 	})
@@ -323,7 +463,7 @@ func (nc *nativeCore) tryLaunchCurrent(mv setup.Multiverse) error {
 
 	b := mv.GetCurrentVersion()
 	if b == nil {
-		return fmt.Errorf("No valid version of %s found installed", nc.cli.AppName)
+		return setup.WithErrorCode(protocol.ErrorCodeNotInstalled, fmt.Errorf("No valid version of %s found installed", nc.cli.AppName))
 	}
 
 	log.Printf("Launching (%s) from (%s)", b.Version, b.Path)
@@ -343,10 +483,12 @@ func (nc *nativeCore) tryLaunchCurrent(mv setup.Multiverse) error {
 
 	err := cmd.Start()
 	if err != nil {
-		nc.ErrorDialog(fmt.Errorf("Encountered a problem while launching %s: %w", nc.cli.AppName, err))
+		return fmt.Errorf("Encountered a problem while launching %s: %w", nc.cli.AppName, err)
 	}
+	setup.Emit(protocol.LaunchStarted{Version: b.Version, Path: exePath})
 
 	log.Printf("App launched, getting out of the way")
+	setup.Emit(protocol.Done{})
 	os.Exit(0)
 
 	// unreachable, but the go compiler doesn't know it
@@ -358,6 +500,7 @@ func (nc *nativeCore) exeName() string {
 }
 
 func (nc *nativeCore) ErrorDialog(err error) {
+	setup.EmitFailed(err)
 	nc.nui.ShowErrorAndQuit(err)
 	os.Exit(1) // just to be extra sure
 }
@@ -386,6 +529,8 @@ func (nc *nativeCore) desktopFileName() string {
 func (nc *nativeCore) installedFiles() []string {
 	return []string{
 		nc.desktopFileName(),
+		nc.systemdServiceFileName(),
+		nc.systemdTimerFileName(),
 	}
 }
 
@@ -393,7 +538,8 @@ func (nc *nativeCore) updateDesktopDatabase() error {
 	log.Printf("Updating desktop database for (%s)", nc.xdgAppDir())
 	{
 		cmd := exec.Command("update-desktop-database", "-v", nc.xdgAppDir())
-		cmd.Stdout = os.Stdout
+		// stdout is for JSON-lines messages
+		cmd.Stdout = os.Stderr
 		cmd.Stderr = os.Stderr
 		err := cmd.Run()
 		if err != nil {
@@ -414,6 +560,16 @@ func (nc *nativeCore) writeFile(path string, contents []byte, perm os.FileMode)
 	return os.WriteFile(path, contents, perm)
 }
 
+func (nc *nativeCore) writeShortcut(kind string, path string, contents []byte, perm os.FileMode) error {
+	err := nc.writeFile(path, contents, perm)
+	if err != nil {
+		return err
+	}
+
+	setup.Emit(protocol.ShortcutCreated{Kind: kind, Path: path})
+	return nil
+}
+
 func (nc *nativeCore) interpolate(source string, vars map[string]string) (string, error) {
 	res := source
 	for k, v := range vars {
@@ -427,25 +583,42 @@ func (nc *nativeCore) interpolate(source string, vars map[string]string) (string
 	return res, nil
 }
 
-func (nc *nativeCore) installDesktopFiles() error {
-	appName := nc.cli.AppName
-
+// installedViaPackage tells if we're running from an OS package, which
+// takes care of desktop files itself
+func (nc *nativeCore) installedViaPackage() (bool, error) {
 	log.Printf("Determining whether or not we've been installed via an OS package...")
 
 	execPath, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("while getting self path: %w", err)
+		return false, fmt.Errorf("while getting self path: %w", err)
 	}
 
 	if filepath.HasPrefix(execPath, "/usr") {
-		log.Printf("Our execPath (%s) is somewhere in /usr, not installing desktop files", execPath)
+		log.Printf("Our execPath (%s) is somewhere in /usr", execPath)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (nc *nativeCore) installDesktopFiles() error {
+	appName := nc.cli.AppName
+
+	packaged, err := nc.installedViaPackage()
+	if err != nil {
+		return err
+	}
+	if packaged {
+		log.Printf("Not installing desktop files")
 		return nil
 	}
 
-	targetExecPath, err := CopySelf(filepath.Join(nc.baseDir, "itch-setup"))
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseIntegrate})
+
+	targetExecPath, err := updateLauncher(filepath.Join(nc.baseDir, "itch-setup"), nc.cli.Version)
 	if err != nil {
 		return fmt.Errorf("while creating copy of self in install folder: %w", err)
 	}
+	setup.Emit(protocol.ShortcutCreated{Kind: "launcher-copy", Path: targetExecPath})
 
 	launchScript := `#!/bin/sh
 {{SETUPPATH}} --prefer-launch --appname {{APPNAME}} -- "$@"
@@ -460,7 +633,7 @@ func (nc *nativeCore) installDesktopFiles() error {
 	}
 
 	launchDstPath := filepath.Join(nc.baseDir, appName)
-	err = nc.writeFile(launchDstPath, []byte(launchScript), 0755)
+	err = nc.writeShortcut("launcher-script", launchDstPath, []byte(launchScript), 0755)
 	if err != nil {
 		return fmt.Errorf("creating launch script: %w", err)
 	}
@@ -471,7 +644,7 @@ func (nc *nativeCore) installDesktopFiles() error {
 	if err != nil {
 		return fmt.Errorf("while reading icon: %w", err)
 	}
-	err = nc.writeFile(iconPath, imageData, 0644)
+	err = nc.writeShortcut("icon", iconPath, imageData, 0644)
 	if err != nil {
 		return fmt.Errorf("while writing icon: %w", err)
 	}
@@ -503,7 +676,7 @@ Comment=Install and play itch.io games easily`
 		return err
 	}
 
-	err = nc.writeFile(desktopFilePath, []byte(desktopContents), 0644)
+	err = nc.writeShortcut("desktop-file", desktopFilePath, []byte(desktopContents), 0644)
 	if err != nil {
 		return fmt.Errorf("writing desktop file: %w", err)
 	}
@@ -513,9 +686,32 @@ Comment=Install and play itch.io games easily`
 		return err
 	}
 
+	if nc.cli.SystemdTimer {
+		err = nc.installSystemdUnits(targetExecPath)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (nc *nativeCore) Info() {
-	log.Printf("nativeCore.Info() on Linux is a stub")
+	mv, err := nc.newMultiverse()
+	if err != nil {
+		nc.ErrorDialog(err)
+	}
+
+	info := setup.NewInfo(nc.cli.AppName, nc.cli.VersionString, nc.baseDir, mv)
+	info.UserDataPath = nc.userDataPath()
+	setup.AddInfoFile(info, "desktop-file", nc.desktopFileName())
+	setup.AddInfoFile(info, "launcher-script", filepath.Join(nc.baseDir, nc.cli.AppName))
+	setup.AddInfoFile(info, "launcher-copy", filepath.Join(nc.baseDir, "itch-setup"))
+	setup.AddInfoFile(info, "icon", filepath.Join(nc.baseDir, "icon.png"))
+	setup.AddInfoFile(info, "systemd-service", nc.systemdServiceFileName())
+	setup.AddInfoFile(info, "systemd-timer", nc.systemdTimerFileName())
+
+	setup.EnableJSON()
+	defer setup.DisableJSON()
+	setup.Emit(info)
 }
@@ -16,6 +16,7 @@ import (
 
 	"github.com/itchio/itch-setup/cl"
 	"github.com/itchio/itch-setup/native/nwin"
+	"github.com/itchio/itch-setup/protocol"
 	"github.com/itchio/itch-setup/setup"
 	"github.com/lxn/walk"
 	ui "github.com/lxn/walk/declarative"
@@ -99,11 +100,23 @@ func (nc *nativeCore) Upgrade() error {
 		return err
 	}
 
-	installer := setup.NewInstaller(setup.InstallerSettings{
+	installer, err := setup.NewInstaller(setup.InstallerSettings{
+		Channel:    channelFor(cli, mv),
+		Pin:        mv.GetPin(),
+		Proxy:      mv.GetProxy(),
+		TLS:        mv.GetTLS(),
+		BrothURLs:  cli.BrothURLs,
 		Localizer:  cli.Localizer,
 		AppName:    cli.AppName,
 		NoFallback: cli.NoFallback,
+		MaxBPS:     cli.MaxBPS,
+		Retry:      retryPolicy(cli),
+		CacheDir:   filepath.Join(nc.baseDir, setup.MetadataCacheName),
+		Control:    upgradeControl(),
 	})
+	if err != nil {
+		return err
+	}
 	res, err := installer.Upgrade(mv)
 	if err != nil {
 		return err
@@ -133,12 +146,14 @@ func (nc *nativeCore) doPostInstall(mv setup.Multiverse, params PostInstallParam
 		return fmt.Errorf("internal error (in post-install with a nil currentBuild)")
 	}
 
-	setupLocalPath, err := CopySelf(filepath.Join(installDir, "itch-setup.exe"))
+	setupLocalPath, err := updateLauncher(filepath.Join(installDir, "itch-setup.exe"), cli.Version)
 	if err != nil {
-		nc.ErrorDialog(err)
+		nc.failWithDialog(err)
 		return err
 	}
 
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseIntegrate})
+
 	// this creates $installDir/app.ico
 	nc.syncUninstallRegistryEntry(currentBuild.Version)
 
@@ -167,6 +182,12 @@ func (nc *nativeCore) doPostInstall(mv setup.Multiverse, params PostInstallParam
 		if err != nil {
 			log.Printf("While creating shortcut: %+v", err)
 			log.Printf("Ignoring shortcut creation error and continuing...")
+			continue
+		}
+
+		// with OnlyIfExists, it might not have been created
+		if _, statErr := os.Stat(spec.Path); statErr == nil {
+			setup.Emit(protocol.ShortcutCreated{Kind: "shortcut", Path: spec.Path})
 		}
 	}
 
@@ -191,11 +212,11 @@ func (nc *nativeCore) Relaunch() error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
-	setup.WaitForProcessToExit(ctx, cli.RelaunchPID)
+	setup.WaitForProcessToExit(ctx, cli.RelaunchPID, nil)
 
 	// Update launcher copy from broth-managed version
 	launcherPath := filepath.Join(nc.baseDir, "itch-setup.exe")
-	_, err = CopySelf(launcherPath)
+	_, err = updateLauncher(launcherPath, cli.Version)
 	if err != nil {
 		log.Printf("While updating launcher: %+v", err)
 		log.Printf("Continuing with relaunch anyway...")
@@ -203,7 +224,8 @@ func (nc *nativeCore) Relaunch() error {
 
 	err = nc.tryLaunchCurrent(mv, nil)
 	if err != nil {
-		nc.ErrorDialog(err)
+		nc.failWithDialog(err)
+		return err
 	}
 
 	return nil
@@ -211,6 +233,7 @@ func (nc *nativeCore) Relaunch() error {
 
 func (nc *nativeCore) Uninstall() error {
 	log.Printf("Uninstall was requested...")
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseUninstall})
 	mv, err := nc.newMultiverse()
 	if err != nil {
 		return err
@@ -239,6 +262,8 @@ func (nc *nativeCore) Uninstall() error {
 		err = os.Remove(spec.Path)
 		if err != nil {
 			warn(err)
+		} else {
+			setup.Emit(protocol.FileRemoved{Path: spec.Path})
 		}
 	}
 
@@ -266,6 +291,14 @@ func (nc *nativeCore) Uninstall() error {
 			nc.visualElementsManifestName(): true,
 			// installed version state
 			"state.json": true,
+			// interrupted version switch, if any
+			"journal.json": true,
+			// proxy settings, see --proxy
+			"proxy.json": true,
+			// TLS settings, see --ca-bundle and --pin-public-key
+			"tls.json": true,
+			// the itch-setup.exe --self-update replaced
+			"itch-setup-previous.exe": true,
 		}
 
 		for _, name := range names {
@@ -276,8 +309,10 @@ func (nc *nativeCore) Uninstall() error {
 				err := os.Remove(fullPath)
 				if err != nil {
 					warn(err)
+				} else {
+					setup.Emit(protocol.FileRemoved{Path: fullPath})
 				}
-			} else if strings.HasPrefix(name, "app-") {
+			} else if strings.HasPrefix(name, "app-") || name == "previous" || name == setup.MetadataCacheName || name == "itch-setup-staging" || name == "staging" {
 				tries := 3
 
 				for {
@@ -291,6 +326,8 @@ func (nc *nativeCore) Uninstall() error {
 							continue
 						}
 						warn(err)
+					} else {
+						setup.Emit(protocol.FileRemoved{Path: fullPath})
 					}
 					break
 				}
@@ -439,7 +476,7 @@ func (nc *nativeCore) tryLaunchCurrent(mv setup.Multiverse, onSuccess onSuccessF
 
 	build := mv.GetCurrentVersion()
 	if build == nil {
-		return nil
+		return setup.WithErrorCode(protocol.ErrorCodeNotInstalled, fmt.Errorf("No valid version of %s found installed", nc.cli.AppName))
 	}
 
 	if didPromoteReady {
@@ -453,14 +490,18 @@ func (nc *nativeCore) tryLaunchCurrent(mv setup.Multiverse, onSuccess onSuccessF
 
 	err := cmd.Start()
 	if err != nil {
-		nc.ErrorDialog(fmt.Errorf("Encountered a problem while launching %s: %w", nc.cli.AppName, err))
+		err = fmt.Errorf("Encountered a problem while launching %s: %w", nc.cli.AppName, err)
+		nc.failWithDialog(err)
+		return err
 	}
+	setup.Emit(protocol.LaunchStarted{Version: build.Version, Path: cmd.Path})
 
 	if onSuccess != nil {
 		onSuccess()
 	}
 
 	log.Printf("App launched, getting out of the way")
+	setup.Emit(protocol.Done{})
 	os.Exit(0)
 
 	// unreachable, but go's compiler doesn't know it
@@ -683,10 +724,32 @@ func (nc *nativeCore) showInstallGUI() error {
 
 	nwin.SetInstallerImage(cli, imageView)
 
-	installer = setup.NewInstaller(setup.InstallerSettings{
+	// the install folder isn't picked yet, so we can't know which
+	// channel it's on (or what it's pinned to): only switch channels,
+	// pin, use a proxy or check certificates differently if asked to
+	proxy, err := proxyFromFlags(cli)
+	if err != nil {
+		return err
+	}
+
+	tls, err := tlsFromFlags(cli)
+	if err != nil {
+		return err
+	}
+
+	installer, err = setup.NewInstaller(setup.InstallerSettings{
+		Channel:    cli.Channel,
+		Pin:        cli.Pin,
+		Proxy:      proxy,
+		TLS:        tls,
+		BrothURLs:  cli.BrothURLs,
 		Localizer:  cli.Localizer,
 		AppName:    cli.AppName,
 		NoFallback: cli.NoFallback,
+		MaxBPS:     cli.MaxBPS,
+		Retry:      retryPolicy(cli),
+		CacheDir:   filepath.Join(nc.baseDir, setup.MetadataCacheName),
+		BundlePath: cli.FromBundle,
 		OnError: func(err error) {
 			nc.mainWindow.Synchronize(func() {
 				nc.ErrorDialog(fmt.Errorf("Error during warm-up: %w", err))
@@ -737,6 +800,9 @@ func (nc *nativeCore) showInstallGUI() error {
 			})
 		},
 	})
+	if err != nil {
+		return err
+	}
 	installer.WarmUp()
 
 	nwin.CenterWindow(nc.mainWindow.AsFormBase())
@@ -750,11 +816,32 @@ func (nc *nativeCore) showInstallGUI() error {
 }
 
 func (nc *nativeCore) ErrorDialog(errShown error) {
+	nc.showErrorDialog(errShown)
+	os.Exit(1)
+}
+
+// failWithDialog shows err in a dialog and exits, after emitting it as a
+// JSON error message too, like main does for errors we return. With --json
+// or --silent, nobody's there to see a dialog: it does nothing, and it's up
+// to the caller to return err.
+func (nc *nativeCore) failWithDialog(err error) {
+	cli := nc.cli
+	if cli.JSON || cli.Silent {
+		return
+	}
+
+	exitCode := setup.EmitError(err, cli.Localizer, cli.AppName)
+	nc.showErrorDialog(err)
+	os.Exit(exitCode)
+}
+
+func (nc *nativeCore) showErrorDialog(errShown error) {
 	cli := nc.cli
 
 	var dlg *walk.Dialog
 
 	log.Printf("Fatal error: %+v", errShown)
+	setup.EmitFailed(errShown)
 
 	buf := new(bytes.Buffer)
 	fmt.Fprintf(buf, `%s`, cli.Localizer.T("setup.error_dialog.title"))
@@ -833,7 +920,6 @@ func (nc *nativeCore) ErrorDialog(errShown error) {
 	te.SetTextSelection(-1, 0)
 
 	dlg.Run()
-	os.Exit(1)
 }
 
 type shortcutSpec struct {
@@ -881,8 +967,63 @@ func (nc *nativeCore) exeName() string {
 	return fmt.Sprintf("%s.exe", nc.cli.AppName)
 }
 
+func (nc *nativeCore) SelfUpdate() error {
+	mv, err := nc.newMultiverse()
+	if err != nil {
+		return err
+	}
+
+	return selfUpdate(nc.cli, mv, filepath.Join(nc.baseDir, "itch-setup.exe"))
+}
+
+func (nc *nativeCore) RepairLauncher() error {
+	return repairLauncher(filepath.Join(nc.baseDir, "itch-setup.exe"))
+}
+
+func (nc *nativeCore) Doctor() error {
+	mv, err := nc.newMultiverse()
+	if err != nil {
+		return err
+	}
+
+	var platform []*setup.Diagnosis
+	if mv.GetCurrentVersion() != nil {
+		platform = diagnoseLauncher(filepath.Join(nc.baseDir, "itch-setup.exe"))
+	}
+	return doctor(nc.cli, mv, platform)
+}
+
+func (nc *nativeCore) ExportBundle() error {
+	return exportBundle(nc.cli)
+}
+
+func (nc *nativeCore) Watch() error {
+	return watch(nc.cli, nc.Upgrade)
+}
+
+func (nc *nativeCore) Rollback() error {
+	setup.Emit(protocol.PhaseStarted{Phase: protocol.PhaseRollback})
+
+	mv, err := nc.newMultiverse()
+	if err != nil {
+		return err
+	}
+
+	nc.killAllPrevious()
+
+	err = mv.Rollback(nc.cli.RollbackVersion)
+	if err != nil {
+		return err
+	}
+
+	build := mv.GetCurrentVersion()
+	log.Printf("Rolled back to (%s)", build.Version)
+	nc.syncUninstallRegistryEntry(build.Version)
+	return nil
+}
+
 func (nc *nativeCore) newMultiverse() (setup.Multiverse, error) {
-	return setup.NewMultiverse(&setup.MultiverseParams{
+	return openMultiverse(nc.cli, &setup.MultiverseParams{
 		AppName: nc.cli.AppName,
 		BaseDir: nc.baseDir,
 	})
@@ -0,0 +1,28 @@
+package native
+
+import (
+	"github.com/itchio/itch-setup/cl"
+	"github.com/itchio/itch-setup/setup"
+)
+
+// selfUpdate is the same on Linux and Windows: it replaces the launcher
+// copy of itch-setup at launcherPath with the latest one from broth,
+// going through the proxy and TLS settings the app uses.
+func selfUpdate(cli cl.CLI, mv setup.Multiverse, launcherPath string) error {
+	installer, err := setup.NewInstaller(setup.InstallerSettings{
+		AppName:    setup.SelfUpdateAppName,
+		Localizer:  cli.Localizer,
+		BrothURLs:  cli.BrothURLs,
+		NoFallback: cli.NoFallback,
+		MaxBPS:     cli.MaxBPS,
+		Retry:      retryPolicy(cli),
+		Proxy:      mv.GetProxy(),
+		TLS:        mv.GetTLS(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = installer.SelfUpdate(launcherPath)
+	return err
+}
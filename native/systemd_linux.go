@@ -0,0 +1,123 @@
+package native
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/setup"
+)
+
+// Typically `~/.config/systemd/user`
+func (nc *nativeCore) systemdUnitDir() string {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		configDir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(configDir, "systemd", "user")
+}
+
+// Like `itch-upgrade.timer`
+func (nc *nativeCore) systemdUnitName(suffix string) string {
+	return fmt.Sprintf("%s-upgrade.%s", nc.cli.AppName, suffix)
+}
+
+func (nc *nativeCore) systemdServiceFileName() string {
+	return filepath.Join(nc.systemdUnitDir(), nc.systemdUnitName("service"))
+}
+
+func (nc *nativeCore) systemdTimerFileName() string {
+	return filepath.Join(nc.systemdUnitDir(), nc.systemdUnitName("timer"))
+}
+
+// installSystemdUnits writes a user service that runs `--upgrade`, and a
+// timer that starts it every --watch-interval, then enables the timer.
+func (nc *nativeCore) installSystemdUnits(setupPath string) error {
+	interval := int64(nc.cli.WatchInterval.Seconds())
+	if interval <= 0 {
+		return setup.WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("--watch-interval must be positive (got %s)", nc.cli.WatchInterval))
+	}
+
+	serviceContents := `[Unit]
+Description=Check for {{APPNAME}} updates
+
+[Service]
+Type=oneshot
+ExecStart={{SETUPPATH}} --appname {{APPNAME}} --upgrade --silent
+`
+
+	serviceContents, err := nc.interpolate(serviceContents, map[string]string{
+		"APPNAME":   nc.cli.AppName,
+		"SETUPPATH": setupPath,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = nc.writeShortcut("systemd-service", nc.systemdServiceFileName(), []byte(serviceContents), 0644)
+	if err != nil {
+		return fmt.Errorf("writing systemd service: %w", err)
+	}
+
+	// RandomizedDelaySec jitters checks, like --watch does
+	timerContents := `[Unit]
+Description=Check for {{APPNAME}} updates periodically
+
+[Timer]
+OnBootSec=10min
+OnUnitActiveSec={{INTERVAL}}s
+RandomizedDelaySec={{JITTER}}s
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`
+
+	timerContents, err = nc.interpolate(timerContents, map[string]string{
+		"APPNAME":  nc.cli.AppName,
+		"INTERVAL": fmt.Sprintf("%d", interval),
+		"JITTER":   fmt.Sprintf("%d", interval/10),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = nc.writeShortcut("systemd-timer", nc.systemdTimerFileName(), []byte(timerContents), 0644)
+	if err != nil {
+		return fmt.Errorf("writing systemd timer: %w", err)
+	}
+
+	nc.systemctl("daemon-reload")
+	nc.systemctl("enable", "--now", nc.systemdUnitName("timer"))
+	return nil
+}
+
+// uninstallSystemdUnits stops the timer if we installed one. The unit
+// files themselves are in installedFiles.
+func (nc *nativeCore) uninstallSystemdUnits() {
+	_, err := os.Stat(nc.systemdTimerFileName())
+	if err != nil {
+		return
+	}
+
+	nc.systemctl("disable", "--now", nc.systemdUnitName("timer"))
+}
+
+// systemctl runs `systemctl --user`, but doesn't hard fail: there's not
+// always a user instance of systemd around to talk to.
+func (nc *nativeCore) systemctl(args ...string) {
+	args = append([]string{"--user"}, args...)
+	log.Printf("Running systemctl %v", args)
+
+	cmd := exec.Command("systemctl", args...)
+	// stdout is for JSON-lines messages
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		log.Printf("Warning: during systemctl invocation: %s", err)
+	}
+}
@@ -0,0 +1,27 @@
+package protocol
+
+// Commands are what programs driving itch-setup can write to its stdin,
+// one per line, in the same format as messages: a JSON object with a
+// `type` and (optionally) a `payload`, see ParseMessage.
+//
+// For now, only `--upgrade` reads them.
+const (
+	// CommandCancel stops the upgrade, see UpdateCancelled
+	CommandCancel = "cancel"
+	// CommandPause stops downloading until CommandResume
+	CommandPause = "pause"
+	// CommandResume undoes CommandPause
+	CommandResume = "resume"
+	// CommandSetBandwidthLimit comes with a SetBandwidthLimit payload
+	CommandSetBandwidthLimit = "set-bandwidth-limit"
+)
+
+//-------------------------------
+
+// SetBandwidthLimit caps how fast we download, in bytes per second.
+// Zero lifts the limit.
+type SetBandwidthLimit struct {
+	BPS int64 `json:"bps"`
+}
+
+func (p SetBandwidthLimit) GetType() string { return CommandSetBandwidthLimit }
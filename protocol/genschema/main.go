@@ -0,0 +1,26 @@
+// Command genschema writes the JSON Schema for itch-setup's JSON-lines
+// messages, see `go generate ./protocol`.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatalf("Usage: genschema OUTPUT")
+	}
+
+	schema, err := protocol.Schema()
+	if err != nil {
+		log.Fatalf("Generating schema: %+v", err)
+	}
+
+	err = os.WriteFile(os.Args[1], schema, 0644)
+	if err != nil {
+		log.Fatalf("Writing schema: %+v", err)
+	}
+}
@@ -0,0 +1,417 @@
+package protocol
+
+import (
+	"encoding/json"
+)
+
+// Message types
+const (
+	TypeHello              = "hello"
+	TypeLog                = "log"
+	TypeProgress           = "progress"
+	TypeInstallingUpdate   = "installing-update"
+	TypeUpdateReady        = "update-ready"
+	TypeNoUpdateAvailable  = "no-update-available"
+	TypeUpdateHeldBack     = "update-held-back"
+	TypeUpdateFailed       = "update-failed"
+	TypeUpdateCancelled    = "update-cancelled"
+	TypeNextCheckScheduled = "next-check-scheduled"
+	TypeRetrying           = "retrying"
+	TypeReadyToRelaunch    = "ready-to-relaunch"
+	TypePhaseStarted       = "phase-started"
+	TypeFileRemoved        = "file-removed"
+	TypeShortcutCreated    = "shortcut-created"
+	TypeLaunchStarted      = "launch-started"
+	TypeSelfUpdated        = "self-updated"
+	TypeDoctorIssue        = "doctor-issue"
+	TypeDone               = "done"
+	TypeFailed             = "failed"
+	TypeError              = "error"
+	TypeInfo               = "info"
+)
+
+//-------------------------------
+
+// Hello is the first message itch-setup prints
+type Hello struct {
+	// ProtocolVersion is Version, as of the itch-setup build that prints it
+	ProtocolVersion int    `json:"protocolVersion"`
+	SetupVersion    string `json:"setupVersion"`
+}
+
+func (p Hello) GetType() string { return TypeHello }
+
+//-------------------------------
+
+type Log struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+func (p Log) GetType() string { return TypeLog }
+
+//-------------------------------
+
+type Progress struct {
+	Progress float64 `json:"progress"`
+	BPS      float64 `json:"bps"`
+	ETA      float64 `json:"eta"`
+	// Bytes and TotalBytes are set when we know them
+	Bytes      int64 `json:"bytes,omitempty"`
+	TotalBytes int64 `json:"totalBytes,omitempty"`
+}
+
+func (p Progress) GetType() string { return TypeProgress }
+
+//-------------------------------
+
+type InstallingUpdate struct {
+	Version string `json:"version"`
+}
+
+func (p InstallingUpdate) GetType() string { return TypeInstallingUpdate }
+
+//-------------------------------
+
+type UpdateReady struct {
+	Version string `json:"version"`
+}
+
+func (p UpdateReady) GetType() string { return TypeUpdateReady }
+
+//-------------------------------
+
+type NoUpdateAvailable struct {
+	// Reason is NoUpdateReasonUpToDate or NoUpdateReasonPinned
+	Reason string `json:"reason"`
+	// Pin is the version we're pinned to, if any
+	Pin string `json:"pin,omitempty"`
+}
+
+const (
+	// NoUpdateReasonUpToDate means we have the version we should have
+	NoUpdateReasonUpToDate = "up-to-date"
+	// NoUpdateReasonPinned means there's a newer version, but the pin
+	// keeps us from moving to it
+	NoUpdateReasonPinned = "pinned"
+)
+
+func (p NoUpdateAvailable) GetType() string { return TypeNoUpdateAvailable }
+
+//-------------------------------
+
+// UpdateHeldBack means there's a newer version, but its staged rollout
+// hasn't reached this install yet
+type UpdateHeldBack struct {
+	Version string `json:"version"`
+	// RolloutPercentage is the share of installs the version is rolled out to
+	RolloutPercentage float64 `json:"rolloutPercentage"`
+	// Bucket is where this install falls, in [0, 100)
+	Bucket float64 `json:"bucket"`
+}
+
+func (p UpdateHeldBack) GetType() string { return TypeUpdateHeldBack }
+
+//-------------------------------
+
+type UpdateFailed struct {
+	Message string `json:"message"`
+}
+
+func (p UpdateFailed) GetType() string { return TypeUpdateFailed }
+
+//-------------------------------
+
+// UpdateCancelled is emitted when an upgrade is stopped by a `cancel`
+// command, once the staging folder has been cleaned up. Version is
+// empty if we were cancelled before we knew what to upgrade to.
+type UpdateCancelled struct {
+	Version string `json:"version,omitempty"`
+}
+
+func (p UpdateCancelled) GetType() string { return TypeUpdateCancelled }
+
+//-------------------------------
+
+// NextCheckScheduled is emitted by `--watch` after every update check
+type NextCheckScheduled struct {
+	// Delay is how long until the next check, in seconds
+	Delay float64 `json:"delay"`
+	// Failures is how many checks failed in a row, including the last one
+	Failures int `json:"failures"`
+	// Error is why the last check failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+func (p NextCheckScheduled) GetType() string { return TypeNextCheckScheduled }
+
+//-------------------------------
+
+// Retrying is emitted when a request to broth failed transiently, and
+// we're about to try again
+type Retrying struct {
+	// What we were trying to get, like `latest version`
+	What string `json:"what"`
+	// Attempt is the attempt we're about to make, starting at 2
+	Attempt  int `json:"attempt"`
+	Attempts int `json:"attempts"`
+	// Delay is how long until we try again, in seconds
+	Delay float64 `json:"delay"`
+	// Error is why the last attempt failed
+	Error string `json:"error"`
+}
+
+func (p Retrying) GetType() string { return TypeRetrying }
+
+//-------------------------------
+
+type ReadyToRelaunch struct{}
+
+func (p ReadyToRelaunch) GetType() string { return TypeReadyToRelaunch }
+
+//-------------------------------
+
+// PhaseStarted is emitted when a verb moves on to another step
+type PhaseStarted struct {
+	Phase string `json:"phase"`
+}
+
+const (
+	// PhaseWarmUp is for resolving the channel and version to install
+	PhaseWarmUp = "warm-up"
+	// PhaseInstall is for downloading and extracting a fresh install
+	PhaseInstall = "install"
+	// PhaseCheck is for looking for updates
+	PhaseCheck = "check"
+	// PhaseIntegrate is for creating shortcuts, desktop files, etc.
+	PhaseIntegrate = "integrate"
+	// PhaseWait is for waiting on the app to exit before relaunching it
+	PhaseWait = "wait"
+	// PhaseUninstall is for removing the app
+	PhaseUninstall = "uninstall"
+	// PhaseRollback is for switching back to a previous version
+	PhaseRollback = "rollback"
+	// PhaseExport is for downloading an offline bundle
+	PhaseExport = "export"
+	// PhaseSelfUpdate is for replacing itch-setup with its latest version
+	PhaseSelfUpdate = "self-update"
+	// PhaseRepair is for fixing a broken installation
+	PhaseRepair = "repair"
+	// PhaseDoctor is for checking an installation, see DoctorIssue
+	PhaseDoctor = "doctor"
+)
+
+func (p PhaseStarted) GetType() string { return TypePhaseStarted }
+
+//-------------------------------
+
+type FileRemoved struct {
+	Path string `json:"path"`
+}
+
+func (p FileRemoved) GetType() string { return TypeFileRemoved }
+
+//-------------------------------
+
+// ShortcutCreated is emitted for every file we create to integrate with
+// the OS. Kind is the same as in Info files, like `desktop-file`.
+type ShortcutCreated struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+func (p ShortcutCreated) GetType() string { return TypeShortcutCreated }
+
+//-------------------------------
+
+type LaunchStarted struct {
+	Version string `json:"version"`
+	Path    string `json:"path"`
+}
+
+func (p LaunchStarted) GetType() string { return TypeLaunchStarted }
+
+//-------------------------------
+
+// SelfUpdated is emitted once itch-setup was replaced with Version.
+// Previous is where the binary it replaced was kept.
+type SelfUpdated struct {
+	Version  string `json:"version"`
+	Previous string `json:"previous"`
+}
+
+func (p SelfUpdated) GetType() string { return TypeSelfUpdated }
+
+//-------------------------------
+
+// DoctorIssue is emitted by `--doctor` for everything it finds wrong
+// with the installation. Fixed is only ever true with `--fix`.
+type DoctorIssue struct {
+	Kind string `json:"kind"`
+	// Path is the file or folder at fault, or that should be there
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+	Message string `json:"message"`
+	// Size is how many bytes fixing it frees up, for leftover folders
+	Size  int64 `json:"size,omitempty"`
+	Fixed bool  `json:"fixed"`
+}
+
+const (
+	// DoctorIssueMissingCurrent means state.json's current version
+	// isn't on disk
+	DoctorIssueMissingCurrent = "missing-current"
+	// DoctorIssueStaleReady means state.json's ready version isn't on disk
+	DoctorIssueStaleReady = "stale-ready"
+	// DoctorIssueMissingPrevious means a version retained for rollback
+	// isn't on disk
+	DoctorIssueMissingPrevious = "missing-previous"
+	// DoctorIssueOrphanFolder is a version folder state.json doesn't know
+	// about, like what an interrupted upgrade leaves behind
+	DoctorIssueOrphanFolder = "orphan-folder"
+	// DoctorIssueLeftoverStaging is a staging folder no upgrade is using
+	DoctorIssueLeftoverStaging = "leftover-staging"
+	// DoctorIssueInterruptedTransition means switching versions was
+	// interrupted, and the multiverse journal says how to recover
+	DoctorIssueInterruptedTransition = "interrupted-transition"
+	// DoctorIssueBrokenLauncher means the launcher script or the copy of
+	// itch-setup it runs is missing or doesn't work
+	DoctorIssueBrokenLauncher = "broken-launcher"
+	// DoctorIssueBrokenDesktopFile means the desktop file is missing or
+	// doesn't point at the launcher script
+	DoctorIssueBrokenDesktopFile = "broken-desktop-file"
+)
+
+func (p DoctorIssue) GetType() string { return TypeDoctorIssue }
+
+//-------------------------------
+
+// Done is the last message of a verb that went fine
+type Done struct{}
+
+func (p Done) GetType() string { return TypeDone }
+
+//-------------------------------
+
+// Failed is the last message of a verb that didn't
+type Failed struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (p Failed) GetType() string { return TypeFailed }
+
+// ErrorCode classifies failures. Codes never change once they're
+// released, see Version.
+type ErrorCode string
+
+const (
+	// ErrorCodeUnknown is for everything we haven't classified
+	ErrorCodeUnknown ErrorCode = "unknown"
+	// ErrorCodeUnavailable means the package source couldn't be reached
+	ErrorCodeUnavailable ErrorCode = "unavailable"
+	// ErrorCodeNotInstalled means the verb needs an existing installation
+	ErrorCodeNotInstalled ErrorCode = "not-installed"
+	// ErrorCodeInvalidArgument means the command-line doesn't make sense
+	ErrorCodeInvalidArgument ErrorCode = "invalid-argument"
+	// ErrorCodePermissionDenied means we weren't allowed to touch a file
+	ErrorCodePermissionDenied ErrorCode = "permission-denied"
+	// ErrorCodeCancelled means we were asked to stop, see UpdateCancelled
+	ErrorCodeCancelled ErrorCode = "cancelled"
+	// ErrorCodeUntrustedCertificate means a broth server's certificate
+	// wasn't trusted, or didn't match the pinned public keys
+	ErrorCodeUntrustedCertificate ErrorCode = "untrusted-certificate"
+	// ErrorCodeVerificationFailed means something we downloaded wasn't
+	// what its signed release manifest says, or had no such manifest
+	ErrorCodeVerificationFailed ErrorCode = "verification-failed"
+)
+
+// ExitCode is what itch-setup exits with when a fatal error has code c.
+// Like codes, exit codes never change once they're released:
+//
+//	unknown               1
+//	invalid-argument      2
+//	unavailable           3
+//	not-installed         4
+//	permission-denied     5
+//	cancelled             6
+//	untrusted-certificate 7
+//	verification-failed   8
+func (c ErrorCode) ExitCode() int {
+	switch c {
+	case ErrorCodeInvalidArgument:
+		return 2
+	case ErrorCodeUnavailable:
+		return 3
+	case ErrorCodeNotInstalled:
+		return 4
+	case ErrorCodePermissionDenied:
+		return 5
+	case ErrorCodeCancelled:
+		return 6
+	case ErrorCodeUntrustedCertificate:
+		return 7
+	case ErrorCodeVerificationFailed:
+		return 8
+	default:
+		return 1
+	}
+}
+
+// Retryable returns true if running the same command again later has a
+// chance of working, without anyone doing anything about it.
+func (c ErrorCode) Retryable() bool {
+	return c == ErrorCodeUnavailable
+}
+
+//-------------------------------
+
+// Error is emitted right before itch-setup exits because of a fatal
+// error, with Code.ExitCode() as exit code. It's sent even without `--json`
+// by verbs that always speak JSON-lines, like `--upgrade` and `--relaunch`.
+type Error struct {
+	Code ErrorCode `json:"code"`
+	// Message is for logs and bug reports, it's always in English
+	Message string `json:"message"`
+	// LocalizedMessage is suitable for showing to the user
+	LocalizedMessage string `json:"localizedMessage"`
+	Retryable        bool   `json:"retryable"`
+	ExitCode         int    `json:"exitCode"`
+}
+
+func (p Error) GetType() string { return TypeError }
+
+//-------------------------------
+
+// Info describes the installation, as printed by `--info`
+type Info struct {
+	AppName      string          `json:"appName"`
+	SetupVersion string          `json:"setupVersion"`
+	Channel      string          `json:"channel"`
+	BaseDir      string          `json:"baseDir"`
+	UserDataPath string          `json:"userDataPath"`
+	State        json.RawMessage `json:"state"`
+	Current      *InfoBuild      `json:"current"`
+	Ready        *InfoBuild      `json:"ready"`
+	Previous     []*InfoBuild    `json:"previous"`
+	Files        []*InfoFile     `json:"files"`
+
+	// PendingTransition is what an interrupted transition was doing, if
+	// any: `--info` leaves it alone, the next verb that changes anything
+	// finishes or undoes it
+	PendingTransition string `json:"pendingTransition,omitempty"`
+}
+
+type InfoBuild struct {
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	Exists  bool   `json:"exists"`
+}
+
+type InfoFile struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+}
+
+func (p Info) GetType() string { return TypeInfo }
@@ -0,0 +1,45 @@
+// Package protocol describes the JSON-lines messages itch-setup prints on
+// stdout, for programs that drive it (the itch app, deployment scripts,
+// our own tests).
+//
+// Every line is a JSON object with a `type` and a `payload`, see Message.
+// The first one is always a Hello, which carries the protocol Version:
+// consumers should refuse to go on if it's not one they know. Commands go
+// the other way, on stdin, see CommandCancel.
+//
+// schema.json is a JSON Schema for all messages, regenerate it with
+// `go generate ./protocol` after changing them.
+package protocol
+
+//go:generate go run ./genschema schema.json
+
+import (
+	"encoding/json"
+)
+
+// Version is bumped whenever a change could break consumers: removing or
+// renaming a message or field, or changing what one means. Adding
+// messages, fields, phases or error codes doesn't bump it.
+const Version = 1
+
+// Payload is implemented by every message payload
+type Payload interface {
+	GetType() string
+}
+
+// Message is a line of itch-setup output, with its payload left
+// undecoded so it can be unmarshalled into the right type.
+type Message struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// ParseMessage parses a line of itch-setup output. It returns false
+// for lines that aren't messages.
+func ParseMessage(line string) (Message, bool) {
+	var m Message
+	if err := json.Unmarshal([]byte(line), &m); err != nil || m.Type == "" {
+		return Message{}, false
+	}
+	return m, true
+}
@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Payloads returns a zero value of every message payload, in the order
+// they're listed in the schema.
+func Payloads() []Payload {
+	return []Payload{
+		Hello{},
+		Log{},
+		Progress{},
+		InstallingUpdate{},
+		UpdateReady{},
+		NoUpdateAvailable{},
+		UpdateHeldBack{},
+		UpdateFailed{},
+		UpdateCancelled{},
+		NextCheckScheduled{},
+		Retrying{},
+		ReadyToRelaunch{},
+		PhaseStarted{},
+		FileRemoved{},
+		ShortcutCreated{},
+		LaunchStarted{},
+		SelfUpdated{},
+		DoctorIssue{},
+		Done{},
+		Failed{},
+		Error{},
+		Info{},
+	}
+}
+
+// Schema returns a JSON Schema (draft 2020-12) that every message matches,
+// built from the payload types with reflection.
+func Schema() ([]byte, error) {
+	sb := &schemaBuilder{
+		defs: make(map[string]interface{}),
+	}
+
+	var oneOf []interface{}
+	for _, p := range Payloads() {
+		payloadSchema, err := sb.schemaFor(reflect.TypeOf(p))
+		if err != nil {
+			return nil, fmt.Errorf("building schema for %s: %w", p.GetType(), err)
+		}
+
+		oneOf = append(oneOf, map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"type":    map[string]interface{}{"const": p.GetType()},
+				"payload": payloadSchema,
+			},
+			"required": []string{"type", "payload"},
+		})
+	}
+
+	schema := map[string]interface{}{
+		"$schema":         "https://json-schema.org/draft/2020-12/schema",
+		"title":           "itch-setup JSON-lines message",
+		"protocolVersion": Version,
+		"oneOf":           oneOf,
+		"$defs":           sb.defs,
+	}
+
+	bs, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(bs, '\n'), nil
+}
+
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+func (sb *schemaBuilder) schemaFor(t reflect.Type) (interface{}, error) {
+	if t == rawMessageType {
+		// any JSON value
+		return map[string]interface{}{}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case reflect.Ptr:
+		elem, err := sb.schemaFor(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return nullable(elem), nil
+	case reflect.Slice:
+		items, err := sb.schemaFor(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return nullable(map[string]interface{}{"type": "array", "items": items}), nil
+	case reflect.Struct:
+		return sb.structRef(t)
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+}
+
+// structRef adds a definition for t, and returns a reference to it
+func (sb *schemaBuilder) structRef(t reflect.Type) (interface{}, error) {
+	ref := map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	if _, ok := sb.defs[t.Name()]; ok {
+		return ref, nil
+	}
+	// placeholder, in case t refers to itself
+	sb.defs[t.Name()] = nil
+
+	properties := make(map[string]interface{})
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = f.Name
+		}
+
+		fieldSchema, err := sb.schemaFor(f.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		properties[name] = fieldSchema
+
+		omitEmpty := false
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				omitEmpty = true
+			}
+		}
+		if !omitEmpty {
+			required = append(required, name)
+		}
+	}
+
+	sb.defs[t.Name()] = map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+	return ref, nil
+}
+
+// nullable is for pointers and slices, which marshal to null when nil
+func nullable(schema interface{}) interface{} {
+	return map[string]interface{}{
+		"anyOf": []interface{}{schema, map[string]interface{}{"type": "null"}},
+	}
+}
@@ -12,6 +12,7 @@ const {
   setenv,
   cd,
 } = require("@itchio/bob");
+const { builtInReleaseKey } = require("./manifest");
 
 const DEFAULT_ARCH = "x86_64";
 
@@ -169,6 +170,21 @@ async function main(args) {
 
   let builtAt = $$("date +%s");
   let ldFlags = `-X main.version=${version} -X main.builtAt=${builtAt} -X main.commit=${buildRef} -w -s`;
+
+  // the public half of the release key, see release/manifest.js. Release
+  // builds refuse to install anything they can't verify with it, other
+  // builds don't check release manifests until it's committed.
+  let releaseBuild = process.env.GITHUB_REF_TYPE === "tag";
+  if (!builtInReleaseKey()) {
+    if (releaseBuild) {
+      throw new Error(
+        `data/release.pub must have the release key to build a release, see release/manifest.js`
+      );
+    }
+    console.log(
+      `${chalk.yellow("data/release.pub")} is empty, this build won't check release manifests`
+    );
+  }
   if (opts.os === "windows") {
     ldFlags += ` -H windowsgui -extldflags=-static`;
   }
@@ -185,11 +201,17 @@ async function main(args) {
     $("file itch-setup.syso");
   }
 
-  let goTags = "";
+  /** @type {string[]} */
+  let tags = [];
   if (opts.os === "linux") {
     // NOTE: we are actually on gtk 3.24 but it doesn't work for Debian buster's specific version: https://github.com/gotk3/gotk3/issues/671#issuecomment-798590357
-    goTags = `-tags "pango_1_42 gtk_3_22 glib_2_58 gdk_pixbuf_2_38"`;
+    tags.push("pango_1_42", "gtk_3_22", "glib_2_58", "gdk_pixbuf_2_38");
+  }
+  if (releaseBuild) {
+    // see setup/release_required.go
+    tags.push("itchsetuprelease");
   }
+  let goTags = tags.length > 0 ? `-tags "${tags.join(" ")}"` : "";
 
   if (opts.os === "darwin") {
     // arm64 requires macOS 11.0+, x86_64 can target 10.10+
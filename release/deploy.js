@@ -4,6 +4,13 @@
 const { $, cd } = require("@itchio/bob");
 const { readdirSync } = require("fs");
 const { resolve } = require("path");
+const {
+  builtInReleaseKey,
+  signingKey,
+  checkReleaseKey,
+  latestHasManifest,
+  signRelease,
+} = require("./manifest");
 
 /**
  * @param {string[]} _args
@@ -31,6 +38,30 @@ async function main(_args) {
     return;
   }
 
+  // builds with a release key only install versions that have a release
+  // manifest: check before pushing anything that we can sign them, and
+  // that the itch app they'll install has one
+  /** @type {import("crypto").KeyObject | null} */
+  let releaseKey = null;
+  if (builtInReleaseKey()) {
+    releaseKey = signingKey();
+    checkReleaseKey(releaseKey);
+
+    let missing = readdirSync("artifacts/itch-setup").filter(
+      (variant) => !latestHasManifest("itch", variant)
+    );
+    if (missing.length > 0) {
+      throw new Error(
+        `The latest itch on ${missing.join(", ")} has no release manifest, ` +
+          `sign it with release/manifest.js and have broth serve it first`
+      );
+    }
+  } else {
+    console.log(
+      `data/release.pub is empty, these builds don't check release manifests: not signing any`
+    );
+  }
+
   // upload to itch.io
   let toolsDir = resolve(process.cwd(), "tools");
   $(`mkdir -p ${toolsDir}`);
@@ -42,6 +73,8 @@ async function main(_args) {
 
   $(`${toolsDir}/butler -V`);
 
+  /** @type {string[]} */
+  let channelNames = [];
   await cd(`artifacts/itch-setup`, async () => {
     let variants = readdirSync(".");
     for (let variant of variants) {
@@ -54,8 +87,16 @@ async function main(_args) {
         `"${itchTarget}"`,
       ];
       $(`${toolsDir}/butler ${butlerArgs.join(" ")}`);
+      channelNames.push(channelName);
     }
   });
+
+  // to artifacts/release-manifests, for broth to serve next to each build
+  if (releaseKey) {
+    for (let channelName of channelNames) {
+      signRelease(releaseKey, "itch-setup", channelName, userVersion);
+    }
+  }
 }
 
 main(process.argv.slice(2));
@@ -0,0 +1,261 @@
+//@ts-check
+"use strict";
+
+// Release manifests vouch for what broth serves for a version: they're
+// signed with the release key, whose public half every build embeds from
+// data/release.pub (see releaseKeyAsset in setup/release.go).
+//
+//   node release/manifest.js keygen
+//
+// makes a new release key: it prints the public half, to be committed as
+// data/release.pub, and the private half, to be stored as the
+// RELEASE_SIGNING_KEY secret of the production environment.
+//
+//   node release/manifest.js sign <app> <channel> <version> [...]
+//
+// downloads the archive and signature of each version from broth (or
+// $BROTH_URL), and writes its signed manifest to artifacts/release-manifests,
+// laid out like broth's URLs. $RELEASE_SIGNING_KEY must match
+// data/release.pub. deploy.js does that for every itch-setup it pushes.
+//
+// Builds can't install versions that have no manifest, so before the
+// public half is committed, the versions clients will install (the
+// latest of every channel) must be signed with this, and served by
+// broth. deploy.js checks that for the itch app.
+
+const { $, header, chalk } = require("@itchio/bob");
+const { spawnSync } = require("child_process");
+const crypto = require("crypto");
+const fs = require("fs");
+const { tmpdir } = require("os");
+const { join } = require("path");
+
+const DEFAULT_BROTH_URL = "https://broth.itch.zone";
+const RELEASE_KEY_PATH = join(__dirname, "..", "data", "release.pub");
+const OUTPUT_DIR = "artifacts/release-manifests";
+
+// what goes before an ed25519 seed to make it a PKCS#8 private key
+const PKCS8_ED25519_PREFIX = Buffer.from("302e020100300506032b657004220420", "hex");
+
+/**
+ * @param {string[]} args
+ */
+async function main(args) {
+  let [command, ...rest] = args;
+  switch (command) {
+    case "keygen":
+      keygen();
+      break;
+    case "sign":
+      if (rest.length == 0 || rest.length % 3 != 0) {
+        usage();
+      }
+      let key = signingKey();
+      checkReleaseKey(key);
+      for (let i = 0; i < rest.length; i += 3) {
+        signRelease(key, rest[i], rest[i + 1], rest[i + 2]);
+      }
+      break;
+    default:
+      usage();
+  }
+}
+
+function usage() {
+  console.log(`Usage:`);
+  console.log(`  node release/manifest.js keygen`);
+  console.log(`  node release/manifest.js sign <app> <channel> <version> [...]`);
+  process.exit(1);
+}
+
+function keygen() {
+  header("Generating release key");
+  let { privateKey } = crypto.generateKeyPairSync("ed25519");
+  let der = privateKey.export({ type: "pkcs8", format: "der" });
+  let seed = der.subarray(der.length - 32).toString("base64");
+
+  console.log(`Commit this as ${chalk.yellow("data/release.pub")}:`);
+  console.log(publicKeyOf(privateKey));
+  console.log(`Store this as the ${chalk.yellow("RELEASE_SIGNING_KEY")} secret, and nowhere else:`);
+  console.log(seed);
+}
+
+/**
+ * Returns the release key, from $RELEASE_SIGNING_KEY (the base64 of its
+ * 32-byte seed, as printed by keygen)
+ * @returns {crypto.KeyObject}
+ */
+function signingKey() {
+  let seed = Buffer.from(process.env.RELEASE_SIGNING_KEY || "", "base64");
+  if (seed.length != 32) {
+    throw new Error(
+      `$RELEASE_SIGNING_KEY must be the base64 of a 32-byte ed25519 seed, see 'node release/manifest.js keygen'`
+    );
+  }
+  return crypto.createPrivateKey({
+    key: Buffer.concat([PKCS8_ED25519_PREFIX, seed]),
+    format: "der",
+    type: "pkcs8",
+  });
+}
+
+/**
+ * Returns the public half of the release key builds trust, as committed
+ * in data/release.pub, or "" if there's none yet
+ * @returns {string}
+ */
+function builtInReleaseKey() {
+  return fs.readFileSync(RELEASE_KEY_PATH, "utf8").trim();
+}
+
+/**
+ * Returns the base64 of the raw public key of key, like data/release.pub
+ * @param {crypto.KeyObject} key
+ * @returns {string}
+ */
+function publicKeyOf(key) {
+  let der = crypto.createPublicKey(key).export({ type: "spki", format: "der" });
+  return der.subarray(der.length - 32).toString("base64");
+}
+
+/**
+ * Throws unless key is the one builds trust, data/release.pub:
+ * manifests signed with anything else would make every install fail
+ * @param {crypto.KeyObject} key
+ */
+function checkReleaseKey(key) {
+  let expected = builtInReleaseKey();
+  if (expected == "") {
+    throw new Error(
+      `data/release.pub must have the release key, to check $RELEASE_SIGNING_KEY against`
+    );
+  }
+  if (expected != publicKeyOf(key)) {
+    throw new Error(
+      `$RELEASE_SIGNING_KEY doesn't match data/release.pub, refusing to sign release manifests builds won't trust`
+    );
+  }
+}
+
+/**
+ * Returns true if broth serves a release manifest for the latest version
+ * of app on channel, or if it has no such channel
+ * @param {string} app
+ * @param {string} channel
+ * @returns {boolean}
+ */
+function latestHasManifest(app, channel) {
+  let channelURL = `${brothURL()}/${app}/${channel}`;
+  let res = spawnSync("curl", ["-sfL", `${channelURL}/LATEST`], {
+    encoding: "utf8",
+  });
+  if (res.status !== 0) {
+    console.log(`${channelURL} has no LATEST, nothing to check`);
+    return true;
+  }
+  let latest = res.stdout.trim();
+  res = spawnSync("curl", [
+    "-sfL",
+    "-o",
+    "/dev/null",
+    `${channelURL}/${latest}/release-manifest`,
+  ]);
+  if (res.status !== 0) {
+    console.log(`${app} ${latest} (${channel}) has no release manifest`);
+    return false;
+  }
+  return true;
+}
+
+/**
+ * @returns {string}
+ */
+function brothURL() {
+  return (process.env.BROTH_URL || DEFAULT_BROTH_URL).replace(/\/$/, "");
+}
+
+/**
+ * Downloads url to dest, waiting for broth to serve it: freshly pushed
+ * builds take a while to be processed
+ * @param {string} url
+ * @param {string} dest
+ */
+function download(url, dest) {
+  for (let attempt = 1; attempt <= 60; attempt++) {
+    let res = spawnSync("curl", ["-sfL", "-o", dest, url], {
+      stdio: "inherit",
+    });
+    if (res.status === 0) {
+      return;
+    }
+    console.log(`${url} isn't available yet (attempt ${attempt}/60)`);
+    spawnSync("sleep", ["10"]);
+  }
+  throw new Error(`Gave up waiting for ${url}`);
+}
+
+/**
+ * @param {string} path
+ * @returns {{size: number, sha256: string}}
+ */
+function describeFile(path) {
+  let contents = fs.readFileSync(path);
+  return {
+    size: contents.length,
+    sha256: crypto.createHash("sha256").update(contents).digest("hex"),
+  };
+}
+
+/**
+ * Writes the signed release manifest of a version to OUTPUT_DIR, as
+ * <app>/<channel>/<version>/release-manifest(.sig)
+ * @param {crypto.KeyObject} key
+ * @param {string} app
+ * @param {string} channel
+ * @param {string} version
+ */
+function signRelease(key, app, channel, version) {
+  header(`Signing release manifest for ${app} ${version} (${channel})`);
+
+  let versionURL = `${brothURL()}/${app}/${channel}/${version}`;
+  let outDir = join(OUTPUT_DIR, app, channel, version);
+  $(`mkdir -p "${outDir}"`);
+
+  let tmpDir = fs.mkdtempSync(join(tmpdir(), "release-manifest-"));
+  try {
+    let signaturePath = join(tmpDir, "signature");
+    let archivePath = join(tmpDir, "archive");
+    download(`${versionURL}/signature/default`, signaturePath);
+    download(`${versionURL}/archive/default`, archivePath);
+
+    // same fields, in the same order, as ReleaseManifest
+    let manifest = Buffer.from(
+      JSON.stringify({
+        appName: app,
+        channel,
+        version,
+        archive: describeFile(archivePath),
+        signature: describeFile(signaturePath),
+      })
+    );
+    let signature = crypto.sign(null, manifest, key).toString("base64") + "\n";
+
+    fs.writeFileSync(join(outDir, "release-manifest"), manifest);
+    fs.writeFileSync(join(outDir, "release-manifest.sig"), signature);
+  } finally {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  }
+  console.log(`Wrote ${chalk.yellow(outDir)}`);
+}
+
+module.exports = {
+  builtInReleaseKey,
+  signingKey,
+  checkReleaseKey,
+  latestHasManifest,
+  signRelease,
+};
+
+if (require.main === module) {
+  main(process.argv.slice(2));
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"net/http"
+	"net/url"
 	"strings"
 
 	itchio "github.com/itchio/go-itchio"
@@ -13,6 +16,10 @@ import (
 type BrothBuildInfo struct {
 	Version string            `json:"version"`
 	Files   []*BrothBuildFile `json:"files"`
+
+	// RolloutPercentage is set when the version is only rolled out to
+	// some installs, see RolloutPolicy
+	RolloutPercentage *float64 `json:"rolloutPercentage,omitempty"`
 }
 
 type BrothBuildFile struct {
@@ -39,54 +46,152 @@ func (bp *BrothPatch) FindSubType(subType itchio.BuildFileSubType) *BrothPatchFi
 	return nil
 }
 
+// PreferredFile returns the patch file we'd rather download: the optimized
+// one if it exists and is smaller, the default one otherwise. It returns nil
+// if there's no default patch file.
+func (bp *BrothPatch) PreferredFile() *BrothPatchFile {
+	f := bp.FindSubType(itchio.BuildFileSubTypeDefault)
+	if f == nil {
+		return nil
+	}
+
+	of := bp.FindSubType(itchio.BuildFileSubTypeOptimized)
+	if of != nil && of.Size < f.Size {
+		f = of
+	}
+	return f
+}
+
 type BrothPatchFile struct {
 	SubType itchio.BuildFileSubType `json:"subType"`
 	Size    int64                   `json:"size"`
 }
 
-func (i *Installer) brothGetBytes(format string, args ...interface{}) ([]byte, error) {
-	subpath := fmt.Sprintf(format, args...)
-	url := fmt.Sprintf("%s/%s", i.brothPackageURL(), strings.Trim(subpath, "/"))
+// notFoundError is a 404 from broth. It's an fs.ErrNotExist, like a file
+// missing from a mirror on disk or from a bundle.
+type notFoundError struct {
+	url string
+}
+
+func (nfe *notFoundError) Error() string {
+	return fmt.Sprintf("Got HTTP 404 for %s", nfe.url)
+}
+
+func (nfe *notFoundError) Is(target error) bool {
+	return target == fs.ErrNotExist
+}
+
+// brothSource talks to a broth server, like https://broth.itch.zone
+type brothSource struct {
+	baseURL  string
+	settings PackageSourceSettings
+}
+
+var _ PackageSource = (*brothSource)(nil)
+
+func newBrothSource(baseURL string, settings PackageSourceSettings) *brothSource {
+	return &brothSource{
+		baseURL:  baseURL,
+		settings: settings,
+	}
+}
+
+func (bs *brothSource) String() string {
+	return bs.packageURL()
+}
 
+func (bs *brothSource) packageURL() string {
+	return fmt.Sprintf("%s/%s/%s", bs.baseURL, bs.settings.AppName, bs.settings.Channel)
+}
+
+func (bs *brothSource) buildURL(values url.Values, format string, args ...interface{}) string {
+	if values == nil {
+		values = make(url.Values)
+	}
+	if bs.settings.DownloadSessionID != "" {
+		values.Set("downloadSessionId", bs.settings.DownloadSessionID)
+	}
+	formattedPath := fmt.Sprintf(format, args...)
+	return fmt.Sprintf("%s/%s?%s", bs.packageURL(), formattedPath, values.Encode())
+}
+
+// getBytes fetches metadata, going through settings.Cache if there's one
+func (bs *brothSource) getBytes(format string, args ...interface{}) ([]byte, error) {
+	subpath := strings.Trim(fmt.Sprintf(format, args...), "/")
+	url := fmt.Sprintf("%s/%s", bs.packageURL(), subpath)
+	key := fmt.Sprintf("%s/%s/%s/%s", bs.settings.CacheScope, bs.settings.AppName, bs.settings.Channel, subpath)
+
+	cached := bs.settings.Cache.get(key)
+	bytes, err := bs.fetchBytes(url, key, cached)
+	if err != nil && cached != nil && bs.settings.StaleFallback && isUnavailable(err) {
+		log.Printf("Broth unreachable, using cached (%s) from (%s): %v", key, cached.URL, err)
+		return cached.Body, nil
+	}
+	return bytes, err
+}
+
+func (bs *brothSource) fetchBytes(url string, key string, cached *metadataCacheEntry) ([]byte, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Could not build GET request to %s: %w", url, err)
 	}
 
-	res, err := i.client.Do(req)
+	// validators from another mirror would be meaningless
+	if cached != nil && cached.URL == url {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	res, err := bs.settings.Client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("While performing GET request to %s: %w", url, err)
+		return nil, &unavailableError{err: fmt.Errorf("While performing GET request to %s: %w", url, err)}
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		log.Printf("Using cached (%s), not modified", key)
+		return cached.Body, nil
+	}
+	if isRetryableStatus(res.StatusCode) {
+		return nil, &unavailableError{
+			err:        fmt.Errorf("Got HTTP %d for %s", res.StatusCode, url),
+			retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &notFoundError{url: url}
+	}
 	if res.StatusCode != 200 {
 		return nil, fmt.Errorf("Got HTTP %d for %s", res.StatusCode, url)
 	}
 
-	bs, err := io.ReadAll(res.Body)
+	bytes, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, fmt.Errorf("While reading GET request to %s: %w", url, err)
+		// most likely a stall, see timeout.NewDefaultClient
+		return nil, &unavailableError{err: fmt.Errorf("While reading GET request to %s: %w", url, err)}
 	}
 
-	return bs, nil
-}
-
-func (i *Installer) brothGetString(format string, args ...interface{}) (string, error) {
-	bs, err := i.brothGetBytes(format, args...)
-	if err != nil {
-		return "", err
-	}
+	bs.settings.Cache.put(key, &metadataCacheEntry{
+		URL:          url,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Body:         bytes,
+	})
 
-	return strings.TrimSpace(string(bs)), nil
+	return bytes, nil
 }
 
-func (i *Installer) brothGetResponse(r interface{}, format string, args ...interface{}) error {
-	bs, err := i.brothGetBytes(format, args...)
+func (bs *brothSource) getResponse(r interface{}, format string, args ...interface{}) error {
+	bytes, err := bs.getBytes(format, args...)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(bs, r)
+	err = json.Unmarshal(bytes, r)
 	if err != nil {
 		return fmt.Errorf("unmarshalling broth response: %w", err)
 	}
@@ -94,24 +199,85 @@ func (i *Installer) brothGetResponse(r interface{}, format string, args ...inter
 	return nil
 }
 
-// checkChannelExists returns true if the channel exists, false if 404, or error for other failures
-func (i *Installer) checkChannelExists() (bool, error) {
-	url := fmt.Sprintf("%s/%s/%s/LATEST", getBrothBaseURL(), i.settings.AppName, i.channelName)
+// ChannelExists returns true if the channel exists, false if 404, or error for other failures
+func (bs *brothSource) ChannelExists() (bool, error) {
+	url := fmt.Sprintf("%s/LATEST", bs.packageURL())
 	req, err := http.NewRequest("HEAD", url, nil)
 	if err != nil {
 		return false, err
 	}
-	res, err := i.client.Do(req)
+	res, err := bs.settings.Client.Do(req)
 	if err != nil {
-		return false, err
+		return false, &unavailableError{err: err}
 	}
 	res.Body.Close()
 
 	if res.StatusCode == 404 {
 		return false, nil
 	}
+	if isRetryableStatus(res.StatusCode) {
+		return false, &unavailableError{
+			err:        fmt.Errorf("unexpected status %d for %s", res.StatusCode, url),
+			retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	}
 	if res.StatusCode != 200 {
 		return false, fmt.Errorf("unexpected status %d for %s", res.StatusCode, url)
 	}
 	return true, nil
 }
+
+func (bs *brothSource) LatestVersion() (string, error) {
+	bytes, err := bs.getBytes("/LATEST")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(bytes)), nil
+}
+
+func (bs *brothSource) BuildInfo(version string) (*BrothBuildInfo, error) {
+	buildInfo := &BrothBuildInfo{}
+	err := bs.getResponse(buildInfo, "/%s/info", version)
+	if err != nil {
+		return nil, err
+	}
+	return buildInfo, nil
+}
+
+func (bs *brothSource) UpgradePath(from string, to string) (*BrothUpgradePath, error) {
+	upgradePath := &BrothUpgradePath{}
+	err := bs.getResponse(upgradePath, "/%s/upgrade-paths/%s", from, to)
+	if err != nil {
+		return nil, err
+	}
+	return upgradePath, nil
+}
+
+func (bs *brothSource) ReleaseManifest(version string) ([]byte, []byte, error) {
+	manifest, err := bs.getBytes("/%s/release-manifest", version)
+	if err != nil {
+		return nil, nil, err
+	}
+	signature, err := bs.getBytes("/%s/release-manifest.sig", version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, signature, nil
+}
+
+func (bs *brothSource) SignatureLocation(version string) string {
+	return bs.buildURL(nil, "%s/signature/default", version)
+}
+
+func (bs *brothSource) ArchiveLocation(version string) string {
+	return bs.buildURL(nil, "%s/archive/default", version)
+}
+
+func (bs *brothSource) PatchLocation(version string, subType itchio.BuildFileSubType) string {
+	return bs.buildURL(nil, "%s/patch/%s", version, subType)
+}
+
+func (bs *brothSource) Close() error {
+	return nil
+}
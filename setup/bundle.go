@@ -0,0 +1,290 @@
+package setup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	itchio "github.com/itchio/go-itchio"
+	"github.com/itchio/savior"
+	"github.com/itchio/savior/zipextractor"
+)
+
+// A bundle lets us install without any network access. It's a folder
+// (or a .zip of that folder) laid out like so:
+//
+//	LATEST                            version to install
+//	<version>/signature.pws           wharf signature of that version
+//	<version>/archive.zip             default archive of that version
+//	<version>/release-manifest.json   release manifest of that version
+//	<version>/release-manifest.sig    and its signature, see ReleaseManifest
+//
+// Bundles made with --export-bundle also have:
+//
+//	manifest.json                        see BundleManifest
+//	<version>/info.json                  broth build info
+//	<from>/upgrade-paths/<version>.json  broth upgrade path, if exported
+//	<patch version>/patch-<subtype>.pwr  patches along that upgrade path
+type bundle struct {
+	location string
+	dir      string
+	settings PackageSourceSettings
+
+	// set if the bundle has a manifest
+	manifest *BundleManifest
+
+	// set if we extracted the bundle from a .zip
+	tempDir string
+}
+
+var _ PackageSource = (*bundle)(nil)
+
+func openBundle(bundlePath string, settings PackageSourceSettings) (*bundle, error) {
+	stats, err := os.Stat(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening bundle: %w", err)
+	}
+
+	if stats.IsDir() {
+		log.Printf("Using bundle folder (%s)", bundlePath)
+		b := &bundle{location: bundlePath, dir: bundlePath, settings: settings}
+		err = b.verify()
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	tempDir, err := os.MkdirTemp("", "itch-setup-bundle-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating folder for bundle: %w", err)
+	}
+
+	log.Printf("Extracting bundle (%s) to (%s)", bundlePath, tempDir)
+	err = extractBundle(bundlePath, tempDir)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("extracting bundle: %w", err)
+	}
+
+	b := &bundle{location: bundlePath, dir: tempDir, settings: settings, tempDir: tempDir}
+	err = b.verify()
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func extractBundle(zipPath string, dir string) error {
+	f, err := os.Open(zipPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stats, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	ex, err := zipextractor.New(f, stats.Size())
+	if err != nil {
+		return err
+	}
+	ex.SetConsumer(newConsumer())
+
+	sink := &savior.FolderSink{
+		Directory: dir,
+	}
+	defer sink.Close()
+
+	_, err = ex.Resume(nil, sink)
+	return err
+}
+
+// verify checks the bundle's files against its manifest, if it has one.
+func (b *bundle) verify() error {
+	manifestBytes, err := os.ReadFile(filepath.Join(b.dir, bundleManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("Bundle has no manifest, not verifying checksums")
+			return nil
+		}
+		return fmt.Errorf("reading bundle manifest: %w", err)
+	}
+
+	manifest := &BundleManifest{}
+	err = json.Unmarshal(manifestBytes, manifest)
+	if err != nil {
+		return fmt.Errorf("parsing bundle manifest: %w", err)
+	}
+
+	log.Printf("Verifying %d bundle files (%s %s for %s)", len(manifest.Files), manifest.AppName, manifest.Version, manifest.Channel)
+	for _, f := range manifest.Files {
+		err = verifyBundleFile(filepath.Join(b.dir, filepath.FromSlash(f.Path)), f)
+		if err != nil {
+			return fmt.Errorf("verifying bundle file (%s): %w", f.Path, err)
+		}
+	}
+
+	b.manifest = manifest
+	return nil
+}
+
+func verifyBundleFile(path string, bf *BundleFile) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+
+	if size != bf.Size {
+		return fmt.Errorf("expected %d bytes, found %d", bf.Size, size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != bf.SHA256 {
+		return fmt.Errorf("expected sha256 %s, found %s", bf.SHA256, sum)
+	}
+	return nil
+}
+
+func (b *bundle) String() string {
+	return b.location
+}
+
+func (b *bundle) localPath(relPath string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(relPath))
+}
+
+// ChannelExists checks the manifest if there is one. Bundles without
+// one are assumed to be for whatever we're installing.
+func (b *bundle) ChannelExists() (bool, error) {
+	if b.manifest != nil {
+		return b.manifest.AppName == b.settings.AppName && b.manifest.Channel == b.settings.Channel, nil
+	}
+	return pathExists(b.localPath(bundleLatestName)), nil
+}
+
+func (b *bundle) LatestVersion() (string, error) {
+	version, err := readTrimmedFile(b.localPath(bundleLatestName))
+	if err != nil {
+		return "", fmt.Errorf("reading bundle's latest version: %w", err)
+	}
+	return version, nil
+}
+
+func (b *bundle) BuildInfo(version string) (*BrothBuildInfo, error) {
+	infoPath := b.localPath(bundleInfoPath(version))
+	if pathExists(infoPath) {
+		buildInfo := &BrothBuildInfo{}
+		err := readJSONFile(infoPath, buildInfo)
+		if err != nil {
+			return nil, err
+		}
+		return buildInfo, nil
+	}
+
+	// hand-made bundles may not have build info, but the
+	// archive is all we need to know about
+	stats, err := os.Stat(b.ArchiveLocation(version))
+	if err != nil {
+		return nil, fmt.Errorf("looking for version %s in bundle: %w", version, err)
+	}
+
+	return &BrothBuildInfo{
+		Version: version,
+		Files: []*BrothBuildFile{
+			{
+				Type:    itchio.BuildFileTypeArchive,
+				SubType: itchio.BuildFileSubTypeDefault,
+				Size:    stats.Size(),
+			},
+		},
+	}, nil
+}
+
+func (b *bundle) UpgradePath(from string, to string) (*BrothUpgradePath, error) {
+	upgradePath := &BrothUpgradePath{}
+	err := readJSONFile(b.localPath(bundleUpgradePathPath(from, to)), upgradePath)
+	if err != nil {
+		return nil, err
+	}
+	return upgradePath, nil
+}
+
+func (b *bundle) ReleaseManifest(version string) ([]byte, []byte, error) {
+	manifest, err := os.ReadFile(b.localPath(bundleReleaseManifestPath(version)))
+	if err != nil {
+		return nil, nil, err
+	}
+	signature, err := os.ReadFile(b.localPath(bundleReleaseManifestSignaturePath(version)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, signature, nil
+}
+
+func (b *bundle) SignatureLocation(version string) string {
+	return b.localPath(bundleSignaturePath(version))
+}
+
+func (b *bundle) ArchiveLocation(version string) string {
+	return b.localPath(bundleArchivePath(version))
+}
+
+func (b *bundle) PatchLocation(version string, subType itchio.BuildFileSubType) string {
+	return b.localPath(bundlePatchPath(version, subType))
+}
+
+// Paths of the files in a bundle, relative to its root and slash-separated,
+// as they appear in the manifest.
+
+const bundleManifestName = "manifest.json"
+const bundleLatestName = "LATEST"
+
+func bundleInfoPath(version string) string {
+	return path.Join(version, "info.json")
+}
+
+func bundleSignaturePath(version string) string {
+	return path.Join(version, "signature.pws")
+}
+
+func bundleReleaseManifestPath(version string) string {
+	return path.Join(version, "release-manifest.json")
+}
+
+func bundleReleaseManifestSignaturePath(version string) string {
+	return path.Join(version, "release-manifest.sig")
+}
+
+func bundleArchivePath(version string) string {
+	return path.Join(version, "archive.zip")
+}
+
+func bundleUpgradePathPath(from string, to string) string {
+	return path.Join(from, "upgrade-paths", to+".json")
+}
+
+func bundlePatchPath(version string, subType itchio.BuildFileSubType) string {
+	return path.Join(version, fmt.Sprintf("patch-%s.pwr", subType))
+}
+
+func (b *bundle) Close() error {
+	if b.tempDir == "" {
+		return nil
+	}
+	return os.RemoveAll(b.tempDir)
+}
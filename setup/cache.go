@@ -0,0 +1,101 @@
+package setup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dchest/safefile"
+)
+
+// MetadataCacheName is the folder, in the base dir, where broth metadata
+// (LATEST, build info and upgrade paths) is cached.
+const MetadataCacheName = "broth-cache"
+
+// MetadataCache keeps broth metadata on disk, along with the ETag and
+// Last-Modified headers it came with, so we can make conditional requests,
+// and fall back to what we last saw when broth can't be reached.
+//
+// Entries are keyed by a hash of the broth URLs they're fetched from (all
+// mirrors together, see cacheScope), then by path relative to the package,
+// like `3fa2b1c9/itch/linux-amd64/LATEST`: mirrors share them, but another
+// broth never gets served what this one said. Validators are only sent
+// back to the mirror they came from.
+type MetadataCache struct {
+	dir string
+}
+
+type metadataCacheEntry struct {
+	// URL is where Body was fetched from
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Body         []byte `json:"body"`
+}
+
+// NewMetadataCache returns a cache stored in dir, which is only created
+// once there's something to store.
+func NewMetadataCache(dir string) *MetadataCache {
+	return &MetadataCache{
+		dir: dir,
+	}
+}
+
+// cacheScope identifies a list of mirrors in cache keys
+func cacheScope(locations []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(locations, "\n")))
+	return hex.EncodeToString(sum[:4])
+}
+
+func (mc *MetadataCache) entryPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(mc.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// get returns nil if there's no (readable) entry for key
+func (mc *MetadataCache) get(key string) *metadataCacheEntry {
+	if mc == nil {
+		return nil
+	}
+
+	entry := &metadataCacheEntry{}
+	err := readJSONFile(mc.entryPath(key), entry)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Ignoring unreadable cache entry for (%s): %v", key, err)
+		}
+		return nil
+	}
+	return entry
+}
+
+// put doesn't hard fail: the cache is only an optimization
+func (mc *MetadataCache) put(key string, entry *metadataCacheEntry) {
+	if mc == nil {
+		return
+	}
+
+	err := mc.write(key, entry)
+	if err != nil {
+		log.Printf("While caching (%s): %v", key, err)
+	}
+}
+
+func (mc *MetadataCache) write(key string, entry *metadataCacheEntry) error {
+	err := os.MkdirAll(mc.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshalling cache entry: %w", err)
+	}
+
+	return safefile.WriteFile(mc.entryPath(key), data, 0644)
+}
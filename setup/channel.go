@@ -0,0 +1,50 @@
+package setup
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+// StableChannel is the release channel everyone is on by default.
+// Other channels, like `beta` or `canary`, are prerelease tracks.
+const StableChannel = "stable"
+
+var channelRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.]*$`)
+
+// ValidateChannel returns an error if channel can't be used as a
+// release channel. The empty string means stable.
+func ValidateChannel(channel string) error {
+	if channel == "" || channelRegexp.MatchString(channel) {
+		return nil
+	}
+	return WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("Invalid release channel %q (must be lowercase letters, digits and dots)", channel))
+}
+
+// normalizeChannel returns "" for the stable channel, so it's not
+// spelled out in the state or in broth channel names.
+func normalizeChannel(channel string) string {
+	if channel == StableChannel {
+		return ""
+	}
+	return channel
+}
+
+// brothChannelName returns the broth channel for a platform (like
+// `linux-amd64`) and a release channel, like `linux-amd64-beta`.
+func brothChannelName(platform string, channel string) string {
+	channel = normalizeChannel(channel)
+	if channel == "" {
+		return platform
+	}
+	return fmt.Sprintf("%s-%s", platform, channel)
+}
+
+// displayChannel is for logs, where an empty channel would be confusing
+func displayChannel(channel string) string {
+	if channel == "" {
+		return StableChannel
+	}
+	return channel
+}
@@ -0,0 +1,182 @@
+package setup
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr/patcher"
+)
+
+// checkpointInterval is how often we persist progress while
+// extracting an archive or applying a patch.
+var checkpointInterval = 2 * time.Second
+
+// stagingCheckpoint is persisted in the staging folder so that an
+// install or upgrade interrupted by a crash, a kill or a flaky
+// connection can pick up where it left off on the next run.
+type stagingCheckpoint struct {
+	// Target identifies what's being staged, see stagingTarget
+	Target string
+
+	// For archive upgrades: where the extractor was at
+	Extractor *savior.ExtractorCheckpoint
+
+	// For patch upgrades: versions whose patch has been fully
+	// applied (their output is in the staging folder)...
+	PatchesDone []string
+	// ...and where the patcher was at for the next one
+	Patcher *patcher.Checkpoint
+}
+
+// stagingTarget returns a string that identifies what we're staging,
+// so that we only ever resume from a checkpoint made for the same thing.
+func stagingTarget(method string, version string) string {
+	return fmt.Sprintf("%s/%s", method, version)
+}
+
+func checkpointPath(stagingFolder string) string {
+	return filepath.Join(stagingFolder, "checkpoint.bin")
+}
+
+// readCheckpoint returns the checkpoint in stagingFolder if there's
+// one and it was made for target, nil otherwise.
+func readCheckpoint(stagingFolder string, target string) *stagingCheckpoint {
+	c, err := decodeCheckpoint(stagingFolder)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Ignoring unreadable checkpoint: %v", err)
+		}
+		return nil
+	}
+
+	if c.Target != target {
+		log.Printf("Ignoring checkpoint for (%s), we're staging (%s)", c.Target, target)
+		return nil
+	}
+
+	return c
+}
+
+// decodeCheckpoint returns the checkpoint in stagingFolder, whatever it
+// was made for
+func decodeCheckpoint(stagingFolder string) (*stagingCheckpoint, error) {
+	f, err := os.Open(checkpointPath(stagingFolder))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &stagingCheckpoint{}
+	err = gob.NewDecoder(f).Decode(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func writeCheckpoint(stagingFolder string, c *stagingCheckpoint) error {
+	f, err := safefile.Create(checkpointPath(stagingFolder), 0644)
+	if err != nil {
+		return fmt.Errorf("creating checkpoint file: %w", err)
+	}
+	defer f.Close()
+
+	err = gob.NewEncoder(f).Encode(c)
+	if err != nil {
+		return fmt.Errorf("encoding checkpoint: %w", err)
+	}
+
+	err = f.Commit()
+	if err != nil {
+		return fmt.Errorf("committing checkpoint file: %w", err)
+	}
+
+	return nil
+}
+
+func removeCheckpoint(stagingFolder string) {
+	err := os.Remove(checkpointPath(stagingFolder))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("While removing checkpoint: %v", err)
+	}
+}
+
+// finishStaging cleans up the staging folder, unless staging failed
+// and left behind a checkpoint a later run can resume from.
+func finishStaging(mv Multiverse, stagingFolder string, target string, err error) {
+	if err != nil && readCheckpoint(stagingFolder, target) != nil {
+		log.Printf("Keeping staging folder (%s) so we can resume later", stagingFolder)
+		return
+	}
+
+	mv.CleanStagingFolder()
+}
+
+// checkpointSaver persists checkpoints at most every checkpointInterval.
+// It's adapted to the savior and patcher save consumer interfaces below.
+type checkpointSaver struct {
+	stagingFolder string
+	checkpoint    *stagingCheckpoint
+	lastSave      time.Time
+
+	// saved is true once we've persisted at least one new checkpoint
+	saved bool
+}
+
+func newCheckpointSaver(stagingFolder string, checkpoint *stagingCheckpoint) *checkpointSaver {
+	return &checkpointSaver{
+		stagingFolder: stagingFolder,
+		checkpoint:    checkpoint,
+		lastSave:      time.Now(),
+	}
+}
+
+func (cs *checkpointSaver) shouldSave() bool {
+	return time.Since(cs.lastSave) > checkpointInterval
+}
+
+func (cs *checkpointSaver) save() error {
+	cs.lastSave = time.Now()
+	err := writeCheckpoint(cs.stagingFolder, cs.checkpoint)
+	if err != nil {
+		return err
+	}
+	cs.saved = true
+	return nil
+}
+
+type extractorSaveConsumer struct {
+	cs *checkpointSaver
+}
+
+var _ savior.SaveConsumer = (*extractorSaveConsumer)(nil)
+
+func (esc *extractorSaveConsumer) ShouldSave(copiedBytes int64) bool {
+	return esc.cs.shouldSave()
+}
+
+func (esc *extractorSaveConsumer) Save(c *savior.ExtractorCheckpoint) (savior.AfterSaveAction, error) {
+	esc.cs.checkpoint.Extractor = c
+	return savior.AfterSaveContinue, esc.cs.save()
+}
+
+type patcherSaveConsumer struct {
+	cs *checkpointSaver
+}
+
+var _ patcher.SaveConsumer = (*patcherSaveConsumer)(nil)
+
+func (psc *patcherSaveConsumer) ShouldSave() bool {
+	return psc.cs.shouldSave()
+}
+
+func (psc *patcherSaveConsumer) Save(c *patcher.Checkpoint) (patcher.AfterSaveAction, error) {
+	psc.cs.checkpoint.Patcher = c
+	return patcher.AfterSaveContinue, psc.cs.save()
+}
@@ -0,0 +1,270 @@
+package setup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"github.com/itchio/headway/united"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+// Control lets whoever runs us steer an upgrade while it's in progress:
+// cancel it, pause it, or limit its bandwidth. Commands usually come from
+// the itch app, through our stdin, see ReadCommands.
+//
+// It applies to every HTTP request made through the clients returned by
+// HTTPClient, and to everything that honors Context.
+type Control struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	paused  bool
+	resumed chan struct{}
+	limiter *rate.Limiter
+}
+
+func NewControl() *Control {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Control{
+		ctx:     ctx,
+		cancel:  cancel,
+		limiter: rate.NewLimiter(rate.Inf, 0),
+	}
+}
+
+// Context is done once we've been cancelled
+func (c *Control) Context() context.Context {
+	return c.ctx
+}
+
+func (c *Control) Cancel() {
+	log.Printf("Cancelling...")
+	c.cancel()
+}
+
+func (c *Control) Pause() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.paused {
+		return
+	}
+	log.Printf("Pausing downloads")
+	c.paused = true
+	c.resumed = make(chan struct{})
+}
+
+func (c *Control) Resume() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.paused {
+		return
+	}
+	log.Printf("Resuming downloads")
+	c.paused = false
+	close(c.resumed)
+}
+
+// SetBandwidthLimit caps downloads to bps bytes per second, or lifts
+// the cap if bps is zero (or less).
+func (c *Control) SetBandwidthLimit(bps int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if bps <= 0 {
+		log.Printf("Lifting bandwidth limit")
+		c.limiter = rate.NewLimiter(rate.Inf, 0)
+		return
+	}
+	log.Printf("Limiting bandwidth to %s/s", united.FormatBytes(bps))
+	// a fresh limiter, so that the new limit applies right away
+	c.limiter = rate.NewLimiter(rate.Limit(bps), int(bps))
+}
+
+// BandwidthLimit returns the download speed cap in bytes per second,
+// or zero if there's none
+func (c *Control) BandwidthLimit() int64 {
+	limit := c.getLimiter().Limit()
+	if limit == rate.Inf {
+		return 0
+	}
+	return int64(limit)
+}
+
+// estimateETA returns how many seconds it'll take to download remaining
+// bytes at bps, or at our bandwidth limit if it's lower: the speed so far
+// doesn't mean much if the limit was lowered since.
+func (c *Control) estimateETA(remaining int64, bps float64) float64 {
+	limit := float64(c.BandwidthLimit())
+	if limit > 0 && (bps <= 0 || bps > limit) {
+		bps = limit
+	}
+	if bps <= 0 || remaining <= 0 {
+		return 0
+	}
+	return float64(remaining) / bps
+}
+
+// ReadCommands handles JSON-lines commands from r until it's closed.
+// Closing it doesn't cancel anything.
+func (c *Control) ReadCommands(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		m, ok := protocol.ParseMessage(line)
+		if !ok {
+			log.Printf("Ignoring invalid command: %s", line)
+			continue
+		}
+		c.handleCommand(m)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		log.Printf("While reading commands: %+v", err)
+	}
+}
+
+func (c *Control) handleCommand(m protocol.Message) {
+	switch m.Type {
+	case protocol.CommandCancel:
+		c.Cancel()
+	case protocol.CommandPause:
+		c.Pause()
+	case protocol.CommandResume:
+		c.Resume()
+	case protocol.CommandSetBandwidthLimit:
+		var p protocol.SetBandwidthLimit
+		err := json.Unmarshal(m.Payload, &p)
+		if err != nil {
+			log.Printf("Ignoring invalid %s command: %v", m.Type, err)
+			return
+		}
+		c.SetBandwidthLimit(p.BPS)
+	default:
+		log.Printf("Ignoring unknown command (%s)", m.Type)
+	}
+}
+
+// waitResumed blocks while we're paused. It returns an error if we're
+// cancelled.
+func (c *Control) waitResumed() error {
+	for {
+		c.lock.Lock()
+		paused, resumed := c.paused, c.resumed
+		c.lock.Unlock()
+
+		if !paused {
+			return c.ctx.Err()
+		}
+
+		select {
+		case <-resumed:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
+
+func (c *Control) getLimiter() *rate.Limiter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.limiter
+}
+
+// HTTPClient returns a copy of base whose requests are subject to c
+func (c *Control) HTTPClient(base *http.Client) *http.Client {
+	transport := base.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	client := *base
+	client.Transport = &controlTransport{
+		control: c,
+		base:    transport,
+	}
+	return &client
+}
+
+type controlTransport struct {
+	control *Control
+	base    http.RoundTripper
+}
+
+func (ct *controlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := ct.control.waitResumed()
+	if err != nil {
+		return nil, err
+	}
+
+	// cancelling either the request or the upgrade cancels the transfer,
+	// up until the body is closed
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(ct.control.ctx, cancel)
+	release := func() {
+		stop()
+		cancel()
+	}
+
+	res, err := ct.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &controlBody{
+		control: ct.control,
+		body:    res.Body,
+		release: release,
+	}
+	return res, nil
+}
+
+type controlBody struct {
+	control *Control
+	body    io.ReadCloser
+	release func()
+}
+
+func (cb *controlBody) Read(p []byte) (int, error) {
+	err := cb.control.waitResumed()
+	if err != nil {
+		return 0, err
+	}
+
+	limiter := cb.control.getLimiter()
+	if limiter.Limit() != rate.Inf && len(p) > limiter.Burst() {
+		p = p[:limiter.Burst()]
+	}
+
+	n, err := cb.body.Read(p)
+	if n > 0 {
+		waitErr := limiter.WaitN(cb.control.ctx, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (cb *controlBody) Close() error {
+	err := cb.body.Close()
+	cb.release()
+	return err
+}
@@ -0,0 +1,209 @@
+package setup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+// Diagnosis is something `--doctor` found wrong with an installation,
+// along with how to fix it
+type Diagnosis struct {
+	Issue protocol.DoctorIssue
+	Fix   func() error
+}
+
+// Diagnose compares state.json with what's actually in the base folder.
+// Fixes either make the state match the disk, or remove what the state
+// doesn't know about.
+func (mv *multiverse) Diagnose() []*Diagnosis {
+	// state.json and the disk disagree until an interrupted transition is
+	// dealt with, so there's no point looking for anything else
+	if operation := mv.PendingTransition(); operation != "" {
+		return []*Diagnosis{{
+			Issue: protocol.DoctorIssue{
+				Kind:    protocol.DoctorIssueInterruptedTransition,
+				Path:    mv.journalPath(),
+				Message: fmt.Sprintf("Switching versions (%s) was interrupted, it'll be finished or undone", operation),
+			},
+			Fix: mv.recoverTransition,
+		}}
+	}
+
+	var res []*Diagnosis
+	s := mv.state
+
+	if s.Current != "" {
+		path := mv.makePathForCurrent(s.Current)
+		if !pathExists(path) {
+			res = append(res, &Diagnosis{
+				Issue: protocol.DoctorIssue{
+					Kind:    protocol.DoctorIssueMissingCurrent,
+					Path:    path,
+					Version: s.Current,
+					Message: fmt.Sprintf("Current version %s isn't on disk, it'll be forgotten so it can be installed again", s.Current),
+				},
+				Fix: mv.fixState(func(s *multiverseState) {
+					s.Current = ""
+				}),
+			})
+		}
+	}
+
+	if s.Ready != "" {
+		path := mv.makePathForReady(s.Ready)
+		if !pathExists(path) {
+			res = append(res, &Diagnosis{
+				Issue: protocol.DoctorIssue{
+					Kind:    protocol.DoctorIssueStaleReady,
+					Path:    path,
+					Version: s.Ready,
+					Message: fmt.Sprintf("Ready version %s isn't on disk, it'll be forgotten", s.Ready),
+				},
+				Fix: mv.fixState(func(s *multiverseState) {
+					s.Ready = ""
+				}),
+			})
+		}
+	}
+
+	for _, b := range mv.ListPrevious() {
+		if pathExists(b.Path) {
+			continue
+		}
+		version := b.Version
+		res = append(res, &Diagnosis{
+			Issue: protocol.DoctorIssue{
+				Kind:    protocol.DoctorIssueMissingPrevious,
+				Path:    b.Path,
+				Version: version,
+				Message: fmt.Sprintf("Previous version %s isn't on disk anymore, it can't be rolled back to", version),
+			},
+			Fix: mv.fixState(func(s *multiverseState) {
+				s.Previous = removeVersion(s.Previous, version)
+			}),
+		})
+	}
+
+	// with a state.json we couldn't read, every version looks orphaned
+	err := readJSONFile(mv.statePath(), &multiverseState{})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Not looking for orphan folders: %v", err)
+	} else {
+		res = append(res, mv.diagnoseOrphans()...)
+	}
+
+	staging := mv.stagingFolderPath()
+	if c, err := decodeCheckpoint(staging); err == nil && c.Target != "" {
+		// the next install or upgrade to the same thing picks up from there
+		log.Printf("Staging folder (%s) can resume (%s), leaving it alone", staging, c.Target)
+	} else if pathExists(staging) {
+		res = append(res, &Diagnosis{
+			Issue: protocol.DoctorIssue{
+				Kind:    protocol.DoctorIssueLeftoverStaging,
+				Path:    staging,
+				Message: "Staging folder was left behind by an interrupted install or upgrade",
+				Size:    folderSize(staging),
+			},
+			Fix: removeAllFix(staging),
+		})
+	}
+
+	return res
+}
+
+// diagnoseOrphans looks for version folders state.json doesn't list,
+// including the `.old` ones switching versions used to leave behind
+func (mv *multiverse) diagnoseOrphans() []*Diagnosis {
+	var res []*Diagnosis
+	s := mv.state
+
+	known := make(map[string]bool)
+	if s.Current != "" {
+		known[mv.makePathForCurrent(s.Current)] = true
+	}
+	if s.Ready != "" {
+		known[mv.makePathForReady(s.Ready)] = true
+	}
+	for _, b := range mv.ListPrevious() {
+		known[b.Path] = true
+	}
+
+	var candidates []string
+	for _, dir := range []string{mv.params.BaseDir, mv.previousFolderPath()} {
+		matches, err := filepath.Glob(filepath.Join(dir, mv.versionToBasename("*")))
+		if err != nil {
+			log.Printf("While looking for orphan folders in (%s): %v", dir, err)
+			continue
+		}
+		candidates = append(candidates, matches...)
+	}
+	if mv.params.ApplicationsDir != "" {
+		candidates = append(candidates, mv.makePathForCurrent("")+".old")
+	}
+
+	for _, path := range candidates {
+		if known[path] {
+			continue
+		}
+		stats, err := os.Stat(path)
+		if err != nil || !stats.IsDir() {
+			continue
+		}
+
+		message := fmt.Sprintf("(%s) isn't a version state.json knows about", filepath.Base(path))
+		if strings.HasSuffix(path, ".old") {
+			message = fmt.Sprintf("(%s) was left behind by an interrupted upgrade", filepath.Base(path))
+		}
+		res = append(res, &Diagnosis{
+			Issue: protocol.DoctorIssue{
+				Kind:    protocol.DoctorIssueOrphanFolder,
+				Path:    path,
+				Message: message,
+				Size:    folderSize(path),
+			},
+			Fix: removeAllFix(path),
+		})
+	}
+	return res
+}
+
+// fixState returns a fix that applies change to the state
+func (mv *multiverse) fixState(change func(s *multiverseState)) func() error {
+	return func() error {
+		j := mv.newJournal("doctor")
+		change(j.After)
+		return mv.transition(j)
+	}
+}
+
+func removeAllFix(path string) func() error {
+	return func() error {
+		log.Printf("Removing (%s)", path)
+		return os.RemoveAll(path)
+	}
+}
+
+// folderSize returns how many bytes the files in path take up, as far as
+// it can tell
+func folderSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if stats, err := d.Info(); err == nil {
+				size += stats.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
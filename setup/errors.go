@@ -0,0 +1,72 @@
+package setup
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+
+	"github.com/itchio/itch-setup/localize"
+	"github.com/itchio/itch-setup/protocol"
+)
+
+type codedError struct {
+	code protocol.ErrorCode
+	err  error
+}
+
+func (ce *codedError) Error() string {
+	return ce.err.Error()
+}
+
+func (ce *codedError) Unwrap() error {
+	return ce.err
+}
+
+// WithErrorCode tags err with code, so that ErrorCodeFor finds it even
+// once err has been wrapped further.
+func WithErrorCode(code protocol.ErrorCode, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// ErrorCodeFor returns the code err was tagged with, if any, or makes
+// an educated guess.
+func ErrorCodeFor(err error) protocol.ErrorCode {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+
+	if isUntrustedCertificate(err) {
+		return protocol.ErrorCodeUntrustedCertificate
+	}
+
+	if isVerificationFailure(err) {
+		return protocol.ErrorCodeVerificationFailed
+	}
+
+	if isUnavailable(err) {
+		return protocol.ErrorCodeUnavailable
+	}
+
+	if errors.Is(err, fs.ErrPermission) {
+		return protocol.ErrorCodePermissionDenied
+	}
+
+	return protocol.ErrorCodeUnknown
+}
+
+// NewError describes a fatal err, see EmitError
+func NewError(err error, localizer *localize.Localizer, appName string) protocol.Error {
+	code := ErrorCodeFor(err)
+	key := "setup.error." + strings.Replace(string(code), "-", "_", -1)
+
+	return protocol.Error{
+		Code:    code,
+		Message: err.Error(),
+		LocalizedMessage: localizer.T(key, localize.Replacements{
+			"app_name": appName,
+		}),
+		Retryable: code.Retryable(),
+		ExitCode:  code.ExitCode(),
+	}
+}
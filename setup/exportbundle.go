@@ -0,0 +1,300 @@
+package setup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/itchio/headway/united"
+	"github.com/itchio/httpkit/eos/option"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+// BundleManifest describes what's in a bundle made by --export-bundle,
+// so it can be checked before it's installed from.
+type BundleManifest struct {
+	AppName     string        `json:"appName"`
+	Channel     string        `json:"channel"`
+	Version     string        `json:"version"`
+	UpgradeFrom string        `json:"upgradeFrom,omitempty"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	Files       []*BundleFile `json:"files"`
+}
+
+type BundleFile struct {
+	// Path is relative to the bundle's root, slash-separated
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ExportBundle downloads everything needed to install the latest version
+// into dir, in the layout --from-bundle expects. If upgradeFrom is set, it
+// also downloads the patches needed to upgrade to it from that version.
+func (i *Installer) ExportBundle(dir string, upgradeFrom string) (*BundleManifest, error) {
+	Emit(protocol.PhaseStarted{Phase: protocol.PhaseExport})
+
+	err := i.openSource()
+	if err != nil {
+		return nil, err
+	}
+	defer i.closeSource()
+
+	err = i.resolveChannel()
+	if err != nil {
+		return nil, fmt.Errorf("while resolving channel: %w", err)
+	}
+
+	version, err := i.getVersion()
+	if err != nil {
+		return nil, fmt.Errorf("while getting latest version: %w", err)
+	}
+
+	log.Printf("Exporting %s %s (%s) to (%s)", i.settings.AppName, version, i.channelName, dir)
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("creating bundle folder: %w", err)
+	}
+
+	bw := &bundleWriter{
+		installer: i,
+		dir:       dir,
+		manifest: &BundleManifest{
+			AppName:   i.settings.AppName,
+			Channel:   i.channelName,
+			Version:   version,
+			CreatedAt: time.Now().UTC(),
+		},
+	}
+
+	buildInfo, err := i.source.BuildInfo(version)
+	if err != nil {
+		return nil, err
+	}
+	err = bw.writeJSON(bundleInfoPath(version), buildInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	releaseManifest, err := bw.exportReleaseManifest(version)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bw.download(bundleSignaturePath(version), func(s PackageSource) string {
+		return s.SignatureLocation(version)
+	}, releaseManifest.signature())
+	if err != nil {
+		return nil, err
+	}
+
+	err = bw.download(bundleArchivePath(version), func(s PackageSource) string {
+		return s.ArchiveLocation(version)
+	}, releaseManifest.archive())
+	if err != nil {
+		return nil, err
+	}
+
+	if upgradeFrom != "" && upgradeFrom != version {
+		err = bw.exportUpgradePath(upgradeFrom, version)
+		if err != nil {
+			return nil, fmt.Errorf("exporting upgrade path from %s: %w", upgradeFrom, err)
+		}
+		bw.manifest.UpgradeFrom = upgradeFrom
+	}
+
+	// LATEST and the manifest go last, so that an interrupted export
+	// doesn't look like a usable bundle
+	err = bw.writeBytes(bundleLatestName, []byte(version+"\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifestBytes, err := json.MarshalIndent(bw.manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshalling bundle manifest: %w", err)
+	}
+	err = writeFileAtomic(filepath.Join(dir, bundleManifestName), manifestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("writing bundle manifest: %w", err)
+	}
+
+	log.Printf("Exported %d files to (%s)", len(bw.manifest.Files), dir)
+	return bw.manifest, nil
+}
+
+type bundleWriter struct {
+	installer *Installer
+	dir       string
+	manifest  *BundleManifest
+}
+
+func (bw *bundleWriter) exportUpgradePath(from string, to string) error {
+	source := bw.installer.source
+
+	upgradePath, err := source.UpgradePath(from, to)
+	if err != nil {
+		return err
+	}
+	if len(upgradePath.Patches) == 0 {
+		return fmt.Errorf("Upgrade path has no patches")
+	}
+
+	err = bw.writeJSON(bundleUpgradePathPath(from, to), upgradePath)
+	if err != nil {
+		return err
+	}
+
+	// the installed version is checked against its signature before
+	// patching, see readInstalledSignature
+	var expected *ReleaseManifestFile
+	releaseManifest, err := bw.exportReleaseManifest(from)
+	if err == nil {
+		expected = releaseManifest.signature()
+	} else if errors.Is(err, errNoReleaseManifest) {
+		log.Printf("No release manifest for (%s), exporting its signature as-is", from)
+	} else {
+		return err
+	}
+
+	err = bw.download(bundleSignaturePath(from), func(s PackageSource) string {
+		return s.SignatureLocation(from)
+	}, expected)
+	if err != nil {
+		return err
+	}
+
+	for _, bp := range upgradePath.Patches {
+		f := bp.PreferredFile()
+		if f == nil {
+			return fmt.Errorf("Could not find default patch file for version %s", bp.Version)
+		}
+
+		// patches aren't in release manifests, what they make is checked instead
+		err = bw.download(bundlePatchPath(bp.Version, f.SubType), func(s PackageSource) string {
+			return s.PatchLocation(bp.Version, f.SubType)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportReleaseManifest copies the release manifest of version into the
+// bundle, as it was signed, once we've checked it's genuine. Builds
+// without a release key that don't require one don't check nor export
+// any, see releaseManifest.
+func (bw *bundleWriter) exportReleaseManifest(version string) (*ReleaseManifest, error) {
+	releaseManifest, err := bw.installer.releaseManifest(version)
+	if err != nil || releaseManifest == nil {
+		return nil, err
+	}
+
+	err = bw.writeBytes(bundleReleaseManifestPath(version), releaseManifest.raw)
+	if err != nil {
+		return nil, err
+	}
+	err = bw.writeBytes(bundleReleaseManifestSignaturePath(version), releaseManifest.rawSignature)
+	if err != nil {
+		return nil, err
+	}
+	return releaseManifest, nil
+}
+
+func (bw *bundleWriter) writeJSON(relPath string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshalling (%s): %w", relPath, err)
+	}
+	return bw.writeBytes(relPath, data)
+}
+
+func (bw *bundleWriter) writeBytes(relPath string, data []byte) error {
+	err := writeFileAtomic(bw.localPath(relPath), data)
+	if err != nil {
+		return fmt.Errorf("writing (%s): %w", relPath, err)
+	}
+
+	sum := sha256.Sum256(data)
+	bw.addFile(relPath, int64(len(data)), sum[:])
+	return nil
+}
+
+// download copies a file from the package source into the bundle,
+// hashing it as it goes. If expected is set, the file is only kept if
+// it matches.
+func (bw *bundleWriter) download(relPath string, locate func(s PackageSource) string, expected *ReleaseManifestFile) error {
+	src, err := openArtifactFile(bw.installer.source, relPath, locate, option.WithHTTPClient(bw.installer.downloadClient))
+	if err != nil {
+		return fmt.Errorf("While opening (%s): %w", relPath, err)
+	}
+	defer src.Close()
+
+	localPath := bw.localPath(relPath)
+	err = os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := safefile.Create(localPath, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), src)
+	if err != nil {
+		return fmt.Errorf("While downloading (%s): %w", relPath, err)
+	}
+
+	sum := h.Sum(nil)
+	if expected != nil {
+		err = expected.check(relPath, size, sum)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f.Commit()
+	if err != nil {
+		return fmt.Errorf("committing (%s): %w", relPath, err)
+	}
+
+	log.Printf("Wrote (%s) (%s)", relPath, united.FormatBytes(size))
+	bw.addFile(relPath, size, sum)
+	return nil
+}
+
+func (bw *bundleWriter) addFile(relPath string, size int64, sum []byte) {
+	bw.manifest.Files = append(bw.manifest.Files, &BundleFile{
+		Path:   relPath,
+		Size:   size,
+		SHA256: hex.EncodeToString(sum),
+	})
+}
+
+func (bw *bundleWriter) localPath(relPath string) string {
+	return filepath.Join(bw.dir, filepath.FromSlash(relPath))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return safefile.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,271 @@
+package setup
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	itchio "github.com/itchio/go-itchio"
+	"github.com/itchio/httpkit/eos"
+	"github.com/itchio/httpkit/eos/option"
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/neterr"
+	"github.com/itchio/savior"
+	"github.com/itchio/savior/filesource"
+)
+
+// unavailableError means a source couldn't be reached or misbehaved,
+// as opposed to not having what we asked for. retryAfter is set if the
+// source told us when to try again.
+type unavailableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (ue *unavailableError) Error() string {
+	return ue.err.Error()
+}
+
+func (ue *unavailableError) Unwrap() error {
+	return ue.err
+}
+
+// isUnavailable returns true for connection errors, 5xx and 429 responses
+// and stalls: another mirror (or the same one, later) might do better.
+// Certificate errors aren't: retrying won't make them go away, and
+// falling back to another mirror or a cached copy would hide them.
+func isUnavailable(err error) bool {
+	if err == nil || isUntrustedCertificate(err) {
+		return false
+	}
+
+	var ue *unavailableError
+	if errors.As(err, &ue) {
+		return true
+	}
+
+	var se *htfs.ServerError
+	if errors.As(err, &se) && isRetryableStatus(se.StatusCode) {
+		return true
+	}
+
+	return neterr.IsNetworkError(err)
+}
+
+// isRetryableStatus returns true for server errors, and for servers
+// asking us to slow down
+func isRetryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// failoverSource tries a list of mirrors in order, moving on to the
+// next one whenever a mirror is unavailable. When they all are, the
+// whole list is retried, according to retrier.
+type failoverSource struct {
+	sources []PackageSource
+	retrier *retrier
+}
+
+var _ PackageSource = (*failoverSource)(nil)
+
+func newFailoverSource(sources []PackageSource, retrier *retrier) *failoverSource {
+	return &failoverSource{
+		sources: sources,
+		retrier: retrier,
+	}
+}
+
+func (fs *failoverSource) String() string {
+	var names []string
+	for _, s := range fs.sources {
+		names = append(names, s.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+func (fs *failoverSource) try(what string, f func(s PackageSource) error) error {
+	return fs.retrier.do(what, func() error {
+		return tryMirrors(fs.sources, what, f)
+	})
+}
+
+func (fs *failoverSource) ChannelExists() (bool, error) {
+	var exists bool
+	err := fs.try("channel", func(s PackageSource) error {
+		var err error
+		exists, err = s.ChannelExists()
+		return err
+	})
+	return exists, err
+}
+
+func (fs *failoverSource) LatestVersion() (string, error) {
+	var version string
+	err := fs.try("latest version", func(s PackageSource) error {
+		var err error
+		version, err = s.LatestVersion()
+		return err
+	})
+	return version, err
+}
+
+func (fs *failoverSource) BuildInfo(version string) (*BrothBuildInfo, error) {
+	var buildInfo *BrothBuildInfo
+	err := fs.try(fmt.Sprintf("build info for %s", version), func(s PackageSource) error {
+		var err error
+		buildInfo, err = s.BuildInfo(version)
+		return err
+	})
+	return buildInfo, err
+}
+
+func (fs *failoverSource) UpgradePath(from string, to string) (*BrothUpgradePath, error) {
+	var upgradePath *BrothUpgradePath
+	err := fs.try(fmt.Sprintf("upgrade path %s → %s", from, to), func(s PackageSource) error {
+		var err error
+		upgradePath, err = s.UpgradePath(from, to)
+		return err
+	})
+	return upgradePath, err
+}
+
+func (fs *failoverSource) ReleaseManifest(version string) ([]byte, []byte, error) {
+	var manifest, signature []byte
+	err := fs.try(fmt.Sprintf("release manifest for %s", version), func(s PackageSource) error {
+		var err error
+		manifest, signature, err = s.ReleaseManifest(version)
+		return err
+	})
+	return manifest, signature, err
+}
+
+// Locations are those of the first mirror: use openArtifact to
+// fail over when opening them.
+
+func (fs *failoverSource) SignatureLocation(version string) string {
+	return fs.sources[0].SignatureLocation(version)
+}
+
+func (fs *failoverSource) ArchiveLocation(version string) string {
+	return fs.sources[0].ArchiveLocation(version)
+}
+
+func (fs *failoverSource) PatchLocation(version string, subType itchio.BuildFileSubType) string {
+	return fs.sources[0].PatchLocation(version, subType)
+}
+
+func (fs *failoverSource) Close() error {
+	var firstErr error
+	for _, s := range fs.sources {
+		err := s.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// mirrorsOf returns the mirrors of source if it's a failoverSource,
+// or just source itself otherwise.
+func mirrorsOf(source PackageSource) []PackageSource {
+	if fs, ok := source.(*failoverSource); ok {
+		return fs.sources
+	}
+	return []PackageSource{source}
+}
+
+// retrierOf returns the retrier of source if it's a failoverSource,
+// or nil (don't retry) otherwise.
+func retrierOf(source PackageSource) *retrier {
+	if fs, ok := source.(*failoverSource); ok {
+		return fs.retrier
+	}
+	return nil
+}
+
+// tryMirrors calls f with each source in turn, until one isn't unavailable.
+func tryMirrors(sources []PackageSource, what string, f func(s PackageSource) error) error {
+	var err error
+	for index, s := range sources {
+		err = f(s)
+		if !isUnavailable(err) {
+			if err == nil && len(sources) > 1 {
+				log.Printf("Mirror (%s) served %s", s, what)
+			}
+			return err
+		}
+
+		if index < len(sources)-1 {
+			log.Printf("Mirror (%s) unavailable for %s, failing over: %v", s, what, err)
+		}
+	}
+
+	if len(sources) > 1 {
+		return fmt.Errorf("all mirrors unavailable for %s, last error: %w", what, err)
+	}
+	return err
+}
+
+// openArtifact opens a file located by locate, failing over to the
+// next mirror of source if it can't be reached. Once it's open, reads
+// from HTTP mirrors fail over through mirrorTransport.
+func openArtifact(source PackageSource, what string, locate func(s PackageSource) string, opts ...option.Option) (savior.FileSource, error) {
+	var src savior.FileSource
+	err := retrierOf(source).do(what, func() error {
+		return tryMirrors(mirrorsOf(source), what, func(s PackageSource) error {
+			location := locate(s)
+			log.Printf("☁ %s", location)
+
+			var err error
+			src, err = filesource.Open(location, opts...)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// openArtifactFile is like openArtifact, for callers that need an eos.File
+func openArtifactFile(source PackageSource, what string, locate func(s PackageSource) string, opts ...option.Option) (eos.File, error) {
+	var f eos.File
+	err := retrierOf(source).do(what, func() error {
+		return tryMirrors(mirrorsOf(source), what, func(s PackageSource) error {
+			location := locate(s)
+			log.Printf("☁ %s", location)
+
+			var err error
+			f, err = eos.Open(location, opts...)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// locateArtifact returns the location of a file on the first mirror
+// of source that can serve it, for callers that open it themselves.
+func locateArtifact(source PackageSource, what string, locate func(s PackageSource) string, opts ...option.Option) (string, error) {
+	var location string
+	err := retrierOf(source).do(what, func() error {
+		return tryMirrors(mirrorsOf(source), what, func(s PackageSource) error {
+			location = locate(s)
+
+			f, err := eos.Open(location, opts...)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	return location, nil
+}
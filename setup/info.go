@@ -0,0 +1,67 @@
+package setup
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+// NewInfo collects the platform-independent parts of the installation
+// state for `--info`. Cores are expected to fill in UserDataPath and
+// Files themselves.
+func NewInfo(appName string, setupVersion string, baseDir string, mv Multiverse) *protocol.Info {
+	info := &protocol.Info{
+		AppName:      appName,
+		SetupVersion: setupVersion,
+		Channel:      brothChannelName(DefaultChannelName(), mv.GetChannel()),
+		BaseDir:      baseDir,
+		Current:      newInfoBuild(mv.GetCurrentVersion()),
+		Ready:        newInfoBuild(mv.GetReadyVersion()),
+
+		PendingTransition: mv.PendingTransition(),
+	}
+
+	for _, b := range mv.ListPrevious() {
+		info.Previous = append(info.Previous, newInfoBuild(b))
+	}
+
+	stateBytes, err := os.ReadFile(filepath.Join(baseDir, "state.json"))
+	if err != nil {
+		log.Printf("While reading state for info: %v", err)
+	} else if json.Valid(stateBytes) {
+		info.State = json.RawMessage(stateBytes)
+	} else {
+		log.Printf("state.json is not valid JSON, leaving it out")
+	}
+
+	return info
+}
+
+// AddInfoFile records whether a file the installation depends on exists
+func AddInfoFile(info *protocol.Info, kind string, path string) {
+	info.Files = append(info.Files, &protocol.InfoFile{
+		Kind:   kind,
+		Path:   path,
+		Exists: pathExists(path),
+	})
+}
+
+func newInfoBuild(b *BuildFolder) *protocol.InfoBuild {
+	if b == nil {
+		return nil
+	}
+
+	return &protocol.InfoBuild{
+		Version: b.Version,
+		Path:    b.Path,
+		Exists:  pathExists(b.Path),
+	}
+}
+
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
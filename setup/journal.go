@@ -0,0 +1,315 @@
+package setup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dchest/safefile"
+)
+
+// Multiverse transitions move build folders around, then save the state
+// that reflects it. Being interrupted in between would leave state.json
+// and the disk disagreeing, so every transition is written to a journal
+// first: NewMultiverse finishes (or undoes) whatever it finds there.
+
+const journalName = "journal.json"
+
+// multiverseJournal describes a transition, before it's made
+type multiverseJournal struct {
+	// Operation is for logs, like `make-ready-current`
+	Operation string `json:"operation"`
+
+	// Before is the state before the transition, After the one it leads to
+	Before *multiverseState `json:"before"`
+	After  *multiverseState `json:"after"`
+
+	// Renames are made in order. Undoing them is what rolling back the
+	// transition amounts to, so nothing is deleted until After is saved.
+	Renames []journalRename `json:"renames,omitempty"`
+
+	// Cleanup lists folders that are deleted once After is saved
+	Cleanup []string `json:"cleanup,omitempty"`
+
+	// Committed is set once After is saved. Cleaning up may have deleted
+	// what undoing the renames needs, so from then on the transition can
+	// only be finished.
+	Committed bool `json:"committed,omitempty"`
+}
+
+type journalRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// done tells if jr was made, given the renames that come after it: one
+// of them may have put something else at jr.From since, like a new
+// `itch.app` on macOS.
+func (jr journalRename) done(later []journalRename) bool {
+	if !pathExists(jr.To) {
+		return false
+	}
+	if !pathExists(jr.From) {
+		return true
+	}
+	for _, l := range later {
+		if l.To == jr.From {
+			return true
+		}
+	}
+	return false
+}
+
+func (jr journalRename) pending() bool {
+	return pathExists(jr.From) && !pathExists(jr.To)
+}
+
+// newJournal starts planning a transition from the current state. The
+// caller changes j.After, and adds renames and cleanups.
+func (mv *multiverse) newJournal(operation string) *multiverseJournal {
+	return &multiverseJournal{
+		Operation: operation,
+		Before:    mv.state.clone(),
+		After:     mv.state.clone(),
+	}
+}
+
+// clearPath plans moving whatever is at path out of the way as part of j,
+// so a rename can put something else there, and deleting it once j.After
+// is saved. It's usually a leftover from a transition that couldn't
+// clean up after itself.
+func (mv *multiverse) clearPath(j *multiverseJournal, path string) {
+	if !pathExists(path) {
+		return
+	}
+
+	stalePath := path + ".stale"
+	for i := 1; pathExists(stalePath); i++ {
+		stalePath = fmt.Sprintf("%s.stale%d", path, i)
+	}
+	log.Printf("Moving (%s) out of the way, will delete it", path)
+	j.Renames = append(j.Renames, journalRename{From: path, To: stalePath})
+	j.Cleanup = append(j.Cleanup, stalePath)
+}
+
+// transition journals j, makes its renames and saves j.After, then
+// cleans up. If a rename fails, the ones already made are undone and the
+// state is left as it was.
+func (mv *multiverse) transition(j *multiverseJournal) error {
+	log.Printf("Journaling %s", j.Operation)
+	err := mv.writeJournal(j)
+	if err != nil {
+		return err
+	}
+	crashPoint("journal written")
+
+	for index, rename := range j.Renames {
+		log.Printf("Renaming (%s) to (%s)", rename.From, rename.To)
+		err = renameWithRetry(rename.From, rename.To)
+		if err != nil {
+			log.Printf("%s failed, rolling back", j.Operation)
+			undoRenames(j.Renames[:index])
+			mv.removeJournal()
+			return err
+		}
+		crashPoint(fmt.Sprintf("renamed (%s)", rename.From))
+	}
+
+	return mv.commitTransition(j)
+}
+
+// commitTransition saves j.After, then cleans up. The journal is only
+// removed once that's all done: until then, it's all there is to redo.
+func (mv *multiverse) commitTransition(j *multiverseJournal) error {
+	err := mv.setState(j.After.clone())
+	if err != nil {
+		return err
+	}
+	crashPoint("state saved")
+
+	// if this fails, recovery still finds that the state matches j.After
+	j.Committed = true
+	err = mv.writeJournal(j)
+	if err != nil {
+		log.Printf("Ignoring: %v", err)
+	}
+	crashPoint("journal committed")
+
+	return mv.finishTransition(j)
+}
+
+// finishTransition cleans up after j, once j.After is saved
+func (mv *multiverse) finishTransition(j *multiverseJournal) error {
+	for _, path := range j.Cleanup {
+		log.Printf("Cleaning up (%s)", path)
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("While cleaning up (%s): %+v", path, err)
+		}
+	}
+	crashPoint("cleaned up")
+
+	return mv.removeJournal()
+}
+
+// committed tells if j.After was saved. A crash between saving it and
+// journaling that leaves state.json as the only clue, which is only
+// telling if the transition changes the state at all.
+func (mv *multiverse) committed(j *multiverseJournal) bool {
+	if j.Committed {
+		return true
+	}
+	return !j.Before.equals(j.After) && mv.state.equals(j.After)
+}
+
+// undoRenames undoes whichever of renames were made, last first, which
+// frees up their sources again.
+// Failures are logged: there's nothing better to do with them.
+func undoRenames(renames []journalRename) {
+	for index := len(renames) - 1; index >= 0; index-- {
+		rename := renames[index]
+		if !rename.done(renames[index+1:]) {
+			continue
+		}
+
+		log.Printf("Renaming (%s) back to (%s)", rename.To, rename.From)
+		err := renameWithRetry(rename.To, rename.From)
+		if err != nil {
+			log.Printf("While undoing rename: %+v", err)
+		}
+	}
+}
+
+// recoverTransition finishes the transition that was interrupted, if
+// any. If it wasn't committed and one of its renames can't be made
+// anymore, the whole transition is undone instead.
+func (mv *multiverse) recoverTransition() error {
+	j := &multiverseJournal{}
+	err := readJSONFile(mv.journalPath(), j)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		// it's written atomically, so that's not on us: leave it for a human
+		return fmt.Errorf("reading multiverse journal: %w", err)
+	}
+	if j.Before == nil || j.After == nil {
+		return fmt.Errorf("reading multiverse journal: it's missing states")
+	}
+
+	if mv.committed(j) {
+		log.Printf("Found interrupted %s, which was committed, cleaning up", j.Operation)
+		mv.state = j.After
+		err = mv.finishTransition(j)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s", mv)
+		return nil
+	}
+
+	log.Printf("Found interrupted %s, recovering", j.Operation)
+	for index, rename := range j.Renames {
+		if rename.done(j.Renames[index+1:]) {
+			continue
+		}
+
+		if rename.pending() {
+			log.Printf("Renaming (%s) to (%s)", rename.From, rename.To)
+			err = renameWithRetry(rename.From, rename.To)
+			if err == nil {
+				continue
+			}
+			log.Printf("While renaming: %+v", err)
+		}
+
+		log.Printf("Can't finish %s, rolling it back", j.Operation)
+		undoRenames(j.Renames[:index])
+		err = mv.setState(j.Before.clone())
+		if err != nil {
+			return err
+		}
+		log.Printf("%s", mv)
+		return mv.removeJournal()
+	}
+
+	log.Printf("Finishing %s", j.Operation)
+	err = mv.commitTransition(j)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s", mv)
+	return nil
+}
+
+func (mv *multiverse) PendingTransition() string {
+	j := &multiverseJournal{}
+	err := readJSONFile(mv.journalPath(), j)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ""
+		}
+		log.Printf("While reading multiverse journal: %v", err)
+		return "unknown"
+	}
+	return j.Operation
+}
+
+func (mv *multiverse) journalPath() string {
+	return filepath.Join(mv.params.BaseDir, journalName)
+}
+
+func (mv *multiverse) writeJournal(j *multiverseJournal) error {
+	bs, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("marshalling multiverse journal: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(mv.journalPath()), 0755)
+	if err != nil {
+		return fmt.Errorf("creating folder for multiverse journal: %w", err)
+	}
+
+	err = safefile.WriteFile(mv.journalPath(), bs, 0644)
+	if err != nil {
+		return fmt.Errorf("writing multiverse journal: %w", err)
+	}
+	return nil
+}
+
+func (mv *multiverse) removeJournal() error {
+	err := os.Remove(mv.journalPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing multiverse journal: %w", err)
+	}
+	return nil
+}
+
+// renameWithRetry renames from to to, creating to's parent if needed.
+// On Windows, it retries for a while if files are still in use.
+func renameWithRetry(from string, to string) error {
+	err := os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+
+	retries := 5
+	for i := 0; i < retries; i++ {
+		err = os.Rename(from, to)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Rename failed (attempt %d/%d): %+v", i+1, retries, err)
+		if i < retries-1 && isRetryableRenameError(err) {
+			log.Printf("Retrying in 2 seconds...")
+			time.Sleep(2 * time.Second)
+		} else {
+			break
+		}
+	}
+	return err
+}
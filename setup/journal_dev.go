@@ -0,0 +1,28 @@
+//go:build itchsetupdev
+// +build itchsetupdev
+
+package setup
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// CrashAfterStepEnv can be set to n to make development builds exit
+// abruptly after the nth step of multiverse transitions (counting every
+// journal write, rename, state save and cleanup), to test recovery.
+const CrashAfterStepEnv = "ITCH_SETUP_CRASH_AFTER_STEP"
+
+// injectedCrashExitCode is what we exit with when CrashAfterStepEnv says so
+const injectedCrashExitCode = 86
+
+var transitionSteps = 0
+
+func crashPoint(step string) {
+	transitionSteps++
+	if os.Getenv(CrashAfterStepEnv) == strconv.Itoa(transitionSteps) {
+		log.Printf("Crashing after step %d (%s), as per $%s", transitionSteps, step, CrashAfterStepEnv)
+		os.Exit(injectedCrashExitCode)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !itchsetupdev
+// +build !itchsetupdev
+
+package setup
+
+// crashPoint only ever crashes development builds, see journal_dev.go
+func crashPoint(step string) {}
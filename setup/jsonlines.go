@@ -6,42 +6,69 @@ import (
 	"log"
 	"os"
 	"sync"
-)
 
-type Payload interface {
-	GetType() string
-}
+	"github.com/itchio/itch-setup/localize"
+	"github.com/itchio/itch-setup/protocol"
+)
 
 type message struct {
-	Type    string  `json:"type"`
-	Payload Payload `json:"payload"`
+	Type    string           `json:"type"`
+	Payload protocol.Payload `json:"payload"`
 }
 
-var jsonEnabled = false
+// jsonEnabled counts EnableJSON calls not undone by DisableJSON yet, so
+// that `--json` keeps messages flowing after a verb is done with them.
+var jsonEnabled = 0
 var jsonLock sync.Mutex
 
+// helloSent is set once the protocol.Hello message has gone out: it
+// precedes every other message.
+var helloSent = false
+var setupVersion = ""
+
+// SetSetupVersion sets the itch-setup version sent in protocol.Hello
+func SetSetupVersion(version string) {
+	jsonLock.Lock()
+	defer jsonLock.Unlock()
+
+	setupVersion = version
+}
+
 func EnableJSON() {
 	jsonLock.Lock()
 	defer jsonLock.Unlock()
 
-	jsonEnabled = true
+	jsonEnabled++
 }
 
 func DisableJSON() {
 	jsonLock.Lock()
 	defer jsonLock.Unlock()
 
-	jsonEnabled = false
+	if jsonEnabled > 0 {
+		jsonEnabled--
+	}
 }
 
-func Emit(p Payload) {
+func Emit(p protocol.Payload) {
 	jsonLock.Lock()
 	defer jsonLock.Unlock()
 
-	if !jsonEnabled {
+	if jsonEnabled == 0 {
 		return
 	}
 
+	if !helloSent {
+		helloSent = true
+		emit(protocol.Hello{
+			ProtocolVersion: protocol.Version,
+			SetupVersion:    setupVersion,
+		})
+	}
+	emit(p)
+}
+
+func emit(p protocol.Payload) {
 	m := &message{
 		Type:    p.GetType(),
 		Payload: p,
@@ -58,55 +85,21 @@ func Emit(p Payload) {
 
 //-------------------------------
 
-type Log struct {
-	Level   string `json:"level"`
-	Message string `json:"message"`
-}
-
-func (p Log) GetType() string { return "log" }
-
-//-------------------------------
-
-type Progress struct {
-	Progress float64 `json:"progress"`
-	BPS      float64 `json:"bps"`
-	ETA      float64 `json:"eta"`
+// EmitFailed emits a protocol.Failed message for err
+func EmitFailed(err error) {
+	Emit(protocol.Failed{
+		Code:    ErrorCodeFor(err),
+		Message: fmt.Sprintf("%+v", err),
+	})
 }
 
-func (p Progress) GetType() string { return "progress" }
-
-//-------------------------------
+// EmitError emits a protocol.Error message for err, even if JSON-lines
+// output wasn't enabled, since it's the last thing we'll ever print.
+// It returns the exit code to use.
+func EmitError(err error, localizer *localize.Localizer, appName string) int {
+	e := NewError(err, localizer, appName)
 
-type InstallingUpdate struct {
-	Version string `json:"version"`
+	EnableJSON()
+	Emit(e)
+	return e.ExitCode
 }
-
-func (p InstallingUpdate) GetType() string { return "installing-update" }
-
-//-------------------------------
-
-type UpdateReady struct {
-	Version string `json:"version"`
-}
-
-func (p UpdateReady) GetType() string { return "update-ready" }
-
-//-------------------------------
-
-type NoUpdateAvailable struct{}
-
-func (p NoUpdateAvailable) GetType() string { return "no-update-available" }
-
-//-------------------------------
-
-type UpdateFailed struct {
-	Message string `json:"message"`
-}
-
-func (p UpdateFailed) GetType() string { return "update-failed" }
-
-//-------------------------------
-
-type ReadyToRelaunch struct{}
-
-func (p ReadyToRelaunch) GetType() string { return "ready-to-relaunch" }
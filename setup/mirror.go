@@ -0,0 +1,96 @@
+package setup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	itchio "github.com/itchio/go-itchio"
+)
+
+// mirrorSource reads from a copy of broth on disk, laid out exactly like
+// the server's URLs: <root>/<app>/<channel>/LATEST, <version>/info,
+// <version>/archive/default and so on.
+type mirrorSource struct {
+	root     string
+	settings PackageSourceSettings
+}
+
+var _ PackageSource = (*mirrorSource)(nil)
+
+func newMirrorSource(root string, settings PackageSourceSettings) (*mirrorSource, error) {
+	stats, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("opening mirror: %w", err)
+	}
+	if !stats.IsDir() {
+		return nil, fmt.Errorf("opening mirror: (%s) is not a folder", root)
+	}
+
+	return &mirrorSource{
+		root:     root,
+		settings: settings,
+	}, nil
+}
+
+func (ms *mirrorSource) String() string {
+	return ms.channelPath()
+}
+
+func (ms *mirrorSource) channelPath(elems ...string) string {
+	return filepath.Join(append([]string{ms.root, ms.settings.AppName, ms.settings.Channel}, elems...)...)
+}
+
+func (ms *mirrorSource) ChannelExists() (bool, error) {
+	return pathExists(ms.channelPath("LATEST")), nil
+}
+
+func (ms *mirrorSource) LatestVersion() (string, error) {
+	return readTrimmedFile(ms.channelPath("LATEST"))
+}
+
+func (ms *mirrorSource) BuildInfo(version string) (*BrothBuildInfo, error) {
+	buildInfo := &BrothBuildInfo{}
+	err := readJSONFile(ms.channelPath(version, "info"), buildInfo)
+	if err != nil {
+		return nil, err
+	}
+	return buildInfo, nil
+}
+
+func (ms *mirrorSource) UpgradePath(from string, to string) (*BrothUpgradePath, error) {
+	upgradePath := &BrothUpgradePath{}
+	err := readJSONFile(ms.channelPath(from, "upgrade-paths", to), upgradePath)
+	if err != nil {
+		return nil, err
+	}
+	return upgradePath, nil
+}
+
+func (ms *mirrorSource) ReleaseManifest(version string) ([]byte, []byte, error) {
+	manifest, err := os.ReadFile(ms.channelPath(version, "release-manifest"))
+	if err != nil {
+		return nil, nil, err
+	}
+	signature, err := os.ReadFile(ms.channelPath(version, "release-manifest.sig"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, signature, nil
+}
+
+func (ms *mirrorSource) SignatureLocation(version string) string {
+	return ms.channelPath(version, "signature", "default")
+}
+
+func (ms *mirrorSource) ArchiveLocation(version string) string {
+	return ms.channelPath(version, "archive", "default")
+}
+
+func (ms *mirrorSource) PatchLocation(version string, subType itchio.BuildFileSubType) string {
+	return ms.channelPath(version, "patch", string(subType))
+}
+
+func (ms *mirrorSource) Close() error {
+	return nil
+}
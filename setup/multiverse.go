@@ -1,6 +1,7 @@
 package setup
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,8 +9,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/dchest/safefile"
 )
@@ -25,8 +26,33 @@ type multiverseState struct {
 	// It'll be used on next launch or when `--relaunch` is
 	// called.
 	Ready string `json:"ready"`
+
+	// Previous lists versions that used to be current and are
+	// still on disk, most recent first. They can be swapped back
+	// in with `--rollback`.
+	Previous []string `json:"previous,omitempty"`
+
+	// KeepPrevious is how many previous versions we retain.
+	// If unset, DefaultKeepPrevious is used.
+	KeepPrevious *int `json:"keepPrevious,omitempty"`
+
+	// Channel is the release channel picked with `--channel`, like
+	// `beta`. Empty means stable.
+	Channel string `json:"channel,omitempty"`
+
+	// Pin is the version set with `--pin`: fresh installs get it
+	// instead of the latest, and upgrades don't go past it.
+	Pin string `json:"pin,omitempty"`
+
+	// InstallID is generated the first time it's needed, and
+	// places this install in a bucket for staged rollouts.
+	InstallID string `json:"installId,omitempty"`
 }
 
+// DefaultKeepPrevious is how many previous versions are retained
+// when the user hasn't configured anything.
+const DefaultKeepPrevious = 1
+
 type BuildFolder struct {
 	Version string
 	Path    string
@@ -36,10 +62,17 @@ type Multiverse interface {
 	// Called on launch, or when upgrading
 	GetCurrentVersion() *BuildFolder
 
-	// Called when we start patching
-	MakeStagingFolder() (string, error)
-	// defer'd at the end of patching
+	// Returns the ready build, if any
+	GetReadyVersion() *BuildFolder
+
+	// Called when we start patching. target identifies what we're
+	// staging: if the staging folder holds a checkpoint for the same
+	// target, it's kept as-is so we can resume.
+	MakeStagingFolder(target string) (string, error)
+	// Called at the end of patching
 	CleanStagingFolder() error
+	// Returns true if the staging folder holds a checkpoint for target
+	CanResumeStaging(target string) bool
 
 	// Record a freshly-patched build as ready
 	QueueReady(build *BuildFolder) error
@@ -50,12 +83,65 @@ type Multiverse interface {
 	// Returns true if the ready pending version is 'version'
 	ReadyPendingIs(version string) bool
 
+	// Removes the ready build, if any
+	DiscardReady() error
+
 	// Make the ready build current.
 	MakeReadyCurrent() error
 
 	// Validates the current build (can be used after heal)
 	ValidateCurrent() error
 
+	// Returns retained previous builds, most recent first
+	ListPrevious() []*BuildFolder
+
+	// Sets (and persists) how many previous builds to retain,
+	// removing any that are now over the limit.
+	SetKeepPrevious(keep int) error
+
+	// Makes a retained previous build current again. If version
+	// is empty, the most recent previous build is used.
+	Rollback(version string) error
+
+	// Returns the release channel we're on, empty for stable
+	GetChannel() string
+
+	// Sets (and persists) the release channel we're on
+	SetChannel(channel string) error
+
+	// Returns the version we're pinned to, if any
+	GetPin() string
+
+	// Sets (and persists) the version we're pinned to. An empty
+	// version unpins.
+	SetPin(version string) error
+
+	// Returns this install's ID, generating (and persisting) it if needed
+	GetInstallID() (string, error)
+
+	// Returns the local rollout policy, or nil if there's none
+	GetRolloutPolicy() (*RolloutPolicy, error)
+
+	// Returns the proxy to go through, or nil to connect directly
+	GetProxy() *ProxySettings
+
+	// Sets (and persists) the proxy to go through. nil forgets it.
+	SetProxy(proxy *ProxySettings) error
+
+	// Returns how broth certificates are checked, or nil for the defaults
+	GetTLS() *TLSSettings
+
+	// Sets (and persists) how broth certificates are checked. nil forgets it.
+	SetTLS(tls *TLSSettings) error
+
+	// Returns what's wrong with the state or the base folder, for `--doctor`
+	Diagnose() []*Diagnosis
+
+	// Returns what an interrupted transition was doing, like
+	// `make-ready-current`, if opening read-only left one alone.
+	// It's empty if there's none, `unknown` if its journal can't be read.
+	PendingTransition() string
+
 	// Returns a human-friendly representation of the state of this multiverse
 	String() string
 }
@@ -63,6 +149,8 @@ type Multiverse interface {
 type multiverse struct {
 	params *MultiverseParams
 	state  *multiverseState
+	proxy  *ProxySettings
+	tls    *TLSSettings
 }
 
 type MultiverseParams struct {
@@ -80,6 +168,10 @@ type MultiverseParams struct {
 
 	// This is called with a folder before making it the current version
 	OnValidate ValidateHandler
+
+	// If true, an interrupted transition is left alone instead of being
+	// finished or undone, for verbs that only look, like `--info`
+	ReadOnly bool
 }
 
 func NewMultiverse(params *MultiverseParams) (Multiverse, error) {
@@ -108,6 +200,31 @@ func NewMultiverse(params *MultiverseParams) (Multiverse, error) {
 		log.Printf("%s", mv)
 	}
 
+	if params.ReadOnly {
+		if operation := mv.PendingTransition(); operation != "" {
+			log.Printf("Found interrupted %s, leaving it alone", operation)
+		}
+	} else {
+		err = mv.recoverTransition()
+		if err != nil {
+			log.Printf("Ignoring: %v", err)
+		}
+	}
+
+	err = mv.readProxy()
+	if err != nil {
+		log.Printf("Ignoring: %v", err)
+	} else if mv.proxy != nil {
+		log.Printf("Using proxy (%s)", mv.proxy)
+	}
+
+	err = mv.readTLS()
+	if err != nil {
+		log.Printf("Won't connect to broth: %v", err)
+	} else if mv.tls != nil {
+		log.Printf("Using TLS settings (%s)", mv.tls)
+	}
+
 	return mv, nil
 }
 
@@ -124,8 +241,25 @@ func (mv *multiverse) GetCurrentVersion() *BuildFolder {
 	return build
 }
 
-func (mv *multiverse) MakeStagingFolder() (string, error) {
+func (mv *multiverse) GetReadyVersion() *BuildFolder {
+	readyVersion := mv.state.Ready
+	if readyVersion == "" {
+		return nil
+	}
+
+	return &BuildFolder{
+		Version: readyVersion,
+		Path:    mv.makePathForReady(readyVersion),
+	}
+}
+
+func (mv *multiverse) MakeStagingFolder(target string) (string, error) {
 	path := mv.stagingFolderPath()
+	if mv.CanResumeStaging(target) {
+		log.Printf("Found checkpoint for (%s), keeping staging folder (%s)", target, path)
+		return path, nil
+	}
+
 	err := os.RemoveAll(path)
 	if err != nil {
 		return "", err
@@ -144,6 +278,10 @@ func (mv *multiverse) CleanStagingFolder() error {
 	return os.RemoveAll(path)
 }
 
+func (mv *multiverse) CanResumeStaging(target string) bool {
+	return readCheckpoint(mv.stagingFolderPath(), target) != nil
+}
+
 func (mv *multiverse) QueueReady(build *BuildFolder) error {
 	s := mv.state
 	if s.Ready != "" {
@@ -156,25 +294,23 @@ func (mv *multiverse) QueueReady(build *BuildFolder) error {
 		return fmt.Errorf("Internal error: Ready BuildFolder must have absolute path, but got (%s)", build.Path)
 	}
 
-	readyPath := filepath.Join(mv.params.BaseDir, mv.versionToBasename(build.Version))
+	readyPath := mv.makePathForReady(build.Version)
 	log.Printf("Storing in (%s)", readyPath)
 
-	err := os.RemoveAll(readyPath)
-	if err != nil {
-		return fmt.Errorf("making sure ready version's folder does not exist: %w", err)
+	j := mv.newJournal("queue-ready")
+	mv.clearPath(j, readyPath)
+	j.Renames = append(j.Renames, journalRename{From: build.Path, To: readyPath})
+	if mv.isPrevious(build.Version) {
+		log.Printf("(%s) was retained as a previous version, replacing it", build.Version)
+		mv.dropPrevious(j, build.Version)
 	}
+	j.After.Ready = build.Version
 
-	err = os.Rename(build.Path, readyPath)
+	err := mv.transition(j)
 	if err != nil {
 		return fmt.Errorf("moving ready version to its proper place: %w", err)
 	}
 
-	s.Ready = build.Version
-	err = mv.saveState()
-	if err != nil {
-		return fmt.Errorf("updating multiverse state with new ready: %w", err)
-	}
-
 	return nil
 }
 
@@ -196,42 +332,22 @@ func (mv *multiverse) MakeReadyCurrent() error {
 	}
 
 	log.Printf("Attempting to make (%s) the current version over (%s)", s.Ready, s.Current)
-	readyPath := filepath.Join(mv.params.BaseDir, mv.versionToBasename(s.Ready))
+	readyPath := mv.makePathForReady(s.Ready)
 
 	err := mv.validateDir(readyPath)
 	if err != nil {
 		return err
 	}
 
+	j := mv.newJournal("make-ready-current")
+
 	currentBuild := mv.GetCurrentVersion()
-	var currentBuildSave string
 	if currentBuild != nil {
 		_, statErr := os.Stat(currentBuild.Path)
 		if statErr == nil {
 			// current build path exists
-			currentBuildSave = currentBuild.Path + ".old"
-			log.Printf("Renaming (%s) to (%s)", currentBuild.Path, currentBuildSave)
-
-			retries := 5
-			var renameErr error
-			for i := 0; i < retries; i++ {
-				renameErr = os.Rename(currentBuild.Path, currentBuildSave)
-				if renameErr == nil {
-					break
-				}
-				log.Printf("Rename failed (attempt %d/%d): %+v", i+1, retries, renameErr)
-				if i < retries-1 && isRetryableRenameError(renameErr) {
-					log.Printf("Retrying in 2 seconds...")
-					time.Sleep(2 * time.Second)
-				} else {
-					break
-				}
-			}
-			if renameErr != nil {
-				return renameErr
-			}
+			mv.retainPrevious(j, currentBuild)
 		} else {
-			currentBuild = nil
 			log.Printf("Was going to back up current's folder, but got: %v", statErr)
 			log.Printf("This means state.json didn't match what was actually on disk")
 			log.Printf("Let's just go with the ready version and cross fingers")
@@ -243,36 +359,342 @@ func (mv *multiverse) MakeReadyCurrent() error {
 	if readyPath == newCurrentPath {
 		log.Printf("(%s) already at right location", readyPath)
 	} else {
-		log.Printf("Renaming (%s) to (%s)", readyPath, newCurrentPath)
-		err := os.MkdirAll(filepath.Dir(newCurrentPath), 0755)
-		if err != nil {
-			return err
-		}
+		j.Renames = append(j.Renames, journalRename{From: readyPath, To: newCurrentPath})
+	}
 
-		err = os.Rename(readyPath, newCurrentPath)
-		if err != nil {
-			if currentBuild != nil {
-				os.Rename(currentBuildSave, currentBuild.Path)
-			}
-			return err
-		}
+	j.After.Current = s.Ready
+	j.After.Ready = ""
+	return mv.transition(j)
+}
+
+func (mv *multiverse) DiscardReady() error {
+	if mv.state.Ready == "" {
+		return nil
 	}
 
-	if currentBuild != nil {
-		log.Printf("Cleaning up (%s)", currentBuildSave)
-		os.RemoveAll(currentBuildSave)
+	j := mv.newJournal("discard-ready")
+	mv.discardReady(j, "a newer version")
+	return mv.transition(j)
+}
+
+// discardReady plans removing the ready build, if any, as part of j
+func (mv *multiverse) discardReady(j *multiverseJournal, reason string) {
+	s := j.After
+	if s.Ready == "" {
+		return
 	}
 
-	s.Current = s.Ready
+	readyPath := mv.makePathForReady(s.Ready)
+	log.Printf("Discarding ready (%s) at (%s) in favor of %s", s.Ready, readyPath, reason)
+	j.Cleanup = append(j.Cleanup, readyPath)
 	s.Ready = ""
-	err = mv.saveState()
+}
+
+func (mv *multiverse) GetChannel() string {
+	return mv.state.Channel
+}
+
+func (mv *multiverse) SetChannel(channel string) error {
+	err := ValidateChannel(channel)
 	if err != nil {
 		return err
 	}
 
+	channel = normalizeChannel(channel)
+	if channel == mv.state.Channel {
+		return nil
+	}
+
+	log.Printf("Switching release channel from (%s) to (%s)", displayChannel(mv.state.Channel), displayChannel(channel))
+	s := mv.state.clone()
+	s.Channel = channel
+	return mv.setState(s)
+}
+
+func (mv *multiverse) GetPin() string {
+	return mv.state.Pin
+}
+
+func (mv *multiverse) SetPin(version string) error {
+	if version == mv.state.Pin {
+		return nil
+	}
+
+	if version == "" {
+		log.Printf("Unpinning from (%s)", mv.state.Pin)
+	} else {
+		log.Printf("Pinning to (%s)", version)
+	}
+	s := mv.state.clone()
+	s.Pin = version
+	return mv.setState(s)
+}
+
+func (mv *multiverse) GetProxy() *ProxySettings {
+	return mv.proxy
+}
+
+func (mv *multiverse) SetProxy(proxy *ProxySettings) error {
+	if proxy == nil {
+		if mv.proxy == nil {
+			return nil
+		}
+		log.Printf("Forgetting proxy (%s)", mv.proxy)
+		mv.proxy = nil
+		err := os.Remove(mv.proxyPath())
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing proxy settings: %w", err)
+		}
+		return nil
+	}
+
+	log.Printf("Setting proxy to (%s)", proxy)
+	mv.proxy = proxy
+
+	bs, err := json.Marshal(proxy)
+	if err != nil {
+		return fmt.Errorf("marshalling proxy settings: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(mv.proxyPath()), 0755)
+	if err != nil {
+		return fmt.Errorf("creating folder for proxy settings: %w", err)
+	}
+
+	// the proxy URL may have a password in it
+	err = safefile.WriteFile(mv.proxyPath(), bs, 0600)
+	if err != nil {
+		return fmt.Errorf("writing proxy settings: %w", err)
+	}
+	return nil
+}
+
+func (mv *multiverse) GetTLS() *TLSSettings {
+	return mv.tls
+}
+
+func (mv *multiverse) SetTLS(tls *TLSSettings) error {
+	if tls == nil {
+		if mv.tls == nil {
+			return nil
+		}
+		log.Printf("Forgetting TLS settings (%s)", mv.tls)
+		mv.tls = nil
+		err := os.Remove(mv.tlsPath())
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing TLS settings: %w", err)
+		}
+		return nil
+	}
+
+	log.Printf("Setting TLS settings to (%s)", tls)
+	mv.tls = tls
+
+	bs, err := json.Marshal(tls)
+	if err != nil {
+		return fmt.Errorf("marshalling TLS settings: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(mv.tlsPath()), 0755)
+	if err != nil {
+		return fmt.Errorf("creating folder for TLS settings: %w", err)
+	}
+
+	err = safefile.WriteFile(mv.tlsPath(), bs, 0644)
+	if err != nil {
+		return fmt.Errorf("writing TLS settings: %w", err)
+	}
 	return nil
 }
 
+func (mv *multiverse) GetInstallID() (string, error) {
+	if mv.state.InstallID != "" {
+		return mv.state.InstallID, nil
+	}
+
+	installID, err := newInstallID()
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Generated install ID (%s)", installID)
+	s := mv.state.clone()
+	s.InstallID = installID
+
+	err = mv.setState(s)
+	if err != nil {
+		return "", err
+	}
+	return installID, nil
+}
+
+func (mv *multiverse) GetRolloutPolicy() (*RolloutPolicy, error) {
+	return readRolloutPolicy(filepath.Join(mv.params.BaseDir, rolloutPolicyName))
+}
+
+func (mv *multiverse) ListPrevious() []*BuildFolder {
+	var builds []*BuildFolder
+	for _, version := range mv.state.Previous {
+		builds = append(builds, &BuildFolder{
+			Version: version,
+			Path:    mv.makePathForPrevious(version),
+		})
+	}
+	return builds
+}
+
+func (mv *multiverse) SetKeepPrevious(keep int) error {
+	if keep < 0 {
+		return fmt.Errorf("Number of previous versions to keep cannot be negative (got %d)", keep)
+	}
+
+	log.Printf("Will keep %d previous version(s)", keep)
+	j := mv.newJournal("set-keep-previous")
+	j.After.KeepPrevious = &keep
+	mv.prunePrevious(j)
+	return mv.transition(j)
+}
+
+func (mv *multiverse) Rollback(version string) error {
+	s := mv.state
+	if len(s.Previous) == 0 {
+		return fmt.Errorf("No previous version retained, cannot roll back")
+	}
+
+	if version == "" {
+		version = s.Previous[0]
+	}
+	if !mv.isPrevious(version) {
+		return fmt.Errorf("Version (%s) is not retained, cannot roll back to it (retained: %s)", version, strings.Join(s.Previous, ", "))
+	}
+
+	log.Printf("Rolling back from (%s) to (%s)", s.Current, version)
+	previousPath := mv.makePathForPrevious(version)
+	_, err := os.Stat(previousPath)
+	if err != nil {
+		log.Printf("Retained version (%s) is gone from disk, forgetting about it", version)
+		j := mv.newJournal("drop-previous")
+		mv.dropPrevious(j, version)
+		dropErr := mv.transition(j)
+		if dropErr != nil {
+			log.Printf("While forgetting about (%s): %+v", version, dropErr)
+		}
+		return fmt.Errorf("checking retained version (%s): %w", version, err)
+	}
+
+	readyPath := mv.makePathForReady(version)
+
+	j := mv.newJournal("rollback")
+	mv.discardReady(j, "rollback")
+	mv.clearPath(j, readyPath)
+	j.Renames = append(j.Renames, journalRename{From: previousPath, To: readyPath})
+	j.After.Previous = removeVersion(j.After.Previous, version)
+	j.After.Ready = version
+
+	err = mv.transition(j)
+	if err != nil {
+		return fmt.Errorf("moving rollback version to its proper place: %w", err)
+	}
+
+	return mv.MakeReadyCurrent()
+}
+
+// retainPrevious plans moving current, which is about to be replaced,
+// into the previous folder as part of j, or deleting it if we're not
+// retaining anything.
+func (mv *multiverse) retainPrevious(j *multiverseJournal, current *BuildFolder) {
+	s := j.After
+	if s.keepPrevious() == 0 {
+		// out of the way first: on macOS, the new current goes in its place
+		oldPath := current.Path + ".old"
+		mv.clearPath(j, oldPath)
+		j.Renames = append(j.Renames, journalRename{From: current.Path, To: oldPath})
+		j.Cleanup = append(j.Cleanup, oldPath)
+		return
+	}
+
+	previousPath := mv.makePathForPrevious(current.Version)
+	log.Printf("Retaining (%s) as (%s)", current.Path, previousPath)
+	mv.clearPath(j, previousPath)
+	j.Renames = append(j.Renames, journalRename{From: current.Path, To: previousPath})
+
+	s.Previous = append([]string{current.Version}, removeVersion(s.Previous, current.Version)...)
+	mv.prunePrevious(j)
+}
+
+// prunePrevious plans removing retained builds over the configured
+// limit as part of j.
+func (mv *multiverse) prunePrevious(j *multiverseJournal) {
+	s := j.After
+	keep := s.keepPrevious()
+	if len(s.Previous) <= keep {
+		return
+	}
+
+	for _, version := range s.Previous[keep:] {
+		path := mv.makePathForPrevious(version)
+		log.Printf("No longer retaining (%s), will delete (%s)", version, path)
+		j.Cleanup = append(j.Cleanup, path)
+	}
+	s.Previous = s.Previous[:keep]
+}
+
+// dropPrevious plans deleting a retained build and forgetting about it
+// as part of j.
+func (mv *multiverse) dropPrevious(j *multiverseJournal, version string) {
+	j.Cleanup = append(j.Cleanup, mv.makePathForPrevious(version))
+	j.After.Previous = removeVersion(j.After.Previous, version)
+}
+
+func (mv *multiverse) isPrevious(version string) bool {
+	for _, v := range mv.state.Previous {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *multiverseState) keepPrevious() int {
+	if s.KeepPrevious == nil {
+		return DefaultKeepPrevious
+	}
+	return *s.KeepPrevious
+}
+
+// clone returns a copy of s that can be changed without affecting it
+func (s *multiverseState) clone() *multiverseState {
+	c := *s
+	c.Previous = append([]string(nil), s.Previous...)
+	if s.KeepPrevious != nil {
+		keep := *s.KeepPrevious
+		c.KeepPrevious = &keep
+	}
+	return &c
+}
+
+// equals tells if s and other would be saved the same
+func (s *multiverseState) equals(other *multiverseState) bool {
+	sb, err := json.Marshal(s)
+	if err != nil {
+		return false
+	}
+	ob, err := json.Marshal(other)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(sb, ob)
+}
+
+func removeVersion(versions []string, version string) []string {
+	var res []string
+	for _, v := range versions {
+		if v != version {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 func (mv *multiverse) ValidateCurrent() error {
 	return mv.validateDir(mv.makePathForCurrent(mv.state.Current))
 }
@@ -312,6 +734,14 @@ func (mv *multiverse) makePathForCurrent(version string) string {
 	return filepath.Join(p.BaseDir, mv.versionToBasename(version))
 }
 
+func (mv *multiverse) makePathForReady(version string) string {
+	return filepath.Join(mv.params.BaseDir, mv.versionToBasename(version))
+}
+
+func (mv *multiverse) makePathForPrevious(version string) string {
+	return filepath.Join(mv.previousFolderPath(), mv.versionToBasename(version))
+}
+
 func (mv *multiverse) versionToBasename(version string) string {
 	return fmt.Sprintf("app-%s", version)
 }
@@ -320,10 +750,69 @@ func (mv *multiverse) stagingFolderPath() string {
 	return filepath.Join(mv.params.BaseDir, "staging")
 }
 
+func (mv *multiverse) previousFolderPath() string {
+	return filepath.Join(mv.params.BaseDir, "previous")
+}
+
 func (mv *multiverse) statePath() string {
 	return filepath.Join(mv.params.BaseDir, "state.json")
 }
 
+func (mv *multiverse) proxyPath() string {
+	return filepath.Join(mv.params.BaseDir, proxySettingsName)
+}
+
+// readProxy leaves mv.proxy nil if there are no proxy settings
+func (mv *multiverse) readProxy() error {
+	if !pathExists(mv.proxyPath()) {
+		return nil
+	}
+
+	saved := &ProxySettings{}
+	err := readJSONFile(mv.proxyPath(), saved)
+	if err != nil {
+		return fmt.Errorf("reading proxy settings: %w", err)
+	}
+
+	proxy, err := NewProxySettings(saved.URL, saved.NoProxy)
+	if err != nil {
+		return fmt.Errorf("reading proxy settings: %w", err)
+	}
+	mv.proxy = proxy
+	return nil
+}
+
+func (mv *multiverse) tlsPath() string {
+	return filepath.Join(mv.params.BaseDir, tlsSettingsName)
+}
+
+// readTLS leaves mv.tls nil if there are no TLS settings. The CA bundle
+// is read again every time, so it can be updated in place. If they can't
+// be loaded, mv.tls is left unusable rather than nil, so nothing connects
+// without them.
+func (mv *multiverse) readTLS() error {
+	if !pathExists(mv.tlsPath()) {
+		return nil
+	}
+
+	saved := &TLSSettings{}
+	err := readJSONFile(mv.tlsPath(), saved)
+	if err != nil {
+		err = fmt.Errorf("reading TLS settings: %w", err)
+		mv.tls = unusableTLSSettings("", nil, err)
+		return err
+	}
+
+	tls, err := NewTLSSettings(saved.CABundle, saved.Pins)
+	if err != nil {
+		err = fmt.Errorf("loading TLS settings (fix them with --ca-bundle and --pin-public-key): %w", err)
+		mv.tls = unusableTLSSettings(saved.CABundle, saved.Pins, err)
+		return err
+	}
+	mv.tls = tls
+	return nil
+}
+
 func (mv *multiverse) readState() error {
 	bs, err := os.ReadFile(mv.statePath())
 	if err != nil {
@@ -341,8 +830,19 @@ func (mv *multiverse) readState() error {
 	return nil
 }
 
-func (mv *multiverse) saveState() error {
-	bs, err := json.Marshal(mv.state)
+// setState saves s, and only makes it the state once that worked, so the
+// state never says anything state.json doesn't.
+func (mv *multiverse) setState(s *multiverseState) error {
+	err := mv.writeState(s)
+	if err != nil {
+		return err
+	}
+	mv.state = s
+	return nil
+}
+
+func (mv *multiverse) writeState(s *multiverseState) error {
+	bs, err := json.Marshal(s)
 	if err != nil {
 		return fmt.Errorf("marshalling multiverse state file: %w", err)
 	}
@@ -372,5 +872,5 @@ func (mv *multiverse) saveState() error {
 }
 
 func (mv *multiverse) String() string {
-	return fmt.Sprintf("(%s)(current = %q, ready = %q)", mv.params.BaseDir, mv.state.Current, mv.state.Ready)
+	return fmt.Sprintf("(%s)(current = %q, ready = %q, previous = %q)", mv.params.BaseDir, mv.state.Current, mv.state.Ready, mv.state.Previous)
 }
@@ -6,15 +6,21 @@ import (
 	"time"
 
 	ps "github.com/mitchellh/go-ps"
+
+	"github.com/itchio/itch-setup/protocol"
 )
 
-func WaitForProcessToExit(ctx context.Context, pid int) {
+// WaitForProcessToExit returns once the process with the given PID is
+// gone. If kill is set, it's called once the process has been seen alive
+// (and ready-to-relaunch sent), instead of waiting for it to quit.
+func WaitForProcessToExit(ctx context.Context, pid int, kill func() error) {
 	retryDuration := 1 * time.Second
 	sentReady := false
 
 	log.Printf("Looking for PID %d", pid)
 	EnableJSON()
 	defer DisableJSON()
+	Emit(protocol.PhaseStarted{Phase: protocol.PhaseWait})
 
 	for {
 		select {
@@ -39,9 +45,17 @@ func WaitForProcessToExit(ctx context.Context, pid int) {
 
 		log.Printf("Process still exists (%s)", proc.Executable())
 		if !sentReady {
-			Emit(ReadyToRelaunch{})
+			Emit(protocol.ReadyToRelaunch{})
 			sentReady = true
 		}
+		if kill != nil {
+			err = kill()
+			if err != nil {
+				log.Printf("While killing: %+v", err)
+			}
+			kill = nil
+			continue
+		}
 		log.Printf("Retrying in %s", retryDuration)
 		time.Sleep(retryDuration)
 	}
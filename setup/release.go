@@ -0,0 +1,284 @@
+package setup
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/itchio/httpkit/eos/option"
+	"github.com/itchio/itch-setup/data"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+)
+
+// ReleaseManifest is published next to every version, along with a
+// detached ed25519 signature made with the release key (see
+// releaseKeyAsset). It vouches for the version's wharf signature,
+// which in turn vouches for every file of the build, so that whoever
+// serves the build can't change it.
+//
+// Archives are mostly read in pieces, so rather than hashing them, we
+// check whatever we install from them against the signature. Their hash
+// is checked when they're downloaded whole, by --export-bundle.
+type ReleaseManifest struct {
+	AppName   string               `json:"appName"`
+	Channel   string               `json:"channel"`
+	Version   string               `json:"version"`
+	Archive   *ReleaseManifestFile `json:"archive,omitempty"`
+	Signature *ReleaseManifestFile `json:"signature"`
+
+	// raw and rawSignature are what we verified, for --export-bundle
+	raw          []byte
+	rawSignature []byte
+}
+
+type ReleaseManifestFile struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// releaseKeyAsset is the base64 of the public half of the release key,
+// see release/manifest.js
+const releaseKeyAsset = "data/release.pub"
+
+// ReleaseKeyEnv can be set to the base64 of another ed25519 public key
+// to trust instead of the release key, for local mock servers. Only
+// builds with the `itchsetupdev` tag look at it, see release_dev.go.
+const ReleaseKeyEnv = "ITCH_SETUP_RELEASE_KEY"
+
+// releaseKey returns the key release manifests must be signed with, or
+// nil if this build has none and doesn't require one (see
+// release_required.go). Release builds without one can't install a thing.
+func releaseKey() (ed25519.PublicKey, error) {
+	var encoded string
+	if releaseKeyOverrideAllowed && os.Getenv(ReleaseKeyEnv) != "" {
+		log.Printf("Trusting release key from $%s instead of the embedded one", ReleaseKeyEnv)
+		encoded = os.Getenv(ReleaseKeyEnv)
+	} else {
+		bs, err := data.Asset(releaseKeyAsset)
+		if err != nil {
+			return nil, fmt.Errorf("reading release key: %w", err)
+		}
+		encoded = string(bs)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		if !releaseKeyRequired {
+			return nil, nil
+		}
+		return nil, &verificationError{fmt.Errorf("this build has no release key (%s is empty), so it can't verify anything", releaseKeyAsset)}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid release key: expected the base64 of a %d-byte ed25519 public key", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// errNoReleaseManifest means a version has no release manifest: it was
+// published before they existed, or someone took it away. Either way,
+// it can't be installed, but what's installed can still be patched,
+// see readInstalledSignature.
+var errNoReleaseManifest = errors.New("no release manifest")
+
+// verificationError means something we downloaded isn't what the release
+// manifest says it should be. Retrying won't help.
+type verificationError struct {
+	err error
+}
+
+func (ve *verificationError) Error() string {
+	return ve.err.Error()
+}
+
+func (ve *verificationError) Unwrap() error {
+	return ve.err
+}
+
+// isVerificationFailure returns true if err is because of something that
+// doesn't match its release manifest, see ErrorCodeVerificationFailed
+func isVerificationFailure(err error) bool {
+	var ve *verificationError
+	return errors.As(err, &ve)
+}
+
+// parseReleaseManifest checks signature (the base64 of an ed25519
+// signature of raw) against key, then parses raw
+func parseReleaseManifest(raw []byte, signature []byte, key ed25519.PublicKey) (*ReleaseManifest, error) {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, &verificationError{fmt.Errorf("invalid release manifest signature")}
+	}
+	if !ed25519.Verify(key, raw, sig) {
+		return nil, &verificationError{fmt.Errorf("release manifest wasn't signed with the release key")}
+	}
+
+	manifest := &ReleaseManifest{}
+	err = json.Unmarshal(raw, manifest)
+	if err != nil {
+		return nil, &verificationError{fmt.Errorf("parsing release manifest: %w", err)}
+	}
+	manifest.raw = raw
+	manifest.rawSignature = signature
+	return manifest, nil
+}
+
+// releaseManifest fetches the release manifest of version and makes sure
+// it's genuine, and that it's for what we asked for. It returns nil if
+// this build has no release key to check it with, and doesn't need one.
+func (i *Installer) releaseManifest(version string) (*ReleaseManifest, error) {
+	key, err := releaseKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		log.Printf("This build has no release key, not checking the release manifest for %s", version)
+		return nil, nil
+	}
+
+	raw, signature, err := i.source.ReleaseManifest(version)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, &verificationError{fmt.Errorf("%w for %s: %v", errNoReleaseManifest, version, err)}
+		}
+		return nil, fmt.Errorf("while fetching release manifest for %s: %w", version, err)
+	}
+
+	manifest, err := parseReleaseManifest(raw, signature, key)
+	if err != nil {
+		return nil, fmt.Errorf("release manifest for %s: %w", version, err)
+	}
+
+	if manifest.AppName != i.settings.AppName || manifest.Channel != i.channelName || manifest.Version != version {
+		return nil, &verificationError{fmt.Errorf("release manifest is for %s %s (%s), expected %s %s (%s)",
+			manifest.AppName, manifest.Version, manifest.Channel, i.settings.AppName, version, i.channelName)}
+	}
+	if manifest.Signature == nil {
+		return nil, &verificationError{fmt.Errorf("release manifest for %s has no signature hash", version)}
+	}
+
+	log.Printf("Release manifest for %s is genuine", version)
+	return manifest, nil
+}
+
+// signature returns what manifest says about the wharf signature, or nil
+// if there's no manifest to go by
+func (manifest *ReleaseManifest) signature() *ReleaseManifestFile {
+	if manifest == nil {
+		return nil
+	}
+	return manifest.Signature
+}
+
+// archive is like signature, for the archive
+func (manifest *ReleaseManifest) archive() *ReleaseManifestFile {
+	if manifest == nil {
+		return nil
+	}
+	return manifest.Archive
+}
+
+// check returns an error unless the file (named what) with the given
+// size and sha256 is the one rmf describes
+func (rmf *ReleaseManifestFile) check(what string, size int64, sum []byte) error {
+	if size != rmf.Size {
+		return &verificationError{fmt.Errorf("%s: expected %d bytes as per the release manifest, got %d", what, rmf.Size, size)}
+	}
+	if hex.EncodeToString(sum) != rmf.SHA256 {
+		return &verificationError{fmt.Errorf("%s: expected sha256 %s as per the release manifest, got %x", what, rmf.SHA256, sum)}
+	}
+	return nil
+}
+
+// readSignature downloads the wharf signature of version, and only
+// parses it if it's the one its release manifest vouches for
+func (i *Installer) readSignature(ctx context.Context, version string, opts ...option.Option) (*pwr.SignatureInfo, error) {
+	manifest, err := i.releaseManifest(version)
+	if err != nil {
+		return nil, err
+	}
+	return i.fetchSignature(ctx, version, manifest.signature(), opts...)
+}
+
+// readInstalledSignature is like readSignature, for the version we
+// have installed, which we check before patching it. If it was published
+// before release manifests existed, its signature is used as-is: at
+// worst, patching fails and we fall back to the archive. What patches
+// make is checked against the signature of the version they make, which
+// must be vouched for.
+func (i *Installer) readInstalledSignature(ctx context.Context, version string, opts ...option.Option) (*pwr.SignatureInfo, error) {
+	sigInfo, err := i.readSignature(ctx, version, opts...)
+	if errors.Is(err, errNoReleaseManifest) {
+		log.Printf("No release manifest for (%s), using its signature as-is to check it before patching", version)
+		return i.fetchSignature(ctx, version, nil, opts...)
+	}
+	return sigInfo, err
+}
+
+// fetchSignature downloads and parses the wharf signature of version,
+// checking it against expected if set
+func (i *Installer) fetchSignature(ctx context.Context, version string, expected *ReleaseManifestFile, opts ...option.Option) (*pwr.SignatureInfo, error) {
+	what := fmt.Sprintf("signature for %s", version)
+	sigSource, err := openArtifact(i.source, what, func(s PackageSource) string {
+		return s.SignatureLocation(version)
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("while opening %s: %w", what, err)
+	}
+	defer sigSource.Close()
+
+	sigBytes, err := io.ReadAll(sigSource)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", what, err)
+	}
+
+	if expected != nil {
+		sum := sha256.Sum256(sigBytes)
+		err = expected.check(what, int64(len(sigBytes)), sum[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	verified := seeksource.FromBytes(sigBytes)
+	_, err = verified.Resume(nil)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", what, err)
+	}
+	sigInfo, err := pwr.ReadSignature(ctx, verified)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %w", what, err)
+	}
+	return sigInfo, nil
+}
+
+// verifyBuildFolder makes sure dir is exactly what sigInfo (which must
+// come from readSignature) describes.
+func verifyBuildFolder(ctx context.Context, dir string, sigInfo *pwr.SignatureInfo, version string) error {
+	log.Printf("Verifying (%s) against the signature of %s", dir, version)
+
+	vc := pwr.ValidatorContext{
+		Consumer: newConsumer(),
+		FailFast: true,
+	}
+	err := vc.Validate(ctx, dir, sigInfo)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return &verificationError{fmt.Errorf("(%s) doesn't match the signature of %s: %w", dir, version, err)}
+	}
+	return nil
+}
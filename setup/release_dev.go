@@ -0,0 +1,8 @@
+//go:build itchsetupdev
+// +build itchsetupdev
+
+package setup
+
+// Development builds (`-tags itchsetupdev`, like the test harness's) may
+// trust another release key, see ReleaseKeyEnv
+const releaseKeyOverrideAllowed = true
@@ -0,0 +1,7 @@
+//go:build !itchsetupdev
+// +build !itchsetupdev
+
+package setup
+
+// Every other build only ever trusts the embedded release key
+const releaseKeyOverrideAllowed = false
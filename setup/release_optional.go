@@ -0,0 +1,8 @@
+//go:build !itchsetuprelease
+// +build !itchsetuprelease
+
+package setup
+
+// Every other build skips release manifests while data/release.pub is
+// empty, so that master stays usable until the release key is committed
+const releaseKeyRequired = false
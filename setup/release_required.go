@@ -0,0 +1,8 @@
+//go:build itchsetuprelease
+// +build itchsetuprelease
+
+package setup
+
+// Release builds (`-tags itchsetuprelease`, see release/build.js) refuse
+// to install anything if they have no release key to verify it with
+const releaseKeyRequired = true
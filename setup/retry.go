@@ -0,0 +1,137 @@
+package setup
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+// RetryPolicy says how requests to broth that fail transiently (see
+// isUnavailable) are retried: up to Attempts times in total, waiting
+// Delay after the first failure, then twice that, and so on up to
+// MaxDelay. Jitter is how far off each delay we may be, as a fraction.
+// A Retry-After header wins over the backoff, up to MaxDelay.
+// StallTimeout is how long a download may go without receiving anything
+// before it's resumed from another mirror, see mirrorTransport. Resumes
+// that don't get anything are retries too, limited and spaced out the same.
+type RetryPolicy struct {
+	Attempts     int
+	Delay        time.Duration
+	MaxDelay     time.Duration
+	Jitter       float64
+	StallTimeout time.Duration
+}
+
+// DefaultRetryPolicy is used when InstallerSettings don't have one
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:     5,
+	Delay:        1 * time.Second,
+	MaxDelay:     30 * time.Second,
+	Jitter:       0.2,
+	StallTimeout: 10 * time.Second,
+}
+
+// delay returns how long to wait after the attempt-th attempt failed
+func (rp RetryPolicy) delay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if retryAfter > rp.MaxDelay {
+			return rp.MaxDelay
+		}
+		return retryAfter
+	}
+
+	delay := rp.Delay
+	for i := 1; i < attempt && delay < rp.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > rp.MaxDelay {
+		delay = rp.MaxDelay
+	}
+
+	jitter := (rand.Float64()*2 - 1) * rp.Jitter * float64(delay)
+	return delay + time.Duration(jitter)
+}
+
+// RetryHandler is called right before waiting to try again
+type RetryHandler func(retrying protocol.Retrying)
+
+// retrier applies a RetryPolicy, giving up early if ctx is done
+type retrier struct {
+	policy  RetryPolicy
+	ctx     context.Context
+	onRetry RetryHandler
+}
+
+// do calls f until it succeeds, fails for good, or we run out of
+// attempts. A nil retrier calls f once.
+func (r *retrier) do(what string, f func() error) error {
+	if r == nil {
+		return f()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if !isUnavailable(err) || attempt >= r.policy.Attempts {
+			return err
+		}
+
+		delay := r.policy.delay(attempt, retryAfterOf(err))
+		log.Printf("Retrying %s (%d/%d) in %s: %v", what, attempt+1, r.policy.Attempts, delay, err)
+		retrying := protocol.Retrying{
+			What:     what,
+			Attempt:  attempt + 1,
+			Attempts: r.policy.Attempts,
+			Delay:    delay.Seconds(),
+			Error:    err.Error(),
+		}
+		Emit(retrying)
+		if r.onRetry != nil {
+			r.onRetry(retrying)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return err
+		}
+	}
+}
+
+// retryAfterOf returns how long the server asked us to wait, if it did
+func retryAfterOf(err error) time.Duration {
+	var ue *unavailableError
+	if errors.As(err, &ue) {
+		return ue.retryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number
+// of seconds or an HTTP date. It returns 0 if there's none.
+func parseRetryAfter(header string) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+package setup
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// RolloutPolicy lets a local file hold versions back from some installs,
+// on top of (or instead of) what broth says. It's read from rollout.json,
+// next to state.json.
+//
+// Percentages go from 0 (nobody gets the version) to 100 (everybody does).
+// Versions lists percentages for specific versions, Percentage applies to
+// all others.
+type RolloutPolicy struct {
+	Percentage *float64           `json:"percentage,omitempty"`
+	Versions   map[string]float64 `json:"versions,omitempty"`
+}
+
+const rolloutPolicyName = "rollout.json"
+
+// readRolloutPolicy returns nil (and no error) if there's no policy file
+func readRolloutPolicy(path string) (*RolloutPolicy, error) {
+	if !pathExists(path) {
+		return nil, nil
+	}
+
+	policy := &RolloutPolicy{}
+	err := readJSONFile(path, policy)
+	if err != nil {
+		return nil, fmt.Errorf("reading rollout policy: %w", err)
+	}
+	return policy, nil
+}
+
+// rolloutPercentage returns which percentage of installs version is rolled
+// out to, and where that came from. The local policy wins over broth, and
+// versions neither of them mention are rolled out to everyone.
+func rolloutPercentage(policy *RolloutPolicy, buildInfo *BrothBuildInfo, version string) (float64, string) {
+	if policy != nil {
+		if percentage, ok := policy.Versions[version]; ok {
+			return percentage, rolloutPolicyName
+		}
+		if policy.Percentage != nil {
+			return *policy.Percentage, rolloutPolicyName
+		}
+	}
+
+	if buildInfo != nil && buildInfo.RolloutPercentage != nil {
+		return *buildInfo.RolloutPercentage, "broth"
+	}
+
+	return 100, ""
+}
+
+// rolloutBucket places an install somewhere in [0, 100) for a given version.
+// It's derived from the install ID, so it doesn't change across runs, and
+// raising a version's percentage only ever adds installs to it. Mixing the
+// version in means it's not always the same installs that go first.
+func rolloutBucket(installID string, version string) float64 {
+	sum := sha256.Sum256([]byte(installID + "/" + version))
+	return float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100
+}
+
+func newInstallID() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("generating install ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,272 @@
+package setup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/itchio/httpkit/eos/option"
+	"github.com/itchio/wharf/pwr"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+// SelfUpdateAppName is the broth package itch-setup itself is published
+// as, on the same platform channels as the app, like `linux-amd64`
+const SelfUpdateAppName = "itch-setup"
+
+// smokeTestTimeout is how long an itch-setup has to answer `--version`
+const smokeTestTimeout = 30 * time.Second
+
+type SelfUpdateResult struct {
+	DidUpdate bool
+}
+
+// SelfUpdatePreviousPath returns where SelfUpdate keeps the itch-setup
+// binary it replaced at target, like `~/.itch/itch-setup-previous`
+func SelfUpdatePreviousPath(target string) string {
+	ext := filepath.Ext(target)
+	return strings.TrimSuffix(target, ext) + "-previous" + ext
+}
+
+// SelfUpdateStagingPath returns the folder SelfUpdate downloads the new
+// itch-setup to, next to target so it can be renamed into place
+func SelfUpdateStagingPath(target string) string {
+	return strings.TrimSuffix(target, filepath.Ext(target)) + "-staging"
+}
+
+// SelfUpdate replaces the itch-setup binary at target with the latest
+// build of the itch-setup package (the Installer must be set up for it,
+// see SelfUpdateAppName), unless that's the version target says it is.
+// The new binary is verified like any other build, then has to pass a
+// `--version` smoke test, or the one it replaced is put back.
+func (i *Installer) SelfUpdate(target string) (*SelfUpdateResult, error) {
+	EnableJSON()
+	defer DisableJSON()
+
+	Emit(protocol.PhaseStarted{Phase: protocol.PhaseSelfUpdate})
+	res := &SelfUpdateResult{}
+
+	_, err := os.Stat(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, WithErrorCode(protocol.ErrorCodeNotInstalled, fmt.Errorf("no copy of itch-setup at (%s) to update", target))
+		}
+		return nil, err
+	}
+
+	err = i.openSource()
+	if err != nil {
+		return nil, err
+	}
+	defer i.closeSource()
+
+	err = i.resolveChannel()
+	if err != nil {
+		return nil, fmt.Errorf("while resolving channel: %w", err)
+	}
+
+	version, err := i.source.LatestVersion()
+	if err != nil {
+		return nil, fmt.Errorf("while getting latest version: %w", err)
+	}
+
+	// a copy that doesn't run is worth replacing, whatever it was
+	currentVersion, err := SetupVersion(target)
+	if err != nil {
+		log.Printf("Can't tell which version (%s) is, updating it anyway: %v", target, err)
+	} else if version == currentVersion {
+		log.Printf("itch-setup is up-to-date (%s)", version)
+		Emit(protocol.NoUpdateAvailable{Reason: protocol.NoUpdateReasonUpToDate})
+		return res, nil
+	}
+	log.Printf("Updating itch-setup at (%s) from %s to %s", target, currentVersion, version)
+	Emit(protocol.InstallingUpdate{Version: version})
+
+	stagingFolder := SelfUpdateStagingPath(target)
+	err = os.RemoveAll(stagingFolder)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stagingFolder)
+
+	staged, err := i.stageSelf(version, stagingFolder, filepath.Base(target))
+	if err != nil {
+		return nil, err
+	}
+
+	previous := SelfUpdatePreviousPath(target)
+	err = replaceSelf(staged, target, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	err = SmokeTestSetup(target, version)
+	if err != nil {
+		log.Printf("Putting back (%s)", previous)
+		rErr := os.Rename(previous, target)
+		if rErr != nil {
+			return nil, fmt.Errorf("itch-setup %s failed its smoke test (%v), and putting back the previous one failed: %w", version, err, rErr)
+		}
+		return nil, fmt.Errorf("itch-setup %s failed its smoke test, put back the previous one: %w", version, err)
+	}
+
+	log.Printf("itch-setup is now %s, the previous one is kept at (%s)", version, previous)
+	Emit(protocol.SelfUpdated{Version: version, Previous: previous})
+	res.DidUpdate = true
+	return res, nil
+}
+
+// stageSelf downloads version into stagingFolder, checks it against its
+// signature, and returns the path of the binary called name in there
+func (i *Installer) stageSelf(version string, stagingFolder string, name string) (string, error) {
+	ctx := i.control.Context()
+
+	sigInfo, err := i.readSignature(ctx, version, option.WithConsumer(i.consumer), option.WithHTTPClient(i.downloadClient))
+	if err != nil {
+		return "", err
+	}
+
+	archiveURL, err := locateArtifact(i.source, "archive", func(s PackageSource) string {
+		return s.ArchiveLocation(version)
+	}, option.WithConsumer(i.consumer), option.WithHTTPClient(i.downloadClient))
+	if err != nil {
+		return "", fmt.Errorf("while opening archive: %w", err)
+	}
+
+	vc := pwr.ValidatorContext{
+		Consumer: newConsumer(),
+		HealPath: fmt.Sprintf("archive,%s", archiveURL),
+	}
+
+	log.Printf("Downloading itch-setup %s to (%s)...", version, stagingFolder)
+	err = i.heal(ctx, &vc, stagingFolder, sigInfo)
+	if err != nil {
+		return "", fmt.Errorf("while downloading itch-setup %s: %w", version, err)
+	}
+
+	err = verifyBuildFolder(ctx, stagingFolder, sigInfo, version)
+	if err != nil {
+		return "", err
+	}
+
+	staged := filepath.Join(stagingFolder, name)
+	_, err = os.Stat(staged)
+	if err != nil {
+		return "", fmt.Errorf("itch-setup %s doesn't have (%s): %w", version, name, err)
+	}
+
+	if runtime.GOOS != "windows" {
+		err = os.Chmod(staged, 0755)
+		if err != nil {
+			return "", fmt.Errorf("while making (%s) executable: %w", staged, err)
+		}
+	}
+	return staged, nil
+}
+
+// replaceSelf moves staged to target, keeping what was there at previous
+func replaceSelf(staged string, target string, previous string) error {
+	err := os.Remove(previous)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("while removing (%s): %w", previous, err)
+	}
+
+	// Where we can, target never goes missing: it's hard-linked as
+	// previous, then replaced in a single rename. Windows won't let us
+	// replace an executable that's running (and target may well be us),
+	// but it does let us move it aside.
+	if runtime.GOOS != "windows" && os.Link(target, previous) == nil {
+		err = os.Rename(staged, target)
+		if err != nil {
+			return fmt.Errorf("while replacing (%s): %w", target, err)
+		}
+		return nil
+	}
+
+	err = os.Rename(target, previous)
+	if err != nil {
+		return fmt.Errorf("while moving (%s) aside: %w", target, err)
+	}
+
+	err = os.Rename(staged, target)
+	if err != nil {
+		rErr := os.Rename(previous, target)
+		if rErr != nil {
+			log.Printf("While putting back (%s): %v", target, rErr)
+		}
+		return fmt.Errorf("while replacing (%s): %w", target, err)
+	}
+	return nil
+}
+
+// SmokeTestSetup makes sure the itch-setup at path runs, and that it
+// says it's version, unless that's empty
+func SmokeTestSetup(path string, version string) error {
+	log.Printf("Smoke-testing (%s)", path)
+	if version == "" {
+		_, err := runSetupVersion(path)
+		return err
+	}
+
+	actual, err := SetupVersion(path)
+	if err != nil {
+		return err
+	}
+	if actual != version {
+		return fmt.Errorf("(%s) --version says %s, not %s", path, actual, version)
+	}
+	return nil
+}
+
+// SetupIsNewer tells if the itch-setup at path is a newer version than
+// the given one, like one that --self-update put there. If its version
+// can't be told, it isn't.
+func SetupIsNewer(path string, version string) bool {
+	actual, err := SetupVersion(path)
+	if err != nil {
+		return false
+	}
+	return compareVersions(actual, version) > 0
+}
+
+// SetupVersion returns the version of the itch-setup at path, as it
+// prints it with `--version`, like `26.1.0, built on ...`. Only the last
+// line of stdout counts: logs go to stderr. itch-setups from before
+// printed their version there too, so we can't tell which they are.
+func SetupVersion(path string) (string, error) {
+	output, err := runSetupVersion(path)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	version, _, _ := strings.Cut(strings.TrimSpace(lines[len(lines)-1]), ",")
+	if version == "" {
+		return "", fmt.Errorf("(%s) --version didn't print a version", path)
+	}
+	return version, nil
+}
+
+// runSetupVersion returns what the itch-setup at path prints on stdout
+// with `--version`
+func runSetupVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), smokeTestTimeout)
+	defer cancel()
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, path, "--version")
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running (%s) --version: %w (%s)", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
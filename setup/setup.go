@@ -5,14 +5,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/itchio/ox"
-	"github.com/itchio/savior/filesource"
 
 	"github.com/itchio/headway/state"
 	"github.com/itchio/headway/united"
@@ -24,6 +24,8 @@ import (
 	"github.com/itchio/wharf/pwr"
 
 	"github.com/itchio/itch-setup/localize"
+
+	"github.com/itchio/itch-setup/protocol"
 )
 
 type ErrorHandler func(err error)
@@ -32,10 +34,30 @@ type ProgressHandler func(progress float64)
 type FinishHandler func(source InstallSource)
 type SourceHandler func(source InstallSource)
 
+// InstallerSettings configure an Installer. Channel is a release channel,
+// like `beta`: when set, it's switched to (and remembered) on install or
+// upgrade. ChannelName overrides the whole broth channel instead, like
+// `windows-amd64`. Pin is the version to install and upgrade to instead
+// of the latest. Control, if set, can cancel, pause or throttle
+// upgrades. MaxBPS caps download speed, in bytes per second. CacheDir,
+// if set, is where broth metadata is cached, see MetadataCache. Retry
+// defaults to DefaultRetryPolicy. Proxy, if set, is used for every
+// request. TLS, if set, changes how broth certificates are checked.
 type InstallerSettings struct {
 	AppName         string
 	Localizer       *localize.Localizer
 	NoFallback      bool
+	ChannelName     string
+	Channel         string
+	Pin             string
+	BrothURLs       []string
+	BundlePath      string
+	Control         *Control
+	MaxBPS          int64
+	CacheDir        string
+	Retry           *RetryPolicy
+	Proxy           *ProxySettings
+	TLS             *TLSSettings
 	OnError         ErrorHandler
 	OnProgressLabel ProgressLabelHandler
 	OnProgress      ProgressHandler
@@ -49,58 +71,200 @@ type Installer struct {
 
 	channelName       string
 	consumer          *state.Consumer
+	control           *Control
 	client            *http.Client
+	downloadClient    *http.Client
 	downloadSessionID string
+	source            PackageSource
+	cache             *MetadataCache
+	retrier           *retrier
 }
 
 type InstallSource struct {
 	Version string
 }
 
-func getBrothBaseURL() string {
-	if url := os.Getenv("ITCH_BROTH_URL"); url != "" {
-		return url
+const defaultBrothURL = "https://broth.itch.zone"
+
+// getBrothURLs returns the package sources to use, in order of preference:
+// the ones passed in, or the comma-separated list in $ITCH_BROTH_URL, or
+// the official broth server. Each can be any location NewPackageSource
+// understands.
+func getBrothURLs(urls []string) []string {
+	if len(urls) == 0 {
+		urls = []string{os.Getenv("ITCH_BROTH_URL")}
+	}
+
+	var res []string
+	for _, u := range urls {
+		for _, part := range strings.Split(u, ",") {
+			part = strings.TrimSpace(part)
+			if part != "" {
+				res = append(res, part)
+			}
+		}
 	}
-	return "https://broth.itch.zone"
+
+	if len(res) == 0 {
+		res = []string{defaultBrothURL}
+	}
+	return res
 }
 
-func NewInstaller(settings InstallerSettings) *Installer {
+// DefaultChannelName returns the broth channel for the platform we're
+// running on, like `linux-amd64`
+func DefaultChannelName() string {
 	runtime := ox.CurrentRuntime()
-	channelName := fmt.Sprintf("%s-%s", runtime.OS(), runtime.Arch())
+	return fmt.Sprintf("%s-%s", runtime.OS(), runtime.Arch())
+}
+
+// baseDownloadClient is eos' default client, which download clients
+// are built on. heal swaps the default for a while, this is the original.
+var baseDownloadClient = option.DefaultSettings().HTTPClient
+
+// NewInstaller returns an Installer for settings. It fails if the proxy
+// or TLS settings can't be applied, rather than go without them.
+func NewInstaller(settings InstallerSettings) (*Installer, error) {
+	control := settings.Control
+	if control == nil {
+		control = NewControl()
+	}
+	if settings.MaxBPS > 0 {
+		control.SetBandwidthLimit(settings.MaxBPS)
+	}
 
 	i := &Installer{
-		settings:    settings,
-		sourceChan:  make(chan InstallSource),
-		channelName: channelName,
+		settings:   settings,
+		sourceChan: make(chan InstallSource),
 		consumer: &state.Consumer{
 			OnMessage: func(lvl string, msg string) {
 				log.Printf("[%s] %s", lvl, msg)
 			},
 		},
-		client:            timeout.NewDefaultClient(),
+		control:           control,
 		downloadSessionID: uuid.New().String(),
 	}
 
-	return i
+	policy := DefaultRetryPolicy
+	if settings.Retry != nil {
+		policy = *settings.Retry
+	}
+
+	var mirrors []string
+	if settings.BundlePath == "" {
+		mirrors = getBrothURLs(settings.BrothURLs)
+	}
+
+	client, err := settings.TLS.HTTPClient(timeout.NewDefaultClient(), mirrors)
+	if err != nil {
+		return nil, err
+	}
+	client, err = settings.Proxy.HTTPClient(client)
+	if err != nil {
+		return nil, err
+	}
+	i.client = control.HTTPClient(client)
+
+	downloadClient, err := settings.TLS.HTTPClient(baseDownloadClient, mirrors)
+	if err != nil {
+		return nil, err
+	}
+	downloadClient, err = settings.Proxy.HTTPClient(downloadClient)
+	if err != nil {
+		return nil, err
+	}
+	i.downloadClient = control.HTTPClient(newMirrorClient(downloadClient, mirrors, policy))
+
+	if settings.CacheDir != "" {
+		i.cache = NewMetadataCache(settings.CacheDir)
+	}
+
+	i.retrier = &retrier{
+		policy: policy,
+		ctx:    control.Context(),
+		onRetry: func(retrying protocol.Retrying) {
+			if settings.OnProgressLabel != nil {
+				settings.OnProgressLabel(settings.Localizer.T("setup.status.retrying", map[string]string{
+					"attempt":  fmt.Sprintf("%d", retrying.Attempt),
+					"attempts": fmt.Sprintf("%d", retrying.Attempts),
+				}))
+			}
+		},
+	}
+
+	if settings.ChannelName != "" {
+		i.channelName = settings.ChannelName
+	} else {
+		i.channelName = brothChannelName(DefaultChannelName(), settings.Channel)
+	}
+
+	return i, nil
 }
 
-func (i *Installer) brothPackageURL() string {
-	return fmt.Sprintf("%s/%s/%s", getBrothBaseURL(), i.settings.AppName, i.channelName)
+// openSource opens the package source for our current channel, closing
+// the previous one if any: a bundle if we were given one, or the mirrors
+// getBrothURLs returns.
+func (i *Installer) openSource() error {
+	i.closeSource()
+
+	err := ValidateChannel(i.settings.Channel)
+	if err != nil {
+		return err
+	}
+
+	locations := getBrothURLs(i.settings.BrothURLs)
+	if i.settings.BundlePath != "" {
+		locations = []string{i.settings.BundlePath}
+	}
+
+	scope := cacheScope(locations)
+	var sources []PackageSource
+	for index, location := range locations {
+		source, err := NewPackageSource(location, PackageSourceSettings{
+			AppName:           i.settings.AppName,
+			Channel:           i.channelName,
+			Client:            i.client,
+			DownloadSessionID: i.downloadSessionID,
+			Cache:             i.cache,
+			// stale metadata is a last resort, other mirrors might be fresher
+			StaleFallback: index == len(locations)-1,
+			CacheScope:    scope,
+		})
+		if err != nil {
+			if len(locations) == 1 {
+				return fmt.Errorf("while opening package source: %w", err)
+			}
+			log.Printf("Skipping mirror (%s): %v", location, err)
+			continue
+		}
+		sources = append(sources, source)
+	}
+
+	if len(sources) == 0 {
+		return fmt.Errorf("while opening package source: none of the %d mirrors could be opened", len(locations))
+	}
+	// even with a single mirror, for retries
+	i.source = newFailoverSource(sources, i.retrier)
+
+	log.Printf("Using package source (%s)", i.source)
+	return nil
 }
 
-func (i *Installer) buildBrothURL(values url.Values, format string, args ...interface{}) string {
-	if values == nil {
-		values = make(url.Values)
+func (i *Installer) closeSource() {
+	if i.source != nil {
+		err := i.source.Close()
+		if err != nil {
+			log.Printf("While closing package source: %v", err)
+		}
+		i.source = nil
 	}
-	values.Set("downloadSessionId", i.downloadSessionID)
-	formattedPath := fmt.Sprintf(format, args...)
-	return fmt.Sprintf("%s/%s?%s", i.brothPackageURL(), formattedPath, values.Encode())
 }
 
 func (i *Installer) WarmUp() {
 	go func() {
 		err := i.warmUp()
 		if err != nil {
+			i.closeSource()
 			log.Printf("Install error: %s", err.Error())
 			i.settings.OnError(err)
 		}
@@ -108,7 +272,7 @@ func (i *Installer) WarmUp() {
 }
 
 func (i *Installer) resolveChannel() error {
-	exists, err := i.checkChannelExists()
+	exists, err := i.source.ChannelExists()
 	if err != nil {
 		return err
 	}
@@ -119,17 +283,25 @@ func (i *Installer) resolveChannel() error {
 	// Channel doesn't exist - check if we can fall back to amd64
 	rt := ox.CurrentRuntime()
 	if !i.settings.NoFallback && (rt.OS() == "darwin" || rt.OS() == "windows") && rt.Arch() == "arm64" {
-		fallbackChannel := fmt.Sprintf("%s-amd64", rt.OS())
+		fallbackChannel := brothChannelName(fmt.Sprintf("%s-amd64", rt.OS()), i.settings.Channel)
 		log.Printf("Channel %s not found, falling back to %s", i.channelName, fallbackChannel)
 		i.channelName = fallbackChannel
-		return nil
+		return i.openSource()
 	}
 
 	return fmt.Errorf("channel %s not found", i.channelName)
 }
 
 func (i *Installer) warmUp() error {
-	if err := i.resolveChannel(); err != nil {
+	Emit(protocol.PhaseStarted{Phase: protocol.PhaseWarmUp})
+
+	err := i.openSource()
+	if err != nil {
+		return err
+	}
+
+	err = i.resolveChannel()
+	if err != nil {
 		return fmt.Errorf("while resolving channel: %w", err)
 	}
 
@@ -151,24 +323,35 @@ func (i *Installer) warmUp() error {
 }
 
 func (i *Installer) getVersion() (string, error) {
+	// the pin wins, but one that disagrees with the environment is more
+	// likely a mistake than something to silently ignore
 	envVersion := os.Getenv("ITCHSETUP_VERSION")
 	if envVersion != "" {
-		log.Printf("Version overriden by environment: %s", envVersion)
-		return envVersion, nil
+		if i.settings.Pin != "" && i.settings.Pin != envVersion {
+			return "", WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("ITCHSETUP_VERSION is set to %s, but the version is pinned to %s: unset one of them (ITCHSETUP_VERSION is deprecated, use --pin)", envVersion, i.settings.Pin))
+		}
+		if i.settings.Pin == "" {
+			log.Printf("Version overriden by environment: %s (ITCHSETUP_VERSION is deprecated, use --pin)", envVersion)
+			return envVersion, nil
+		}
 	}
 
-	latestVersion, err := i.brothGetString("/LATEST")
-	if err != nil {
-		return "", err
+	if i.settings.Pin != "" {
+		log.Printf("Pinned to version %s", i.settings.Pin)
+		return i.settings.Pin, nil
 	}
 
-	return latestVersion, nil
+	return i.source.LatestVersion()
 }
 
 func (i *Installer) Install(mv Multiverse) {
 	go func() {
 		installSource := <-i.sourceChan
 		err := i.doInstall(mv, installSource)
+		i.closeSource()
+		if err == nil && i.settings.Channel != "" {
+			err = mv.SetChannel(i.settings.Channel)
+		}
 		if err != nil {
 			i.settings.OnError(err)
 		} else {
@@ -177,27 +360,19 @@ func (i *Installer) Install(mv Multiverse) {
 	}()
 }
 
-func (i *Installer) doInstall(mv Multiverse, installSource InstallSource) error {
+func (i *Installer) doInstall(mv Multiverse, installSource InstallSource) (rErr error) {
 	ctx := context.Background()
 	localizer := i.settings.Localizer
 
+	Emit(protocol.PhaseStarted{Phase: protocol.PhaseInstall})
 	i.settings.OnProgressLabel(localizer.T("setup.status.preparing"))
 
 	version := installSource.Version
 
-	signatureURL := i.buildBrothURL(nil, "%s/signature/default", version)
-	archiveURL := i.buildBrothURL(nil, "%s/archive/default", version)
-
-	sigSource, err := filesource.Open(signatureURL, option.WithConsumer(i.consumer))
-	if err != nil {
-		return fmt.Errorf("while opening remote signature file: %w", err)
-	}
-	defer sigSource.Close()
-
 	log.Printf("Reading signature...")
-	sigInfo, err := pwr.ReadSignature(ctx, sigSource)
+	sigInfo, err := i.readSignature(ctx, version, option.WithConsumer(i.consumer), option.WithHTTPClient(i.downloadClient))
 	if err != nil {
-		return fmt.Errorf("while parsing signature file: %w", err)
+		return err
 	}
 
 	container := sigInfo.Container
@@ -205,6 +380,8 @@ func (i *Installer) doInstall(mv Multiverse, installSource InstallSource) error
 
 	startTime := time.Now()
 
+	var lastEmit time.Time
+
 	consumer := newConsumer()
 	consumer.OnProgress = func(progressVal float64) {
 		percent := int(progressVal * 100.0)
@@ -221,6 +398,18 @@ func (i *Installer) doInstall(mv Multiverse, installSource InstallSource) error
 		)
 		i.settings.OnProgressLabel(progressLabel)
 		i.settings.OnProgress(progressVal)
+
+		if time.Since(lastEmit) >= 1*time.Second || progressVal >= 1 {
+			lastEmit = time.Now()
+			p := protocol.Progress{
+				Progress:   progressVal,
+				BPS:        float64(donePerSec),
+				Bytes:      doneSize,
+				TotalBytes: container.Size,
+				ETA:        i.control.estimateETA(container.Size-doneSize, float64(donePerSec)),
+			}
+			Emit(p)
+		}
 	}
 
 	useStaging := false
@@ -238,16 +427,35 @@ func (i *Installer) doInstall(mv Multiverse, installSource InstallSource) error
 		}
 		useStaging = true
 
-		stagingFolder, err := mv.MakeStagingFolder()
+		// healing only fetches what's missing or damaged, so resuming an
+		// interrupted install is just a matter of keeping the staging folder.
+		target := stagingTarget("heal", version)
+		stagingFolder, err := mv.MakeStagingFolder(target)
 		if err != nil {
 			return err
 		}
-		defer mv.CleanStagingFolder()
+		if readCheckpoint(stagingFolder, target) != nil {
+			log.Printf("Resuming interrupted install of (%s)", version)
+		} else {
+			err = writeCheckpoint(stagingFolder, &stagingCheckpoint{Target: target})
+			if err != nil {
+				return err
+			}
+		}
+		defer func() {
+			finishStaging(mv, stagingFolder, target, rErr)
+		}()
 		appDir = filepath.Join(stagingFolder, fmt.Sprintf("app-%s", version))
 	}
 
 	log.Printf("Installing to (%s)", appDir)
 
+	archiveURL, err := locateArtifact(i.source, "archive", func(s PackageSource) string {
+		return s.ArchiveLocation(version)
+	}, option.WithConsumer(i.consumer), option.WithHTTPClient(i.downloadClient))
+	if err != nil {
+		return fmt.Errorf("while opening archive: %w", err)
+	}
 	healPath := fmt.Sprintf("archive,%s", archiveURL)
 
 	vc := pwr.ValidatorContext{
@@ -256,11 +464,21 @@ func (i *Installer) doInstall(mv Multiverse, installSource InstallSource) error
 	}
 
 	log.Printf("Healing (%s)...", appDir)
-	err = vc.Validate(ctx, appDir, sigInfo)
+	err = i.heal(ctx, &vc, appDir, sigInfo)
 	if err != nil {
 		return fmt.Errorf("while installing: %w", err)
 	}
 
+	// healing copies files out of the archive as-is
+	err = verifyBuildFolder(ctx, appDir, sigInfo, version)
+	if err != nil {
+		if useStaging {
+			// there's nothing worth resuming
+			removeCheckpoint(filepath.Dir(appDir))
+		}
+		return err
+	}
+
 	duration := time.Since(startTime)
 
 	wc := vc.WoundsConsumer
@@ -300,6 +518,28 @@ func (i *Installer) doInstall(mv Multiverse, installSource InstallSource) error
 	return nil
 }
 
+// healLock keeps heals from swapping eos' default client from under
+// each other, see heal
+var healLock sync.Mutex
+
+// heal runs vc, which must have a HealPath, on dir. wharf's archive
+// healer opens the archive with eos' default client, and can't be handed
+// another: while it runs, the default is a copy of our download client,
+// so the healer goes through our proxy, TLS settings, throttle and mirror
+// failover. The previous default is put back afterwards, so that other
+// installers and eos users don't end up with ours.
+func (i *Installer) heal(ctx context.Context, vc *pwr.ValidatorContext, dir string, sigInfo *pwr.SignatureInfo) error {
+	healLock.Lock()
+	defer healLock.Unlock()
+
+	previous := option.DefaultSettings().HTTPClient
+	client := *i.downloadClient
+	option.SetDefaultHTTPClient(&client)
+	defer option.SetDefaultHTTPClient(previous)
+
+	return vc.Validate(ctx, dir, sigInfo)
+}
+
 func localSignaturePath(appDir string) string {
 	return filepath.Join(appDir, "signature.pws")
 }
@@ -0,0 +1,113 @@
+package setup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	itchio "github.com/itchio/go-itchio"
+)
+
+// PackageSource is where versions, build info and files for one app and
+// channel come from. Every install, upgrade and export goes through one.
+type PackageSource interface {
+	fmt.Stringer
+
+	// ChannelExists returns false (and no error) if the source doesn't
+	// have anything for the channel it was opened for.
+	ChannelExists() (bool, error)
+	LatestVersion() (string, error)
+	BuildInfo(version string) (*BrothBuildInfo, error)
+	UpgradePath(from string, to string) (*BrothUpgradePath, error)
+	// ReleaseManifest returns the release manifest of version as-is,
+	// along with its detached signature, see ReleaseManifest.
+	ReleaseManifest(version string) (manifest []byte, signature []byte, err error)
+
+	// Locations are either URLs or local paths, and can be
+	// passed to filesource.Open or eos.Open as-is.
+	SignatureLocation(version string) string
+	ArchiveLocation(version string) string
+	PatchLocation(version string, subType itchio.BuildFileSubType) string
+
+	Close() error
+}
+
+type PackageSourceSettings struct {
+	AppName string
+	Channel string
+
+	// Client is used for HTTP sources
+	Client *http.Client
+	// DownloadSessionID is passed along to HTTP sources
+	DownloadSessionID string
+	// Cache, if set, is used by HTTP sources for conditional requests.
+	// With StaleFallback, cached metadata is also served when the
+	// source can't be reached.
+	Cache         *MetadataCache
+	StaleFallback bool
+	// CacheScope keeps Cache entries apart from other broths': it's the
+	// same for all the mirrors of one, so they share entries
+	CacheScope string
+}
+
+// NewPackageSource opens the package source at location, picking an
+// implementation by URL scheme:
+//
+//   - http:// and https:// are broth servers
+//   - file:// is a mirror of broth on disk (same paths as the server)
+//   - anything else is a local path to a bundle, see --export-bundle
+func NewPackageSource(location string, settings PackageSourceSettings) (PackageSource, error) {
+	u, err := url.Parse(location)
+	// single-letter schemes are Windows drive letters, like C:\bundle
+	if err != nil || len(u.Scheme) <= 1 {
+		return openBundle(location, settings)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return newBrothSource(strings.TrimRight(location, "/"), settings), nil
+	case "file":
+		return newMirrorSource(fileURLToPath(u), settings)
+	default:
+		return nil, fmt.Errorf("unsupported package source scheme %q (in %s)", u.Scheme, location)
+	}
+}
+
+func fileURLToPath(u *url.URL) string {
+	p := u.Path
+	if u.Host != "" && u.Host != "localhost" {
+		// file://server/share/path
+		return `\\` + u.Host + strings.ReplaceAll(p, "/", `\`)
+	}
+	// file:///C:/mirror
+	if len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return p
+}
+
+// Helpers for sources backed by local files
+
+func readTrimmedFile(path string) (string, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
+
+func readJSONFile(path string, r interface{}) error {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(bs, r)
+	if err != nil {
+		return fmt.Errorf("unmarshalling (%s): %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package setup
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+// TLSSettings change how the certificates of broth servers are checked.
+// CABundle is a PEM file with certificate authorities to trust on top of
+// the system's, for networks that do TLS interception. Pins, if any, are
+// the SHA-256 hashes of the public keys we accept from broth servers
+// (base64, optionally prefixed with `sha256/`): one of the certificates
+// of the chain must have one of them. They don't apply to the CDNs broth
+// redirects downloads to.
+type TLSSettings struct {
+	CABundle string   `json:"caBundle,omitempty"`
+	Pins     []string `json:"pins,omitempty"`
+
+	extraCAs []*x509.Certificate
+	pins     map[string]bool
+
+	// err is why saved settings can't be used, see unusableTLSSettings
+	err error
+}
+
+// TLSReset can be passed to `--ca-bundle` or `--pin-public-key` to
+// forget what we were told before
+const TLSReset = "none"
+
+const tlsSettingsName = "tls.json"
+
+// certificateError means a server's certificate wasn't trusted, or
+// didn't match our pins. Retrying won't help.
+type certificateError struct {
+	err error
+}
+
+func (ce *certificateError) Error() string {
+	return ce.err.Error()
+}
+
+func (ce *certificateError) Unwrap() error {
+	return ce.err
+}
+
+// isUntrustedCertificate returns true if err is because of a certificate
+// we don't trust, see ErrorCodeUntrustedCertificate
+func isUntrustedCertificate(err error) bool {
+	var ce *certificateError
+	if errors.As(err, &ce) {
+		return true
+	}
+
+	var uae x509.UnknownAuthorityError
+	if errors.As(err, &uae) {
+		return true
+	}
+
+	var cie x509.CertificateInvalidError
+	if errors.As(err, &cie) {
+		return true
+	}
+
+	var he x509.HostnameError
+	if errors.As(err, &he) {
+		return true
+	}
+
+	var cve *tls.CertificateVerificationError
+	return errors.As(err, &cve)
+}
+
+// NewTLSSettings loads the CA bundle (if any) and validates pins
+func NewTLSSettings(caBundle string, pins []string) (*TLSSettings, error) {
+	ts := &TLSSettings{
+		pins: make(map[string]bool),
+	}
+
+	if caBundle != "" {
+		absPath, err := filepath.Abs(caBundle)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(absPath)
+		if err != nil {
+			return nil, WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("reading CA bundle: %w", err))
+		}
+
+		ts.extraCAs, err = parsePEMCertificates(data)
+		if err != nil {
+			return nil, WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("reading CA bundle (%s): %w", absPath, err))
+		}
+		ts.CABundle = absPath
+	}
+
+	for _, pin := range pins {
+		hash, err := parsePin(pin)
+		if err != nil {
+			return nil, WithErrorCode(protocol.ErrorCodeInvalidArgument, err)
+		}
+		ts.Pins = append(ts.Pins, pin)
+		ts.pins[hash] = true
+	}
+
+	return ts, nil
+}
+
+// unusableTLSSettings keeps saved settings that can't be loaded anymore,
+// like when the CA bundle is gone, so they can still be changed with
+// flags: until then, HTTPClient fails with err rather than connect
+// without them.
+func unusableTLSSettings(caBundle string, pins []string, err error) *TLSSettings {
+	return &TLSSettings{
+		CABundle: caBundle,
+		Pins:     pins,
+		err:      err,
+	}
+}
+
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificates found")
+	}
+	return certs, nil
+}
+
+// parsePin returns the raw SHA-256 hash of a pin, as a string
+func parsePin(pin string) (string, error) {
+	encoded := strings.TrimPrefix(strings.TrimPrefix(pin, "sha256/"), "/")
+	hash, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(hash) != sha256.Size {
+		return "", fmt.Errorf("invalid public key pin %q: expected the base64 of a SHA-256 hash, like sha256/AAAA...=", pin)
+	}
+	return string(hash), nil
+}
+
+// PublicKeyPin returns the pin for cert's public key, in the format
+// --pin-public-key takes
+func PublicKeyPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func (ts *TLSSettings) String() string {
+	var parts []string
+	if ts.CABundle != "" {
+		parts = append(parts, fmt.Sprintf("%d extra CAs from (%s)", len(ts.extraCAs), ts.CABundle))
+	}
+	if len(ts.Pins) > 0 {
+		parts = append(parts, fmt.Sprintf("%d pinned public keys", len(ts.Pins)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// HTTPClient returns a copy of base that checks certificates according
+// to ts. Pins only apply to the hosts of mirrors (broth URLs): the
+// CDNs broth redirects downloads to have certificates of their own. A
+// nil TLSSettings returns base as-is.
+func (ts *TLSSettings) HTTPClient(base *http.Client, mirrors []string) (*http.Client, error) {
+	if ts == nil {
+		return base, nil
+	}
+	if ts.err != nil {
+		return nil, ts.err
+	}
+
+	transport, ok := base.Transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("can't apply TLS settings (%s) to HTTP client with (%T) transport", ts, base.Transport)
+	}
+	transport = transport.Clone()
+
+	var config *tls.Config
+	if transport.TLSClientConfig != nil {
+		config = transport.TLSClientConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	if len(ts.extraCAs) > 0 {
+		pool := config.RootCAs
+		if pool != nil {
+			pool = pool.Clone()
+		} else {
+			var err error
+			pool, err = x509.SystemCertPool()
+			if err != nil {
+				log.Printf("Could not load system CAs, only trusting the CA bundle: %v", err)
+				pool = x509.NewCertPool()
+			}
+		}
+		for _, cert := range ts.extraCAs {
+			pool.AddCert(cert)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(ts.pins) > 0 {
+		hosts := make(pinnedHosts)
+		for _, mirror := range mirrors {
+			u, err := url.Parse(mirror)
+			if err == nil && u.Scheme == "https" {
+				hosts[strings.ToLower(u.Hostname())] = true
+			}
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if !hosts.covers(cs) {
+				return nil
+			}
+			return ts.verifyPins(cs)
+		}
+	}
+
+	transport.TLSClientConfig = config
+
+	client := *base
+	client.Transport = transport
+	return &client, nil
+}
+
+// pinnedHosts are the hosts pins apply to, lowercase
+type pinnedHosts map[string]bool
+
+// covers returns true if cs is a connection to one of the hosts
+func (ph pinnedHosts) covers(cs tls.ConnectionState) bool {
+	if cs.ServerName != "" {
+		return ph[strings.ToLower(cs.ServerName)]
+	}
+
+	// connections to IP addresses don't keep the name they were for, but
+	// their (verified) certificate is for that IP address
+	if len(cs.PeerCertificates) == 0 {
+		return false
+	}
+	for host := range ph {
+		if net.ParseIP(host) != nil && cs.PeerCertificates[0].VerifyHostname(host) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPins runs after the usual certificate checks. Only certificates
+// of verified chains count: anyone can send a pinned certificate along.
+func (ts *TLSSettings) verifyPins(cs tls.ConnectionState) error {
+	var certs []*x509.Certificate
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if ts.pins[string(hash[:])] {
+			return nil
+		}
+	}
+
+	leaf := "(none)"
+	if len(cs.PeerCertificates) > 0 {
+		leaf = PublicKeyPin(cs.PeerCertificates[0])
+	}
+	return &certificateError{fmt.Errorf("certificate pinning failed for %s: none of its certificates have a pinned public key (leaf is %s)", cs.ServerName, leaf)}
+}
@@ -0,0 +1,397 @@
+package setup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errStalled is what reading a download fails with, when nothing has
+// come in for a while
+var errStalled = errors.New("download stalled")
+
+// mirrorTransport fails downloads over between the HTTP mirrors of broth,
+// for every request, not just the ones openArtifact makes: htfs and
+// wharf's healer make plenty of their own, at various offsets. A request
+// to a mirror that's unavailable goes to the next one instead. A body
+// that errors out, or goes stallTimeout without receiving anything, is
+// picked up where it left off from the next mirror, with a Range request,
+// as many times in a row as policy allows attempts.
+type mirrorTransport struct {
+	mirrors []string // base URLs, without a trailing slash
+	policy  RetryPolicy
+	base    http.RoundTripper
+
+	// follows redirects on its own, so that every hop is retried when
+	// failing over, not just the first one
+	client *http.Client
+
+	lock   sync.Mutex
+	failed map[int]bool // mirrors that failed us already, tried last
+}
+
+// newMirrorClient returns a copy of base whose downloads from one of
+// locations fail over to the others, see mirrorTransport. Locations that
+// aren't HTTP URLs are left alone: openArtifact takes care of those.
+func newMirrorClient(base *http.Client, locations []string, policy RetryPolicy) *http.Client {
+	var mirrors []string
+	for _, location := range locations {
+		if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+			mirrors = append(mirrors, strings.TrimRight(location, "/"))
+		}
+	}
+	if len(mirrors) == 0 {
+		return base
+	}
+
+	transport := base.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	mt := &mirrorTransport{
+		mirrors: mirrors,
+		policy:  policy,
+		base:    transport,
+		failed:  make(map[int]bool),
+	}
+	mt.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			// keep Range and friends across redirects
+			for key, values := range via[0].Header {
+				if key != "Referer" {
+					req.Header[key] = values
+				}
+			}
+			return nil
+		},
+	}
+
+	client := *base
+	client.Transport = mt
+	return &client
+}
+
+// match returns which mirror u is on, and the rest of it
+func (mt *mirrorTransport) match(u *url.URL) (int, string, bool) {
+	s := u.String()
+	for index, mirror := range mt.mirrors {
+		if strings.HasPrefix(s, mirror+"/") {
+			return index, strings.TrimPrefix(s, mirror), true
+		}
+	}
+	return 0, "", false
+}
+
+// order returns the mirrors to try, starting with index and going round,
+// the ones that failed us already last
+func (mt *mirrorTransport) order(index int) []int {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+
+	var good, bad []int
+	for k := 0; k < len(mt.mirrors); k++ {
+		i := (index + k) % len(mt.mirrors)
+		if mt.failed[i] {
+			bad = append(bad, i)
+		} else {
+			good = append(good, i)
+		}
+	}
+	return append(good, bad...)
+}
+
+func (mt *mirrorTransport) markFailed(index int) {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+
+	mt.failed[index] = true
+}
+
+func (mt *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	index, suffix, ok := mt.match(req.URL)
+	if !ok || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return mt.base.RoundTrip(req)
+	}
+
+	var lastErr error
+	for _, k := range mt.order(index) {
+		res, cancel, err := mt.get(req, k, suffix, "")
+		if err != nil {
+			if req.Context().Err() != nil || !isUnavailable(err) {
+				return nil, err
+			}
+			log.Printf("Mirror (%s) unavailable for %s, failing over: %v", mt.mirrors[k], suffix, err)
+			mt.markFailed(k)
+			lastErr = err
+			continue
+		}
+		if k != index {
+			log.Printf("Mirror (%s) served %s", mt.mirrors[k], suffix)
+		}
+
+		res.Request = req
+		if req.Method == http.MethodHead {
+			res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+			return res, nil
+		}
+
+		start, end := int64(0), int64(-1)
+		if res.StatusCode == http.StatusPartialContent {
+			start, end, ok = parseContentRange(res.Header.Get("Content-Range"))
+			if !ok {
+				res.Body.Close()
+				cancel()
+				return nil, fmt.Errorf("mirror (%s) sent an invalid Content-Range: %q", mt.mirrors[k], res.Header.Get("Content-Range"))
+			}
+		}
+		res.Body = &mirrorBody{
+			transport: mt,
+			req:       req,
+			suffix:    suffix,
+			index:     k,
+			start:     start,
+			end:       end,
+			body:      res.Body,
+			cancel:    cancel,
+		}
+		return res, nil
+	}
+	return nil, lastErr
+}
+
+// get requests suffix from the index-th mirror, following redirects, with
+// rangeHeader if set. Server errors come back as unavailableError. The
+// returned cancel must be called once done with the response.
+func (mt *mirrorTransport) get(req *http.Request, index int, suffix string, rangeHeader string) (*http.Response, context.CancelFunc, error) {
+	u, err := url.Parse(mt.mirrors[index] + suffix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	r := req.Clone(ctx)
+	r.URL = u
+	r.Host = ""
+	r.RequestURI = ""
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+
+	res, err := mt.client.Do(r)
+	if err == nil && isRetryableStatus(res.StatusCode) {
+		res.Body.Close()
+		err = &unavailableError{
+			err:        fmt.Errorf("%s: %s", u.Redacted(), res.Status),
+			retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return res, cancel, nil
+}
+
+// parseContentRange reads a header like `bytes 100-199/1000`
+func parseContentRange(header string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	spec, _, _ = strings.Cut(spec, "/")
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+// mirrorBody is the body of a download from one of the mirrors of a
+// mirrorTransport, which resumes from another one if reading fails
+type mirrorBody struct {
+	transport *mirrorTransport
+	req       *http.Request
+	suffix    string
+
+	index int   // the mirror we're reading from
+	start int64 // offset of the body's first byte in the file
+	end   int64 // offset of the last byte we asked for, or -1 for the end of the file
+	read  int64
+
+	// resumes counts resumes since bytes last came in
+	resumes int
+
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+func (mb *mirrorBody) Read(p []byte) (int, error) {
+	for {
+		n, err := mb.readOnce(p)
+		mb.read += int64(n)
+		if n > 0 {
+			mb.resumes = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			// the error comes back on the next read
+			return n, nil
+		}
+		if mb.req.Context().Err() != nil {
+			return 0, err
+		}
+
+		// a mirror may fail every time without sending a thing, so
+		// resumes are limited like other retries, and spaced out the same
+		policy := mb.transport.policy
+		mb.resumes++
+		if mb.resumes >= policy.Attempts {
+			// not a network error anymore, or htfs would reconnect,
+			// and we'd start over
+			return 0, fmt.Errorf("giving up on %s after %d attempts: %w", mb.suffix, mb.resumes, err)
+		}
+		if mb.resumes > 1 {
+			delay := policy.delay(mb.resumes-1, 0)
+			log.Printf("Resuming %s (%d/%d) in %s", mb.suffix, mb.resumes+1, policy.Attempts, delay)
+			select {
+			case <-time.After(delay):
+			case <-mb.req.Context().Done():
+				return 0, err
+			}
+		}
+
+		resumeErr := mb.resume(err)
+		if resumeErr != nil {
+			return 0, err
+		}
+	}
+}
+
+// readOnce reads from the current mirror, giving up if nothing comes in
+// for the policy's StallTimeout (if set)
+func (mb *mirrorBody) readOnce(p []byte) (int, error) {
+	if mb.stalled.Load() {
+		return 0, errStalled
+	}
+	stallTimeout := mb.transport.policy.StallTimeout
+	if stallTimeout <= 0 {
+		return mb.body.Read(p)
+	}
+
+	cancel := mb.cancel
+	timer := time.AfterFunc(stallTimeout, func() {
+		mb.stalled.Store(true)
+		cancel()
+	})
+	n, err := mb.body.Read(p)
+	timer.Stop()
+
+	if err != nil && err != io.EOF && mb.stalled.Load() {
+		err = fmt.Errorf("nothing received for %s: %w", stallTimeout, errStalled)
+	}
+	return n, err
+}
+
+// resume requests the rest of the body from the next mirror that has it,
+// and switches to reading from there
+func (mb *mirrorBody) resume(cause error) error {
+	mt := mb.transport
+	offset := mb.start + mb.read
+	if mb.end >= 0 && offset > mb.end {
+		return cause
+	}
+
+	rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+	if mb.end >= 0 {
+		rangeHeader = fmt.Sprintf("bytes=%d-%d", offset, mb.end)
+	}
+
+	failed := mb.index
+	mt.markFailed(failed)
+	log.Printf("Mirror (%s) failed at byte %d of %s: %v", mt.mirrors[failed], offset, mb.suffix, cause)
+
+	// the failed mirror goes last, it may have been a blip
+	for _, k := range mt.order((failed + 1) % len(mt.mirrors)) {
+		res, cancel, err := mt.get(mb.req, k, mb.suffix, rangeHeader)
+		if err == nil {
+			err = checkResumed(res, offset)
+			if err != nil {
+				res.Body.Close()
+				cancel()
+			}
+		}
+		if err != nil {
+			if mb.req.Context().Err() != nil {
+				return err
+			}
+			log.Printf("Mirror (%s) can't resume %s: %v", mt.mirrors[k], mb.suffix, err)
+			continue
+		}
+
+		log.Printf("Resuming %s at byte %d from mirror (%s)", mb.suffix, offset, mt.mirrors[k])
+		mb.body.Close()
+		mb.cancel()
+		mb.index = k
+		mb.start = offset
+		mb.read = 0
+		mb.body = res.Body
+		mb.cancel = cancel
+		mb.stalled.Store(false)
+		return nil
+	}
+	return cause
+}
+
+// checkResumed makes sure res picks up at offset
+func checkResumed(res *http.Response, offset int64) error {
+	if res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("expected a partial response, got %s", res.Status)
+	}
+	start, _, ok := parseContentRange(res.Header.Get("Content-Range"))
+	if !ok || start != offset {
+		return fmt.Errorf("expected a response starting at byte %d, got Content-Range %q", offset, res.Header.Get("Content-Range"))
+	}
+	return nil
+}
+
+func (mb *mirrorBody) Close() error {
+	err := mb.body.Close()
+	mb.cancel()
+	return err
+}
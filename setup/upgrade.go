@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -14,7 +15,6 @@ import (
 	"github.com/itchio/headway/tracker"
 	"github.com/itchio/headway/united"
 
-	"github.com/itchio/httpkit/eos"
 	"github.com/itchio/httpkit/eos/option"
 	"github.com/itchio/httpkit/timeout"
 
@@ -26,8 +26,9 @@ import (
 	"github.com/itchio/wharf/taskgroup"
 
 	"github.com/itchio/go-itchio"
-	"github.com/itchio/savior/filesource"
 	"github.com/itchio/savior/zipextractor"
+
+	"github.com/itchio/itch-setup/protocol"
 )
 
 type localState struct {
@@ -56,16 +57,23 @@ func (i *Installer) Upgrade(mv Multiverse) (*UpgradeResult, error) {
 	EnableJSON()
 	defer DisableJSON()
 
+	Emit(protocol.PhaseStarted{Phase: protocol.PhaseCheck})
 	res := &UpgradeResult{}
 
+	err := i.openSource()
+	if err != nil {
+		return nil, err
+	}
+	defer i.closeSource()
+
 	var ls *localState
 	var rs *remoteState
 
-	ctx := context.Background()
-	err := taskgroup.Do(ctx,
+	ctx := i.control.Context()
+	err = taskgroup.Do(ctx,
 		// check latest version
 		func() error {
-			latestVersion, err := i.brothGetString("/LATEST")
+			latestVersion, err := i.source.LatestVersion()
 			if err != nil {
 				return err
 			}
@@ -79,7 +87,7 @@ func (i *Installer) Upgrade(mv Multiverse) (*UpgradeResult, error) {
 		func() error {
 			currentBuild := mv.GetCurrentVersion()
 			if currentBuild == nil {
-				return fmt.Errorf("No version currently installed")
+				return WithErrorCode(protocol.ErrorCodeNotInstalled, fmt.Errorf("No version currently installed"))
 			}
 
 			ls = &localState{
@@ -90,39 +98,103 @@ func (i *Installer) Upgrade(mv Multiverse) (*UpgradeResult, error) {
 		},
 	)
 	if err != nil {
-		return nil, err
+		return nil, i.checkCancelled(mv, "", err)
 	}
 
 	log.Printf("Installed %s", ls.version)
 	log.Printf("Latest    %s", rs.version)
 
+	latestVersion := rs.version
+	pinned := i.settings.Pin != ""
+	if pinned {
+		log.Printf("Pinned    %s", i.settings.Pin)
+		if compareVersions(i.settings.Pin, latestVersion) > 0 {
+			return nil, WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("Pinned to version %s, but the latest version is %s", i.settings.Pin, latestVersion))
+		}
+
+		if compareVersions(i.settings.Pin, ls.version) < 0 {
+			// going back is what --rollback is for
+			log.Printf("Already past the pinned version, staying on %s", ls.version)
+			rs.version = ls.version
+		} else {
+			rs.version = i.settings.Pin
+		}
+	}
+
+	// when switching release channels, whatever the other channel's latest
+	// is goes, even if it's a downgrade. We only remember the new channel
+	// once we've gotten there, so an interrupted switch is retried.
+	switching := i.settings.Channel != "" && normalizeChannel(i.settings.Channel) != mv.GetChannel()
+	finishSwitch := func() error {
+		if !switching {
+			return nil
+		}
+		return mv.SetChannel(i.settings.Channel)
+	}
+	if switching {
+		log.Printf("Switching from (%s) to (%s) release channel", displayChannel(mv.GetChannel()), displayChannel(i.settings.Channel))
+	}
+
 	if ls.version == rs.version {
 		log.Printf("We're up-to-date!")
-		Emit(NoUpdateAvailable{})
+		err = finishSwitch()
+		if err != nil {
+			return nil, err
+		}
+		reason := protocol.NoUpdateReasonUpToDate
+		if rs.version != latestVersion {
+			reason = protocol.NoUpdateReasonPinned
+		}
+		Emit(protocol.NoUpdateAvailable{Reason: reason, Pin: i.settings.Pin})
 		return res, nil
 	}
 
+	if (switching || pinned) && mv.HasReadyPending() && !mv.ReadyPendingIs(rs.version) {
+		// it came from the channel we're leaving, or it's not the one we're pinned to
+		err = mv.DiscardReady()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if mv.HasReadyPending() {
 		log.Printf("Current is behind, but we have a ready version...")
 		if mv.ReadyPendingIs(rs.version) {
 			log.Printf("...and it is the latest! (%s)", rs.version)
 		}
-		Emit(UpdateReady{Version: rs.version})
+		err = finishSwitch()
+		if err != nil {
+			return nil, err
+		}
+		Emit(protocol.UpdateReady{Version: rs.version})
 		res.DidUpgrade = true
 		return res, nil
 	}
 
+	buildInfo, err := i.source.BuildInfo(rs.version)
+	if err != nil {
+		return nil, i.checkCancelled(mv, rs.version, fmt.Errorf("While looking for archive plan: %w", err))
+	}
+
+	// what the user asked for explicitly isn't subject to staged rollouts
+	if !switching && !pinned {
+		heldBack, err := i.checkRollout(mv, buildInfo, rs.version)
+		if err != nil {
+			return nil, err
+		}
+		if heldBack != nil {
+			Emit(*heldBack)
+			return res, nil
+		}
+	}
+
 	var pp *patchPlan
 	var ap *archivePlan
 
 	err = taskgroup.Do(ctx,
 		// try to find patch plan
 		func() error {
-			upgradePath := &BrothUpgradePath{}
-			err = i.brothGetResponse(upgradePath, "/%s/upgrade-paths/%s",
-				ls.version,
-				rs.version,
-			)
+			upgradePath, err := i.source.UpgradePath(ls.version, rs.version)
 			if err != nil {
 				log.Printf("While looking for upgrade path: %v", err)
 				log.Printf("Giving up patch plan")
@@ -139,17 +211,12 @@ func (i *Installer) Upgrade(mv Multiverse) (*UpgradeResult, error) {
 
 			var totalSize int64
 			for _, bp := range upgradePath.Patches {
-				f := bp.FindSubType(itchio.BuildFileSubTypeDefault)
+				f := bp.PreferredFile()
 				if f == nil {
 					log.Printf("Missing patch for version %s, giving up patch plan", bp.Version)
 					return nil
 				}
 
-				of := bp.FindSubType(itchio.BuildFileSubTypeOptimized)
-				if of != nil && of.Size < f.Size {
-					f = of
-				}
-
 				totalSize += f.Size
 			}
 			pp = &patchPlan{
@@ -162,12 +229,6 @@ func (i *Installer) Upgrade(mv Multiverse) (*UpgradeResult, error) {
 
 		// try to find archive plan
 		func() error {
-			buildInfo := &BrothBuildInfo{}
-			err = i.brothGetResponse(buildInfo, "/%s/info", rs.version)
-			if err != nil {
-				return fmt.Errorf("While looking for archive plan: %w", err)
-			}
-
 			found := false
 			for _, f := range buildInfo.Files {
 				if f.Type == itchio.BuildFileTypeArchive &&
@@ -189,7 +250,7 @@ func (i *Installer) Upgrade(mv Multiverse) (*UpgradeResult, error) {
 		},
 	)
 	if err != nil {
-		return nil, err
+		return nil, i.checkCancelled(mv, rs.version, err)
 	}
 
 	if pp == nil {
@@ -204,50 +265,114 @@ func (i *Installer) Upgrade(mv Multiverse) (*UpgradeResult, error) {
 		united.FormatBytes(ap.totalSize),
 	)
 
+	if pp != nil && pp.totalSize < ap.totalSize && mv.CanResumeStaging(stagingTarget("archive", rs.version)) {
+		log.Printf("Found an interrupted archive upgrade to (%s), resuming that instead of patching", rs.version)
+		pp = nil
+	}
+
 	if pp != nil && pp.totalSize < ap.totalSize {
-		err = i.applyPatches(mv, ls, pp)
+		err = i.applyPatches(ctx, mv, ls, pp)
 		if err == nil {
 			log.Printf("Patching went fine!")
-			Emit(UpdateReady{Version: rs.version})
+			err = finishSwitch()
+			if err != nil {
+				return nil, err
+			}
+			Emit(protocol.UpdateReady{Version: rs.version})
 			res.DidUpgrade = true
 			return res, nil
 		}
 
+		if ctx.Err() != nil {
+			return nil, i.checkCancelled(mv, rs.version, err)
+		}
 		log.Printf("Patching went wrong, falling back to archive.")
 		log.Printf("The patching error was: %+v", err)
 	}
 
-	err = i.applyArchive(mv, rs, ap)
+	err = i.applyArchive(ctx, mv, rs, ap)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, i.checkCancelled(mv, rs.version, err)
+		}
+		Emit(protocol.UpdateFailed{Message: fmt.Sprintf("%+v", err)})
+		return nil, err
+	}
+
+	err = finishSwitch()
 	if err != nil {
-		Emit(UpdateFailed{Message: fmt.Sprintf("%+v", err)})
 		return nil, err
 	}
 
-	Emit(UpdateReady{Version: rs.version})
+	Emit(protocol.UpdateReady{Version: rs.version})
 	res.DidUpgrade = true
 	return res, nil
 }
 
-func (i *Installer) applyPatches(mv Multiverse, ls *localState, pp *patchPlan) error {
+// checkCancelled returns err as-is, unless we've been cancelled: then
+// it cleans up the staging folder (checkpoint included, there's nothing
+// to resume) and returns an error saying so.
+func (i *Installer) checkCancelled(mv Multiverse, version string, err error) error {
+	if i.control.Context().Err() == nil {
+		return err
+	}
+
+	log.Printf("Upgrade cancelled (%v), cleaning up", err)
+	cleanErr := mv.CleanStagingFolder()
+	if cleanErr != nil {
+		log.Printf("While cleaning up staging folder: %+v", cleanErr)
+	}
+
+	Emit(protocol.UpdateCancelled{Version: version})
+	return WithErrorCode(protocol.ErrorCodeCancelled, fmt.Errorf("Upgrade cancelled: %w", context.Canceled))
+}
+
+// checkRollout returns an protocol.UpdateHeldBack if version's staged rollout
+// hasn't reached this install yet, and nil if we can go ahead.
+func (i *Installer) checkRollout(mv Multiverse, buildInfo *BrothBuildInfo, version string) (*protocol.UpdateHeldBack, error) {
+	policy, err := mv.GetRolloutPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	percentage, from := rolloutPercentage(policy, buildInfo, version)
+	if percentage >= 100 {
+		return nil, nil
+	}
+
+	installID, err := mv.GetInstallID()
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := rolloutBucket(installID, version)
+	if bucket < percentage {
+		log.Printf("%s is rolled out to %.2f%% of installs (per %s), and we're in bucket %.2f: going ahead", version, percentage, from, bucket)
+		return nil, nil
+	}
+
+	log.Printf("%s is rolled out to %.2f%% of installs (per %s), and we're in bucket %.2f: holding back", version, percentage, from, bucket)
+	return &protocol.UpdateHeldBack{
+		Version:           version,
+		RolloutPercentage: percentage,
+		Bucket:            bucket,
+	}, nil
+}
+
+func (i *Installer) applyPatches(ctx context.Context, mv Multiverse, ls *localState, pp *patchPlan) (rErr error) {
 	up := pp.path
+	if len(up.Patches) == 0 {
+		return fmt.Errorf("Upgrade path has no patches")
+	}
 	log.Printf("Applying %d patches...", len(up.Patches))
 
 	{
 		log.Printf("But first, let's check (%s) is a valid build for (%s)", ls.appDir, ls.version)
 
-		signatureURL := i.buildBrothURL(nil, "%s/signature/default", ls.version)
-		log.Printf("☁ %s", signatureURL)
-
 		consumer := newConsumer()
-		sigSource, err := filesource.Open(signatureURL, option.WithConsumer(consumer))
-		if err != nil {
-			return err
-		}
-		defer sigSource.Close()
-
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
-		sigInfo, err := pwr.ReadSignature(ctx, sigSource)
+		sigInfo, err := i.readInstalledSignature(ctx, ls.version, option.WithConsumer(consumer), option.WithHTTPClient(i.downloadClient))
 		if err != nil {
 			return err
 		}
@@ -262,34 +387,52 @@ func (i *Installer) applyPatches(mv Multiverse, ls *localState, pp *patchPlan) e
 		}
 	}
 
-	stagingDir, err := mv.MakeStagingFolder()
+	latestVersion := up.Patches[len(up.Patches)-1].Version
+
+	// patches can make anything: what they made is checked against this
+	latestSigInfo, err := i.readSignature(ctx, latestVersion, option.WithConsumer(newConsumer()), option.WithHTTPClient(i.downloadClient))
+	if err != nil {
+		return err
+	}
+
+	target := stagingTarget(fmt.Sprintf("patch-from-%s", ls.version), latestVersion)
+	stagingDir, err := mv.MakeStagingFolder(target)
 	if err != nil {
 		return err
 	}
-	defer mv.CleanStagingFolder()
 	log.Printf("Using (%s) as staging directory", stagingDir)
 
+	checkpoint := readCheckpoint(stagingDir, target)
+	resuming := checkpoint != nil
+	if resuming {
+		log.Printf("Resuming interrupted upgrade (%d/%d patches done)", len(checkpoint.PatchesDone), len(up.Patches))
+	} else {
+		checkpoint = &stagingCheckpoint{Target: target}
+	}
+	saver := newCheckpointSaver(stagingDir, checkpoint)
+	defer func() {
+		if rErr != nil && resuming && !saver.saved {
+			log.Printf("Could not make progress from checkpoint, discarding it")
+			removeCheckpoint(stagingDir)
+		}
+		finishStaging(mv, stagingDir, target, rErr)
+	}()
+
 	applyOne := func(bp *BrothPatch, targetDir string, outputDir string) error {
 		log.Printf("Upgrading to %s...", bp.Version)
-		Emit(InstallingUpdate{Version: bp.Version})
+		Emit(protocol.InstallingUpdate{Version: bp.Version})
 
-		f := bp.FindSubType(itchio.BuildFileSubTypeDefault)
+		f := bp.PreferredFile()
 		if f == nil {
 			return fmt.Errorf("Could not find default patch file for version %s, giving up", bp.Version)
 		}
-
-		of := bp.FindSubType(itchio.BuildFileSubTypeOptimized)
-		if of != nil && of.Size < f.Size {
-			f = of
-		}
 		log.Printf("Using (%s) patch (%s)", f.SubType, united.FormatBytes(f.Size))
 
 		consumer := newConsumer()
 
-		patchURL := i.buildBrothURL(nil, "%s/patch/%s", bp.Version, f.SubType)
-		log.Printf("☁ %s", patchURL)
-
-		patchSource, err := filesource.Open(patchURL, option.WithConsumer(consumer))
+		patchSource, err := openArtifact(i.source, fmt.Sprintf("patch to %s", bp.Version), func(s PackageSource) string {
+			return s.PatchLocation(bp.Version, f.SubType)
+		}, option.WithConsumer(consumer), option.WithHTTPClient(i.downloadClient))
 		if err != nil {
 			return err
 		}
@@ -301,14 +444,15 @@ func (i *Installer) applyPatches(mv Multiverse, ls *localState, pp *patchPlan) e
 			},
 		})
 
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
 
 		p, err := patcher.New(patchSource, consumer)
 		if err != nil {
 			return err
 		}
-		startPrintingProgress(ctx, tracker)
+		p.SetSaveConsumer(&patcherSaveConsumer{cs: saver})
+		i.startPrintingProgress(ctx, tracker, patchSource.Size())
 
 		targetPool := fspool.New(p.GetTargetContainer(), targetDir)
 
@@ -322,7 +466,10 @@ func (i *Installer) applyPatches(mv Multiverse, ls *localState, pp *patchPlan) e
 			return err
 		}
 
-		err = p.Resume(nil, targetPool, bwl)
+		if checkpoint.Patcher != nil {
+			log.Printf("Resuming patch from file %d", checkpoint.Patcher.FileIndex)
+		}
+		err = p.Resume(checkpoint.Patcher, targetPool, bwl)
 		if err != nil {
 			return err
 		}
@@ -332,23 +479,42 @@ func (i *Installer) applyPatches(mv Multiverse, ls *localState, pp *patchPlan) e
 			return err
 		}
 
-		return nil
+		checkpoint.PatchesDone = append(checkpoint.PatchesDone, bp.Version)
+		checkpoint.Patcher = nil
+		return saver.save()
 	}
 
 	targetDir := ls.appDir
 	var outputDir string
-	var latestVersion string
-	for _, p := range up.Patches {
+	for index, p := range up.Patches {
 		outputDir = filepath.Join(stagingDir, fmt.Sprintf("app-%s", p.Version))
-		err := applyOne(p, targetDir, outputDir)
-		if err != nil {
-			return err
+		if index < len(checkpoint.PatchesDone) {
+			if checkpoint.PatchesDone[index] != p.Version {
+				return fmt.Errorf("internal error: checkpoint has patch for %s, expected %s", checkpoint.PatchesDone[index], p.Version)
+			}
+			log.Printf("Patch to %s already applied", p.Version)
+		} else {
+			err := applyOne(p, targetDir, outputDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the output of the previous patch is only needed to apply the next one
+		if targetDir != ls.appDir {
+			os.RemoveAll(targetDir)
 		}
 		targetDir = outputDir
-		latestVersion = p.Version
 	}
 
 	log.Printf("Fully upgraded into (%s)", outputDir)
+	err = verifyBuildFolder(ctx, outputDir, latestSigInfo, latestVersion)
+	if err != nil {
+		// there's nothing worth resuming
+		removeCheckpoint(stagingDir)
+		return err
+	}
+
 	err = mv.QueueReady(&BuildFolder{
 		Version: latestVersion,
 		Path:    outputDir,
@@ -360,16 +526,21 @@ func (i *Installer) applyPatches(mv Multiverse, ls *localState, pp *patchPlan) e
 	return nil
 }
 
-func (i *Installer) applyArchive(mv Multiverse, rs *remoteState, ap *archivePlan) error {
+func (i *Installer) applyArchive(ctx context.Context, mv Multiverse, rs *remoteState, ap *archivePlan) (rErr error) {
 	log.Printf("Upgrading to (%s) using archive...", rs.version)
-	Emit(InstallingUpdate{Version: rs.version})
-
-	archiveURL := i.buildBrothURL(nil, "%s/archive/default", rs.version)
-	log.Printf("☁ %s", archiveURL)
+	Emit(protocol.InstallingUpdate{Version: rs.version})
 
 	consumer := newConsumer()
 
-	archiveFile, err := eos.Open(archiveURL, option.WithConsumer(i.consumer))
+	// what we extract is checked against this
+	sigInfo, err := i.readSignature(ctx, rs.version, option.WithConsumer(i.consumer), option.WithHTTPClient(i.downloadClient))
+	if err != nil {
+		return err
+	}
+
+	archiveFile, err := openArtifactFile(i.source, fmt.Sprintf("archive for %s", rs.version), func(s PackageSource) string {
+		return s.ArchiveLocation(rs.version)
+	}, option.WithConsumer(i.consumer), option.WithHTTPClient(i.downloadClient))
 	if err != nil {
 		return err
 	}
@@ -384,7 +555,7 @@ func (i *Installer) applyArchive(mv Multiverse, rs *remoteState, ap *archivePlan
 		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	tracker := tracker.New(tracker.Opts{
@@ -393,13 +564,30 @@ func (i *Installer) applyArchive(mv Multiverse, rs *remoteState, ap *archivePlan
 
 	consumer.OnProgress = tracker.SetProgress
 	ex.SetConsumer(consumer)
-	startPrintingProgress(ctx, tracker)
+	i.startPrintingProgress(ctx, tracker, archiveStats.Size())
 
-	stagingFolder, err := mv.MakeStagingFolder()
+	target := stagingTarget("archive", rs.version)
+	stagingFolder, err := mv.MakeStagingFolder(target)
 	if err != nil {
 		return err
 	}
-	defer mv.CleanStagingFolder()
+
+	checkpoint := readCheckpoint(stagingFolder, target)
+	resuming := checkpoint != nil
+	if resuming && checkpoint.Extractor != nil {
+		log.Printf("Resuming interrupted extraction at %.2f%%", checkpoint.Extractor.Progress*100)
+	} else if !resuming {
+		checkpoint = &stagingCheckpoint{Target: target}
+	}
+	saver := newCheckpointSaver(stagingFolder, checkpoint)
+	ex.SetSaveConsumer(&extractorSaveConsumer{cs: saver})
+	defer func() {
+		if rErr != nil && resuming && !saver.saved {
+			log.Printf("Could not make progress from checkpoint, discarding it")
+			removeCheckpoint(stagingFolder)
+		}
+		finishStaging(mv, stagingFolder, target, rErr)
+	}()
 
 	outputDir := filepath.Join(stagingFolder, fmt.Sprintf("app-%s", rs.version))
 	log.Printf("Extracting %s to (%s)", united.FormatBytes(archiveStats.Size()), outputDir)
@@ -415,7 +603,7 @@ func (i *Installer) applyArchive(mv Multiverse, rs *remoteState, ap *archivePlan
 
 	startTime := time.Now()
 
-	res, err := ex.Resume(nil, sink)
+	res, err := ex.Resume(checkpoint.Extractor, sink)
 	if err != nil {
 		return err
 	}
@@ -430,6 +618,13 @@ func (i *Installer) applyArchive(mv Multiverse, rs *remoteState, ap *archivePlan
 		sink.Close()
 	})
 
+	err = verifyBuildFolder(ctx, outputDir, sigInfo, rs.version)
+	if err != nil {
+		// there's nothing worth resuming
+		removeCheckpoint(stagingFolder)
+		return err
+	}
+
 	err = mv.QueueReady(&BuildFolder{
 		Version: rs.version,
 		Path:    outputDir,
@@ -441,13 +636,17 @@ func (i *Installer) applyArchive(mv Multiverse, rs *remoteState, ap *archivePlan
 	return nil
 }
 
-func startPrintingProgress(ctx context.Context, tracker tracker.Tracker) {
+// startPrintingProgress emits progress about downloading totalBytes
+// every second, until ctx is done
+func (i *Installer) startPrintingProgress(ctx context.Context, tracker tracker.Tracker, totalBytes int64) {
 	go func() {
 		for {
 			select {
 			case <-time.After(1 * time.Second):
-				p := Progress{
-					Progress: tracker.Progress(),
+				p := protocol.Progress{
+					Progress:   tracker.Progress(),
+					Bytes:      int64(tracker.Progress() * float64(totalBytes)),
+					TotalBytes: totalBytes,
 				}
 				stats := tracker.Stats()
 				if stats != nil {
@@ -460,6 +659,10 @@ func startPrintingProgress(ctx context.Context, tracker tracker.Tracker) {
 						p.ETA = stats.TimeLeft().Seconds()
 					}
 				}
+				if i.control.BandwidthLimit() > 0 {
+					// the tracker only knows about the speed so far
+					p.ETA = i.control.estimateETA(totalBytes-p.Bytes, p.BPS)
+				}
 				Emit(p)
 				log.Printf("%.2f%% done - %s / s, ETA %v",
 					tracker.Progress()*100,
@@ -0,0 +1,66 @@
+package setup
+
+import (
+	"strconv"
+	"strings"
+)
+
+// compareVersions returns -1, 0 or 1 depending on whether a is older,
+// the same as, or newer than b. Versions are dot-separated numbers
+// (like `26.1.0`), optionally followed by a prerelease suffix (like
+// `26.1.0-canary.3`) which makes them older than the same version
+// without one. Parts that aren't numbers are compared as strings.
+func compareVersions(a string, b string) int {
+	aCore, aPre, aHasPre := strings.Cut(a, "-")
+	bCore, bPre, bHasPre := strings.Cut(b, "-")
+
+	c := compareVersionParts(strings.Split(aCore, "."), strings.Split(bCore, "."))
+	if c != 0 {
+		return c
+	}
+
+	switch {
+	case !aHasPre && !bHasPre:
+		return 0
+	case !aHasPre:
+		return 1
+	case !bHasPre:
+		return -1
+	}
+	return compareVersionParts(strings.Split(aPre, "."), strings.Split(bPre, "."))
+}
+
+func compareVersionParts(a []string, b []string) int {
+	for k := 0; k < len(a) || k < len(b); k++ {
+		// missing parts count as zero, so 1.0 is the same as 1.0.0
+		ap, bp := "0", "0"
+		if k < len(a) {
+			ap = a[k]
+		}
+		if k < len(b) {
+			bp = b[k]
+		}
+
+		an, aErr := strconv.ParseUint(ap, 10, 64)
+		bn, bErr := strconv.ParseUint(bp, 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			// numbers sort before words, like semver
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(ap, bp); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,105 @@
+package setup
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/itchio/itch-setup/protocol"
+)
+
+// WatchSettings configure Watch. Upgrade checks for a new version, and
+// stages it if there's one.
+type WatchSettings struct {
+	Interval time.Duration
+	Control  *Control
+	Upgrade  func() error
+}
+
+// watchRetryDelay is how long we wait to check again after a failed
+// check. It doubles with every failure in a row, up to the interval.
+var watchRetryDelay = 1 * time.Minute
+
+// watchJitter is how far off the interval we may check, as a fraction,
+// so that a lab full of machines doesn't hit broth all at once
+const watchJitter = 0.1
+
+// Watch calls settings.Upgrade every settings.Interval, give or take some
+// jitter, until the Control is cancelled (by a `cancel` command, SIGINT
+// or SIGTERM).
+func Watch(settings WatchSettings) error {
+	if settings.Interval <= 0 {
+		return WithErrorCode(protocol.ErrorCodeInvalidArgument, fmt.Errorf("--watch-interval must be positive (got %s)", settings.Interval))
+	}
+
+	EnableJSON()
+	defer DisableJSON()
+
+	ctx := settings.Control.Context()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Got %s", sig)
+			settings.Control.Cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	log.Printf("Watching for updates every %s", settings.Interval)
+	failures := 0
+	for {
+		err := settings.Upgrade()
+		if ctx.Err() != nil {
+			log.Printf("Stopped watching for updates")
+			return nil
+		}
+
+		scheduled := protocol.NextCheckScheduled{}
+		if err != nil {
+			failures++
+			log.Printf("Update check failed (%d in a row): %+v", failures, err)
+			scheduled.Error = err.Error()
+		} else {
+			failures = 0
+		}
+
+		delay := nextCheckDelay(settings.Interval, failures)
+		scheduled.Delay = delay.Seconds()
+		scheduled.Failures = failures
+		Emit(scheduled)
+		log.Printf("Next update check in %s", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			log.Printf("Stopped watching for updates")
+			return nil
+		}
+	}
+}
+
+// nextCheckDelay returns how long to wait before the next check, after
+// failures failed checks in a row
+func nextCheckDelay(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	if failures > 0 {
+		backoff := watchRetryDelay
+		for i := 1; i < failures && backoff < interval; i++ {
+			backoff *= 2
+		}
+		if backoff < delay {
+			delay = backoff
+		}
+	}
+
+	jitter := (rand.Float64()*2 - 1) * watchJitter * float64(delay)
+	return delay + time.Duration(jitter)
+}
@@ -0,0 +1,213 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestInstall_FromBundle(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	archive := h.Server().CreateMockArchive("itch")
+	signature := h.Server().CreateMockSignature(archive)
+	manifest, manifestSig := h.Server().CreateReleaseManifest("itch", "3.0.0", archive, signature)
+
+	bundleDir := filepath.Join(h.TempDir(), "bundle")
+	writeFile(t, filepath.Join(bundleDir, "LATEST"), []byte("3.0.0\n"))
+	writeFile(t, filepath.Join(bundleDir, "3.0.0", "signature.pws"), signature)
+	writeFile(t, filepath.Join(bundleDir, "3.0.0", "archive.zip"), archive)
+	writeFile(t, filepath.Join(bundleDir, "3.0.0", "release-manifest.json"), manifest)
+	writeFile(t, filepath.Join(bundleDir, "3.0.0", "release-manifest.sig"), manifestSig)
+
+	// The mock server has nothing: everything must come from the bundle
+	result := h.Run("--appname", "itch", "--from-bundle", bundleDir)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	state := mv.ReadState()
+	if state == nil || state.Current != "3.0.0" {
+		t.Fatalf("Expected current to be 3.0.0, got %+v", state)
+	}
+
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "app-3.0.0", "itch")); err != nil {
+		t.Errorf("Expected app to be installed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "itch")); err != nil {
+		t.Errorf("Expected launcher script to be installed: %v", err)
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestExportBundle_RoundTrip(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	archive := h.Server().CreateMockArchive("itch")
+	h.Server().SetLatestVersion("itch", "2.0.0")
+	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+	h.Server().SetArchive("itch", "2.0.0", archive)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(archive))
+	h.Server().SetSignature("itch", "1.0.0", h.Server().CreateMockSignature(archive))
+	h.Server().SetPatch("itch", "2.0.0", []byte("mock patch"))
+	h.Server().SetUpgradePath("itch", "1.0.0", "2.0.0", "2.0.0")
+
+	bundleDir := filepath.Join(h.TempDir(), "bundle")
+	result := h.Run("--appname", "itch", "--export-bundle", bundleDir, "--export-from", "1.0.0")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	manifest := readBundleManifest(t, bundleDir)
+	if manifest.Version != "2.0.0" || manifest.UpgradeFrom != "1.0.0" {
+		t.Errorf("Expected manifest for 2.0.0 from 1.0.0, got %s from %q", manifest.Version, manifest.UpgradeFrom)
+	}
+
+	expected := []string{
+		"2.0.0/info.json",
+		"2.0.0/release-manifest.json",
+		"2.0.0/release-manifest.sig",
+		"2.0.0/signature.pws",
+		"2.0.0/archive.zip",
+		"1.0.0/upgrade-paths/2.0.0.json",
+		"1.0.0/release-manifest.json",
+		"1.0.0/release-manifest.sig",
+		"1.0.0/signature.pws",
+		"2.0.0/patch-default.pwr",
+		"LATEST",
+	}
+	for _, p := range expected {
+		f, ok := manifest.Files[p]
+		if !ok {
+			t.Errorf("Expected %s to be in the manifest", p)
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(bundleDir, p))
+		if err != nil {
+			t.Errorf("Expected %s to be in the bundle: %v", p, err)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if f.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("Checksum mismatch for %s", p)
+		}
+	}
+
+	// The exported bundle can be installed from
+	result = h.Run("--appname", "itch", "--from-bundle", bundleDir)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected install from exported bundle to succeed, got %d", result.ExitCode)
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	state := mv.ReadState()
+	if state == nil || state.Current != "2.0.0" {
+		t.Errorf("Expected current to be 2.0.0, got %+v", state)
+	}
+}
+
+func TestInstall_FromBundle_ChecksumMismatch(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	archive := h.Server().CreateMockArchive("itch")
+	h.Server().SetLatestVersion("itch", "2.0.0")
+	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+	h.Server().SetArchive("itch", "2.0.0", archive)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(archive))
+
+	bundleDir := filepath.Join(h.TempDir(), "bundle")
+	result := h.Run("--appname", "itch", "--export-bundle", bundleDir)
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected export to succeed, got %d\n%s", result.ExitCode, result.Stderr)
+	}
+
+	writeFile(t, filepath.Join(bundleDir, "2.0.0", "archive.zip"), []byte("not the archive"))
+
+	result = h.Run("--appname", "itch", "--from-bundle", bundleDir)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Errorf("Expected install from a tampered bundle to fail")
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	if state := mv.ReadState(); state != nil && state.Current != "" {
+		t.Errorf("Expected nothing to be installed, got current %q", state.Current)
+	}
+}
+
+type bundleManifest struct {
+	Version     string
+	UpgradeFrom string
+	Files       map[string]bundleFile
+}
+
+type bundleFile struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func readBundleManifest(t *testing.T, dir string) *bundleManifest {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatalf("Failed to read bundle manifest: %v", err)
+	}
+
+	var raw struct {
+		Version     string `json:"version"`
+		UpgradeFrom string `json:"upgradeFrom"`
+		Files       []struct {
+			Path string `json:"path"`
+			bundleFile
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Failed to parse bundle manifest: %v", err)
+	}
+
+	m := &bundleManifest{
+		Version:     raw.Version,
+		UpgradeFrom: raw.UpgradeFrom,
+		Files:       make(map[string]bundleFile),
+	}
+	for _, f := range raw.Files {
+		m.Files[f.Path] = f.bundleFile
+	}
+	return m
+}
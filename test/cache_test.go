@@ -0,0 +1,145 @@
+package test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestUpgrade_MetadataCache_NotModified(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+
+	for run := 1; run <= 2; run++ {
+		result := h.Run("--appname", "itch", "--upgrade")
+
+		t.Logf("Exit code: %d", result.ExitCode)
+		t.Logf("Stderr:\n%s", result.Stderr)
+
+		if result.ExitCode != 0 {
+			t.Fatalf("Expected exit code 0 on run %d, got %d", run, result.ExitCode)
+		}
+		if !result.HasMessageType(harness.TypeNoUpdateAvailable) {
+			t.Fatalf("Expected no-update-available on run %d, got messages: %v", run, result.Messages)
+		}
+	}
+
+	notModified := h.Server().NotModifiedRequests()
+	if len(notModified) != 1 || !strings.HasSuffix(notModified[0], "/LATEST") {
+		t.Errorf("Expected LATEST to be revalidated on the second run, got 304s for %v", notModified)
+	}
+}
+
+func TestUpgrade_MetadataCache_Offline(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected first upgrade to succeed, got exit code %d", result.ExitCode)
+	}
+
+	h.Server().SetFailWith(http.StatusServiceUnavailable)
+
+	result = h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected stale cache to be used, got exit code %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeNoUpdateAvailable) {
+		t.Errorf("Expected no-update-available, got messages: %v", result.Messages)
+	}
+	if !strings.Contains(result.Stderr, "Broth unreachable, using cached") {
+		t.Errorf("Expected the stale cache to be logged")
+	}
+}
+
+func TestUpgrade_MetadataCache_FreshMirrorWins(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected first upgrade to succeed, got exit code %d", result.ExitCode)
+	}
+
+	// the mirror we have a cache for goes down, another one has news
+	h.Server().SetFailWith(http.StatusServiceUnavailable)
+
+	fresh := harness.NewMockServer(t)
+	defer fresh.Close()
+	archive := fresh.CreateMockArchive("itch")
+	fresh.SetLatestVersion("itch", "2.0.0")
+	fresh.SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+	fresh.SetArchive("itch", "2.0.0", archive)
+	fresh.SetSignature("itch", "2.0.0", fresh.CreateMockSignature(archive))
+
+	result = h.Run("--appname", "itch", "--upgrade",
+		"--broth-url", h.ServerURL(),
+		"--broth-url", fresh.URL(),
+	)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected the fresh mirror's 2.0.0 to be ready, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_MetadataCache_OtherBroth(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected first upgrade to succeed, got exit code %d", result.ExitCode)
+	}
+
+	// what the first broth said isn't what this one would
+	other := harness.NewMockServer(t)
+	defer other.Close()
+	other.SetFailWith(http.StatusServiceUnavailable)
+
+	result = h.Run("--appname", "itch", "--upgrade", "--broth-url", other.URL())
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Fatalf("Expected the upgrade to fail without the first broth's cache")
+	}
+	if strings.Contains(result.Stderr, "Broth unreachable, using cached") {
+		t.Errorf("Expected the first broth's cache not to be used")
+	}
+}
@@ -0,0 +1,179 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// setUpRelease makes version the latest on a release channel of the
+// mock server ("" is stable)
+func setUpRelease(h *harness.Harness, channel string, version string) {
+	archive := h.Server().CreateMockArchive("itch")
+	ms := h.Server().OnReleaseChannel(channel)
+	ms.SetLatestVersion("itch", version)
+	ms.SetBuildInfo("itch", version, int64(len(archive)))
+	ms.SetArchive("itch", version, archive)
+	ms.SetSignature("itch", version, h.Server().CreateMockSignature(archive))
+}
+
+func TestInstall_Channel(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	setUpRelease(h, "", "1.0.0")
+	setUpRelease(h, "canary", "1.1.0-canary")
+
+	result := h.Run("--appname", "itch", "--channel", "canary")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	state := mv.ReadState()
+	if state.Current != "1.1.0-canary" {
+		t.Errorf("Expected current to be 1.1.0-canary, got %q", state.Current)
+	}
+	if state.Channel != "canary" {
+		t.Errorf("Expected channel to be remembered as canary, got %q", state.Channel)
+	}
+}
+
+func TestUpgrade_SwitchChannel_Downgrade(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("2.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	setUpRelease(h, "beta", "1.5.0-beta")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--channel", "beta")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeUpdateReady) {
+		t.Errorf("Expected update-ready message, got messages: %v", result.Messages)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "1.5.0-beta" {
+		t.Errorf("Expected ready to be 1.5.0-beta, got %q", state.Ready)
+	}
+	if state.Channel != "beta" {
+		t.Errorf("Expected channel to be remembered as beta, got %q", state.Channel)
+	}
+}
+
+func TestUpgrade_StaysOnRememberedChannel(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateAppVersion("1.1.0-beta")
+	mv.WriteState(&harness.MultiverseState{
+		Current: "1.1.0-beta",
+		Channel: "beta",
+	})
+
+	setUpRelease(h, "", "1.0.0")
+	setUpRelease(h, "beta", "1.2.0-beta")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "1.2.0-beta" {
+		t.Errorf("Expected ready to be 1.2.0-beta, got %q", state.Ready)
+	}
+	if state.Channel != "beta" {
+		t.Errorf("Expected channel to stay beta, got %q", state.Channel)
+	}
+}
+
+func TestUpgrade_SwitchChannel_DiscardsReady(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	// 2.0.0 was downloaded from stable but not launched yet
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateWithReadyPending("1.0.0", "2.0.0")
+	mv.WriteState(&harness.MultiverseState{
+		Current: "1.0.0",
+		Ready:   "2.0.0",
+		Channel: "beta",
+	})
+
+	setUpRelease(h, "", "2.0.0")
+	setUpRelease(h, "beta", "1.5.0-beta")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--channel", "stable")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	// the ready build is stable's latest, so it's kept
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to stay 2.0.0, got %q", state.Ready)
+	}
+	if state.Channel != "" {
+		t.Errorf("Expected channel to be back to stable, got %q", state.Channel)
+	}
+
+	// now switch to beta: the stable ready build has to go
+	result = h.Run("--appname", "itch", "--upgrade", "--channel", "beta")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	state = mv.ReadState()
+	if state.Ready != "1.5.0-beta" {
+		t.Errorf("Expected ready to be 1.5.0-beta, got %q", state.Ready)
+	}
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "app-2.0.0")); !os.IsNotExist(err) {
+		t.Errorf("Expected discarded ready build to be removed, got %v", err)
+	}
+}
+
+func TestUpgrade_InvalidChannel(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--channel", "../beta")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Errorf("Expected non-zero exit code for an invalid channel")
+	}
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestControl_CancelStalledUpgrade(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// leftovers from an interrupted upgrade
+	stagingDir := filepath.Join(mv.BaseDir(), "staging")
+	if err := os.MkdirAll(filepath.Join(stagingDir, "app-2.0.0"), 0755); err != nil {
+		t.Fatalf("Creating staging folder: %v", err)
+	}
+
+	setUpRelease(h, "", "2.0.0")
+	stalled := h.Server().StallRequests()
+
+	stdinReader, stdinWriter := io.Pipe()
+	resultChan := make(chan *harness.Result, 1)
+	go func() {
+		resultChan <- h.RunWithStdin(stdinReader, "--appname", "itch", "--upgrade")
+	}()
+
+	select {
+	case path := <-stalled:
+		t.Logf("Request to %s is hanging, cancelling", path)
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for itch-setup to make a request")
+	}
+	io.WriteString(stdinWriter, `{"type":"cancel"}`+"\n")
+	stdinWriter.Close()
+
+	var result *harness.Result
+	select {
+	case result = <-resultChan:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for itch-setup to cancel")
+	}
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if !result.HasMessageType(harness.TypeUpdateCancelled) {
+		t.Errorf("Expected update-cancelled message, got messages: %v", result.Messages)
+	}
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeCancelled {
+		t.Errorf("Expected code cancelled, got %q (%s)", payload.Code, payload.Message)
+	}
+	if result.ExitCode != 6 {
+		t.Errorf("Expected exit code 6, got %d", result.ExitCode)
+	}
+
+	if _, err := os.Stat(stagingDir); !os.IsNotExist(err) {
+		t.Errorf("Expected staging folder to be cleaned up, got %v", err)
+	}
+	if state := mv.ReadState(); state.Ready != "" {
+		t.Errorf("Expected no ready version, got %q", state.Ready)
+	}
+}
+
+func TestControl_CommandsDontGetInTheWay(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	commands := strings.Join([]string{
+		`{"type":"pause"}`,
+		`{"type":"set-bandwidth-limit","payload":{"bps":1048576}}`,
+		`not a command`,
+		`{"type":"resume"}`,
+		`{"type":"set-bandwidth-limit","payload":{"bps":0}}`,
+	}, "\n") + "\n"
+
+	result := h.RunWithStdin(strings.NewReader(commands), "--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeUpdateReady) {
+		t.Errorf("Expected update-ready message, got messages: %v", result.Messages)
+	}
+	if result.HasMessageType(harness.TypeUpdateCancelled) {
+		t.Errorf("Expected upgrade not to be cancelled")
+	}
+}
@@ -0,0 +1,226 @@
+package test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// doctorIssues returns the doctor-issue payloads of result, by kind
+func doctorIssues(t *testing.T, result *harness.Result) map[string][]*protocol.DoctorIssue {
+	t.Helper()
+
+	issues := make(map[string][]*protocol.DoctorIssue)
+	for _, msg := range result.GetAllMessagesOfType(harness.TypeDoctorIssue) {
+		payload, ok := msg.GetDoctorIssuePayload()
+		if !ok {
+			t.Fatalf("Could not parse doctor-issue payload: %s", msg.Payload)
+		}
+		t.Logf("Issue: %+v", payload)
+		issues[payload.Kind] = append(issues[payload.Kind], payload)
+	}
+	return issues
+}
+
+// setUpBrokenMultiverse makes a state.json that lists nothing that's on
+// disk, and a base folder full of what it doesn't list
+func setUpBrokenMultiverse(t *testing.T, mv *harness.MultiverseSetup) {
+	t.Helper()
+
+	mv.WriteState(&harness.MultiverseState{
+		Current:  "2.0.0",
+		Ready:    "3.0.0",
+		Previous: []string{"1.0.0"},
+	})
+	mv.CreateAppVersion("0.5.0")
+	mv.CreateAppVersion("2.0.0.old")
+	mv.CreatePreviousVersion("0.9.0")
+	writeFile(t, filepath.Join(mv.BaseDir(), "staging", "itch"), []byte("half a download"))
+}
+
+func TestDoctor_ReportsIssues(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	setUpBrokenMultiverse(t, mv)
+
+	result := h.Run("--appname", "itch", "--doctor")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	issues := doctorIssues(t, result)
+	expected := map[string]int{
+		protocol.DoctorIssueMissingCurrent:  1,
+		protocol.DoctorIssueStaleReady:      1,
+		protocol.DoctorIssueMissingPrevious: 1,
+		protocol.DoctorIssueOrphanFolder:    3,
+		protocol.DoctorIssueLeftoverStaging: 1,
+	}
+	for kind, count := range expected {
+		if len(issues[kind]) != count {
+			t.Errorf("Expected %d %s issue(s), got %d", count, kind, len(issues[kind]))
+		}
+	}
+	for _, kindIssues := range issues {
+		for _, issue := range kindIssues {
+			if issue.Fixed {
+				t.Errorf("Expected nothing to be fixed without --fix, got %+v", issue)
+			}
+		}
+	}
+	for _, issue := range issues[protocol.DoctorIssueOrphanFolder] {
+		if issue.Size <= 0 {
+			t.Errorf("Expected orphan (%s) to have a size, got %d", issue.Path, issue.Size)
+		}
+	}
+
+	if state := mv.ReadState(); state.Current != "2.0.0" || state.Ready != "3.0.0" {
+		t.Errorf("Expected state to be left alone, got %+v", state)
+	}
+	expectExists(t, filepath.Join(mv.BaseDir(), "app-0.5.0"))
+	expectExists(t, filepath.Join(mv.BaseDir(), "staging"))
+}
+
+func TestDoctor_Fix(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	setUpBrokenMultiverse(t, mv)
+
+	result := h.Run("--appname", "itch", "--doctor", "--fix")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	issues := doctorIssues(t, result)
+	if len(issues) == 0 {
+		t.Fatalf("Expected issues to be reported")
+	}
+	for _, kindIssues := range issues {
+		for _, issue := range kindIssues {
+			if !issue.Fixed {
+				t.Errorf("Expected every issue to be fixed, got %+v", issue)
+			}
+		}
+	}
+
+	state := mv.ReadState()
+	if state.Current != "" || state.Ready != "" || len(state.Previous) != 0 {
+		t.Errorf("Expected state to forget what's not on disk, got %+v", state)
+	}
+	expectMissing(t, filepath.Join(mv.BaseDir(), "app-0.5.0"))
+	expectMissing(t, filepath.Join(mv.BaseDir(), "app-2.0.0.old"))
+	expectMissing(t, filepath.Join(mv.BaseDir(), "previous", "app-0.9.0"))
+	expectMissing(t, filepath.Join(mv.BaseDir(), "staging"))
+
+	result = h.Run("--appname", "itch", "--doctor")
+	if issues := doctorIssues(t, result); len(issues) != 0 {
+		t.Errorf("Expected nothing left to fix, got %v", issues)
+	}
+}
+
+func TestDoctor_KeepsResumableStaging(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// gob matches fields by name, this decodes as a checkpoint for an
+	// upgrade to 2.0.0 that got interrupted
+	var checkpoint bytes.Buffer
+	err := gob.NewEncoder(&checkpoint).Encode(struct{ Target string }{Target: "archive/2.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := filepath.Join(mv.BaseDir(), "staging")
+	writeFile(t, filepath.Join(staging, "checkpoint.bin"), checkpoint.Bytes())
+	writeFile(t, filepath.Join(staging, "itch"), []byte("half a download"))
+
+	result := h.Run("--appname", "itch", "--doctor", "--fix")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if issues := doctorIssues(t, result)[protocol.DoctorIssueLeftoverStaging]; len(issues) != 0 {
+		t.Errorf("Expected a resumable staging folder not to be reported, got %v", issues)
+	}
+	expectExists(t, filepath.Join(staging, "checkpoint.bin"))
+	expectExists(t, filepath.Join(staging, "itch"))
+}
+
+func TestDoctor_FixesIntegration(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("desktop files are only a thing on Linux")
+	}
+
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	// like an install whose desktop files were deleted
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	result := h.Run("--appname", "itch", "--doctor", "--fix")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	issues := doctorIssues(t, result)
+	for _, kind := range []string{protocol.DoctorIssueBrokenLauncher, protocol.DoctorIssueBrokenDesktopFile} {
+		if len(issues[kind]) == 0 {
+			t.Errorf("Expected a %s issue", kind)
+		}
+		for _, issue := range issues[kind] {
+			if !issue.Fixed {
+				t.Errorf("Expected %s (%s) to be fixed", kind, issue.Path)
+			}
+		}
+	}
+	expectWorkingLauncher(t, filepath.Join(mv.BaseDir(), "itch-setup"))
+	expectExists(t, filepath.Join(h.TempDir(), ".local", "share", "applications", "io.itch.itch.desktop"))
+	expectExists(t, filepath.Join(mv.BaseDir(), "app-1.0.0", "itch"))
+
+	result = h.Run("--appname", "itch", "--doctor")
+	if issues := doctorIssues(t, result); len(issues) != 0 {
+		t.Errorf("Expected nothing left to fix, got %v", issues)
+	}
+}
+
+func TestDoctor_FixNeedsDoctor(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	result := h.Run("--appname", "itch", "--fix")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeInvalidArgument {
+		t.Errorf("Expected code invalid-argument, got %q (%s)", payload.Code, payload.Message)
+	}
+}
@@ -0,0 +1,139 @@
+package test
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// lastErrorOf returns the payload of the error message, which must be
+// the last one printed
+func lastErrorOf(t *testing.T, result *harness.Result) *protocol.Error {
+	t.Helper()
+
+	if len(result.Messages) == 0 {
+		t.Fatalf("Expected an error message, got no messages")
+	}
+	payload, ok := result.Messages[len(result.Messages)-1].GetErrorPayload()
+	if !ok {
+		t.Fatalf("Expected last message to be an error, got messages: %v", result.Messages)
+	}
+	if payload.ExitCode != result.ExitCode {
+		t.Errorf("Expected exit code %d (as advertised), got %d", payload.ExitCode, result.ExitCode)
+	}
+	if payload.ExitCode != payload.Code.ExitCode() {
+		t.Errorf("Expected exit code %d for %q, got %d", payload.Code.ExitCode(), payload.Code, payload.ExitCode)
+	}
+	if payload.Message == "" {
+		t.Errorf("Expected a message")
+	}
+	if payload.LocalizedMessage == "" || strings.HasPrefix(payload.LocalizedMessage, "setup.error.") {
+		t.Errorf("Expected a localized message, got %q", payload.LocalizedMessage)
+	}
+	return payload
+}
+
+func TestError_UpgradeUnavailable(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// Nothing listens on port 1
+	result := h.Run("--appname", "itch", "--upgrade", "--broth-url", "http://127.0.0.1:1")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeUnavailable {
+		t.Errorf("Expected code unavailable, got %q (%s)", payload.Code, payload.Message)
+	}
+	if !payload.Retryable {
+		t.Errorf("Expected unavailable error to be retryable")
+	}
+	if result.ExitCode != 3 {
+		t.Errorf("Expected exit code 3, got %d", result.ExitCode)
+	}
+	if result.HasMessageType(harness.TypeFailed) {
+		t.Errorf("Expected no failed message without --json")
+	}
+}
+
+func TestError_UpgradeNotInstalled_JSON(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--json")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 4 {
+		t.Errorf("Expected exit code 4, got %d", result.ExitCode)
+	}
+
+	errorMsg := result.GetFirstMessageOfType(harness.TypeError)
+	if errorMsg == nil {
+		t.Fatalf("Expected error message, got messages: %v", result.Messages)
+	}
+	payload, _ := errorMsg.GetErrorPayload()
+	if payload.Code != protocol.ErrorCodeNotInstalled || payload.Retryable {
+		t.Errorf("Expected non-retryable not-installed error, got %+v", payload)
+	}
+
+	// with --json, the verb still ends with failed
+	if lastMessageType(result) != harness.TypeFailed {
+		t.Errorf("Expected last message to be failed, got messages: %v", result.Messages)
+	}
+}
+
+func TestError_RelaunchNotInstalled(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	cmd := exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	pid := cmd.Process.Pid
+	cmd.Wait()
+
+	result := h.Run("--appname", "itch", "--relaunch", "--relaunch-pid", strconv.Itoa(pid))
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeNotInstalled {
+		t.Errorf("Expected code not-installed, got %q (%s)", payload.Code, payload.Message)
+	}
+	if result.ExitCode != 4 {
+		t.Errorf("Expected exit code 4, got %d", result.ExitCode)
+	}
+}
+
+func TestError_RelaunchInvalidPID(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	result := h.Run("--appname", "itch", "--relaunch", "--relaunch-pid", "0")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeInvalidArgument || payload.Retryable {
+		t.Errorf("Expected non-retryable invalid-argument error, got %+v", payload)
+	}
+	if result.ExitCode != 2 {
+		t.Errorf("Expected exit code 2, got %d", result.ExitCode)
+	}
+}
@@ -0,0 +1,262 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestInstall_MirrorFailover_ConnectionRefused(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	archive := h.Server().CreateMockArchive("itch")
+	h.Server().SetLatestVersion("itch", "1.0.0")
+	h.Server().SetBuildInfo("itch", "1.0.0", int64(len(archive)))
+	h.Server().SetArchive("itch", "1.0.0", archive)
+	h.Server().SetSignature("itch", "1.0.0", h.Server().CreateMockSignature(archive))
+
+	// Nothing listens on port 1
+	result := h.RunWithEnv(map[string]string{
+		"ITCH_BROTH_URL": "http://127.0.0.1:1," + h.ServerURL(),
+	}, "--appname", "itch")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !strings.Contains(result.Stderr, "failing over") {
+		t.Errorf("Expected failover to be logged")
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "app-1.0.0", "itch")); err != nil {
+		t.Errorf("Expected app to be installed: %v", err)
+	}
+}
+
+func TestUpgrade_MirrorFailover_ServerError(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	broken := harness.NewMockServer(t)
+	defer broken.Close()
+	broken.SetFailWith(http.StatusServiceUnavailable)
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	archive := h.Server().CreateMockArchive("itch")
+	h.Server().SetLatestVersion("itch", "2.0.0")
+	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+	h.Server().SetArchive("itch", "2.0.0", archive)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(archive))
+
+	result := h.Run("--appname", "itch", "--upgrade",
+		"--broth-url", broken.URL(),
+		"--broth-url", h.ServerURL(),
+	)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !strings.Contains(result.Stderr, "Mirror ("+h.ServerURL()) {
+		t.Errorf("Expected the serving mirror to be logged")
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_AllMirrorsUnavailable(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	h.Server().SetFailWith(http.StatusInternalServerError)
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade",
+		"--broth-url", "http://127.0.0.1:1",
+		"--broth-url", h.ServerURL(),
+	)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Errorf("Expected non-zero exit code when every mirror is down")
+	}
+	if !strings.Contains(result.Stderr, "all mirrors unavailable") {
+		t.Errorf("Expected all mirrors to be reported unavailable")
+	}
+}
+
+func TestUpgrade_MirrorFailover_StallMidDownload(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	stalling := harness.NewMockServer(t)
+	defer stalling.Close()
+
+	archive := h.Server().CreateMockArchive("itch")
+	signature := h.Server().CreateMockSignature(archive)
+	for _, server := range []*harness.MockServer{stalling, h.Server()} {
+		server.SetLatestVersion("itch", "2.0.0")
+		server.SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+		server.SetArchive("itch", "2.0.0", archive)
+		server.SetSignature("itch", "2.0.0", signature)
+	}
+	const stallAt = 64
+	stalling.StallArtifactsAfter(stallAt)
+
+	result := h.Run("--appname", "itch", "--upgrade",
+		"--broth-url", stalling.URL(),
+		"--broth-url", h.ServerURL(),
+		"--stall-timeout", "500ms",
+	)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+
+	// the good mirror only sends what the stalling one didn't
+	resumed := false
+	for _, r := range h.Server().RequestsTo("/archive/default") {
+		t.Logf("Archive request to the good mirror: %s %q", r.Method, r.Range)
+		if strings.HasPrefix(r.Range, fmt.Sprintf("bytes=%d-", stallAt)) {
+			resumed = true
+		}
+	}
+	if !resumed {
+		t.Errorf("Expected the archive to be resumed at byte %d from the good mirror", stallAt)
+	}
+	if !strings.Contains(result.Stderr, fmt.Sprintf("at byte %d from mirror (%s)", stallAt, h.ServerURL())) {
+		t.Errorf("Expected the resume to be logged")
+	}
+}
+
+func TestExportBundle_MirrorFailover_StallMidDownload(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	stalling := harness.NewMockServer(t)
+	defer stalling.Close()
+
+	archive := h.Server().CreateMockArchive("itch")
+	signature := h.Server().CreateMockSignature(archive)
+	for _, server := range []*harness.MockServer{stalling, h.Server()} {
+		server.SetLatestVersion("itch", "2.0.0")
+		server.SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+		server.SetArchive("itch", "2.0.0", archive)
+		server.SetSignature("itch", "2.0.0", signature)
+	}
+	const stallAt = 64
+	stalling.StallArtifactsAfter(stallAt)
+
+	// without stall detection, the export would hang for good
+	bundleDir := filepath.Join(h.TempDir(), "bundle")
+	start := time.Now()
+	result := h.RunUntil(func() bool {
+		return time.Since(start) > 30*time.Second
+	}, "--appname", "itch", "--export-bundle", bundleDir,
+		"--broth-url", stalling.URL(),
+		"--broth-url", h.ServerURL(),
+		"--stall-timeout", "500ms",
+	)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.Killed {
+		t.Fatalf("Expected the stalled download to be resumed from the good mirror")
+	}
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	exported, err := os.ReadFile(filepath.Join(bundleDir, "2.0.0", "archive.zip"))
+	if err != nil {
+		t.Fatalf("Expected the archive to be exported: %v", err)
+	}
+	if string(exported) != string(archive) {
+		t.Errorf("Expected the exported archive to match")
+	}
+
+	// the good mirror only sends what the stalling one didn't
+	resumed := false
+	for _, r := range h.Server().RequestsTo("/archive/default") {
+		t.Logf("Archive request to the good mirror: %s %q", r.Method, r.Range)
+		if strings.HasPrefix(r.Range, fmt.Sprintf("bytes=%d-", stallAt)) {
+			resumed = true
+		}
+	}
+	if !resumed {
+		t.Errorf("Expected the archive to be resumed at byte %d from the good mirror", stallAt)
+	}
+}
+
+func TestUpgrade_MirrorFailover_DropsEveryTime(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	archive := h.Server().CreateMockArchive("itch")
+	h.Server().SetLatestVersion("itch", "2.0.0")
+	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+	h.Server().SetArchive("itch", "2.0.0", archive)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(archive))
+	h.Server().DropArtifacts()
+
+	// the only mirror accepts every resume, then sends nothing: that
+	// must not go on forever
+	start := time.Now()
+	result := h.RunUntil(func() bool {
+		return time.Since(start) > 30*time.Second
+	}, "--appname", "itch", "--upgrade", "--retry-attempts", "3")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.Killed {
+		t.Fatalf("Expected itch-setup to give up on its own")
+	}
+	if result.ExitCode == 0 {
+		t.Errorf("Expected non-zero exit code when the mirror never sends anything")
+	}
+	if !strings.Contains(result.Stderr, "after 3 attempts") {
+		t.Errorf("Expected resuming to be given up on after 3 attempts")
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "" {
+		t.Errorf("Expected nothing to be ready, got %q", state.Ready)
+	}
+}
@@ -0,0 +1,68 @@
+package harness
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// StartCDN serves the same packages from another HTTPS server, at
+// https://localhost, with a certificate (and public key) of its own, and
+// makes the HTTPS server (see StartTLS, which must be called first)
+// redirect archive, signature and patch downloads there, like broth
+// does. CertificatePEM includes its certificate.
+func (ms *MockServer) StartCDN() {
+	ms.t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ms.t.Fatalf("Generating CDN key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		ms.t.Fatalf("Creating CDN certificate: %v", err)
+	}
+
+	ms.cdnServer = httptest.NewUnstartedServer(ms.mux)
+	ms.cdnServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	ms.cdnServer.StartTLS()
+}
+
+// redirectToCDN redirects downloads made to the HTTPS server to the CDN,
+// if StartCDN was called. It returns true if it did.
+func (ms *MockServer) redirectToCDN(w http.ResponseWriter, r *http.Request) bool {
+	if ms.cdnServer == nil || ms.tlsServer == nil || r.Host != strings.TrimPrefix(ms.tlsServer.URL, "https://") {
+		return false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 5 || (parts[3] != "archive" && parts[3] != "signature" && parts[3] != "patch") {
+		return false
+	}
+
+	_, port, _ := net.SplitHostPort(ms.cdnServer.Listener.Addr().String())
+	http.Redirect(w, r, "https://localhost:"+port+r.URL.Path, http.StatusFound)
+	return true
+}
@@ -0,0 +1,115 @@
+package harness
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+)
+
+// StagingCheckpoint mirrors what itch-setup persists in its staging
+// folder to resume interrupted installs and upgrades (see
+// setup/checkpoint.go), as far as tests are concerned. gob matches
+// fields by name, and skips the ones that aren't here.
+type StagingCheckpoint struct {
+	// Target is like `archive/2.0.0`, `patch-from-1.0.0/2.0.0` or `heal/1.0.0`
+	Target      string
+	Extractor   *ExtractorCheckpoint
+	PatchesDone []string
+	Patcher     *PatcherCheckpoint
+}
+
+// ExtractorCheckpoint is where extracting an archive was at
+type ExtractorCheckpoint struct {
+	SourceCheckpoint *SourceCheckpoint
+	EntryIndex       int64
+	Progress         float64
+}
+
+// SourceCheckpoint is where reading a stream was at
+type SourceCheckpoint struct {
+	Offset int64
+}
+
+// PatcherCheckpoint is where applying a patch was at
+type PatcherCheckpoint struct {
+	MessageCheckpoint *MessageCheckpoint
+	FileIndex         int64
+}
+
+// MessageCheckpoint is where reading a patch file was at
+type MessageCheckpoint struct {
+	Offset int64
+}
+
+// StagingDir returns where upgrades and installs are staged
+func (m *MultiverseSetup) StagingDir() string {
+	return filepath.Join(m.baseDir, "staging")
+}
+
+func (m *MultiverseSetup) checkpointPath() string {
+	return filepath.Join(m.StagingDir(), "checkpoint.bin")
+}
+
+// ReadCheckpoint returns the checkpoint in the staging folder, or nil
+// if there's none
+func (m *MultiverseSetup) ReadCheckpoint() *StagingCheckpoint {
+	m.t.Helper()
+
+	f, err := os.Open(m.checkpointPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		m.t.Fatalf("Failed to open checkpoint: %v", err)
+	}
+	defer f.Close()
+
+	c := &StagingCheckpoint{}
+	if err := gob.NewDecoder(f).Decode(c); err != nil {
+		m.t.Fatalf("Failed to decode checkpoint: %v", err)
+	}
+	return c
+}
+
+// HasCheckpoint returns true if there's a checkpoint in the staging
+// folder. Unlike ReadCheckpoint, it's safe to call while itch-setup runs.
+func (m *MultiverseSetup) HasCheckpoint() bool {
+	_, err := os.Stat(m.checkpointPath())
+	return err == nil
+}
+
+// WriteCheckpoint creates the staging folder with a checkpoint for
+// target in it, and a file that tells whether it was kept, see
+// StagingKept
+func (m *MultiverseSetup) WriteCheckpoint(target string) {
+	m.t.Helper()
+
+	if err := os.MkdirAll(m.StagingDir(), 0755); err != nil {
+		m.t.Fatalf("Failed to create staging dir: %v", err)
+	}
+
+	f, err := os.Create(m.checkpointPath())
+	if err != nil {
+		m.t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	defer f.Close()
+
+	if err := gob.NewEncoder(f).Encode(&StagingCheckpoint{Target: target}); err != nil {
+		m.t.Fatalf("Failed to encode checkpoint: %v", err)
+	}
+
+	if err := os.WriteFile(m.stagingMarkerPath(), []byte("staged"), 0644); err != nil {
+		m.t.Fatalf("Failed to write staging marker: %v", err)
+	}
+}
+
+func (m *MultiverseSetup) stagingMarkerPath() string {
+	return filepath.Join(m.StagingDir(), "marker")
+}
+
+// StagingKept returns true if the staging folder made by WriteCheckpoint
+// is still there, instead of having been started over
+func (m *MultiverseSetup) StagingKept() bool {
+	_, err := os.Stat(m.stagingMarkerPath())
+	return err == nil
+}
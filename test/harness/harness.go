@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // Harness manages the test environment for itch-setup
@@ -27,6 +29,8 @@ type Result struct {
 	Stdout   string
 	Stderr   string
 	Messages []Message
+	// Killed is set if we killed itch-setup, see RunUntil
+	Killed bool
 }
 
 // New creates a new test harness
@@ -40,52 +44,129 @@ func New(t *testing.T) *Harness {
 	}
 
 	h := &Harness{
-		t:       t,
-		tempDir: tempDir,
+		t:          t,
+		tempDir:    tempDir,
+		binaryPath: buildBinary(t, "itch-setup", devTags),
 	}
 
-	// Build the binary
-	h.buildBinary()
-
 	// Start mock server
 	h.server = NewMockServer(t)
 
 	return h
 }
 
-// buildBinary builds itch-setup for testing
-func (h *Harness) buildBinary() {
+// Builds are shared by every test in the package: building itch-setup
+// takes a lot longer than most tests do.
+var builds = struct {
+	sync.Mutex
+	dir   string
+	paths map[string]string
+}{paths: map[string]string{}}
+
+// devTags builds itch-setup without GTK to keep integration test builds
+// fast, and as a development build, so it trusts the mock release key.
+const devTags = "nogtk,itchsetupdev"
+
+// BuildVersion builds another itch-setup, that says it's version, and
+// returns its path
+func (h *Harness) BuildVersion(version string) string {
+	h.t.Helper()
+	return buildBinary(h.t, fmt.Sprintf("itch-setup-%s", version), devTags,
+		"-ldflags", fmt.Sprintf("-X main.version=%s", version))
+}
+
+// UseVersion makes later runs use an itch-setup that says it's version,
+// see BuildVersion
+func (h *Harness) UseVersion(version string) {
+	h.t.Helper()
+	h.binaryPath = h.BuildVersion(version)
+}
+
+// UseReleaseBuild makes later runs use an itch-setup built like release
+// builds, with the itchsetuprelease tag and without itchsetupdev: it
+// ignores ITCH_SETUP_RELEASE_KEY and only trusts the key in data/release.pub.
+func (h *Harness) UseReleaseBuild() {
+	h.t.Helper()
+	h.binaryPath = buildBinary(h.t, "itch-setup-release", "nogtk,itchsetuprelease")
+}
+
+// UsePlainBuild makes later runs use an itch-setup built without any of
+// the itchsetupdev or itchsetuprelease tags, like a plain go build.
+func (h *Harness) UsePlainBuild() {
 	h.t.Helper()
+	h.binaryPath = buildBinary(h.t, "itch-setup-plain", "nogtk")
+}
+
+// buildBinary builds itch-setup for testing as name, or returns the path
+// it was already built to
+func buildBinary(t *testing.T, name string, tags string, extraArgs ...string) string {
+	t.Helper()
+
+	builds.Lock()
+	defer builds.Unlock()
 
-	// Get the project root (two levels up from test/harness)
-	projectRoot := filepath.Join(h.tempDir, "..", "..", "..")
+	if path, ok := builds.paths[name]; ok {
+		return path
+	}
+
+	if builds.dir == "" {
+		dir, err := os.MkdirTemp("", "itch-setup-test-builds-*")
+		if err != nil {
+			t.Fatalf("Failed to create builds dir: %v", err)
+		}
+		builds.dir = dir
+	}
+
+	path := filepath.Join(builds.dir, name)
+	build(t, path, tags, extraArgs...)
+	builds.paths[name] = path
+	return path
+}
+
+// CleanupBuilds removes every itch-setup built by the harness. It's
+// meant to be called from TestMain, once all tests have run.
+func CleanupBuilds() {
+	builds.Lock()
+	defer builds.Unlock()
+
+	if builds.dir != "" {
+		os.RemoveAll(builds.dir)
+	}
+	builds.dir = ""
+	builds.paths = map[string]string{}
+}
+
+// findProjectRoot walks up from the working directory to find go.mod
+func findProjectRoot(t *testing.T) string {
+	t.Helper()
 
-	// Use a simpler approach - find the project root from the current test
-	// The test is run from the project root
 	cwd, err := os.Getwd()
 	if err != nil {
-		h.t.Fatalf("Failed to get working directory: %v", err)
+		t.Fatalf("Failed to get working directory: %v", err)
 	}
 
-	// Walk up to find go.mod
-	projectRoot = cwd
+	projectRoot := cwd
 	for {
 		if _, err := os.Stat(filepath.Join(projectRoot, "go.mod")); err == nil {
-			break
+			return projectRoot
 		}
 		parent := filepath.Dir(projectRoot)
 		if parent == projectRoot {
-			h.t.Fatalf("Could not find project root (go.mod)")
+			t.Fatalf("Could not find project root (go.mod)")
 		}
 		projectRoot = parent
 	}
+}
+
+func build(t *testing.T, dest string, tags string, extraArgs ...string) {
+	t.Helper()
 
-	h.binaryPath = filepath.Join(h.tempDir, "itch-setup")
 	goCache := filepath.Join(os.TempDir(), "itch-setup-go-cache")
 
-	// Build the binary without GTK to keep integration test builds fast.
-	cmd := exec.Command("go", "build", "-tags", "nogtk", "-o", h.binaryPath, ".")
-	cmd.Dir = projectRoot
+	args := []string{"build", "-tags", tags, "-o", dest}
+	args = append(args, extraArgs...)
+	cmd := exec.Command("go", append(args, ".")...)
+	cmd.Dir = findProjectRoot(t)
 	cmd.Env = append(os.Environ(),
 		"CGO_ENABLED=0",
 		fmt.Sprintf("GOCACHE=%s", goCache),
@@ -93,7 +174,7 @@ func (h *Harness) buildBinary() {
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		h.t.Fatalf("Failed to build binary: %v\nOutput: %s", err, output)
+		t.Fatalf("Failed to build binary: %v\nOutput: %s", err, output)
 	}
 }
 
@@ -123,15 +204,50 @@ func (h *Harness) Run(args ...string) *Result {
 // Always injects --silent to avoid GTK initialization in tests.
 func (h *Harness) RunWithEnv(extraEnv map[string]string, args ...string) *Result {
 	h.t.Helper()
+	return h.run(extraEnv, nil, nil, nil, args...)
+}
+
+// RunWithStdin executes itch-setup with stdin read from the given reader,
+// to send it commands. It returns once itch-setup has exited and stdin
+// has been closed.
+func (h *Harness) RunWithStdin(stdin io.Reader, args ...string) *Result {
+	h.t.Helper()
+	return h.run(nil, stdin, nil, nil, args...)
+}
+
+// RunUntil executes itch-setup, and kills it (with SIGKILL, so it can't
+// clean up after itself) as soon as stop returns true. stop is checked
+// every few milliseconds while itch-setup runs.
+func (h *Harness) RunUntil(stop func() bool, args ...string) *Result {
+	h.t.Helper()
+	return h.run(nil, nil, stop, nil, args...)
+}
+
+// RunOnMessage executes itch-setup, and calls onMessage with every JSON
+// message it prints, as soon as it's printed, so tests can act on them
+// while it runs, like the itch app does.
+func (h *Harness) RunOnMessage(onMessage func(Message), args ...string) *Result {
+	h.t.Helper()
+	return h.run(nil, nil, nil, onMessage, args...)
+}
+
+func (h *Harness) run(extraEnv map[string]string, stdin io.Reader, stop func() bool, onMessage func(Message), args ...string) *Result {
+	h.t.Helper()
 
 	// Always run in silent mode to avoid GTK dependency
 	fullArgs := append([]string{"--silent"}, args...)
+
+	// Don't spend ages retrying unavailable servers, unless a test cares
+	if !containsArg(args, "--retry-delay") {
+		fullArgs = append([]string{"--retry-delay", "10ms"}, fullArgs...)
+	}
 	cmd := exec.Command(h.binaryPath, fullArgs...)
 
 	// Set up environment
 	env := []string{
 		fmt.Sprintf("HOME=%s", h.tempDir),
 		fmt.Sprintf("ITCH_BROTH_URL=%s", h.server.URL()),
+		fmt.Sprintf("ITCH_SETUP_RELEASE_KEY=%s", ReleasePublicKey()),
 		"DISPLAY=:0", // Required for GTK even in silent mode
 	}
 
@@ -151,14 +267,45 @@ func (h *Harness) RunWithEnv(extraEnv map[string]string, args ...string) *Result
 	cmd.Env = env
 
 	var stdout, stderr bytes.Buffer
+	cmd.Stdin = stdin
 	cmd.Stdout = &stdout
+	if onMessage != nil {
+		cmd.Stdout = &messageWriter{w: &stdout, onMessage: onMessage}
+	}
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	killed := false
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+
+		if stop == nil {
+			err = <-done
+		} else {
+			ticker := time.NewTicker(5 * time.Millisecond)
+		poll:
+			for {
+				select {
+				case err = <-done:
+					break poll
+				case <-ticker.C:
+					if !killed && stop() {
+						killed = true
+						cmd.Process.Kill()
+					}
+				}
+			}
+			ticker.Stop()
+		}
+	}
 
 	result := &Result{
 		Stdout: stdout.String(),
 		Stderr: stderr.String(),
+		Killed: killed,
 	}
 
 	if err != nil {
@@ -176,6 +323,38 @@ func (h *Harness) RunWithEnv(extraEnv map[string]string, args ...string) *Result
 	return result
 }
 
+// messageWriter passes everything to w, and every JSON message in it, line
+// by line, to onMessage.
+type messageWriter struct {
+	w         io.Writer
+	onMessage func(Message)
+	line      []byte
+}
+
+func (mw *messageWriter) Write(p []byte) (int, error) {
+	mw.line = append(mw.line, p...)
+	for {
+		i := bytes.IndexByte(mw.line, '\n')
+		if i < 0 {
+			break
+		}
+		if msg, ok := ParseMessage(string(mw.line[:i])); ok {
+			mw.onMessage(msg)
+		}
+		mw.line = mw.line[i+1:]
+	}
+	return mw.w.Write(p)
+}
+
+func containsArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg || strings.HasPrefix(a, arg+"=") {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseMessages extracts JSON messages from stdout
 func ParseMessages(stdout string) []Message {
 	var messages []Message
@@ -3,61 +3,45 @@ package harness
 import (
 	"encoding/json"
 	"strings"
+
+	"github.com/itchio/itch-setup/protocol"
 )
 
 // MessageType represents the type of JSON message emitted by itch-setup
 type MessageType string
 
 const (
-	TypeNoUpdateAvailable MessageType = "no-update-available"
-	TypeInstallingUpdate  MessageType = "installing-update"
-	TypeProgress          MessageType = "progress"
-	TypeUpdateReady       MessageType = "update-ready"
-	TypeUpdateFailed      MessageType = "update-failed"
-	TypeReadyToRelaunch   MessageType = "ready-to-relaunch"
-	TypeLog               MessageType = "log"
+	TypeHello              MessageType = protocol.TypeHello
+	TypeNoUpdateAvailable  MessageType = protocol.TypeNoUpdateAvailable
+	TypeUpdateHeldBack     MessageType = protocol.TypeUpdateHeldBack
+	TypeInstallingUpdate   MessageType = protocol.TypeInstallingUpdate
+	TypeProgress           MessageType = protocol.TypeProgress
+	TypeUpdateReady        MessageType = protocol.TypeUpdateReady
+	TypeUpdateFailed       MessageType = protocol.TypeUpdateFailed
+	TypeUpdateCancelled    MessageType = protocol.TypeUpdateCancelled
+	TypeNextCheckScheduled MessageType = protocol.TypeNextCheckScheduled
+	TypeRetrying           MessageType = protocol.TypeRetrying
+	TypeReadyToRelaunch    MessageType = protocol.TypeReadyToRelaunch
+	TypeLog                MessageType = protocol.TypeLog
+	TypeInfo               MessageType = protocol.TypeInfo
+	TypePhaseStarted       MessageType = protocol.TypePhaseStarted
+	TypeFileRemoved        MessageType = protocol.TypeFileRemoved
+	TypeShortcutCreated    MessageType = protocol.TypeShortcutCreated
+	TypeLaunchStarted      MessageType = protocol.TypeLaunchStarted
+	TypeSelfUpdated        MessageType = protocol.TypeSelfUpdated
+	TypeDoctorIssue        MessageType = protocol.TypeDoctorIssue
+	TypeDone               MessageType = protocol.TypeDone
+	TypeFailed             MessageType = protocol.TypeFailed
+	TypeError              MessageType = protocol.TypeError
 )
 
-// Message represents a parsed JSON message from itch-setup stdout
+// Message represents a parsed JSON message from itch-setup stdout.
+// Payloads are the types from the protocol package.
 type Message struct {
 	Type    MessageType     `json:"type"`
 	Payload json.RawMessage `json:"payload"`
 }
 
-// NoUpdateAvailablePayload is empty
-type NoUpdateAvailablePayload struct{}
-
-// InstallingUpdatePayload contains the version being installed
-type InstallingUpdatePayload struct {
-	Version string `json:"version"`
-}
-
-// ProgressPayload contains download/install progress
-type ProgressPayload struct {
-	Progress float64 `json:"progress"`
-	BPS      float64 `json:"bps"`
-	ETA      float64 `json:"eta"`
-}
-
-// UpdateReadyPayload contains the version that's ready
-type UpdateReadyPayload struct {
-	Version string `json:"version"`
-}
-
-// UpdateFailedPayload contains the error message
-type UpdateFailedPayload struct {
-	Message string `json:"message"`
-}
-
-// ReadyToRelaunchPayload is empty
-type ReadyToRelaunchPayload struct{}
-
-// LogPayload contains log messages
-type LogPayload struct {
-	Level   string `json:"level"`
-	Message string `json:"message"`
-}
-
 // ParseMessage parses a single line of JSON output
 func ParseMessage(line string) (Message, bool) {
 	line = strings.TrimSpace(line)
@@ -65,72 +49,124 @@ func ParseMessage(line string) (Message, bool) {
 		return Message{}, false
 	}
 
-	var msg Message
-	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+	msg, ok := protocol.ParseMessage(line)
+	if !ok {
 		return Message{}, false
 	}
 
-	return msg, true
+	return Message{Type: MessageType(msg.Type), Payload: msg.Payload}, true
 }
 
-// GetInstallingUpdatePayload extracts the payload for installing-update messages
-func (m Message) GetInstallingUpdatePayload() (*InstallingUpdatePayload, bool) {
-	if m.Type != TypeInstallingUpdate {
+// decodePayload unmarshals the payload of m, if it's of type t
+func decodePayload[P any](m Message, t MessageType) (*P, bool) {
+	if m.Type != t {
 		return nil, false
 	}
-	var p InstallingUpdatePayload
+	var p P
 	if err := json.Unmarshal(m.Payload, &p); err != nil {
 		return nil, false
 	}
 	return &p, true
 }
 
+// GetHelloPayload extracts the payload for hello messages
+func (m Message) GetHelloPayload() (*protocol.Hello, bool) {
+	return decodePayload[protocol.Hello](m, TypeHello)
+}
+
+// GetInstallingUpdatePayload extracts the payload for installing-update messages
+func (m Message) GetInstallingUpdatePayload() (*protocol.InstallingUpdate, bool) {
+	return decodePayload[protocol.InstallingUpdate](m, TypeInstallingUpdate)
+}
+
 // GetProgressPayload extracts the payload for progress messages
-func (m Message) GetProgressPayload() (*ProgressPayload, bool) {
-	if m.Type != TypeProgress {
-		return nil, false
-	}
-	var p ProgressPayload
-	if err := json.Unmarshal(m.Payload, &p); err != nil {
-		return nil, false
-	}
-	return &p, true
+func (m Message) GetProgressPayload() (*protocol.Progress, bool) {
+	return decodePayload[protocol.Progress](m, TypeProgress)
+}
+
+// GetNoUpdateAvailablePayload extracts the payload for no-update-available messages
+func (m Message) GetNoUpdateAvailablePayload() (*protocol.NoUpdateAvailable, bool) {
+	return decodePayload[protocol.NoUpdateAvailable](m, TypeNoUpdateAvailable)
+}
+
+// GetUpdateHeldBackPayload extracts the payload for update-held-back messages
+func (m Message) GetUpdateHeldBackPayload() (*protocol.UpdateHeldBack, bool) {
+	return decodePayload[protocol.UpdateHeldBack](m, TypeUpdateHeldBack)
+}
+
+// GetPhaseStartedPayload extracts the payload for phase-started messages
+func (m Message) GetPhaseStartedPayload() (*protocol.PhaseStarted, bool) {
+	return decodePayload[protocol.PhaseStarted](m, TypePhaseStarted)
+}
+
+// GetFileRemovedPayload extracts the payload for file-removed messages
+func (m Message) GetFileRemovedPayload() (*protocol.FileRemoved, bool) {
+	return decodePayload[protocol.FileRemoved](m, TypeFileRemoved)
+}
+
+// GetShortcutCreatedPayload extracts the payload for shortcut-created messages
+func (m Message) GetShortcutCreatedPayload() (*protocol.ShortcutCreated, bool) {
+	return decodePayload[protocol.ShortcutCreated](m, TypeShortcutCreated)
+}
+
+// GetLaunchStartedPayload extracts the payload for launch-started messages
+func (m Message) GetLaunchStartedPayload() (*protocol.LaunchStarted, bool) {
+	return decodePayload[protocol.LaunchStarted](m, TypeLaunchStarted)
+}
+
+// GetSelfUpdatedPayload extracts the payload for self-updated messages
+func (m Message) GetSelfUpdatedPayload() (*protocol.SelfUpdated, bool) {
+	return decodePayload[protocol.SelfUpdated](m, TypeSelfUpdated)
+}
+
+// GetDoctorIssuePayload extracts the payload for doctor-issue messages
+func (m Message) GetDoctorIssuePayload() (*protocol.DoctorIssue, bool) {
+	return decodePayload[protocol.DoctorIssue](m, TypeDoctorIssue)
+}
+
+// GetFailedPayload extracts the payload for failed messages
+func (m Message) GetFailedPayload() (*protocol.Failed, bool) {
+	return decodePayload[protocol.Failed](m, TypeFailed)
+}
+
+// GetErrorPayload extracts the payload for error messages
+func (m Message) GetErrorPayload() (*protocol.Error, bool) {
+	return decodePayload[protocol.Error](m, TypeError)
 }
 
 // GetUpdateReadyPayload extracts the payload for update-ready messages
-func (m Message) GetUpdateReadyPayload() (*UpdateReadyPayload, bool) {
-	if m.Type != TypeUpdateReady {
-		return nil, false
-	}
-	var p UpdateReadyPayload
-	if err := json.Unmarshal(m.Payload, &p); err != nil {
-		return nil, false
-	}
-	return &p, true
+func (m Message) GetUpdateReadyPayload() (*protocol.UpdateReady, bool) {
+	return decodePayload[protocol.UpdateReady](m, TypeUpdateReady)
 }
 
 // GetUpdateFailedPayload extracts the payload for update-failed messages
-func (m Message) GetUpdateFailedPayload() (*UpdateFailedPayload, bool) {
-	if m.Type != TypeUpdateFailed {
-		return nil, false
-	}
-	var p UpdateFailedPayload
-	if err := json.Unmarshal(m.Payload, &p); err != nil {
-		return nil, false
-	}
-	return &p, true
+func (m Message) GetUpdateFailedPayload() (*protocol.UpdateFailed, bool) {
+	return decodePayload[protocol.UpdateFailed](m, TypeUpdateFailed)
+}
+
+// GetUpdateCancelledPayload extracts the payload for update-cancelled messages
+func (m Message) GetUpdateCancelledPayload() (*protocol.UpdateCancelled, bool) {
+	return decodePayload[protocol.UpdateCancelled](m, TypeUpdateCancelled)
+}
+
+// GetNextCheckScheduledPayload extracts the payload for next-check-scheduled messages
+func (m Message) GetNextCheckScheduledPayload() (*protocol.NextCheckScheduled, bool) {
+	return decodePayload[protocol.NextCheckScheduled](m, TypeNextCheckScheduled)
+}
+
+// GetRetryingPayload extracts the payload for retrying messages
+func (m Message) GetRetryingPayload() (*protocol.Retrying, bool) {
+	return decodePayload[protocol.Retrying](m, TypeRetrying)
+}
+
+// GetInfoPayload extracts the payload for info messages
+func (m Message) GetInfoPayload() (*protocol.Info, bool) {
+	return decodePayload[protocol.Info](m, TypeInfo)
 }
 
 // GetLogPayload extracts the payload for log messages
-func (m Message) GetLogPayload() (*LogPayload, bool) {
-	if m.Type != TypeLog {
-		return nil, false
-	}
-	var p LogPayload
-	if err := json.Unmarshal(m.Payload, &p); err != nil {
-		return nil, false
-	}
-	return &p, true
+func (m Message) GetLogPayload() (*protocol.Log, bool) {
+	return decodePayload[protocol.Log](m, TypeLog)
 }
 
 // HasMessageType checks if the result contains a message of the given type
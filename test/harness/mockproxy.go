@@ -0,0 +1,114 @@
+package harness
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// MockProxy is a forward HTTP proxy that wants basic auth, for testing
+// --proxy. It only proxies plain HTTP, which is all the mock server speaks.
+type MockProxy struct {
+	t        *testing.T
+	server   *httptest.Server
+	user     string
+	password string
+
+	lock     sync.Mutex
+	requests []string
+	rejected int
+}
+
+// NewMockProxy starts a proxy that only lets user:password through
+func NewMockProxy(t *testing.T, user, password string) *MockProxy {
+	t.Helper()
+
+	mp := &MockProxy{
+		t:        t,
+		user:     user,
+		password: password,
+	}
+	mp.server = httptest.NewServer(http.HandlerFunc(mp.handleRequest))
+	return mp
+}
+
+// URL returns the proxy's URL, with the credentials it wants
+func (mp *MockProxy) URL() string {
+	return mp.URLWithCredentials(mp.user, mp.password)
+}
+
+// URLWithCredentials returns the proxy's URL, with arbitrary credentials
+func (mp *MockProxy) URLWithCredentials(user, password string) string {
+	u, _ := url.Parse(mp.server.URL)
+	u.User = url.UserPassword(user, password)
+	return u.String()
+}
+
+// Requests returns the URLs of the requests the proxy forwarded so far
+func (mp *MockProxy) Requests() []string {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+	return append([]string(nil), mp.requests...)
+}
+
+// Rejected returns how many requests had the wrong credentials
+func (mp *MockProxy) Rejected() int {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+	return mp.rejected
+}
+
+// Close shuts down the proxy
+func (mp *MockProxy) Close() {
+	mp.server.Close()
+}
+
+func (mp *MockProxy) handleRequest(w http.ResponseWriter, r *http.Request) {
+	mp.t.Logf("Mock proxy request: %s %s", r.Method, r.URL)
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+
+	// r.BasicAuth reads Authorization, we want Proxy-Authorization
+	authReq := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+	user, password, ok := authReq.BasicAuth()
+	if !ok || user != mp.user || password != mp.password {
+		mp.lock.Lock()
+		mp.rejected++
+		mp.lock.Unlock()
+
+		w.Header().Set("Proxy-Authenticate", `Basic realm="mock"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	mp.lock.Lock()
+	mp.requests = append(mp.requests, r.URL.String())
+	mp.lock.Unlock()
+
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+	outReq.Header.Del("Proxy-Authorization")
+	// so the mock server can tell what came through us
+	outReq.Header.Set("Via", "1.1 mockproxy")
+
+	res, err := http.DefaultTransport.RoundTrip(outReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	for k, vs := range res.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
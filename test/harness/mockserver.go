@@ -3,29 +3,90 @@ package harness
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // MockServer simulates broth.itch.zone for testing
 type MockServer struct {
 	t         *testing.T
 	server    *httptest.Server
-	latestVer map[string]string        // channel -> version
-	builds    map[string]*MockBuild    // "channel/version" -> build info
-	archives  map[string][]byte        // "channel/version" -> zip data
+	tlsServer *httptest.Server            // see StartTLS
+	cdnServer *httptest.Server            // see StartCDN
+	latestVer map[string]string           // channel -> version
+	builds    map[string]*MockBuild       // "channel/version" -> build info
+	archives  map[string][]byte           // "channel/version" -> zip data
+	sigs      map[string][]byte           // "channel/version" -> signature data
+	patches   map[string][]byte           // "channel/version" -> patch data
+	upgrades  map[string]*MockUpgradePath // "channel/from/to" -> upgrade path
+	failWith  int                         // if non-zero, every request gets this status
+	stalled   chan string                 // if non-nil, every request hangs, see StallRequests
+	stallAt   int64                       // if non-zero, artifacts hang at that offset, see StallArtifactsAfter
+	dropping  bool                        // if set, artifacts are cut short, see DropArtifacts
+	release   string                      // release channel the setters apply to, see OnReleaseChannel
 	mux       *http.ServeMux
+
+	notModifiedLock *sync.Mutex
+	notModified     *[]string // paths answered with 304, see NotModifiedRequests
+
+	requestsLock *sync.Mutex
+	requests     *[]MockRequest // every request received, see Requests
+
+	failNext *mockFailures // see FailNextRequests
+
+	releaseManifests  map[string][]byte   // "app/channel/version" -> release manifest, see SetReleaseManifest
+	releaseSigningKey *ed25519.PrivateKey // see SignReleaseManifestsWith
+}
+
+// mockFailures is a number of requests to fail, and how
+type mockFailures struct {
+	lock       sync.Mutex
+	count      int
+	status     int
+	retryAfter string
+}
+
+// take returns how the current request should fail, if it should
+func (mf *mockFailures) take() (status int, retryAfter string, ok bool) {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	if mf.count == 0 {
+		return 0, "", false
+	}
+	mf.count--
+	return mf.status, mf.retryAfter, true
+}
+
+// MockRequest is a request the server received, see Requests
+type MockRequest struct {
+	Method string
+	Path   string
+	// Range is the Range header, if any
+	Range string
+	// Via is the Via header, set by proxies like MockProxy
+	Via string
 }
 
 // MockBuild represents build info returned by the /info endpoint
 type MockBuild struct {
-	Version string          `json:"version"`
-	Files   []MockBuildFile `json:"files"`
+	Version           string          `json:"version"`
+	Files             []MockBuildFile `json:"files"`
+	RolloutPercentage *float64        `json:"rolloutPercentage,omitempty"`
 }
 
 // MockBuildFile represents a file in the build
@@ -35,16 +96,48 @@ type MockBuildFile struct {
 	Size    int64  `json:"size"`
 }
 
+// MockUpgradePath represents the patches returned by the /upgrade-paths endpoint
+type MockUpgradePath struct {
+	Patches []MockPatch `json:"patches"`
+}
+
+// MockPatch represents a patch along an upgrade path
+type MockPatch struct {
+	Version string          `json:"version"`
+	Files   []MockPatchFile `json:"files"`
+}
+
+// MockPatchFile represents a file of a patch
+type MockPatchFile struct {
+	SubType string `json:"subType"`
+	Size    int64  `json:"size"`
+}
+
 // NewMockServer creates a new mock broth server
 func NewMockServer(t *testing.T) *MockServer {
 	t.Helper()
 
+	signingKey := releaseKey
 	ms := &MockServer{
 		t:         t,
 		latestVer: make(map[string]string),
 		builds:    make(map[string]*MockBuild),
 		archives:  make(map[string][]byte),
+		sigs:      make(map[string][]byte),
+		patches:   make(map[string][]byte),
+		upgrades:  make(map[string]*MockUpgradePath),
 		mux:       http.NewServeMux(),
+
+		notModifiedLock: new(sync.Mutex),
+		notModified:     new([]string),
+
+		requestsLock: new(sync.Mutex),
+		requests:     new([]MockRequest),
+
+		failNext: &mockFailures{},
+
+		releaseManifests:  make(map[string][]byte),
+		releaseSigningKey: &signingKey,
 	}
 
 	ms.mux.HandleFunc("/", ms.handleRequest)
@@ -61,6 +154,45 @@ func (ms *MockServer) URL() string {
 // Close shuts down the mock server
 func (ms *MockServer) Close() {
 	ms.server.Close()
+	if ms.tlsServer != nil {
+		ms.tlsServer.Close()
+	}
+	if ms.cdnServer != nil {
+		ms.cdnServer.Close()
+	}
+}
+
+// StartTLS also serves the same packages over HTTPS, with a self-signed
+// certificate, and returns the HTTPS URL. See CertificatePEM and
+// PublicKeyPin to get itch-setup to trust it.
+func (ms *MockServer) StartTLS() string {
+	if ms.tlsServer == nil {
+		ms.tlsServer = httptest.NewTLSServer(ms.mux)
+	}
+	return ms.tlsServer.URL
+}
+
+// CertificatePEM returns the certificate of the HTTPS server, see
+// StartTLS, and of the CDN, if any, see StartCDN
+func (ms *MockServer) CertificatePEM() []byte {
+	res := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ms.tlsServer.Certificate().Raw,
+	})
+	if ms.cdnServer != nil {
+		res = append(res, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: ms.cdnServer.Certificate().Raw,
+		})...)
+	}
+	return res
+}
+
+// PublicKeyPin returns the pin of the HTTPS server's public key, in the
+// format --pin-public-key takes
+func (ms *MockServer) PublicKeyPin() string {
+	hash := sha256.Sum256(ms.tlsServer.Certificate().RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
 }
 
 // channelName returns the channel name for the current platform
@@ -70,16 +202,49 @@ func channelName() string {
 	return fmt.Sprintf("%s-%s", os, arch)
 }
 
+// OnReleaseChannel returns a view of the server whose setters apply to
+// a release channel, like `beta` (served as `<os>-<arch>-beta`)
+func (ms *MockServer) OnReleaseChannel(release string) *MockServer {
+	view := *ms
+	view.release = release
+	return &view
+}
+
+// channelName returns the channel the setters apply to
+func (ms *MockServer) channelName() string {
+	if ms.release == "" {
+		return channelName()
+	}
+	return fmt.Sprintf("%s-%s", channelName(), ms.release)
+}
+
+// SetFailWith makes the server answer every request with the given
+// HTTP status, to simulate a broken mirror. Zero restores normal behavior.
+func (ms *MockServer) SetFailWith(status int) {
+	ms.failWith = status
+}
+
+// FailNextRequests makes the server answer the next count requests with
+// the given HTTP status, to simulate a transient failure. retryAfter, if
+// not empty, is sent as the Retry-After header.
+func (ms *MockServer) FailNextRequests(count int, status int, retryAfter string) {
+	ms.failNext.lock.Lock()
+	defer ms.failNext.lock.Unlock()
+	ms.failNext.count = count
+	ms.failNext.status = status
+	ms.failNext.retryAfter = retryAfter
+}
+
 // SetLatestVersion sets the latest version for an app's channel
 func (ms *MockServer) SetLatestVersion(appName, version string) {
-	channel := channelName()
+	channel := ms.channelName()
 	key := fmt.Sprintf("%s/%s", appName, channel)
 	ms.latestVer[key] = version
 }
 
 // SetBuildInfo sets the build info for a specific version
 func (ms *MockServer) SetBuildInfo(appName, version string, archiveSize int64) {
-	channel := channelName()
+	channel := ms.channelName()
 	key := fmt.Sprintf("%s/%s/%s", appName, channel, version)
 	ms.builds[key] = &MockBuild{
 		Version: version,
@@ -93,26 +258,194 @@ func (ms *MockServer) SetBuildInfo(appName, version string, archiveSize int64) {
 	}
 }
 
+// SetRolloutPercentage makes a version (whose build info must be set)
+// only rolled out to some installs
+func (ms *MockServer) SetRolloutPercentage(appName, version string, percentage float64) {
+	channel := ms.channelName()
+	key := fmt.Sprintf("%s/%s/%s", appName, channel, version)
+	ms.builds[key].RolloutPercentage = &percentage
+}
+
 // SetArchive sets the archive data for a specific version
 func (ms *MockServer) SetArchive(appName, version string, data []byte) {
-	channel := channelName()
+	channel := ms.channelName()
 	key := fmt.Sprintf("%s/%s/%s", appName, channel, version)
 	ms.archives[key] = data
 }
 
+// SetSignature sets the signature data for a specific version
+func (ms *MockServer) SetSignature(appName, version string, data []byte) {
+	channel := ms.channelName()
+	key := fmt.Sprintf("%s/%s/%s", appName, channel, version)
+	ms.sigs[key] = data
+}
+
+// SetPatch sets the default patch data for a specific version
+func (ms *MockServer) SetPatch(appName, version string, data []byte) {
+	channel := ms.channelName()
+	key := fmt.Sprintf("%s/%s/%s", appName, channel, version)
+	ms.patches[key] = data
+}
+
+// SetUpgradePath sets the upgrade path between two versions. Each version
+// along the path must have its patch set with SetPatch first.
+func (ms *MockServer) SetUpgradePath(appName, from, to string, versions ...string) {
+	channel := ms.channelName()
+	up := &MockUpgradePath{}
+	for _, v := range versions {
+		data, ok := ms.patches[fmt.Sprintf("%s/%s/%s", appName, channel, v)]
+		if !ok {
+			ms.t.Fatalf("No patch set for version %s", v)
+		}
+		up.Patches = append(up.Patches, MockPatch{
+			Version: v,
+			Files: []MockPatchFile{
+				{SubType: "default", Size: int64(len(data))},
+			},
+		})
+	}
+	key := fmt.Sprintf("%s/%s/%s/%s", appName, channel, from, to)
+	ms.upgrades[key] = up
+}
+
+// StallRequests makes the server hang on every request until the client
+// gives up, to simulate a stuck download. The path of each request that
+// hangs is sent on the returned channel (if it has room).
+func (ms *MockServer) StallRequests() <-chan string {
+	ms.stalled = make(chan string, 16)
+	return ms.stalled
+}
+
+// NotModifiedRequests returns the paths of the metadata requests that
+// were answered with 304 Not Modified so far
+func (ms *MockServer) NotModifiedRequests() []string {
+	ms.notModifiedLock.Lock()
+	defer ms.notModifiedLock.Unlock()
+	return append([]string(nil), *ms.notModified...)
+}
+
+// Requests returns every request received so far, in order
+func (ms *MockServer) Requests() []MockRequest {
+	ms.requestsLock.Lock()
+	defer ms.requestsLock.Unlock()
+	return append([]MockRequest(nil), *ms.requests...)
+}
+
+// RequestsTo returns the requests received so far whose path ends
+// with suffix
+func (ms *MockServer) RequestsTo(suffix string) []MockRequest {
+	var res []MockRequest
+	for _, r := range ms.Requests() {
+		if strings.HasSuffix(r.Path, suffix) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// serveMetadata writes body with an ETag, or 304 if the client already has it
+func (ms *MockServer) serveMetadata(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%x"`, sum[:8])
+
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		ms.notModifiedLock.Lock()
+		*ms.notModified = append(*ms.notModified, r.URL.Path)
+		ms.notModifiedLock.Unlock()
+
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// StallArtifactsAfter makes the server hang once it has sent the first
+// n bytes of signatures, archives and patches, until the client gives
+// up, to simulate a mirror that stops halfway through a download.
+// Requests for what comes after hang right away.
+func (ms *MockServer) StallArtifactsAfter(n int64) {
+	ms.stallAt = n
+}
+
+// DropArtifacts makes the server cut every signature, archive and patch
+// short right after sending its headers, to simulate a mirror that
+// accepts requests and then drops the connection every time.
+func (ms *MockServer) DropArtifacts() {
+	ms.dropping = true
+}
+
+// serveArtifact writes data like broth does: with a Content-Length,
+// and honoring Range requests
+func (ms *MockServer) serveArtifact(w http.ResponseWriter, r *http.Request, data []byte) {
+	var content io.ReadSeeker = bytes.NewReader(data)
+	if ms.dropping {
+		content = &droppingReader{Reader: bytes.NewReader(data)}
+	} else if ms.stallAt > 0 {
+		content = &stallingReader{
+			Reader:  bytes.NewReader(data),
+			stallAt: ms.stallAt,
+			w:       w,
+			ctx:     r.Context(),
+		}
+	}
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// stallingReader hangs once it gets to stallAt, after flushing what was
+// read so far to w
+type stallingReader struct {
+	*bytes.Reader
+	stallAt int64
+	w       http.ResponseWriter
+	ctx     context.Context
+}
+
+func (sr *stallingReader) Read(p []byte) (int, error) {
+	offset := sr.Size() - int64(sr.Len())
+	if offset >= sr.stallAt {
+		if f, ok := sr.w.(http.Flusher); ok {
+			f.Flush()
+		}
+		<-sr.ctx.Done()
+		return 0, sr.ctx.Err()
+	}
+	if remaining := sr.stallAt - offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	return sr.Reader.Read(p)
+}
+
+// droppingReader fails every read, so that only headers are sent
+type droppingReader struct {
+	*bytes.Reader
+}
+
+func (dr *droppingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("dropping the connection")
+}
+
 // CreateMockArchive creates a minimal zip archive with a mock executable
 func (ms *MockServer) CreateMockArchive(appName string) []byte {
+	// Write a simple shell script as the executable
+	script := fmt.Sprintf("#!/bin/sh\necho '%s mock executable'\n", appName)
+	return ms.CreateMockArchiveWithScript(appName, script)
+}
+
+// CreateMockArchiveWithScript creates an archive with a single
+// executable called name, that runs script
+func (ms *MockServer) CreateMockArchiveWithScript(name string, script string) []byte {
 	buf := new(bytes.Buffer)
 	w := zip.NewWriter(buf)
 
 	// Create mock executable
-	f, err := w.Create(appName)
+	f, err := w.Create(name)
 	if err != nil {
 		ms.t.Fatalf("Failed to create zip entry: %v", err)
 	}
 
-	// Write a simple shell script as the executable
-	script := fmt.Sprintf("#!/bin/sh\necho '%s mock executable'\n", appName)
 	if _, err := f.Write([]byte(script)); err != nil {
 		ms.t.Fatalf("Failed to write zip content: %v", err)
 	}
@@ -124,11 +457,82 @@ func (ms *MockServer) CreateMockArchive(appName string) []byte {
 	return buf.Bytes()
 }
 
+// CreateMockArchiveWithFiles creates an archive with a mock executable
+// for appName, and files stored as-is (not compressed), in name order
+func (ms *MockServer) CreateMockArchiveWithFiles(appName string, files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+
+	f, err := w.Create(appName)
+	if err != nil {
+		ms.t.Fatalf("Failed to create zip entry: %v", err)
+	}
+	if _, err := fmt.Fprintf(f, "#!/bin/sh\necho '%s mock executable'\n", appName); err != nil {
+		ms.t.Fatalf("Failed to write zip content: %v", err)
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			ms.t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			ms.t.Fatalf("Failed to write zip content: %v", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		ms.t.Fatalf("Failed to close zip: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
 func (ms *MockServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/")
 	parts := strings.Split(path, "/")
 
 	ms.t.Logf("Mock server request: %s %s", r.Method, r.URL.Path)
+	ms.requestsLock.Lock()
+	*ms.requests = append(*ms.requests, MockRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Range:  r.Header.Get("Range"),
+		Via:    r.Header.Get("Via"),
+	})
+	ms.requestsLock.Unlock()
+
+	if ms.redirectToCDN(w, r) {
+		return
+	}
+
+	if ms.failWith != 0 {
+		http.Error(w, "mock failure", ms.failWith)
+		return
+	}
+
+	if status, retryAfter, ok := ms.failNext.take(); ok {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		http.Error(w, "mock transient failure", status)
+		return
+	}
+
+	if ms.stalled != nil {
+		select {
+		case ms.stalled <- r.URL.Path:
+		default:
+		}
+		<-r.Context().Done()
+		return
+	}
 
 	if len(parts) < 2 {
 		http.Error(w, "invalid path", http.StatusBadRequest)
@@ -155,7 +559,7 @@ func (ms *MockServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
-		w.Write([]byte(version))
+		ms.serveMetadata(w, r, "text/plain", []byte(version))
 		return
 	}
 
@@ -171,8 +575,8 @@ func (ms *MockServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "not found", http.StatusNotFound)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(build)
+			body, _ := json.Marshal(build)
+			ms.serveMetadata(w, r, "application/json", body)
 			return
 		}
 
@@ -184,15 +588,58 @@ func (ms *MockServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			w.Header().Set("Content-Type", "application/zip")
-			w.Write(data)
+			ms.serveArtifact(w, r, data)
 			return
 		}
 
-		// /{app}/{channel}/{version}/signature/default - return empty signature for now
+		// /{app}/{channel}/{version}/patch/default
+		if len(parts) == 5 && parts[3] == "patch" && parts[4] == "default" {
+			data, ok := ms.patches[buildKey]
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			ms.serveArtifact(w, r, data)
+			return
+		}
+
+		// /{app}/{channel}/{from}/upgrade-paths/{to}
+		if len(parts) == 5 && parts[3] == "upgrade-paths" {
+			up, ok := ms.upgrades[fmt.Sprintf("%s/%s", buildKey, parts[4])]
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			body, _ := json.Marshal(up)
+			ms.serveMetadata(w, r, "application/json", body)
+			return
+		}
+
+		// /{app}/{channel}/{version}/release-manifest(.sig)
+		if len(parts) == 4 && (parts[3] == "release-manifest" || parts[3] == "release-manifest.sig") {
+			manifest, signature := ms.releaseManifest(appName, channel, version)
+			if manifest == nil {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			if parts[3] == "release-manifest.sig" {
+				ms.serveMetadata(w, r, "text/plain", signature)
+			} else {
+				ms.serveMetadata(w, r, "application/json", manifest)
+			}
+			return
+		}
+
+		// /{app}/{channel}/{version}/signature/default
 		if len(parts) == 5 && parts[3] == "signature" && parts[4] == "default" {
-			// Return a minimal valid signature placeholder
-			// In real tests, we might need to generate actual signatures
-			http.Error(w, "signature not implemented", http.StatusNotImplemented)
+			data, ok := ms.sigs[buildKey]
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			ms.serveArtifact(w, r, data)
 			return
 		}
 	}
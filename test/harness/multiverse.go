@@ -10,8 +10,13 @@ import (
 
 // MultiverseState represents the state.json format
 type MultiverseState struct {
-	Current string `json:"current"`
-	Ready   string `json:"ready"`
+	Current      string   `json:"current"`
+	Ready        string   `json:"ready"`
+	Previous     []string `json:"previous,omitempty"`
+	KeepPrevious *int     `json:"keepPrevious,omitempty"`
+	Channel      string   `json:"channel,omitempty"`
+	Pin          string   `json:"pin,omitempty"`
+	InstallID    string   `json:"installId,omitempty"`
 }
 
 // MultiverseSetup helps create test directory structures
@@ -46,10 +51,15 @@ func (m *MultiverseSetup) BaseDir() string {
 func (m *MultiverseSetup) SetState(current, ready string) {
 	m.t.Helper()
 
-	state := MultiverseState{
+	m.WriteState(&MultiverseState{
 		Current: current,
 		Ready:   ready,
-	}
+	})
+}
+
+// WriteState writes the state.json file from a full state
+func (m *MultiverseSetup) WriteState(state *MultiverseState) {
+	m.t.Helper()
 
 	data, err := json.Marshal(state)
 	if err != nil {
@@ -81,6 +91,24 @@ func (m *MultiverseSetup) CreateAppVersion(version string) string {
 	return appDir
 }
 
+// CreatePreviousVersion creates a mock app installation retained for rollback
+func (m *MultiverseSetup) CreatePreviousVersion(version string) string {
+	m.t.Helper()
+
+	appDir := filepath.Join(m.baseDir, "previous", fmt.Sprintf("app-%s", version))
+	if err := os.MkdirAll(appDir, 0755); err != nil {
+		m.t.Fatalf("Failed to create previous app dir: %v", err)
+	}
+
+	exePath := filepath.Join(appDir, m.appName)
+	script := fmt.Sprintf("#!/bin/sh\necho '%s version %s'\n", m.appName, version)
+	if err := os.WriteFile(exePath, []byte(script), 0755); err != nil {
+		m.t.Fatalf("Failed to write mock executable: %v", err)
+	}
+
+	return appDir
+}
+
 // CreateFullSetup creates a complete multiverse with current version installed
 func (m *MultiverseSetup) CreateFullSetup(currentVersion string) {
 	m.t.Helper()
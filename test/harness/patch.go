@@ -0,0 +1,63 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/itchio/arkive/zip"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/zippool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+)
+
+// CreateMockPatch computes a wharf patch from the contents of one zip
+// archive to those of another, as broth would serve it. It isn't
+// compressed, so offsets in it are offsets in the file.
+func (ms *MockServer) CreateMockPatch(from []byte, to []byte) []byte {
+	ms.t.Helper()
+
+	fromContainer, fromPool := ms.walkArchive(from)
+	toContainer, toPool := ms.walkArchive(to)
+
+	fromSignature, err := pwr.ComputeSignature(context.Background(), fromContainer, fromPool, &state.Consumer{})
+	if err != nil {
+		ms.t.Fatalf("Failed to compute signature: %v", err)
+	}
+
+	dctx := &pwr.DiffContext{
+		Compression: &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_NONE,
+		},
+		Consumer: &state.Consumer{},
+
+		SourceContainer: toContainer,
+		Pool:            toPool,
+
+		TargetContainer: fromContainer,
+		TargetSignature: fromSignature,
+	}
+
+	patch := new(bytes.Buffer)
+	err = dctx.WritePatch(context.Background(), patch, new(bytes.Buffer))
+	if err != nil {
+		ms.t.Fatalf("Failed to write patch: %v", err)
+	}
+	return patch.Bytes()
+}
+
+func (ms *MockServer) walkArchive(archive []byte) (*tlc.Container, *zippool.ZipPool) {
+	ms.t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		ms.t.Fatalf("Failed to open archive: %v", err)
+	}
+
+	container, err := tlc.WalkZip(zr, tlc.WalkOpts{})
+	if err != nil {
+		ms.t.Fatalf("Failed to walk archive: %v", err)
+	}
+	return container, zippool.New(container, zr)
+}
@@ -0,0 +1,111 @@
+package harness
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// releaseKey signs the release manifests of every mock server. It's the
+// same for every test, see ReleasePublicKey.
+var releaseKey = ed25519.NewKeyFromSeed(releaseKeySeed[:])
+
+var releaseKeySeed = sha256.Sum256([]byte("itch-setup test release key"))
+
+// ReleasePublicKey returns the key itch-setup is told to trust instead of
+// the real release key, in the format of ITCH_SETUP_RELEASE_KEY
+func ReleasePublicKey() string {
+	return base64.StdEncoding.EncodeToString(releaseKey.Public().(ed25519.PublicKey))
+}
+
+// MockReleaseManifest is a release manifest, as broth would sign it
+type MockReleaseManifest struct {
+	AppName   string                   `json:"appName"`
+	Channel   string                   `json:"channel"`
+	Version   string                   `json:"version"`
+	Archive   *MockReleaseManifestFile `json:"archive,omitempty"`
+	Signature *MockReleaseManifestFile `json:"signature,omitempty"`
+}
+
+// MockReleaseManifestFile describes a file in a release manifest
+type MockReleaseManifestFile struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func mockReleaseManifestFile(data []byte) *MockReleaseManifestFile {
+	if data == nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return &MockReleaseManifestFile{
+		Size:   int64(len(data)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+// CreateReleaseManifest returns the release manifest of a version with
+// the given archive and signature (either can be nil), on the channel the
+// setters apply to, and its detached signature.
+func (ms *MockServer) CreateReleaseManifest(appName, version string, archive []byte, signature []byte) ([]byte, []byte) {
+	ms.t.Helper()
+
+	manifest, err := json.Marshal(&MockReleaseManifest{
+		AppName:   appName,
+		Channel:   ms.channelName(),
+		Version:   version,
+		Archive:   mockReleaseManifestFile(archive),
+		Signature: mockReleaseManifestFile(signature),
+	})
+	if err != nil {
+		ms.t.Fatalf("Failed to marshal release manifest: %v", err)
+	}
+	return manifest, SignReleaseManifest(releaseKey, manifest)
+}
+
+// SignReleaseManifest returns the detached signature of manifest, made
+// with key
+func SignReleaseManifest(key ed25519.PrivateKey, manifest []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)) + "\n")
+}
+
+// SetReleaseManifest makes the server serve manifest (signed with the
+// release key) for a version, instead of one that matches its archive
+// and signature. A nil manifest makes it answer 404 instead, like broth
+// does for versions published before release manifests existed.
+func (ms *MockServer) SetReleaseManifest(appName, version string, manifest []byte) {
+	key := fmt.Sprintf("%s/%s/%s", appName, ms.channelName(), version)
+	ms.releaseManifests[key] = manifest
+}
+
+// SignReleaseManifestsWith makes the server sign release manifests with
+// another key than the one itch-setup trusts
+func (ms *MockServer) SignReleaseManifestsWith(key ed25519.PrivateKey) {
+	*ms.releaseSigningKey = key
+}
+
+// releaseManifest returns what the server serves for a version, and its
+// signature, or nils if it doesn't have that version
+func (ms *MockServer) releaseManifest(appName, channel, version string) ([]byte, []byte) {
+	buildKey := fmt.Sprintf("%s/%s/%s", appName, channel, version)
+	manifest, ok := ms.releaseManifests[buildKey]
+	if !ok {
+		archive := ms.archives[buildKey]
+		signature := ms.sigs[buildKey]
+		if archive == nil && signature == nil {
+			return nil, nil
+		}
+
+		manifest, _ = json.Marshal(&MockReleaseManifest{
+			AppName:   appName,
+			Channel:   channel,
+			Version:   version,
+			Archive:   mockReleaseManifestFile(archive),
+			Signature: mockReleaseManifestFile(signature),
+		})
+	}
+	return manifest, SignReleaseManifest(*ms.releaseSigningKey, manifest)
+}
@@ -0,0 +1,68 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+	"github.com/itchio/arkive/zip"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/zippool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+)
+
+// CreateMockSignature computes a wharf signature (signature.pws) for the
+// contents of a zip archive, as broth would serve it
+func (ms *MockServer) CreateMockSignature(archive []byte) []byte {
+	ms.t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		ms.t.Fatalf("Failed to open archive: %v", err)
+	}
+
+	container, err := tlc.WalkZip(zr, tlc.WalkOpts{})
+	if err != nil {
+		ms.t.Fatalf("Failed to walk archive: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	compression := &pwr.CompressionSettings{
+		Algorithm: pwr.CompressionAlgorithm_NONE,
+	}
+
+	rawSigWire := wire.NewWriteContext(buf)
+	if err := rawSigWire.WriteMagic(pwr.SignatureMagic); err != nil {
+		ms.t.Fatalf("Failed to write signature magic: %v", err)
+	}
+	if err := rawSigWire.WriteMessage(&pwr.SignatureHeader{Compression: compression}); err != nil {
+		ms.t.Fatalf("Failed to write signature header: %v", err)
+	}
+
+	sigWire, err := pwr.CompressWire(rawSigWire, compression)
+	if err != nil {
+		ms.t.Fatalf("Failed to set up signature compression: %v", err)
+	}
+	if err := sigWire.WriteMessage(container); err != nil {
+		ms.t.Fatalf("Failed to write signature container: %v", err)
+	}
+
+	pool := zippool.New(container, zr)
+	err = pwr.ComputeSignatureToWriter(context.Background(), container, pool, &state.Consumer{}, func(bh wsync.BlockHash) error {
+		return sigWire.WriteMessage(&pwr.BlockHash{
+			WeakHash:   bh.WeakHash,
+			StrongHash: bh.StrongHash,
+		})
+	})
+	if err != nil {
+		ms.t.Fatalf("Failed to compute signature: %v", err)
+	}
+
+	if err := sigWire.Close(); err != nil {
+		ms.t.Fatalf("Failed to finish signature: %v", err)
+	}
+
+	return buf.Bytes()
+}
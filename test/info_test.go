@@ -0,0 +1,63 @@
+package test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestInfo_ReportsInstallationState(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("--info only reports installation state on Linux")
+	}
+
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateWithReadyPending("1.0.0", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--info")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stdout:\n%s", result.Stdout)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	msg := result.GetFirstMessageOfType(harness.TypeInfo)
+	if msg == nil {
+		t.Fatalf("Expected info message, got messages: %v", result.Messages)
+	}
+	info, ok := msg.GetInfoPayload()
+	if !ok {
+		t.Fatalf("Could not parse info payload: %s", msg.Payload)
+	}
+
+	if info.AppName != "itch" {
+		t.Errorf("Expected app name itch, got %q", info.AppName)
+	}
+	if info.BaseDir != mv.BaseDir() {
+		t.Errorf("Expected base dir %q, got %q", mv.BaseDir(), info.BaseDir)
+	}
+	if info.Channel != runtime.GOOS+"-"+runtime.GOARCH {
+		t.Errorf("Unexpected channel %q", info.Channel)
+	}
+	if info.Current == nil || info.Current.Version != "1.0.0" || !info.Current.Exists {
+		t.Errorf("Expected existing current 1.0.0, got %+v", info.Current)
+	}
+	if info.Ready == nil || info.Ready.Version != "2.0.0" || !info.Ready.Exists {
+		t.Errorf("Expected existing ready 2.0.0, got %+v", info.Ready)
+	}
+	if len(info.State) == 0 {
+		t.Errorf("Expected state.json contents to be included")
+	}
+
+	for _, f := range info.Files {
+		if f.Exists {
+			t.Errorf("Expected %s (%s) not to exist yet", f.Kind, f.Path)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// injectedCrashExitCode is what itch-setup exits with when told to crash
+// by ITCH_SETUP_CRASH_AFTER_STEP
+const injectedCrashExitCode = 86
+
+// crashAfterStep runs itch-setup with args, expecting it to crash after
+// the given step of a version switch, with its journal left behind
+func crashAfterStep(t *testing.T, h *harness.Harness, mv *harness.MultiverseSetup, step int, args ...string) {
+	t.Helper()
+
+	result := h.RunWithEnv(map[string]string{
+		"ITCH_SETUP_CRASH_AFTER_STEP": strconv.Itoa(step),
+	}, args...)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != injectedCrashExitCode {
+		t.Fatalf("Expected to crash with exit code %d, got %d", injectedCrashExitCode, result.ExitCode)
+	}
+	if _, err := os.Stat(journalPath(mv)); err != nil {
+		t.Fatalf("Expected journal to be left behind: %v", err)
+	}
+}
+
+// recoverFromCrash checks that --info leaves whatever was interrupted
+// alone, then has --doctor --fix finish or undo it
+func recoverFromCrash(t *testing.T, h *harness.Harness, mv *harness.MultiverseSetup) {
+	t.Helper()
+
+	result := h.Run("--appname", "itch", "--info")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	msg := result.GetFirstMessageOfType(harness.TypeInfo)
+	if msg == nil {
+		t.Fatalf("Expected info message, got messages: %v", result.Messages)
+	}
+	if info, ok := msg.GetInfoPayload(); !ok || info.PendingTransition == "" {
+		t.Errorf("Expected info to report a pending transition, got %s", msg.Payload)
+	}
+	if _, err := os.Stat(journalPath(mv)); err != nil {
+		t.Fatalf("Expected --info to leave the journal alone: %v", err)
+	}
+
+	result = h.Run("--appname", "itch", "--doctor", "--fix")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	issues := doctorIssues(t, result)[protocol.DoctorIssueInterruptedTransition]
+	if len(issues) != 1 || !issues[0].Fixed {
+		t.Errorf("Expected one fixed interrupted-transition issue, got %v", issues)
+	}
+	if _, err := os.Stat(journalPath(mv)); !os.IsNotExist(err) {
+		t.Errorf("Expected journal to be gone after recovering, got %v", err)
+	}
+}
+
+func journalPath(mv *harness.MultiverseSetup) string {
+	return filepath.Join(mv.BaseDir(), "journal.json")
+}
+
+func expectExists(t *testing.T, path string) {
+	t.Helper()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected (%s) to exist: %v", path, err)
+	}
+}
+
+func expectMissing(t *testing.T, path string) {
+	t.Helper()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected (%s) not to exist, got %v", path, err)
+	}
+}
+
+func TestJournal_MakeReadyCurrentInterrupted(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("recovery is checked with --info and --doctor, which only run headless on Linux")
+	}
+
+	// journal written, current retained, state saved, journal committed,
+	// cleaned up: on Linux, the ready folder is already where current goes
+	for step := 1; step <= 5; step++ {
+		t.Run(strconv.Itoa(step), func(t *testing.T) {
+			h := harness.New(t)
+			defer h.Cleanup()
+
+			mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+			mv.CreateWithReadyPending("1.0.0", "2.0.0")
+
+			crashAfterStep(t, h, mv, step, "--appname", "itch", "--prefer-launch")
+			recoverFromCrash(t, h, mv)
+
+			state := mv.ReadState()
+			if state.Current != "2.0.0" || state.Ready != "" {
+				t.Errorf("Expected current 2.0.0 and no ready, got current %q, ready %q", state.Current, state.Ready)
+			}
+			if len(state.Previous) != 1 || state.Previous[0] != "1.0.0" {
+				t.Errorf("Expected previous to be [1.0.0], got %v", state.Previous)
+			}
+
+			expectExists(t, filepath.Join(mv.BaseDir(), "app-2.0.0", "itch"))
+			expectExists(t, filepath.Join(mv.BaseDir(), "previous", "app-1.0.0", "itch"))
+			expectMissing(t, filepath.Join(mv.BaseDir(), "app-1.0.0"))
+		})
+	}
+}
+
+func TestJournal_RollbackInterrupted(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("recovery is checked with --info and --doctor, which only run headless on Linux")
+	}
+
+	// a rollback makes the previous version ready, then makes it
+	// current (5 steps each): each is finished on its own
+	for step := 1; step <= 10; step++ {
+		t.Run(strconv.Itoa(step), func(t *testing.T) {
+			h := harness.New(t)
+			defer h.Cleanup()
+
+			mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+			mv.CreateAppVersion("2.0.0")
+			mv.CreatePreviousVersion("1.0.0")
+			mv.WriteState(&harness.MultiverseState{
+				Current:  "2.0.0",
+				Previous: []string{"1.0.0"},
+			})
+
+			crashAfterStep(t, h, mv, step, "--appname", "itch", "--rollback")
+			recoverFromCrash(t, h, mv)
+
+			state := mv.ReadState()
+			if step <= 5 {
+				if state.Current != "2.0.0" || state.Ready != "1.0.0" || len(state.Previous) != 0 {
+					t.Errorf("Expected current 2.0.0, ready 1.0.0 and nothing previous, got %+v", state)
+				}
+				expectExists(t, filepath.Join(mv.BaseDir(), "app-2.0.0", "itch"))
+				expectExists(t, filepath.Join(mv.BaseDir(), "app-1.0.0", "itch"))
+				expectMissing(t, filepath.Join(mv.BaseDir(), "previous", "app-1.0.0"))
+				return
+			}
+
+			if state.Current != "1.0.0" || state.Ready != "" {
+				t.Errorf("Expected current 1.0.0 and no ready, got current %q, ready %q", state.Current, state.Ready)
+			}
+			if len(state.Previous) != 1 || state.Previous[0] != "2.0.0" {
+				t.Errorf("Expected previous to be [2.0.0], got %v", state.Previous)
+			}
+			expectExists(t, filepath.Join(mv.BaseDir(), "app-1.0.0", "itch"))
+			expectExists(t, filepath.Join(mv.BaseDir(), "previous", "app-2.0.0", "itch"))
+			expectMissing(t, filepath.Join(mv.BaseDir(), "app-2.0.0"))
+		})
+	}
+}
+
+func TestJournal_NoPreviousInterrupted(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("recovery is checked with --info and --doctor, which only run headless on Linux")
+	}
+
+	// with no previous versions kept, current is moved aside, then
+	// deleted once the state is saved: a crash after that must not
+	// bring back a state that points at it
+	for step := 1; step <= 5; step++ {
+		t.Run(strconv.Itoa(step), func(t *testing.T) {
+			h := harness.New(t)
+			defer h.Cleanup()
+
+			keep := 0
+			mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+			mv.CreateAppVersion("1.0.0")
+			mv.CreateAppVersion("2.0.0")
+			mv.WriteState(&harness.MultiverseState{
+				Current:      "1.0.0",
+				Ready:        "2.0.0",
+				KeepPrevious: &keep,
+			})
+
+			crashAfterStep(t, h, mv, step, "--appname", "itch", "--prefer-launch")
+			recoverFromCrash(t, h, mv)
+
+			state := mv.ReadState()
+			if state.Current != "2.0.0" || state.Ready != "" || len(state.Previous) != 0 {
+				t.Errorf("Expected current 2.0.0 and nothing else, got %+v", state)
+			}
+
+			expectExists(t, filepath.Join(mv.BaseDir(), "app-2.0.0", "itch"))
+			expectMissing(t, filepath.Join(mv.BaseDir(), "app-1.0.0"))
+			expectMissing(t, filepath.Join(mv.BaseDir(), "app-1.0.0.old"))
+		})
+	}
+}
+
+func TestJournal_UnfinishableIsRolledBack(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("recovery is checked with --info and --doctor, which only run headless on Linux")
+	}
+
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	// 1.0.0 was moved aside to make room for 2.0.0, which then went
+	// missing: there's no finishing that, so 1.0.0 must be put back
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreatePreviousVersion("1.0.0")
+	mv.SetState("1.0.0", "2.0.0")
+
+	base := mv.BaseDir()
+	journal := `{
+		"operation": "make-ready-current",
+		"before": {"current": "1.0.0", "ready": "2.0.0"},
+		"after": {"current": "2.0.0", "ready": "", "previous": ["1.0.0"]},
+		"renames": [
+			{"from": "` + filepath.Join(base, "app-1.0.0") + `", "to": "` + filepath.Join(base, "previous", "app-1.0.0") + `"},
+			{"from": "` + filepath.Join(base, "app-2.0.0") + `", "to": "` + filepath.Join(base, "app-2.0.0-current") + `"}
+		]
+	}`
+	writeFile(t, journalPath(mv), []byte(journal))
+
+	recoverFromCrash(t, h, mv)
+
+	state := mv.ReadState()
+	if state.Current != "1.0.0" || state.Ready != "2.0.0" || len(state.Previous) != 0 {
+		t.Errorf("Expected the state from before, got %+v", state)
+	}
+	expectExists(t, filepath.Join(base, "app-1.0.0", "itch"))
+	expectMissing(t, filepath.Join(base, "previous", "app-1.0.0"))
+}
+
+func TestJournal_RecoveredBeforeUpgrade(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("on macOS, the ready version isn't where current goes")
+	}
+
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateWithReadyPending("1.0.0", "2.0.0")
+
+	// the switch to 2.0.0 is interrupted after retaining 1.0.0
+	crashAfterStep(t, h, mv, 2, "--appname", "itch", "--prefer-launch")
+
+	setUpRelease(h, "", "2.0.0")
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeNoUpdateAvailable) {
+		t.Errorf("Expected no-update-available once 2.0.0 is current, got messages: %v", result.Messages)
+	}
+	expectMissing(t, journalPath(mv))
+	if state := mv.ReadState(); state.Current != "2.0.0" || state.Ready != "" {
+		t.Errorf("Expected current 2.0.0 and no ready, got %+v", state)
+	}
+}
+
+func TestJournal_LeftoverMovedAside(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("recovery is checked with --info and --doctor, which only run headless on Linux")
+	}
+
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateWithReadyPending("1.0.0", "2.0.0")
+
+	// where 1.0.0 is about to be retained, from an earlier attempt that
+	// didn't clean up after itself
+	leftover := filepath.Join(mv.BaseDir(), "previous", "app-1.0.0", "leftover")
+	writeFile(t, leftover, []byte("from before"))
+
+	// interrupted once it's been moved aside, before it's deleted
+	crashAfterStep(t, h, mv, 2, "--appname", "itch", "--prefer-launch")
+	expectExists(t, filepath.Join(mv.BaseDir(), "previous", "app-1.0.0.stale", "leftover"))
+
+	recoverFromCrash(t, h, mv)
+
+	state := mv.ReadState()
+	if state.Current != "2.0.0" || len(state.Previous) != 1 || state.Previous[0] != "1.0.0" {
+		t.Errorf("Expected current 2.0.0 and previous [1.0.0], got %+v", state)
+	}
+	expectExists(t, filepath.Join(mv.BaseDir(), "previous", "app-1.0.0", "itch"))
+	expectMissing(t, leftover)
+	expectMissing(t, filepath.Join(mv.BaseDir(), "previous", "app-1.0.0.stale"))
+}
@@ -0,0 +1,205 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// phasesOf returns the phases of all phase-started messages, in order
+func phasesOf(result *harness.Result) []string {
+	var phases []string
+	for _, msg := range result.GetAllMessagesOfType(harness.TypePhaseStarted) {
+		if p, ok := msg.GetPhaseStartedPayload(); ok {
+			phases = append(phases, p.Phase)
+		}
+	}
+	return phases
+}
+
+func lastMessageType(result *harness.Result) harness.MessageType {
+	if len(result.Messages) == 0 {
+		return ""
+	}
+	return result.Messages[len(result.Messages)-1].Type
+}
+
+func TestJSON_Install(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--json")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	phases := phasesOf(result)
+	expected := []string{"warm-up", "install", "integrate"}
+	if len(phases) != len(expected) {
+		t.Fatalf("Expected phases %v, got %v", expected, phases)
+	}
+	for i := range expected {
+		if phases[i] != expected[i] {
+			t.Errorf("Expected phases %v, got %v", expected, phases)
+			break
+		}
+	}
+
+	progress := result.GetFirstMessageOfType(harness.TypeProgress)
+	if progress == nil {
+		t.Errorf("Expected progress message, got messages: %v", result.Messages)
+	} else if p, ok := progress.GetProgressPayload(); !ok || p.TotalBytes <= 0 {
+		t.Errorf("Expected progress to have total bytes, got %+v", p)
+	}
+
+	desktopFile := filepath.Join(h.TempDir(), ".local", "share", "applications", "io.itch.itch.desktop")
+	foundDesktopFile := false
+	for _, msg := range result.GetAllMessagesOfType(harness.TypeShortcutCreated) {
+		p, _ := msg.GetShortcutCreatedPayload()
+		if p != nil && p.Kind == "desktop-file" && p.Path == desktopFile {
+			foundDesktopFile = true
+		}
+	}
+	if !foundDesktopFile {
+		t.Errorf("Expected shortcut-created message for (%s), got messages: %v", desktopFile, result.Messages)
+	}
+
+	if lastMessageType(result) != harness.TypeDone {
+		t.Errorf("Expected last message to be done, got %q", lastMessageType(result))
+	}
+}
+
+func TestJSON_Uninstall(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+	// an upgrade that didn't finish
+	mv.WriteCheckpoint("2.0.0")
+
+	result := h.Run("--appname", "itch", "--uninstall", "--json")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	phases := phasesOf(result)
+	if len(phases) != 1 || phases[0] != "uninstall" {
+		t.Errorf("Expected phases [uninstall], got %v", phases)
+	}
+
+	removed := map[string]bool{}
+	for _, msg := range result.GetAllMessagesOfType(harness.TypeFileRemoved) {
+		if p, ok := msg.GetFileRemovedPayload(); ok {
+			removed[p.Path] = true
+		}
+	}
+	for _, path := range []string{
+		filepath.Join(mv.BaseDir(), "state.json"),
+		filepath.Join(mv.BaseDir(), "app-1.0.0"),
+		mv.StagingDir(),
+	} {
+		if !removed[path] {
+			t.Errorf("Expected file-removed message for (%s), got messages: %v", path, result.Messages)
+		}
+	}
+	if _, err := os.Stat(mv.StagingDir()); !os.IsNotExist(err) {
+		t.Errorf("Expected staging folder to be gone, got %v", err)
+	}
+
+	if lastMessageType(result) != harness.TypeDone {
+		t.Errorf("Expected last message to be done, got %q", lastMessageType(result))
+	}
+}
+
+func TestJSON_PreferLaunch(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	result := h.Run("--appname", "itch", "--prefer-launch", "--json")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	msg := result.GetFirstMessageOfType(harness.TypeLaunchStarted)
+	if msg == nil {
+		t.Fatalf("Expected launch-started message, got messages: %v", result.Messages)
+	}
+	payload, ok := msg.GetLaunchStartedPayload()
+	if !ok || payload.Version != "1.0.0" {
+		t.Errorf("Expected launch-started for 1.0.0, got %+v", payload)
+	}
+
+	if lastMessageType(result) != harness.TypeDone {
+		t.Errorf("Expected last message to be done, got %q", lastMessageType(result))
+	}
+}
+
+func TestJSON_UpgradeNotInstalled(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--json")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Fatalf("Expected non-zero exit code")
+	}
+
+	msg := result.GetFirstMessageOfType(harness.TypeFailed)
+	if msg == nil {
+		t.Fatalf("Expected failed message, got messages: %v", result.Messages)
+	}
+	payload, ok := msg.GetFailedPayload()
+	if !ok {
+		t.Fatalf("Could not parse failed payload")
+	}
+	if payload.Code != "not-installed" {
+		t.Errorf("Expected code not-installed, got %q (%s)", payload.Code, payload.Message)
+	}
+}
+
+func TestUpgrade_WithoutJSONFlag_NoDone(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	// the app parses --upgrade's output without --json: only messages
+	// from the upgrade itself show up
+	if result.HasMessageType(harness.TypeDone) {
+		t.Errorf("Expected no done message without --json, got messages: %v", result.Messages)
+	}
+}
@@ -0,0 +1,14 @@
+package test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	harness.CleanupBuilds()
+	os.Exit(code)
+}
@@ -0,0 +1,280 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestInstall_Pin(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	setUpRelease(h, "", "1.0.0")
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--pin", "1.0.0")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	state := mv.ReadState()
+	if state.Current != "1.0.0" {
+		t.Errorf("Expected current to be 1.0.0, got %q", state.Current)
+	}
+	if state.Pin != "1.0.0" {
+		t.Errorf("Expected pin to be remembered as 1.0.0, got %q", state.Pin)
+	}
+}
+
+func TestUpgrade_Pinned_NoUpdate(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateAppVersion("1.0.0")
+	mv.WriteState(&harness.MultiverseState{
+		Current: "1.0.0",
+		Pin:     "1.0.0",
+	})
+
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	msg := result.GetFirstMessageOfType(harness.TypeNoUpdateAvailable)
+	if msg == nil {
+		t.Fatalf("Expected no-update-available message, got messages: %v", result.Messages)
+	}
+	payload, ok := msg.GetNoUpdateAvailablePayload()
+	if !ok {
+		t.Fatalf("Could not parse no-update-available payload")
+	}
+	if payload.Reason != "pinned" {
+		t.Errorf("Expected reason to be pinned, got %q", payload.Reason)
+	}
+	if payload.Pin != "1.0.0" {
+		t.Errorf("Expected pin to be 1.0.0, got %q", payload.Pin)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "" {
+		t.Errorf("Expected nothing to be ready, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_UpToDate_Reason(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	msg := result.GetFirstMessageOfType(harness.TypeNoUpdateAvailable)
+	if msg == nil {
+		t.Fatalf("Expected no-update-available message, got messages: %v", result.Messages)
+	}
+	payload, _ := msg.GetNoUpdateAvailablePayload()
+	if payload == nil || payload.Reason != "up-to-date" {
+		t.Errorf("Expected reason to be up-to-date, got %+v", payload)
+	}
+}
+
+func TestUpgrade_PinBelowCurrent(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("2.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+	setUpRelease(h, "", "2.0.0")
+	setUpRelease(h, "", "3.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--pin", "1.0.0")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	// we don't go back to the pin, but we don't go past it either
+	msg := result.GetFirstMessageOfType(harness.TypeNoUpdateAvailable)
+	if msg == nil {
+		t.Fatalf("Expected no-update-available message, got messages: %v", result.Messages)
+	}
+	payload, _ := msg.GetNoUpdateAvailablePayload()
+	if payload == nil || payload.Reason != "pinned" {
+		t.Errorf("Expected reason to be pinned, got %+v", payload)
+	}
+
+	state := mv.ReadState()
+	if state.Current != "2.0.0" {
+		t.Errorf("Expected current to stay 2.0.0, got %q", state.Current)
+	}
+	if state.Ready != "" {
+		t.Errorf("Expected nothing to be ready, got %q", state.Ready)
+	}
+	if state.Pin != "1.0.0" {
+		t.Errorf("Expected pin to be 1.0.0, got %q", state.Pin)
+	}
+}
+
+func TestUpgrade_PinBetweenCurrentAndLatest(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+	setUpRelease(h, "", "2.0.0")
+	setUpRelease(h, "", "3.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--pin", "2.0.0")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_PinAboveLatest(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--pin", "3.0.0")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeInvalidArgument {
+		t.Errorf("Expected code invalid-argument, got %q (%s)", payload.Code, payload.Message)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "" {
+		t.Errorf("Expected nothing to be ready, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_Unpin(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateAppVersion("1.0.0")
+	mv.WriteState(&harness.MultiverseState{
+		Current: "1.0.0",
+		Pin:     "1.0.0",
+	})
+
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--unpin")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+	if state.Pin != "" {
+		t.Errorf("Expected pin to be forgotten, got %q", state.Pin)
+	}
+}
+
+func TestInstall_PinAndEnvironmentDisagree(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	setUpRelease(h, "", "1.0.0")
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.RunWithEnv(map[string]string{"ITCHSETUP_VERSION": "2.0.0"}, "--appname", "itch", "--pin", "1.0.0")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Fatalf("Expected non-zero exit code when ITCHSETUP_VERSION and --pin disagree")
+	}
+	if !strings.Contains(result.Stderr, "ITCHSETUP_VERSION is set to 2.0.0, but the version is pinned to 1.0.0") {
+		t.Errorf("Expected the conflict to be explained")
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	state := mv.ReadState()
+	if state.Current != "" {
+		t.Errorf("Expected nothing to be installed, got %q", state.Current)
+	}
+}
+
+func TestInstall_PinAndEnvironmentAgree(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	setUpRelease(h, "", "1.0.0")
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.RunWithEnv(map[string]string{"ITCHSETUP_VERSION": "1.0.0"}, "--appname", "itch", "--pin", "1.0.0")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	state := mv.ReadState()
+	if state.Current != "1.0.0" {
+		t.Errorf("Expected current to be 1.0.0, got %q", state.Current)
+	}
+}
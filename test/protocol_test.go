@@ -0,0 +1,113 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestProtocol_HelloComesFirst(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if len(result.Messages) == 0 {
+		t.Fatalf("Expected messages, got none")
+	}
+
+	hello, ok := result.Messages[0].GetHelloPayload()
+	if !ok {
+		t.Fatalf("Expected first message to be hello, got %q", result.Messages[0].Type)
+	}
+	if hello.ProtocolVersion != protocol.Version {
+		t.Errorf("Expected protocol version %d, got %d", protocol.Version, hello.ProtocolVersion)
+	}
+	if hello.SetupVersion == "" {
+		t.Errorf("Expected setup version to be set")
+	}
+
+	if len(result.GetAllMessagesOfType(harness.TypeHello)) != 1 {
+		t.Errorf("Expected exactly one hello message, got messages: %v", result.Messages)
+	}
+}
+
+func TestProtocol_SchemaUpToDate(t *testing.T) {
+	schema, err := protocol.Schema()
+	if err != nil {
+		t.Fatalf("Generating schema: %v", err)
+	}
+
+	onDisk, err := os.ReadFile(filepath.Join("..", "protocol", "schema.json"))
+	if err != nil {
+		t.Fatalf("Reading schema.json: %v", err)
+	}
+
+	if !bytes.Equal(schema, onDisk) {
+		t.Errorf("protocol/schema.json is out of date, run `go generate ./protocol`")
+	}
+}
+
+func TestProtocol_SchemaCoversMessages(t *testing.T) {
+	schema, err := protocol.Schema()
+	if err != nil {
+		t.Fatalf("Generating schema: %v", err)
+	}
+
+	var parsed struct {
+		OneOf []struct {
+			Properties struct {
+				Type struct {
+					Const string `json:"const"`
+				} `json:"type"`
+			} `json:"properties"`
+		} `json:"oneOf"`
+	}
+	if err := json.Unmarshal(schema, &parsed); err != nil {
+		t.Fatalf("Parsing schema: %v", err)
+	}
+
+	inSchema := map[string]bool{}
+	for _, variant := range parsed.OneOf {
+		inSchema[variant.Properties.Type.Const] = true
+	}
+
+	for _, typ := range []harness.MessageType{
+		harness.TypeHello,
+		harness.TypeProgress,
+		harness.TypeUpdateReady,
+		harness.TypeNoUpdateAvailable,
+		harness.TypeUpdateHeldBack,
+		harness.TypeReadyToRelaunch,
+		harness.TypePhaseStarted,
+		harness.TypeDone,
+		harness.TypeFailed,
+		harness.TypeError,
+		harness.TypeUpdateCancelled,
+		harness.TypeNextCheckScheduled,
+		harness.TypeRetrying,
+		harness.TypeInfo,
+		harness.TypeSelfUpdated,
+		harness.TypeDoctorIssue,
+	} {
+		if !inSchema[string(typ)] {
+			t.Errorf("Expected schema to describe %q messages", typ)
+		}
+	}
+}
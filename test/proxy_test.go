@@ -0,0 +1,214 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestUpgrade_Proxy(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	proxy := harness.NewMockProxy(t, "user", "hunter2")
+	defer proxy.Close()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--proxy", proxy.URL())
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if state := mv.ReadState(); state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+
+	requests := strings.Join(proxy.Requests(), "\n")
+	for _, suffix := range []string{"/LATEST", "/2.0.0/info", "/2.0.0/archive/default"} {
+		if !strings.Contains(requests, suffix) {
+			t.Errorf("Expected %s to go through the proxy, got:\n%s", suffix, requests)
+		}
+	}
+	if strings.Contains(result.Stderr, "hunter2") {
+		t.Errorf("Expected the proxy password to stay out of the logs")
+	}
+
+	proxyPath := filepath.Join(mv.BaseDir(), "proxy.json")
+	stats, err := os.Stat(proxyPath)
+	if err != nil {
+		t.Fatalf("Expected proxy to be remembered: %v", err)
+	}
+	if stats.Mode().Perm() != 0600 {
+		t.Errorf("Expected proxy settings to only be readable by the user, got %v", stats.Mode().Perm())
+	}
+
+	// the proxy is remembered
+	before := len(proxy.Requests())
+	result = h.Run("--appname", "itch", "--upgrade")
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if len(proxy.Requests()) == before {
+		t.Errorf("Expected the remembered proxy to be used")
+	}
+
+	// until we're told to go direct
+	before = len(proxy.Requests())
+	result = h.Run("--appname", "itch", "--upgrade", "--proxy", "direct")
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if len(proxy.Requests()) != before {
+		t.Errorf("Expected --proxy direct to bypass the proxy")
+	}
+	if _, err := os.Stat(proxyPath); !os.IsNotExist(err) {
+		t.Errorf("Expected proxy settings to be forgotten, got %v", err)
+	}
+}
+
+func TestInstall_Proxy(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	proxy := harness.NewMockProxy(t, "user", "hunter2")
+	defer proxy.Close()
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--proxy", proxy.URL())
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	if state := mv.ReadState(); state.Current != "1.0.0" {
+		t.Errorf("Expected current to be 1.0.0, got %q", state.Current)
+	}
+
+	// the archive is fetched by wharf's healer, which opens it itself
+	expectAllProxied(t, h, "/1.0.0/signature/default", "/1.0.0/archive/default")
+}
+
+// expectAllProxied checks that there were requests for each suffix, and
+// that every one of them went through MockProxy
+func expectAllProxied(t *testing.T, h *harness.Harness, suffixes ...string) {
+	t.Helper()
+
+	for _, suffix := range suffixes {
+		requests := h.Server().RequestsTo(suffix)
+		if len(requests) == 0 {
+			t.Errorf("Expected requests for %s", suffix)
+		}
+		for _, r := range requests {
+			if r.Via == "" {
+				t.Errorf("Expected %s %s (range %q) to go through the proxy", r.Method, r.Path, r.Range)
+			}
+		}
+	}
+}
+
+func TestSelfUpdate_Proxy(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	proxy := harness.NewMockProxy(t, "user", "hunter2")
+	defer proxy.Close()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+	installOldSetup(t, mv)
+
+	setUpSetupRelease(h, "2.0.0", "#!/bin/sh\necho '2.0.0, no build date'\n")
+
+	result := h.Run("--appname", "itch", "--self-update", "--proxy", proxy.URL())
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	expectAllProxied(t, h, "/2.0.0/signature/default", "/2.0.0/archive/default")
+}
+
+func TestUpgrade_NoProxy(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	proxy := harness.NewMockProxy(t, "user", "hunter2")
+	defer proxy.Close()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--proxy", proxy.URL(), "--no-proxy", "example.org, 127.0.0.0/8")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if requests := proxy.Requests(); len(requests) != 0 {
+		t.Errorf("Expected the mock server to be reached directly, got proxied requests: %v", requests)
+	}
+}
+
+func TestUpgrade_ProxyBadCredentials(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	proxy := harness.NewMockProxy(t, "user", "hunter2")
+	defer proxy.Close()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--proxy", proxy.URLWithCredentials("user", "wrong"))
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Errorf("Expected upgrade to fail")
+	}
+	if proxy.Rejected() == 0 {
+		t.Errorf("Expected the proxy to be asked, and to say no")
+	}
+}
+
+func TestUpgrade_InvalidProxy(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--proxy", "ftp://proxy:21")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 2 {
+		t.Errorf("Expected exit code 2, got %d", result.ExitCode)
+	}
+}
@@ -1,7 +1,11 @@
 package test
 
 import (
+	"bytes"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"testing"
 	"time"
@@ -63,6 +67,48 @@ func TestRelaunch_WaitForProcess(t *testing.T) {
 	}
 }
 
+func TestRelaunch_ReadyToRelaunchWhileWaiting(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// Stands in for the itch app, which doesn't quit on its own
+	sleepCmd := exec.Command("sleep", "60")
+	if err := sleepCmd.Start(); err != nil {
+		t.Fatalf("Failed to start sleep process: %v", err)
+	}
+	pid := sleepCmd.Process.Pid
+	defer sleepCmd.Process.Kill()
+
+	// Like the itch app, quit once itch-setup is ready to relaunch. Until
+	// then, the process isn't reaped, so it's there for itch-setup to see
+	// even if it gets killed.
+	ready := false
+	result := h.RunOnMessage(func(msg harness.Message) {
+		if msg.Type != harness.TypeReadyToRelaunch || ready {
+			return
+		}
+		ready = true
+		go func() {
+			sleepCmd.Process.Kill()
+			sleepCmd.Wait()
+		}()
+	},
+		"--appname", "itch",
+		"--relaunch",
+		"--relaunch-pid", strconv.Itoa(pid),
+	)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if !ready {
+		t.Errorf("Expected ready-to-relaunch message, got messages: %v", result.Messages)
+	}
+}
+
 func TestRelaunch_ProcessAlreadyExited(t *testing.T) {
 	h := harness.New(t)
 	defer h.Cleanup()
@@ -134,3 +180,60 @@ func TestRelaunch_InvalidPID(t *testing.T) {
 		t.Errorf("Expected non-zero exit code for invalid PID")
 	}
 }
+
+func TestRelaunch_LauncherCopy(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the launcher copy is at the root of the base folder on Linux")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		launcher string
+		replaced bool
+	}{
+		{name: "older", launcher: "1.0.0", replaced: true},
+		{name: "newer", launcher: "3.0.0", replaced: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := harness.New(t)
+			defer h.Cleanup()
+			h.UseVersion("2.0.0")
+
+			mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+			mv.CreateFullSetup("1.0.0")
+
+			launcherBinary, err := os.ReadFile(h.BuildVersion(tc.launcher))
+			if err != nil {
+				t.Fatalf("Reading launcher build: %v", err)
+			}
+			launcher := filepath.Join(mv.BaseDir(), "itch-setup")
+			err = os.WriteFile(launcher, launcherBinary, 0755)
+			if err != nil {
+				t.Fatalf("Writing launcher: %v", err)
+			}
+
+			// nothing to wait for
+			cmd := exec.Command("true")
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("Failed to run process: %v", err)
+			}
+
+			result := h.Run(
+				"--appname", "itch",
+				"--relaunch",
+				"--relaunch-pid", strconv.Itoa(cmd.Process.Pid),
+			)
+
+			t.Logf("Exit code: %d", result.ExitCode)
+			t.Logf("Stderr:\n%s", result.Stderr)
+
+			contents, err := os.ReadFile(launcher)
+			if err != nil {
+				t.Fatalf("Reading launcher: %v", err)
+			}
+			if replaced := !bytes.Equal(contents, launcherBinary); replaced != tc.replaced {
+				t.Errorf("Expected launcher %s to be replaced by 2.0.0: %v, got %v", tc.launcher, tc.replaced, replaced)
+			}
+		})
+	}
+}
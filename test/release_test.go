@@ -0,0 +1,323 @@
+package test
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// expectVerificationFailed checks the upgrade was refused, and that
+// nothing was staged
+func expectVerificationFailed(t *testing.T, result *harness.Result, mv *harness.MultiverseSetup) {
+	t.Helper()
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeVerificationFailed {
+		t.Errorf("Expected code verification-failed, got %q (%s)", payload.Code, payload.Message)
+	}
+	if result.ExitCode != 8 {
+		t.Errorf("Expected exit code 8, got %d", result.ExitCode)
+	}
+	if state := mv.ReadState(); state.Ready != "" {
+		t.Errorf("Expected nothing to be staged, got %q", state.Ready)
+	}
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "staging")); !os.IsNotExist(err) {
+		t.Errorf("Expected staging folder to be cleaned up, got %v", err)
+	}
+}
+
+func TestUpgrade_TamperedSignature(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	// the signature is genuine, but for another build
+	archive := h.Server().CreateMockArchive("itch")
+	manifest, _ := h.Server().CreateReleaseManifest("itch", "2.0.0", archive, h.Server().CreateMockSignature(archive))
+	h.Server().SetReleaseManifest("itch", "2.0.0", manifest)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(h.Server().CreateMockArchive("kitch")))
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	expectVerificationFailed(t, result, mv)
+}
+
+func TestUpgrade_TamperedArchive(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	archive := h.Server().CreateMockArchive("itch")
+	manifest, _ := h.Server().CreateReleaseManifest("itch", "2.0.0", archive, h.Server().CreateMockSignature(archive))
+	h.Server().SetReleaseManifest("itch", "2.0.0", manifest)
+	h.Server().SetArchive("itch", "2.0.0", h.Server().CreateMockArchive("kitch"))
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	expectVerificationFailed(t, result, mv)
+}
+
+func TestUpgrade_UntrustedReleaseManifest(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Generating key: %v", err)
+	}
+	h.Server().SignReleaseManifestsWith(otherKey)
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	expectVerificationFailed(t, result, mv)
+}
+
+func TestUpgrade_NoReleaseManifest(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// published before release manifests existed: there's nothing to
+	// check it against
+	setUpRelease(h, "", "2.0.0")
+	h.Server().SetReleaseManifest("itch", "2.0.0", nil)
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	expectVerificationFailed(t, result, mv)
+	if payload := lastErrorOf(t, result); !strings.Contains(payload.Message, "no release manifest") {
+		t.Errorf("Expected the error to say there's no release manifest, got %q", payload.Message)
+	}
+	if len(h.Server().RequestsTo("/2.0.0/archive/default")) > 0 {
+		t.Errorf("Expected the archive not to be downloaded")
+	}
+}
+
+func TestUpgrade_Patch_InstalledWithoutReleaseManifest(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	// 1.0.0 has to be installed for real, patches apply to its files
+	oldFiles := randomFiles(t, "old", 2, 256*1024)
+	oldArchive := h.Server().CreateMockArchiveWithFiles("itch", oldFiles)
+	h.Server().SetLatestVersion("itch", "1.0.0")
+	h.Server().SetBuildInfo("itch", "1.0.0", int64(len(oldArchive)))
+	h.Server().SetArchive("itch", "1.0.0", oldArchive)
+	h.Server().SetSignature("itch", "1.0.0", h.Server().CreateMockSignature(oldArchive))
+
+	result := h.Run("--appname", "itch")
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected 1.0.0 to install, got exit code %d\n%s", result.ExitCode, result.Stderr)
+	}
+
+	// then it turns out 1.0.0 was published before release manifests
+	// existed, but 2.0.0 has one
+	h.Server().SetReleaseManifest("itch", "1.0.0", nil)
+
+	newFiles := randomFiles(t, "new", 2, 256*1024)
+	for name, data := range oldFiles {
+		newFiles[name] = data
+	}
+	newArchive := h.Server().CreateMockArchiveWithFiles("itch", newFiles)
+	h.Server().SetLatestVersion("itch", "2.0.0")
+	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(newArchive)))
+	h.Server().SetArchive("itch", "2.0.0", newArchive)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(newArchive))
+	h.Server().SetPatch("itch", "2.0.0", h.Server().CreateMockPatch(oldArchive, newArchive))
+	h.Server().SetUpgradePath("itch", "1.0.0", "2.0.0", "2.0.0")
+
+	result = h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !strings.Contains(result.Stderr, "No release manifest for (1.0.0), using its signature as-is") {
+		t.Errorf("Expected the signature of 1.0.0 to be used as-is")
+	}
+	if len(h.Server().RequestsTo("/2.0.0/patch/default")) == 0 {
+		t.Errorf("Expected the upgrade to use the patch")
+	}
+	if len(h.Server().RequestsTo("/2.0.0/archive/default")) > 0 {
+		t.Errorf("Expected the upgrade not to fall back to the archive")
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	if state := mv.ReadState(); state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+// releaseKeyBuiltIn tells if data/release.pub has a key, which builds
+// trust when ITCH_SETUP_RELEASE_KEY isn't set
+func releaseKeyBuiltIn(t *testing.T) bool {
+	t.Helper()
+
+	bs, err := os.ReadFile(filepath.Join("..", "data", "release.pub"))
+	if err != nil {
+		t.Fatalf("Failed to read release key: %v", err)
+	}
+	return strings.TrimSpace(string(bs)) != ""
+}
+
+func TestUpgrade_NoReleaseKey(t *testing.T) {
+	if releaseKeyBuiltIn(t) {
+		t.Skip("data/release.pub has a key")
+	}
+
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	h.Server().SetReleaseManifest("itch", "2.0.0", nil)
+
+	// like a development build, with nothing in data/release.pub
+	result := h.RunWithEnv(map[string]string{"ITCH_SETUP_RELEASE_KEY": ""}, "--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !strings.Contains(result.Stderr, "This build has no release key") {
+		t.Errorf("Expected the missing release key to be logged")
+	}
+	if len(h.Server().RequestsTo("/release-manifest")) > 0 {
+		t.Errorf("Expected no release manifest to be fetched")
+	}
+	if state := mv.ReadState(); state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_PlainBuild_NoReleaseKey(t *testing.T) {
+	if releaseKeyBuiltIn(t) {
+		t.Skip("data/release.pub has a key")
+	}
+
+	h := harness.New(t)
+	defer h.Cleanup()
+	h.UsePlainBuild()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// ITCH_SETUP_RELEASE_KEY is ignored, and with nothing in
+	// data/release.pub, builds without itchsetuprelease don't check
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if strings.Contains(result.Stderr, "Trusting release key from") {
+		t.Errorf("Expected ITCH_SETUP_RELEASE_KEY to be ignored")
+	}
+	if len(h.Server().RequestsTo("/release-manifest")) > 0 {
+		t.Errorf("Expected no release manifest to be fetched")
+	}
+	if state := mv.ReadState(); state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_ReleaseBuild_OnlyTrustsBuiltInKey(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+	h.UseReleaseBuild()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// the manifest is signed with the mock key, which release builds
+	// don't trust, even from ITCH_SETUP_RELEASE_KEY. Without a key in
+	// data/release.pub, they don't trust anything.
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeVerificationFailed {
+		t.Errorf("Expected code verification-failed, got %q (%s)", payload.Code, payload.Message)
+	}
+	if strings.Contains(result.Stderr, "Trusting release key from") {
+		t.Errorf("Expected ITCH_SETUP_RELEASE_KEY to be ignored")
+	}
+	if state := mv.ReadState(); state.Ready != "" {
+		t.Errorf("Expected nothing to be ready, got %q", state.Ready)
+	}
+}
+
+func TestExportBundle_TamperedArchive(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	setUpRelease(h, "", "2.0.0")
+
+	archive := h.Server().CreateMockArchive("itch")
+	manifest, _ := h.Server().CreateReleaseManifest("itch", "2.0.0", archive, h.Server().CreateMockSignature(archive))
+	h.Server().SetReleaseManifest("itch", "2.0.0", manifest)
+	h.Server().SetArchive("itch", "2.0.0", h.Server().CreateMockArchive("kitch"))
+
+	bundleDir := filepath.Join(h.TempDir(), "bundle")
+	result := h.Run("--appname", "itch", "--export-bundle", bundleDir)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeVerificationFailed {
+		t.Errorf("Expected code verification-failed, got %q (%s)", payload.Code, payload.Message)
+	}
+	if _, err := os.Stat(filepath.Join(bundleDir, "2.0.0", "archive.zip")); !os.IsNotExist(err) {
+		t.Errorf("Expected the tampered archive not to be exported, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bundleDir, "manifest.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected no bundle manifest, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// expectWorkingLauncher checks the launcher copy is the itch-setup we built
+func expectWorkingLauncher(t *testing.T, launcher string) {
+	t.Helper()
+
+	output, err := exec.Command(launcher, "--version").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Expected launcher to run, got %v:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "head") {
+		t.Errorf("Expected launcher to be a test build, got:\n%s", output)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(launcher), ".itch-setup-*.tmp"))
+	if len(leftovers) > 0 {
+		t.Errorf("Expected no temporary copies to be left, got %v", leftovers)
+	}
+}
+
+func TestRepairLauncher_Truncated(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// what an interrupted copy used to leave behind
+	launcher := filepath.Join(mv.BaseDir(), "itch-setup")
+	writeFile(t, launcher, []byte("\x7fELF\x02\x01\x01\x00"))
+	if err := os.Chmod(launcher, 0755); err != nil {
+		t.Fatalf("Making launcher executable: %v", err)
+	}
+	leftover := filepath.Join(mv.BaseDir(), ".itch-setup-1234.tmp")
+	writeFile(t, leftover, []byte("\x7fELF"))
+
+	result := h.Run("--appname", "itch", "--repair-launcher", "--json")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	expectWorkingLauncher(t, launcher)
+
+	repaired := false
+	for _, msg := range result.GetAllMessagesOfType(harness.TypeShortcutCreated) {
+		payload, _ := msg.GetShortcutCreatedPayload()
+		if payload.Kind == "launcher-copy" && payload.Path == launcher {
+			repaired = true
+		}
+	}
+	if !repaired {
+		t.Errorf("Expected a shortcut-created message for the launcher copy")
+	}
+	if !result.HasMessageType(harness.TypeFileRemoved) {
+		t.Errorf("Expected a file-removed message for the leftover")
+	}
+}
+
+func TestRepairLauncher_Missing(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	result := h.Run("--appname", "itch", "--repair-launcher")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	expectWorkingLauncher(t, filepath.Join(mv.BaseDir(), "itch-setup"))
+}
+
+func TestRepairLauncher_Healthy(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// like one installed by --self-update, which we shouldn't downgrade
+	launcher := installOldSetup(t, mv)
+
+	result := h.Run("--appname", "itch", "--repair-launcher", "--json")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if result.HasMessageType(harness.TypeShortcutCreated) {
+		t.Errorf("Expected a working launcher to be left alone")
+	}
+	expectFileContents(t, launcher, oldSetup)
+}
@@ -0,0 +1,304 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// These kill itch-setup once it has made some progress, and check the
+// next run picks up where it left off instead of downloading it all
+// again. Downloads are throttled to 1 MiB/s so there's time for a
+// checkpoint (they're written every 2 seconds), and files are big enough
+// that it lands a few MiB in: htfs reads on rather than reconnect to get
+// less than 1 MiB further, and there'd be no Range request to look for.
+const resumeBPS = "1048576"
+
+// randomFiles returns count files of size random (incompressible) bytes
+func randomFiles(t *testing.T, prefix string, count int, size int) map[string][]byte {
+	files := make(map[string][]byte)
+	for i := 0; i < count; i++ {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatalf("Failed to generate data: %v", err)
+		}
+		files[fmt.Sprintf("data/%s-%d.bin", prefix, i)] = data
+	}
+	return files
+}
+
+// killAfterCheckpoint runs itch-setup with args until it has written
+// a checkpoint, then kills it
+func killAfterCheckpoint(t *testing.T, h *harness.Harness, mv *harness.MultiverseSetup, args ...string) *harness.StagingCheckpoint {
+	t.Helper()
+
+	result := h.RunUntil(mv.HasCheckpoint, append(args, "--max-bps", resumeBPS)...)
+	t.Logf("Stderr (killed run):\n%s", result.Stderr)
+	if !result.Killed {
+		t.Fatalf("Expected itch-setup to be killed after writing a checkpoint, it exited with code %d", result.ExitCode)
+	}
+
+	c := mv.ReadCheckpoint()
+	if c == nil {
+		t.Fatalf("Expected a checkpoint to be left behind")
+	}
+	return c
+}
+
+// expectResumed checks that one of requests asked for suffix from
+// somewhere after its start, up to offset. It's not always offset on
+// the dot: reading on from an earlier spot and skipping what's already
+// done is cheaper than reconnecting, if it's close enough. A download
+// that starts over reads on from byte 0 instead.
+func expectResumed(t *testing.T, requests []harness.MockRequest, suffix string, offset int64) {
+	t.Helper()
+
+	var got []string
+	for _, r := range requests {
+		if !strings.HasSuffix(r.Path, suffix) {
+			continue
+		}
+		var start int64
+		if _, err := fmt.Sscanf(r.Range, "bytes=%d-", &start); err == nil && start > 0 && start <= offset {
+			return
+		}
+		got = append(got, fmt.Sprintf("%q", r.Range))
+	}
+	t.Errorf("Expected a request for %s from somewhere up to byte %d, got ranges %s", suffix, offset, strings.Join(got, ", "))
+}
+
+// dataOffset returns where the contents of the index-th file of archive start
+func dataOffset(t *testing.T, archive []byte, index int64) int64 {
+	t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	offset, err := zr.File[index].DataOffset()
+	if err != nil {
+		t.Fatalf("Failed to find entry %d: %v", index, err)
+	}
+	return offset
+}
+
+func TestUpgrade_Archive_ResumeAfterKill(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	archive := h.Server().CreateMockArchiveWithFiles("itch", randomFiles(t, "file", 6, 1024*1024))
+	h.Server().SetLatestVersion("itch", "2.0.0")
+	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+	h.Server().SetArchive("itch", "2.0.0", archive)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(archive))
+
+	c := killAfterCheckpoint(t, h, mv, "--appname", "itch", "--upgrade")
+	if c.Target != "archive/2.0.0" || c.Extractor == nil || c.Extractor.SourceCheckpoint == nil {
+		t.Fatalf("Expected a checkpoint partway through extracting 2.0.0, got %+v", c)
+	}
+
+	before := len(h.Server().Requests())
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !strings.Contains(result.Stderr, "Resuming interrupted extraction") {
+		t.Errorf("Expected extraction to be resumed")
+	}
+
+	offset := dataOffset(t, archive, c.Extractor.EntryIndex) + c.Extractor.SourceCheckpoint.Offset
+	expectResumed(t, h.Server().Requests()[before:], "/archive/default", offset)
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_Patch_ResumeAfterKill(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	// 1.0.0 has to be installed for real, patches apply to its files
+	oldFiles := randomFiles(t, "old", 2, 1024*1024)
+	oldArchive := h.Server().CreateMockArchiveWithFiles("itch", oldFiles)
+	h.Server().SetLatestVersion("itch", "1.0.0")
+	h.Server().SetBuildInfo("itch", "1.0.0", int64(len(oldArchive)))
+	h.Server().SetArchive("itch", "1.0.0", oldArchive)
+	h.Server().SetSignature("itch", "1.0.0", h.Server().CreateMockSignature(oldArchive))
+
+	result := h.Run("--appname", "itch")
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected 1.0.0 to install, got exit code %d\n%s", result.ExitCode, result.Stderr)
+	}
+
+	// 2.0.0 keeps the old files and adds fresh ones: the patch is
+	// cheaper than the archive, so that's what's used
+	newFiles := randomFiles(t, "new", 6, 1024*1024)
+	for name, data := range oldFiles {
+		newFiles[name] = data
+	}
+	newArchive := h.Server().CreateMockArchiveWithFiles("itch", newFiles)
+	patch := h.Server().CreateMockPatch(oldArchive, newArchive)
+	h.Server().SetLatestVersion("itch", "2.0.0")
+	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(newArchive)))
+	h.Server().SetArchive("itch", "2.0.0", newArchive)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(newArchive))
+	h.Server().SetPatch("itch", "2.0.0", patch)
+	h.Server().SetUpgradePath("itch", "1.0.0", "2.0.0", "2.0.0")
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	c := killAfterCheckpoint(t, h, mv, "--appname", "itch", "--upgrade")
+	if c.Target != "patch-from-1.0.0/2.0.0" || c.Patcher == nil || c.Patcher.MessageCheckpoint == nil {
+		t.Fatalf("Expected a checkpoint partway through the patch to 2.0.0, got %+v", c)
+	}
+
+	before := len(h.Server().Requests())
+	result = h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !strings.Contains(result.Stderr, "Resuming patch from file") {
+		t.Errorf("Expected the patch to be resumed")
+	}
+
+	// the patch isn't compressed, so that's an offset in the file
+	expectResumed(t, h.Server().Requests()[before:], "/patch/default", c.Patcher.MessageCheckpoint.Offset)
+	if len(h.Server().RequestsTo("/2.0.0/archive/default")) > 0 {
+		t.Errorf("Expected the upgrade not to fall back to the archive")
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestInstall_ResumeAfterKill(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	archive := h.Server().CreateMockArchiveWithFiles("itch", randomFiles(t, "file", 6, 1024*1024))
+	h.Server().SetLatestVersion("itch", "1.0.0")
+	h.Server().SetBuildInfo("itch", "1.0.0", int64(len(archive)))
+	h.Server().SetArchive("itch", "1.0.0", archive)
+	h.Server().SetSignature("itch", "1.0.0", h.Server().CreateMockSignature(archive))
+
+	// installs checkpoint right away, and heal file after file: once the
+	// third one has started, the first two are there to keep
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	third := filepath.Join(mv.StagingDir(), "app-1.0.0", "data", "file-2.bin")
+	result := h.RunUntil(func() bool {
+		_, err := os.Stat(third)
+		return err == nil
+	}, "--appname", "itch", "--max-bps", resumeBPS)
+	t.Logf("Stderr (killed run):\n%s", result.Stderr)
+	if !result.Killed {
+		t.Fatalf("Expected itch-setup to be killed halfway through installing, it exited with code %d", result.ExitCode)
+	}
+	if c := mv.ReadCheckpoint(); c == nil || c.Target != "heal/1.0.0" {
+		t.Fatalf("Expected a checkpoint for heal/1.0.0, got %+v", c)
+	}
+
+	before := len(h.Server().Requests())
+	result = h.Run("--appname", "itch")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !strings.Contains(result.Stderr, "Resuming interrupted install") {
+		t.Errorf("Expected the install to be resumed")
+	}
+
+	// the entry with index 3 is the third data file, after the executable
+	offset := dataOffset(t, archive, 3)
+	var starts []int64
+	for _, r := range h.Server().Requests()[before:] {
+		if !strings.HasSuffix(r.Path, "/archive/default") {
+			continue
+		}
+		var start int64
+		if _, err := fmt.Sscanf(r.Range, "bytes=%d-", &start); err == nil {
+			starts = append(starts, start)
+		}
+	}
+	resumed := false
+	for _, start := range starts {
+		if start > 0 && start <= offset {
+			resumed = true
+		}
+		if start > 0 && start < dataOffset(t, archive, 2) {
+			t.Errorf("Expected the files that were there to be kept, but the archive was requested from byte %d", start)
+		}
+	}
+	if !resumed {
+		t.Errorf("Expected the archive to be requested from the third file on (byte %d), got requests from %v", offset, starts)
+	}
+
+	if state := mv.ReadState(); state == nil || state.Current != "1.0.0" {
+		t.Errorf("Expected current to be 1.0.0, got %+v", state)
+	}
+}
+
+func TestUpgrade_StagingCheckpoint(t *testing.T) {
+	for _, tc := range []struct {
+		target string
+		kept   bool
+	}{
+		{"archive/2.0.0", true},
+		{"archive/1.5.0", false},
+		{"patch-from-1.0.0/2.0.0", false},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			h := harness.New(t)
+			defer h.Cleanup()
+
+			mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+			mv.CreateFullSetup("1.0.0")
+			mv.WriteCheckpoint(tc.target)
+
+			archive := h.Server().CreateMockArchiveWithFiles("itch", randomFiles(t, "file", 4, 1024*1024))
+			h.Server().SetLatestVersion("itch", "2.0.0")
+			h.Server().SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+			h.Server().SetArchive("itch", "2.0.0", archive)
+			h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(archive))
+
+			// stop as soon as extraction has started, before staging
+			// gets cleaned up
+			staged := filepath.Join(mv.StagingDir(), "app-2.0.0")
+			result := h.RunUntil(func() bool {
+				_, err := os.Stat(staged)
+				return err == nil
+			}, "--appname", "itch", "--upgrade", "--max-bps", resumeBPS)
+			t.Logf("Stderr:\n%s", result.Stderr)
+			if !result.Killed {
+				t.Fatalf("Expected itch-setup to be killed while extracting, it exited with code %d", result.ExitCode)
+			}
+
+			if mv.StagingKept() != tc.kept {
+				t.Errorf("Expected staging folder to be kept: %v, got %v", tc.kept, mv.StagingKept())
+			}
+		})
+	}
+}
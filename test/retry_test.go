@@ -0,0 +1,103 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestUpgrade_RetriesTransientErrors(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	h.Server().FailNextRequests(2, http.StatusBadGateway, "")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	retries := result.GetAllMessagesOfType(harness.TypeRetrying)
+	if len(retries) != 2 {
+		t.Fatalf("Expected 2 retries, got messages: %v", result.Messages)
+	}
+	for index, msg := range retries {
+		p, ok := msg.GetRetryingPayload()
+		if !ok {
+			t.Fatalf("Could not parse retrying payload")
+		}
+		if p.Attempt != index+2 || p.Attempts != 5 {
+			t.Errorf("Expected attempt %d/5, got %d/%d", index+2, p.Attempt, p.Attempts)
+		}
+		if p.Error == "" {
+			t.Errorf("Expected retry to say what went wrong")
+		}
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_RetryAfter(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+	h.Server().FailNextRequests(1, http.StatusTooManyRequests, "1")
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	msg := result.GetFirstMessageOfType(harness.TypeRetrying)
+	if msg == nil {
+		t.Fatalf("Expected a retry, got messages: %v", result.Messages)
+	}
+	if p, _ := msg.GetRetryingPayload(); p.Delay != 1 {
+		t.Errorf("Expected Retry-After to be honoured, waited %.3fs", p.Delay)
+	}
+}
+
+func TestUpgrade_RetriesGiveUp(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	h.Server().SetFailWith(http.StatusBadGateway)
+
+	result := h.Run("--appname", "itch", "--upgrade", "--retry-attempts", "3")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 3 {
+		t.Errorf("Expected exit code 3 (unavailable), got %d", result.ExitCode)
+	}
+	if n := len(result.GetAllMessagesOfType(harness.TypeRetrying)); n != 2 {
+		t.Errorf("Expected 2 retries, got %d", n)
+	}
+	if !result.HasMessageType(harness.TypeError) {
+		t.Errorf("Expected an error message, got messages: %v", result.Messages)
+	}
+}
@@ -0,0 +1,160 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestRollback_MostRecentPrevious(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	// Current 2.0.0 is broken, 1.0.0 was retained
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateAppVersion("2.0.0")
+	mv.CreatePreviousVersion("1.0.0")
+	mv.WriteState(&harness.MultiverseState{
+		Current:  "2.0.0",
+		Previous: []string{"1.0.0"},
+	})
+
+	result := h.Run("--appname", "itch", "--rollback")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	state := mv.ReadState()
+	if state.Current != "1.0.0" {
+		t.Errorf("Expected current to be 1.0.0, got %q", state.Current)
+	}
+	if len(state.Previous) != 1 || state.Previous[0] != "2.0.0" {
+		t.Errorf("Expected previous to be [2.0.0], got %v", state.Previous)
+	}
+
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "app-1.0.0", "itch")); err != nil {
+		t.Errorf("Expected rolled back version to be in place: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "previous", "app-2.0.0", "itch")); err != nil {
+		t.Errorf("Expected rolled back from version to be retained: %v", err)
+	}
+}
+
+func TestRollback_NothingRetained(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	result := h.Run("--appname", "itch", "--rollback")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Errorf("Expected non-zero exit code when nothing is retained")
+	}
+
+	state := mv.ReadState()
+	if state.Current != "1.0.0" {
+		t.Errorf("Expected current to stay 1.0.0, got %q", state.Current)
+	}
+}
+
+func TestRollback_ReplacedVersionIsRetained(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateWithReadyPending("1.0.0", "2.0.0")
+
+	// Launching makes the ready version current
+	result := h.Run("--appname", "itch", "--prefer-launch")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	state := mv.ReadState()
+	if state.Current != "2.0.0" {
+		t.Fatalf("Expected current to be 2.0.0, got %q", state.Current)
+	}
+	if len(state.Previous) != 1 || state.Previous[0] != "1.0.0" {
+		t.Errorf("Expected previous to be [1.0.0], got %v", state.Previous)
+	}
+
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "previous", "app-1.0.0", "itch")); err != nil {
+		t.Errorf("Expected replaced version to be retained: %v", err)
+	}
+}
+
+func TestRollback_GivenVersion(t *testing.T) {
+	for _, args := range [][]string{
+		{"--rollback", "1.0.0"},
+		{"--rollback=1.0.0"},
+	} {
+		t.Run(args[0], func(t *testing.T) {
+			h := harness.New(t)
+			defer h.Cleanup()
+
+			mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+			mv.CreateAppVersion("3.0.0")
+			mv.CreatePreviousVersion("2.0.0")
+			mv.CreatePreviousVersion("1.0.0")
+			mv.WriteState(&harness.MultiverseState{
+				Current:  "3.0.0",
+				Previous: []string{"2.0.0", "1.0.0"},
+			})
+
+			result := h.Run(append([]string{"--appname", "itch"}, args...)...)
+
+			t.Logf("Exit code: %d", result.ExitCode)
+			t.Logf("Stderr:\n%s", result.Stderr)
+
+			if result.ExitCode != 0 {
+				t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+			}
+
+			state := mv.ReadState()
+			if state.Current != "1.0.0" {
+				t.Errorf("Expected current to be 1.0.0, got %q", state.Current)
+			}
+			if _, err := os.Stat(filepath.Join(mv.BaseDir(), "app-1.0.0", "itch")); err != nil {
+				t.Errorf("Expected rolled back version to be in place: %v", err)
+			}
+		})
+	}
+}
+
+func TestRollback_ExtraArguments(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateAppVersion("2.0.0")
+	mv.CreatePreviousVersion("1.0.0")
+	mv.WriteState(&harness.MultiverseState{
+		Current:  "2.0.0",
+		Previous: []string{"1.0.0"},
+	})
+
+	result := h.Run("--appname", "itch", "--rollback", "1.0.0", "oops")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Errorf("Expected non-zero exit code with more than one version")
+	}
+
+	state := mv.ReadState()
+	if state.Current != "2.0.0" {
+		t.Errorf("Expected current to stay 2.0.0, got %q", state.Current)
+	}
+}
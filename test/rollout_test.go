@@ -0,0 +1,133 @@
+package test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestUpgrade_Rollout_HeldBack(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	h.Server().SetRolloutPercentage("itch", "2.0.0", 0)
+
+	var buckets []float64
+	for run := 0; run < 2; run++ {
+		result := h.Run("--appname", "itch", "--upgrade")
+
+		t.Logf("Exit code: %d", result.ExitCode)
+		t.Logf("Stderr:\n%s", result.Stderr)
+
+		if result.ExitCode != 0 {
+			t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+		}
+		if result.HasMessageType(harness.TypeNoUpdateAvailable) {
+			t.Errorf("Expected update-held-back instead of no-update-available")
+		}
+
+		msg := result.GetFirstMessageOfType(harness.TypeUpdateHeldBack)
+		if msg == nil {
+			t.Fatalf("Expected update-held-back message, got messages: %v", result.Messages)
+		}
+		payload, ok := msg.GetUpdateHeldBackPayload()
+		if !ok {
+			t.Fatalf("Could not parse update-held-back payload")
+		}
+		if payload.Version != "2.0.0" {
+			t.Errorf("Expected held back version to be 2.0.0, got %q", payload.Version)
+		}
+		if payload.Bucket < 0 || payload.Bucket >= 100 {
+			t.Errorf("Expected bucket in [0, 100), got %v", payload.Bucket)
+		}
+		buckets = append(buckets, payload.Bucket)
+	}
+
+	if buckets[0] != buckets[1] {
+		t.Errorf("Expected bucket to be stable across runs, got %v", buckets)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "" {
+		t.Errorf("Expected nothing to be ready, got %q", state.Ready)
+	}
+	if state.InstallID == "" {
+		t.Errorf("Expected install ID to be persisted")
+	}
+}
+
+func TestUpgrade_Rollout_LocalPolicy(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	// held back locally, even though broth rolls it out to everyone
+	policyPath := filepath.Join(mv.BaseDir(), "rollout.json")
+	writeFile(t, policyPath, []byte(`{"percentage": 0}`))
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeUpdateHeldBack) {
+		t.Fatalf("Expected update-held-back message, got messages: %v", result.Messages)
+	}
+
+	// per-version entries win
+	writeFile(t, policyPath, []byte(`{"percentage": 0, "versions": {"2.0.0": 100}}`))
+
+	result = h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeUpdateReady) {
+		t.Errorf("Expected update-ready message, got messages: %v", result.Messages)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_Rollout_PinIgnoresRollout(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	h.Server().SetRolloutPercentage("itch", "2.0.0", 0)
+
+	result := h.Run("--appname", "itch", "--upgrade", "--pin", "2.0.0")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
@@ -0,0 +1,277 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// oldSetup stands in for the launcher copy of itch-setup
+const oldSetup = "#!/bin/sh\necho '1.0.0, no build date'\n"
+
+// setUpSetupRelease publishes an itch-setup that runs script
+func setUpSetupRelease(h *harness.Harness, version string, script string) {
+	archive := h.Server().CreateMockArchiveWithScript("itch-setup", script)
+	h.Server().SetLatestVersion("itch-setup", version)
+	h.Server().SetBuildInfo("itch-setup", version, int64(len(archive)))
+	h.Server().SetArchive("itch-setup", version, archive)
+	h.Server().SetSignature("itch-setup", version, h.Server().CreateMockSignature(archive))
+}
+
+// installOldSetup writes oldSetup as the launcher copy, and returns its path
+func installOldSetup(t *testing.T, mv *harness.MultiverseSetup) string {
+	t.Helper()
+
+	launcher := filepath.Join(mv.BaseDir(), "itch-setup")
+	err := os.WriteFile(launcher, []byte(oldSetup), 0755)
+	if err != nil {
+		t.Fatalf("Writing launcher: %v", err)
+	}
+	return launcher
+}
+
+func expectFileContents(t *testing.T, path string, expected string) {
+	t.Helper()
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading (%s): %v", path, err)
+	}
+	if string(contents) != expected {
+		t.Errorf("Expected (%s) to be %q, got %q", path, expected, contents)
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+	launcher := installOldSetup(t, mv)
+
+	newSetup := "#!/bin/sh\necho '2.0.0, no build date'\n"
+	setUpSetupRelease(h, "2.0.0", newSetup)
+
+	result := h.Run("--appname", "itch", "--self-update")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	msg := result.GetFirstMessageOfType(harness.TypeSelfUpdated)
+	if msg == nil {
+		t.Fatalf("Expected a self-updated message")
+	}
+	payload, _ := msg.GetSelfUpdatedPayload()
+	if payload.Version != "2.0.0" {
+		t.Errorf("Expected version 2.0.0, got %q", payload.Version)
+	}
+
+	previous := filepath.Join(mv.BaseDir(), "itch-setup-previous")
+	if payload.Previous != previous {
+		t.Errorf("Expected previous to be (%s), got (%s)", previous, payload.Previous)
+	}
+	expectFileContents(t, launcher, newSetup)
+	expectFileContents(t, previous, oldSetup)
+
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "itch-setup-staging")); !os.IsNotExist(err) {
+		t.Errorf("Expected staging folder to be cleaned up, got %v", err)
+	}
+	if state := mv.ReadState(); state.Current != "1.0.0" || state.Ready != "" {
+		t.Errorf("Expected the app to be left alone, got current %q, ready %q", state.Current, state.Ready)
+	}
+}
+
+func TestSelfUpdate_UpToDate(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+	launcher := installOldSetup(t, mv)
+
+	setUpSetupRelease(h, "1.0.0", oldSetup)
+
+	result := h.Run("--appname", "itch", "--self-update")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeNoUpdateAvailable) {
+		t.Errorf("Expected a no-update-available message")
+	}
+	expectFileContents(t, launcher, oldSetup)
+}
+
+func TestSelfUpdate_ComparesWithTarget(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+	launcher := installOldSetup(t, mv)
+
+	// test builds are version "head": being up-to-date ourselves doesn't
+	// mean the launcher copy is
+	newSetup := "#!/bin/sh\necho 'head, no build date'\n"
+	setUpSetupRelease(h, "head", newSetup)
+
+	result := h.Run("--appname", "itch", "--self-update")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if result.HasMessageType(harness.TypeNoUpdateAvailable) {
+		t.Errorf("Expected no no-update-available message")
+	}
+	if !result.HasMessageType(harness.TypeSelfUpdated) {
+		t.Errorf("Expected a self-updated message")
+	}
+	expectFileContents(t, launcher, newSetup)
+}
+
+func TestSelfUpdate_SmokeTestFails(t *testing.T) {
+	for name, script := range map[string]string{
+		"crashes":      "#!/bin/sh\nexit 1\n",
+		"wrongVersion": "#!/bin/sh\necho '1.5.0, no build date'\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := harness.New(t)
+			defer h.Cleanup()
+
+			mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+			mv.CreateFullSetup("1.0.0")
+			launcher := installOldSetup(t, mv)
+
+			setUpSetupRelease(h, "2.0.0", script)
+
+			result := h.Run("--appname", "itch", "--self-update")
+
+			t.Logf("Exit code: %d", result.ExitCode)
+			t.Logf("Stderr:\n%s", result.Stderr)
+
+			if result.ExitCode == 0 {
+				t.Fatalf("Expected a failure")
+			}
+			if result.HasMessageType(harness.TypeSelfUpdated) {
+				t.Errorf("Expected no self-updated message")
+			}
+			lastErrorOf(t, result)
+			expectFileContents(t, launcher, oldSetup)
+		})
+	}
+}
+
+func TestSelfUpdate_Tampered(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+	launcher := installOldSetup(t, mv)
+
+	setUpSetupRelease(h, "2.0.0", "#!/bin/sh\necho '2.0.0'\n")
+	h.Server().SetArchive("itch-setup", "2.0.0", h.Server().CreateMockArchiveWithScript("itch-setup", "#!/bin/sh\necho 'pwned, 2.0.0'\n"))
+
+	result := h.Run("--appname", "itch", "--self-update")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeVerificationFailed {
+		t.Errorf("Expected code verification-failed, got %q (%s)", payload.Code, payload.Message)
+	}
+	expectFileContents(t, launcher, oldSetup)
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "itch-setup-previous")); !os.IsNotExist(err) {
+		t.Errorf("Expected the launcher not to be touched, got %v", err)
+	}
+}
+
+func TestSelfUpdate_NotInstalled(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	setUpSetupRelease(h, "2.0.0", "#!/bin/sh\necho '2.0.0'\n")
+
+	result := h.Run("--appname", "itch", "--self-update")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeNotInstalled {
+		t.Errorf("Expected code not-installed, got %q (%s)", payload.Code, payload.Message)
+	}
+	if result.ExitCode != protocol.ErrorCodeNotInstalled.ExitCode() {
+		t.Errorf("Expected exit code %d, got %d", protocol.ErrorCodeNotInstalled.ExitCode(), result.ExitCode)
+	}
+}
+
+func TestSelfUpdate_RealBinary(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// real builds log to stderr before printing their version
+	oldBinary, err := os.ReadFile(h.BuildVersion("1.0.0"))
+	if err != nil {
+		t.Fatalf("Reading old build: %v", err)
+	}
+	newBinary, err := os.ReadFile(h.BuildVersion("2.0.0"))
+	if err != nil {
+		t.Fatalf("Reading new build: %v", err)
+	}
+
+	launcher := filepath.Join(mv.BaseDir(), "itch-setup")
+	err = os.WriteFile(launcher, oldBinary, 0755)
+	if err != nil {
+		t.Fatalf("Writing launcher: %v", err)
+	}
+	setUpSetupRelease(h, "2.0.0", string(newBinary))
+
+	result := h.Run("--appname", "itch", "--self-update")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeSelfUpdated) {
+		t.Fatalf("Expected a self-updated message, got messages: %v", result.Messages)
+	}
+	expectFileContents(t, launcher, string(newBinary))
+
+	// now that it's there, it's up-to-date
+	result = h.Run("--appname", "itch", "--self-update")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if result.HasMessageType(harness.TypeSelfUpdated) {
+		t.Errorf("Expected no self-updated message")
+	}
+	if !result.HasMessageType(harness.TypeNoUpdateAvailable) {
+		t.Errorf("Expected a no-update-available message, got messages: %v", result.Messages)
+	}
+	expectFileContents(t, filepath.Join(mv.BaseDir(), "itch-setup-previous"), string(oldBinary))
+}
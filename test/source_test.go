@@ -0,0 +1,119 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestUpgrade_FromFileMirror(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// A mirror has the same layout as broth's URLs
+	archive := h.Server().CreateMockArchive("itch")
+	signature := h.Server().CreateMockSignature(archive)
+	manifest, manifestSig := h.Server().CreateReleaseManifest("itch", "2.0.0", archive, signature)
+	info, err := json.Marshal(harness.MockBuild{
+		Version: "2.0.0",
+		Files: []harness.MockBuildFile{
+			{Type: "archive", SubType: "default", Size: int64(len(archive))},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal build info: %v", err)
+	}
+
+	mirrorDir := filepath.Join(h.TempDir(), "mirror")
+	channelDir := filepath.Join(mirrorDir, "itch", fmt.Sprintf("%s-%s", runtime.GOOS, runtime.GOARCH))
+	writeFile(t, filepath.Join(channelDir, "LATEST"), []byte("2.0.0\n"))
+	writeFile(t, filepath.Join(channelDir, "2.0.0", "info"), info)
+	writeFile(t, filepath.Join(channelDir, "2.0.0", "archive", "default"), archive)
+	writeFile(t, filepath.Join(channelDir, "2.0.0", "signature", "default"), signature)
+	writeFile(t, filepath.Join(channelDir, "2.0.0", "release-manifest"), manifest)
+	writeFile(t, filepath.Join(channelDir, "2.0.0", "release-manifest.sig"), manifestSig)
+
+	mirrorURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(mirrorDir)}).String()
+	result := h.RunWithEnv(map[string]string{
+		"ITCH_BROTH_URL": mirrorURL,
+	}, "--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeUpdateReady) {
+		t.Errorf("Expected update-ready message, got messages: %v", result.Messages)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_FromBundle(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	archive := h.Server().CreateMockArchive("itch")
+	h.Server().SetLatestVersion("itch", "2.0.0")
+	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+	h.Server().SetArchive("itch", "2.0.0", archive)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(archive))
+
+	bundleDir := filepath.Join(h.TempDir(), "bundle")
+	result := h.Run("--appname", "itch", "--export-bundle", bundleDir)
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected export to succeed, got %d\n%s", result.ExitCode, result.Stderr)
+	}
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// Plain paths are bundles
+	result = h.RunWithEnv(map[string]string{
+		"ITCH_BROTH_URL": bundleDir,
+	}, "--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_UnsupportedSourceScheme(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	result := h.RunWithEnv(map[string]string{
+		"ITCH_BROTH_URL": "ftp://broth.example.org",
+	}, "--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode == 0 {
+		t.Errorf("Expected non-zero exit code for an unsupported package source")
+	}
+}
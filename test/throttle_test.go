@@ -0,0 +1,46 @@
+package test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestUpgrade_MaxBPS(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	archive := h.Server().CreateMockArchive("itch")
+
+	// the first second's worth goes through right away, the rest of
+	// the archive has to wait
+	maxBPS := len(archive) / 2
+	minDuration := 1 * time.Second
+
+	startTime := time.Now()
+	result := h.Run("--appname", "itch", "--upgrade", "--max-bps", strconv.Itoa(maxBPS))
+	duration := time.Since(startTime)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if !result.HasMessageType(harness.TypeUpdateReady) {
+		t.Errorf("Expected update-ready message, got messages: %v", result.Messages)
+	}
+	if !strings.Contains(result.Stderr, "Limiting bandwidth") {
+		t.Errorf("Expected bandwidth limit to be logged")
+	}
+	if duration < minDuration {
+		t.Errorf("Expected throttled upgrade to take at least %s, took %s", minDuration, duration)
+	}
+}
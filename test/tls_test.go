@@ -0,0 +1,224 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itchio/itch-setup/protocol"
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+// writeCABundle saves the certificate of the mock server's HTTPS
+// listener, for --ca-bundle
+func writeCABundle(t *testing.T, h *harness.Harness) string {
+	t.Helper()
+
+	caBundle := filepath.Join(h.TempDir(), "ca-bundle.pem")
+	err := os.WriteFile(caBundle, h.Server().CertificatePEM(), 0644)
+	if err != nil {
+		t.Fatalf("Writing CA bundle: %v", err)
+	}
+	return caBundle
+}
+
+func TestUpgrade_CABundle(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	brothURL := h.Server().StartTLS()
+	caBundle := writeCABundle(t, h)
+
+	// the mock server's certificate is self-signed
+	result := h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeUntrustedCertificate {
+		t.Errorf("Expected code untrusted-certificate, got %q (%s)", payload.Code, payload.Message)
+	}
+	if payload.Retryable {
+		t.Errorf("Expected untrusted certificates not to be retryable")
+	}
+	if result.ExitCode != 7 {
+		t.Errorf("Expected exit code 7, got %d", result.ExitCode)
+	}
+	if result.HasMessageType(harness.TypeRetrying) {
+		t.Errorf("Expected untrusted certificates not to be retried")
+	}
+
+	result = h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL, "--ca-bundle", caBundle)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if state := mv.ReadState(); state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+
+	// the CA bundle is remembered
+	result = h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL)
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected the remembered CA bundle to be trusted, got exit code %d", result.ExitCode)
+	}
+
+	// until we're told to forget it
+	result = h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL, "--ca-bundle", "none")
+	if result.ExitCode != 7 {
+		t.Errorf("Expected exit code 7 once the CA bundle is forgotten, got %d", result.ExitCode)
+	}
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "tls.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected TLS settings to be forgotten, got %v", err)
+	}
+}
+
+func TestUpgrade_CABundleGone(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	brothURL := h.Server().StartTLS()
+	caBundle := writeCABundle(t, h)
+
+	result := h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL, "--ca-bundle", caBundle, "--pin-public-key", h.Server().PublicKeyPin())
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected first upgrade to succeed, got exit code %d", result.ExitCode)
+	}
+
+	// without it, nothing connects, not even with the pins alone
+	err := os.Remove(caBundle)
+	if err != nil {
+		t.Fatalf("Removing CA bundle: %v", err)
+	}
+
+	result = h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeInvalidArgument {
+		t.Errorf("Expected code invalid-argument, got %q (%s)", payload.Code, payload.Message)
+	}
+	if len(h.Server().RequestsTo("/LATEST")) > 1 {
+		t.Errorf("Expected broth not to be contacted without the CA bundle")
+	}
+
+	// the pins are kept when it's replaced
+	caBundle = writeCABundle(t, h)
+	result = h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL, "--ca-bundle", caBundle)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0 once the CA bundle is back, got %d", result.ExitCode)
+	}
+	if !strings.Contains(result.Stderr, "1 pinned public keys") {
+		t.Errorf("Expected the pin to be kept")
+	}
+}
+
+func TestUpgrade_PinPublicKey(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	brothURL := h.Server().StartTLS()
+	caBundle := writeCABundle(t, h)
+
+	wrongPin := "sha256/" + strings.Repeat("A", 43) + "="
+	result := h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL, "--ca-bundle", caBundle, "--pin-public-key", wrongPin)
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeUntrustedCertificate {
+		t.Errorf("Expected code untrusted-certificate, got %q (%s)", payload.Code, payload.Message)
+	}
+	if !strings.Contains(payload.Message, h.Server().PublicKeyPin()) {
+		t.Errorf("Expected the error to show the server's pin, got %q", payload.Message)
+	}
+	if state := mv.ReadState(); state.Ready != "" {
+		t.Errorf("Expected nothing to be staged, got %q", state.Ready)
+	}
+
+	result = h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL, "--pin-public-key", wrongPin, "--pin-public-key", h.Server().PublicKeyPin())
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if state := mv.ReadState(); state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_PinPublicKey_UnpinnedCDN(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+	brothURL := h.Server().StartTLS()
+	h.Server().StartCDN()
+	caBundle := writeCABundle(t, h)
+
+	// downloads are redirected to a CDN with another public key, which
+	// isn't pinned: only broth is
+	result := h.Run("--appname", "itch", "--upgrade", "--broth-url", brothURL, "--ca-bundle", caBundle, "--pin-public-key", h.Server().PublicKeyPin())
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+	if len(h.Server().RequestsTo("/2.0.0/signature/default")) < 2 {
+		t.Errorf("Expected downloads to be redirected to the CDN")
+	}
+	if state := mv.ReadState(); state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+}
+
+func TestUpgrade_InvalidPin(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	result := h.Run("--appname", "itch", "--upgrade", "--pin-public-key", "sha256/not-a-hash")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	payload := lastErrorOf(t, result)
+	if payload.Code != protocol.ErrorCodeInvalidArgument {
+		t.Errorf("Expected code invalid-argument, got %q (%s)", payload.Code, payload.Message)
+	}
+}
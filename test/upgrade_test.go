@@ -1,6 +1,8 @@
 package test
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/itchio/itch-setup/test/harness"
@@ -86,32 +88,41 @@ func TestUpgrade_ReadyPending(t *testing.T) {
 	}
 }
 
-// Note: TestUpgrade_UpdateAvailable requires full archive download which is complex
-// to set up with signatures. Keeping it commented for now as the key flows
-// (no-update and ready-pending) are tested above.
-//
-// func TestUpgrade_UpdateAvailable(t *testing.T) {
-// 	h := harness.New(t)
-// 	defer h.Cleanup()
-//
-// 	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
-// 	mv.CreateFullSetup("1.0.0")
-//
-// 	// Server reports newer version
-// 	h.Server().SetLatestVersion("itch", "2.0.0")
-//
-// 	// Set up mock archive
-// 	archive := h.Server().CreateMockArchive("itch")
-// 	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(archive)))
-// 	h.Server().SetArchive("itch", "2.0.0", archive)
-//
-// 	result := h.Run("--appname", "itch", "--upgrade")
-//
-// 	// Should emit installing-update and update-ready
-// 	if !result.HasMessageType(harness.TypeInstallingUpdate) {
-// 		t.Errorf("Expected installing-update message")
-// 	}
-// 	if !result.HasMessageType(harness.TypeUpdateReady) {
-// 		t.Errorf("Expected update-ready message")
-// 	}
-// }
+func TestUpgrade_UpdateAvailable(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	// Server reports newer version, with no patch path (archive upgrade)
+	h.Server().SetLatestVersion("itch", "2.0.0")
+
+	archive := h.Server().CreateMockArchive("itch")
+	h.Server().SetBuildInfo("itch", "2.0.0", int64(len(archive)))
+	h.Server().SetArchive("itch", "2.0.0", archive)
+	h.Server().SetSignature("itch", "2.0.0", h.Server().CreateMockSignature(archive))
+
+	result := h.Run("--appname", "itch", "--upgrade")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	// Should emit installing-update and update-ready
+	if !result.HasMessageType(harness.TypeInstallingUpdate) {
+		t.Errorf("Expected installing-update message")
+	}
+	if !result.HasMessageType(harness.TypeUpdateReady) {
+		t.Errorf("Expected update-ready message")
+	}
+
+	state := mv.ReadState()
+	if state.Ready != "2.0.0" {
+		t.Errorf("Expected ready to be 2.0.0, got %q", state.Ready)
+	}
+
+	// A successful upgrade leaves nothing to resume
+	if _, err := os.Stat(filepath.Join(mv.BaseDir(), "staging")); !os.IsNotExist(err) {
+		t.Errorf("Expected staging folder to be cleaned up, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itchio/itch-setup/test/harness"
+)
+
+func TestWatch_StagesUpdates(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "2.0.0")
+
+	stdinReader, stdinWriter := io.Pipe()
+	resultChan := make(chan *harness.Result, 1)
+	go func() {
+		resultChan <- h.RunWithStdin(stdinReader, "--appname", "itch", "--watch", "--watch-interval", "500ms")
+	}()
+
+	// long enough for a few checks
+	time.Sleep(3 * time.Second)
+	io.WriteString(stdinWriter, `{"type":"cancel"}`+"\n")
+	stdinWriter.Close()
+
+	var result *harness.Result
+	select {
+	case result = <-resultChan:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Timed out waiting for --watch to stop")
+	}
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	msg := result.GetFirstMessageOfType(harness.TypeUpdateReady)
+	if msg == nil {
+		t.Fatalf("Expected update-ready message, got messages: %v", result.Messages)
+	}
+	if p, _ := msg.GetUpdateReadyPayload(); p.Version != "2.0.0" {
+		t.Errorf("Expected update to 2.0.0, got %s", p.Version)
+	}
+
+	scheduled := result.GetAllMessagesOfType(harness.TypeNextCheckScheduled)
+	if len(scheduled) < 2 {
+		t.Fatalf("Expected several checks, got messages: %v", result.Messages)
+	}
+	for _, msg := range scheduled {
+		p, ok := msg.GetNextCheckScheduledPayload()
+		if !ok {
+			t.Fatalf("Could not parse next-check-scheduled payload")
+		}
+		if p.Failures != 0 || p.Error != "" {
+			t.Errorf("Expected checks to succeed, got %+v", p)
+		}
+		if p.Delay < 0.45 || p.Delay > 0.55 {
+			t.Errorf("Expected delay to be 500ms give or take 10%%, got %.3fs", p.Delay)
+		}
+	}
+
+	state := mv.ReadState()
+	if state.Current != "1.0.0" || state.Ready != "2.0.0" {
+		t.Errorf("Expected 2.0.0 to be staged as ready, got current=%q ready=%q", state.Current, state.Ready)
+	}
+}
+
+func TestWatch_InvalidInterval(t *testing.T) {
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	result := h.Run("--appname", "itch", "--watch", "--watch-interval", "0s")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 2 {
+		t.Errorf("Expected exit code 2, got %d", result.ExitCode)
+	}
+}
+
+func TestUpgrade_SystemdTimer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("systemd units are only installed on Linux")
+	}
+
+	h := harness.New(t)
+	defer h.Cleanup()
+
+	mv := harness.NewMultiverseSetup(t, h.TempDir(), "itch")
+	mv.CreateFullSetup("1.0.0")
+
+	setUpRelease(h, "", "1.0.0")
+
+	result := h.Run("--appname", "itch", "--json", "--upgrade", "--systemd-timer", "--watch-interval", "1h")
+
+	t.Logf("Exit code: %d", result.ExitCode)
+	t.Logf("Stderr:\n%s", result.Stderr)
+
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", result.ExitCode)
+	}
+
+	unitDir := filepath.Join(h.TempDir(), ".config", "systemd", "user")
+	servicePath := filepath.Join(unitDir, "itch-upgrade.service")
+	timerPath := filepath.Join(unitDir, "itch-upgrade.timer")
+
+	created := map[string]string{}
+	for _, msg := range result.GetAllMessagesOfType(harness.TypeShortcutCreated) {
+		if p, ok := msg.GetShortcutCreatedPayload(); ok {
+			created[p.Kind] = p.Path
+		}
+	}
+	if created["systemd-service"] != servicePath || created["systemd-timer"] != timerPath {
+		t.Errorf("Expected systemd units to be reported, got %v", created)
+	}
+
+	service, err := os.ReadFile(servicePath)
+	if err != nil {
+		t.Fatalf("Reading service: %v", err)
+	}
+	setupPath := filepath.Join(mv.BaseDir(), "itch-setup")
+	if !strings.Contains(string(service), "ExecStart="+setupPath+" --appname itch --upgrade") {
+		t.Errorf("Expected service to run the upgrade, got:\n%s", service)
+	}
+
+	timer, err := os.ReadFile(timerPath)
+	if err != nil {
+		t.Fatalf("Reading timer: %v", err)
+	}
+	if !strings.Contains(string(timer), "OnUnitActiveSec=3600s") {
+		t.Errorf("Expected timer to go off every hour, got:\n%s", timer)
+	}
+
+	result = h.Run("--appname", "itch", "--uninstall")
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected uninstall to succeed, got exit code %d", result.ExitCode)
+	}
+	for _, path := range []string{servicePath, timerPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed on uninstall, got %v", path, err)
+		}
+	}
+}